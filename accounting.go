@@ -0,0 +1,133 @@
+package rtcsocks
+
+import (
+	"context"
+	"sync"
+)
+
+// Usage is the rendezvous usage of a user, for billing or capping the rendezvous
+// consumption of paid or quota'd services.
+type Usage struct {
+	Offers      uint64 // offers registered
+	OfferBytes  uint64 // total size of the offer SDPs
+	Answers     uint64 // offers answered by an Edge Server
+	AnswerBytes uint64 // total size of the answer SDPs
+}
+
+// Add adds the other usage to u.
+func (u *Usage) Add(other Usage) {
+	u.Offers += other.Offers
+	u.OfferBytes += other.OfferBytes
+	u.Answers += other.Answers
+	u.AnswerBytes += other.AnswerBytes
+}
+
+// Accountant records the rendezvous usage of users. The Negotiator records each offer
+// once registered and each answer once registered by an Edge Server. Offers registered
+// again by a retrying Client, answers registered again and events replicated from peer
+// replicas are not recorded, each replica records its own.
+type Accountant interface {
+	// Record adds the usage of the user. It is called synchronously and SHOULD NOT
+	// block, errors are to be handled by the Accountant itself.
+	Record(ctx context.Context, user UserID, usage Usage)
+}
+
+// UsageLimiter is implemented by the Accountants capping the usage of users.
+type UsageLimiter interface {
+	// Allow returns an error, e.g. ErrQuotaExceeded, if the user may not register
+	// another offer, including an offer registered again. The error is returned by
+	// RegisterOffer.
+	Allow(ctx context.Context, user UserID) error
+}
+
+// SetAccountant sets the Accountant recording the usage of users, and capping it if
+// it implements UsageLimiter.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetAccountant(a Accountant) {
+	n.accountant = a
+}
+
+// allowOffer checks the usage cap of the user, if any.
+func (n *Negotiator) allowOffer(ctx context.Context, user UserID) error {
+	if limiter, ok := n.accountant.(UsageLimiter); ok {
+		return limiter.Allow(ctx, user)
+	}
+	return nil
+}
+
+func (n *Negotiator) account(ctx context.Context, user UserID, usage Usage) {
+	if n.accountant != nil {
+		n.accountant.Record(ctx, user, usage)
+	}
+}
+
+// MemoryAccountant is an Accountant keeping the usage of users in memory, capped
+// by Limit. Operators bill by exporting the usage periodically with Drain.
+type MemoryAccountant struct {
+	Limit Usage // max usage per user until drained, zero fields -> unlimited
+
+	usage map[UserID]*Usage
+	mutex sync.Mutex
+}
+
+// NewMemoryAccountant creates a MemoryAccountant capping the usage per user.
+func NewMemoryAccountant(limit Usage) *MemoryAccountant {
+	return &MemoryAccountant{
+		Limit: limit,
+		usage: make(map[UserID]*Usage),
+	}
+}
+
+func (m *MemoryAccountant) Record(_ context.Context, user UserID, usage Usage) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u, ok := m.usage[user]
+	if !ok {
+		u = &Usage{}
+		m.usage[user] = u
+	}
+	u.Add(usage)
+}
+
+// Allow returns ErrQuotaExceeded once the user reached any of the limits.
+func (m *MemoryAccountant) Allow(_ context.Context, user UserID) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	u, ok := m.usage[user]
+	if !ok {
+		return nil
+	}
+	if exceeded(u.Offers, m.Limit.Offers) || exceeded(u.OfferBytes, m.Limit.OfferBytes) ||
+		exceeded(u.Answers, m.Limit.Answers) || exceeded(u.AnswerBytes, m.Limit.AnswerBytes) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func exceeded(used, limit uint64) bool {
+	return limit > 0 && used >= limit
+}
+
+// Usage returns the usage of the user since the last Drain.
+func (m *MemoryAccountant) Usage(user UserID) Usage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if u, ok := m.usage[user]; ok {
+		return *u
+	}
+	return Usage{}
+}
+
+// Drain returns the usage of all users since the last Drain and resets it, e.g. at
+// the end of a billing period.
+func (m *MemoryAccountant) Drain() map[UserID]Usage {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	drained := make(map[UserID]Usage, len(m.usage))
+	for user, u := range m.usage {
+		drained[user] = *u
+	}
+	m.usage = make(map[UserID]*Usage)
+	return drained
+}
@@ -0,0 +1,121 @@
+package rtcsocks
+
+import (
+	"context"
+	"sync"
+)
+
+// DeclineOfferCallbackFunction puts an offer dispatched to the session back in queue
+// for other Edge Servers of the groups it lists.
+type DeclineOfferCallbackFunction func(ctx context.Context, group GroupID, session string, offerID OfferID) error
+
+// DeclineAPI is implemented by the NegotiatorAPIs letting Edge Servers decline the
+// offers they cannot accept, e.g. when saturated, rather than accept them and starve
+// the Clients. HookToAPI sets the callback if the API implements it.
+type DeclineAPI interface {
+	// SetDeclineOfferCallback sets the callback function for offers declined by an
+	// Edge Server. It returns ErrInvalidOfferID if the offer does not exist, and
+	// ErrNoAccess if it is not dispatched to the session or already answered.
+	SetDeclineOfferCallback(DeclineOfferCallbackFunction)
+}
+
+func (n *Negotiator) declineOffer(_ context.Context, group GroupID, session string, offerID OfferID) error {
+	if group == 0 || group > n.maxGroupID {
+		return ErrBadGroupID
+	}
+	if session == "" {
+		return ErrInvalidSessionID
+	}
+
+	n.mutexAnswers.Lock()
+	answer, ok := n.answers[offerID]
+	n.mutexAnswers.Unlock()
+	if !ok {
+		return ErrInvalidOfferID
+	}
+	answer.mutex.Lock()
+	dispatched := answer.body == nil && answer.group == group && answer.session == session
+	answer.mutex.Unlock()
+	if !dispatched {
+		return ErrNoAccess
+	}
+
+	if n.requeue(group, session, offerID) > 0 && n.logger != nil {
+		n.logger.Debugf("Negotiator: offer %s declined by session %q of group %s, requeued", offerID, session, group)
+	}
+	return nil
+}
+
+// ConcurrencyLimit is the admission control of an Edge Server: it caps the peer
+// connections and the streams handled at once. The Edge Server acquires a peer before
+// answering an offer and a stream before accepting one, and declines the offers it
+// cannot admit, e.g. with Admit as the admission function of its ServerNegotiator.
+//
+// A ConcurrencyLimit MUST NOT be copied after first use.
+type ConcurrencyLimit struct {
+	MaxPeers   int // max peer connections, 0 -> unlimited
+	MaxStreams int // max streams over all peer connections, 0 -> unlimited
+
+	peers   int
+	streams int
+	mutex   sync.Mutex
+}
+
+// Admit reports whether a new peer connection would be admitted. Saturated streams
+// admit no new peer either.
+func (l *ConcurrencyLimit) Admit() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.admit()
+}
+
+func (l *ConcurrencyLimit) admit() bool {
+	return (l.MaxPeers <= 0 || l.peers < l.MaxPeers) && (l.MaxStreams <= 0 || l.streams < l.MaxStreams)
+}
+
+// AcquirePeer admits a new peer connection if there is room for it. The caller MUST
+// call ReleasePeer once the peer connection is closed if it returns true.
+func (l *ConcurrencyLimit) AcquirePeer() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if !l.admit() {
+		return false
+	}
+	l.peers++
+	return true
+}
+
+func (l *ConcurrencyLimit) ReleasePeer() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.peers > 0 {
+		l.peers--
+	}
+}
+
+// AcquireStream admits a new stream if there is room for it. The caller MUST call
+// ReleaseStream once the stream is closed if it returns true.
+func (l *ConcurrencyLimit) AcquireStream() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.MaxStreams > 0 && l.streams >= l.MaxStreams {
+		return false
+	}
+	l.streams++
+	return true
+}
+
+func (l *ConcurrencyLimit) ReleaseStream() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.streams > 0 {
+		l.streams--
+	}
+}
+
+// Usage returns the peer connections and streams currently acquired.
+func (l *ConcurrencyLimit) Usage() (peers, streams int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.peers, l.streams
+}
@@ -0,0 +1,64 @@
+package rtcsocks
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks/auth"
+)
+
+// AliasCredentialStore authenticates users by their rotating aliases instead of their
+// UIDs, see auth.Alias. The Negotiator then only ever sees aliases, so offers of the
+// same user in different epochs cannot be linked from its state or logs.
+//
+// Aliases of the previous and next epochs are accepted as well, to tolerate clock
+// skew and offers registered just before an epoch ends.
+type AliasCredentialStore struct {
+	CredentialStore               // credentials of the real users and of the groups
+	Users           []UserID      // users authenticating with aliases
+	Period          time.Duration // epoch length, e.g. 24 * time.Hour
+
+	epoch uint64
+	table map[UserID]UserID // alias -> uid
+	mutex sync.Mutex
+}
+
+// UserSecret returns the secret of the user the alias belongs to. Real UIDs are not
+// accepted.
+func (s *AliasCredentialStore) UserSecret(alias UserID) (string, error) {
+	user, ok := s.User(alias)
+	if !ok {
+		return "", ErrNotAuthenticated
+	}
+	return s.CredentialStore.UserSecret(user)
+}
+
+// User resolves an alias of the current, previous or next epoch to the UID.
+func (s *AliasCredentialStore) User(alias UserID) (UserID, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	epoch := auth.Epoch(time.Now(), s.Period)
+	if s.table == nil || epoch != s.epoch {
+		s.rebuild(epoch)
+	}
+	user, ok := s.table[alias]
+	return user, ok
+}
+
+// rebuild computes the aliases of all users around the epoch. The caller MUST hold
+// s.mutex.
+func (s *AliasCredentialStore) rebuild(epoch uint64) {
+	table := make(map[UserID]UserID, 3*len(s.Users))
+	for _, user := range s.Users {
+		secret, err := s.CredentialStore.UserSecret(user)
+		if err != nil {
+			continue
+		}
+		for e := epoch - 1; e <= epoch+1; e++ {
+			table[UserID(auth.Alias(secret, e))] = user
+		}
+	}
+	s.table = table
+	s.epoch = epoch
+}
@@ -0,0 +1,60 @@
+package rtcsocks
+
+import "time"
+
+// SetMaxAnswers caps the offers stored, answered or not, so that a burst of
+// registrations cannot exhaust the memory of the Negotiator before they expire. Once
+// the cap is reached, registering an offer evicts the offer expiring soonest. If it is
+// not expired yet, the eviction is logged and counted in Stats.AnswersEvicted, and its
+// owner is told that it expired. 0 disables the cap.
+//
+// LoadShedding.MaxAnswers rejects new offers below the cap instead, and SHOULD be set
+// lower so that evictions only happen if load shedding falls behind.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetMaxAnswers(max int) {
+	n.mutexAnswers.Lock()
+	defer n.mutexAnswers.Unlock()
+	n.maxAnswers = max
+}
+
+// makeRoom evicts offers until there is room for one more under the cap. The caller
+// MUST hold n.mutexAnswers.
+func (n *Negotiator) makeRoom() {
+	if n.maxAnswers <= 0 {
+		return
+	}
+	for len(n.answers) >= n.maxAnswers {
+		offerID, ok := n.answerExpiry.soonest(func(offerID OfferID) bool {
+			_, ok := n.answers[offerID]
+			return ok
+		})
+		if !ok {
+			return // not indexed, cannot happen
+		}
+		n.evict(offerID)
+	}
+}
+
+func (n *Negotiator) evict(offerID OfferID) {
+	answer := n.answers[offerID]
+	answer.mutex.Lock()
+	user, pending, live := answer.user, answer.body == nil, answer.expiry.After(time.Now())
+	answer.mutex.Unlock()
+
+	if pending {
+		grace := n.expiryGrace
+		if grace <= 0 {
+			grace = n.ttl
+		}
+		n.bury(offerID, user, grace)
+	}
+	n.deleteAnswer(offerID)
+
+	if live {
+		n.answersEvicted++
+		if n.logger != nil {
+			n.logger.Warnf("Negotiator: answers at capacity %d, offer %s of user %s evicted before expiry", n.maxAnswers, offerID, user)
+		}
+	}
+}
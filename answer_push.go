@@ -0,0 +1,54 @@
+package rtcsocks
+
+import (
+	"context"
+	"time"
+)
+
+// WaitAnswerCallbackFunction waits for the answer to the offer like LookupAnswer,
+// except that it returns ErrAnswerPending only once ctx is done.
+type WaitAnswerCallbackFunction func(ctx context.Context, user UserID, offerID OfferID) (sdp []byte, err error)
+
+// AnswerPushAPI is implemented by the NegotiatorAPIs able to push the answer to the
+// Client over the channel the offer was registered on, e.g. by holding the response
+// to RegisterOffer until the answer is registered, for a single round-trip rendezvous.
+// HookToAPI sets the callback if the API implements it.
+type AnswerPushAPI interface {
+	// SetWaitAnswerCallback sets the callback function waiting for the answer to an
+	// offer of the user. The answer is returned as soon as an Edge Server registers it,
+	// on this Negotiator or on a peer replica.
+	SetWaitAnswerCallback(WaitAnswerCallbackFunction)
+}
+
+func (n *Negotiator) waitAnswer(ctx context.Context, user UserID, offerID OfferID) ([]byte, error) {
+	for {
+		sdp, err := n.lookupAnswer(ctx, user, offerID)
+		if err != ErrAnswerPending {
+			return sdp, err
+		}
+
+		n.mutexAnswers.Lock()
+		answer, ok := n.answers[offerID]
+		n.mutexAnswers.Unlock()
+		if !ok {
+			continue // purged meanwhile, lookupAnswer tells why
+		}
+
+		// wake up at expiry, and in time to tell a silent edge server
+		answer.mutex.Lock()
+		wait := time.Until(answer.expiry)
+		answer.mutex.Unlock()
+		if n.livenessTimeout > 0 && n.livenessTimeout < wait {
+			wait = n.livenessTimeout
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-answer.ready:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ErrAnswerPending
+		}
+		timer.Stop()
+	}
+}
@@ -0,0 +1,58 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// answerSignatureAttribute carries the signature of the Edge Server in the answer
+// SDP, so that it passes through any Negotiator unmodified.
+const answerSignatureAttribute = "a=rtcsocks-sig:"
+
+// SignAnswer appends the Edge Server signature over the offer and the answer to the
+// answer SDP, terminating its last line with CRLF if needed. Binding the offer
+// prevents an answer from being replayed to another Client.
+func SignAnswer(key ed25519.PrivateKey, offer, answer []byte) []byte {
+	signed := make([]byte, 0, len(answer)+len(answerSignatureAttribute)+ed25519.SignatureSize*2)
+	signed = append(signed, answer...)
+	if len(signed) > 0 && signed[len(signed)-1] != '\n' {
+		signed = append(signed, '\r', '\n')
+	}
+	sig := ed25519.Sign(key, answerSignatureMessage(offer, signed))
+
+	signed = append(signed, answerSignatureAttribute...)
+	signed = append(signed, base64.StdEncoding.EncodeToString(sig)...)
+	signed = append(signed, '\r', '\n')
+	return signed
+}
+
+// VerifyAnswer checks the answer SDP was signed for the offer by any of the keys,
+// and returns the answer without the signature attribute.
+func VerifyAnswer(keys []ed25519.PublicKey, offer, signed []byte) ([]byte, error) {
+	idx := bytes.LastIndex(signed, []byte(answerSignatureAttribute))
+	if idx < 0 {
+		return nil, ErrAnswerNotSigned
+	}
+	answer := signed[:idx]
+	sigB64 := bytes.TrimRight(signed[idx+len(answerSignatureAttribute):], "\r\n")
+	sig, err := base64.StdEncoding.DecodeString(string(sigB64))
+	if err != nil {
+		return nil, ErrBadAnswerSignature
+	}
+
+	msg := answerSignatureMessage(offer, answer)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return answer, nil
+		}
+	}
+	return nil, ErrBadAnswerSignature
+}
+
+func answerSignatureMessage(offer, answer []byte) []byte {
+	offerHash := sha256.Sum256(offer)
+	answerHash := sha256.Sum256(answer)
+	return append(offerHash[:], answerHash[:]...)
+}
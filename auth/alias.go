@@ -0,0 +1,30 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+)
+
+const aliasContext = "rtcsocks user alias"
+
+// Alias returns the pseudonymous UID of a user in the epoch, derived from the user
+// secret as stored by the Negotiator, e.g. the password or "ed25519:<public key>".
+// Aliases of different epochs cannot be linked without the secret.
+func Alias(secret string, epoch uint64) uint64 {
+	key := hmac.New(sha256.New, []byte(secret))
+	key.Write([]byte(aliasContext))
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], epoch)
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write(msg[:])
+	return binary.BigEndian.Uint64(mac.Sum(nil)[:8])
+}
+
+// Epoch returns the number of the alias epoch t falls in, with epochs of the period
+// counted from the Unix epoch.
+func Epoch(t time.Time, period time.Duration) uint64 {
+	return uint64(t.UnixNano() / int64(period))
+}
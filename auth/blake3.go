@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/subtle"
+
+	"github.com/zeebo/blake3"
+)
+
+const blake3KeyContext = "github.com/gaukas/rtcsocks auth blake3 key"
+
+// BLAKE3 authenticates with the BLAKE3 keyed hash, keyed by a key derived from the password.
+type BLAKE3 struct{}
+
+func (BLAKE3) Name() string {
+	return "blake3"
+}
+
+func (BLAKE3) Sign(credential, msg []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	blake3.DeriveKey(blake3KeyContext, credential, key)
+	h, err := blake3.NewKeyed(key)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (s BLAKE3) Verify(secret string, msg, mac []byte) bool {
+	if isPublicKey(secret) {
+		return false
+	}
+	sum, err := s.Sign([]byte(secret), msg)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(sum, mac) == 1
+}
@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+)
+
+const ed25519Prefix = "ed25519:"
+
+// Ed25519 authenticates with Ed25519 signatures. The client-side credential is the
+// private key (or its 32-byte seed), the stored secret is "ed25519:" followed by the
+// base64-encoded public key, see Ed25519Secret.
+type Ed25519 struct{}
+
+func (Ed25519) Name() string {
+	return "ed25519"
+}
+
+func (Ed25519) Sign(credential, msg []byte) ([]byte, error) {
+	priv, err := ed25519PrivateKey(credential)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.Sign(priv, msg), nil
+}
+
+func (Ed25519) Verify(secret string, msg, sig []byte) bool {
+	if !strings.HasPrefix(secret, ed25519Prefix) {
+		return false
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(secret, ed25519Prefix))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+}
+
+// Ed25519Secret returns the secret to be stored for a user authenticating with the public key.
+func Ed25519Secret(pub ed25519.PublicKey) string {
+	return ed25519Prefix + base64.StdEncoding.EncodeToString(pub)
+}
+
+// Ed25519PublicKey returns the public key of the client-side credential.
+func Ed25519PublicKey(credential []byte) (ed25519.PublicKey, error) {
+	priv, err := ed25519PrivateKey(credential)
+	if err != nil {
+		return nil, err
+	}
+	return priv.Public().(ed25519.PublicKey), nil
+}
+
+// ed25519PrivateKey accepts the private key or its 32-byte seed.
+func ed25519PrivateKey(credential []byte) (ed25519.PrivateKey, error) {
+	switch len(credential) {
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(credential), nil
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(credential), nil
+	default:
+		return nil, ErrInvalidCredential
+	}
+}
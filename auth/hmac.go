@@ -0,0 +1,27 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+// HMACSHA256 authenticates with HMAC-SHA256 keyed by the password.
+type HMACSHA256 struct{}
+
+func (HMACSHA256) Name() string {
+	return "hmac-sha256"
+}
+
+func (HMACSHA256) Sign(credential, msg []byte) ([]byte, error) {
+	h := hmac.New(sha256.New, credential)
+	h.Write(msg)
+	return h.Sum(nil), nil
+}
+
+func (s HMACSHA256) Verify(secret string, msg, mac []byte) bool {
+	if isPublicKey(secret) {
+		return false
+	}
+	sum, _ := s.Sign([]byte(secret), msg)
+	return hmac.Equal(sum, mac)
+}
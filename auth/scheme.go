@@ -0,0 +1,119 @@
+// Package auth implements the schemes used to authenticate requests to the Negotiator.
+//
+// A user credential is stored as a secret string. Keyed-hash schemes use the secret
+// itself as the password, while signature schemes store the public key prefixed with
+// the scheme name, e.g. "ed25519:<base64 public key>", and SRP stores a verifier,
+// "srp:<base64 salt>:<base64 verifier>". A keyed-hash scheme never accepts a secret
+// with such a prefix.
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownScheme     = errors.New("unknown authentication scheme")
+	ErrInvalidCredential = errors.New("invalid credential for the authentication scheme")
+)
+
+// Scheme authenticates a message with a user credential.
+type Scheme interface {
+	// Name is the identifier of the scheme sent along with the request.
+	Name() string
+
+	// Sign computes the authenticator of msg with the client-side credential.
+	Sign(credential, msg []byte) ([]byte, error)
+
+	// Verify checks the authenticator of msg with the secret stored server-side.
+	Verify(secret string, msg, mac []byte) bool
+}
+
+// Registry holds the schemes accepted by a Negotiator API.
+type Registry struct {
+	schemes map[string]Scheme
+}
+
+// DefaultScheme is assumed when a request does not specify a scheme.
+const DefaultScheme = "hmac-sha256"
+
+// Default accepts all schemes implemented by this package.
+var Default = NewRegistry(HMACSHA256{}, BLAKE3{}, Ed25519{})
+
+func NewRegistry(schemes ...Scheme) *Registry {
+	r := &Registry{
+		schemes: make(map[string]Scheme),
+	}
+	for _, s := range schemes {
+		r.schemes[s.Name()] = s
+	}
+	return r
+}
+
+// Get returns the scheme by name, or the DefaultScheme if name is empty.
+func (r *Registry) Get(name string) (Scheme, error) {
+	if name == "" {
+		name = DefaultScheme
+	}
+	s, ok := r.schemes[name]
+	if !ok {
+		return nil, ErrUnknownScheme
+	}
+	return s, nil
+}
+
+// publicSecretSchemes are the schemes whose stored secret is not a password.
+var publicSecretSchemes = []string{"ed25519", "srp"}
+
+// isPublicKey reports whether the secret is not a password, e.g. a public key.
+func isPublicKey(secret string) bool {
+	for _, name := range publicSecretSchemes {
+		if strings.HasPrefix(secret, name+":") {
+			return true
+		}
+	}
+	return false
+}
+
+// IsPublicSecret reports whether the stored secret is public or a verifier, i.e.
+// it is not shared with the client and cannot key anything but the scheme itself.
+func IsPublicSecret(secret string) bool {
+	return isPublicKey(secret)
+}
+
+var (
+	dummySecrets      = make(map[string]string)
+	mutexDummySecrets sync.Mutex
+)
+
+// DummySecret returns a random secret in the format expected by the named scheme.
+// Requests from unknown users SHOULD be verified against it, so that they take the
+// same code path and time as requests from known users.
+func DummySecret(name string) string {
+	if name == "" {
+		name = DefaultScheme
+	}
+
+	mutexDummySecrets.Lock()
+	defer mutexDummySecrets.Unlock()
+	if secret, ok := dummySecrets[name]; ok {
+		return secret
+	}
+
+	var secret string
+	switch name {
+	case "ed25519":
+		pub, _, _ := ed25519.GenerateKey(rand.Reader)
+		secret = Ed25519Secret(pub)
+	default:
+		var buf [32]byte
+		rand.Read(buf[:])
+		secret = base64.RawStdEncoding.EncodeToString(buf[:])
+	}
+	dummySecrets[name] = secret
+	return secret
+}
@@ -0,0 +1,194 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// SRP-6a (RFC 5054) with SHA-256 and the 2048-bit group, an augmented PAKE: the
+// Negotiator stores only a verifier derived from the password, from which the
+// password cannot be recovered without an offline dictionary attack on the
+// verifier itself, and captured handshakes reveal nothing about the password.
+
+var (
+	ErrSRPBadParameter = errors.New("bad SRP parameter")
+	ErrSRPBadProof     = errors.New("bad SRP proof")
+)
+
+const (
+	srpPrefix   = "srp:"
+	srpSaltSize = 16
+	srpGroupN   = "AC6BDB41324A9A9BF166DE5E1389582FAF72B6651987EE07FC3192943DB56050A37329CBB4A099ED8193E0757767A13DD52312AB4B03310DCD7F48A9DA04FD50E8083969EDB767B0CF6095179A163AB3661A05FBD5FAAAE82918A9962F0B93B855F97993EC975EEAA80D740ADBF4FF747359D041D5C33EA71D281E446B14773BCA97B43A23FB801676BD207A436C6481F1D2B9078717461A5B9D32E688F87748544523B524B0D57D5EA77A2775D2ECFA032CFBDBF52FB3786160279004E57AE6AF874E7303CE53299CCC041C7BC308D82A5698F3A8D0C38271AE35F8E9DBFBB694B5C803D89F7AE435DE236D525F54759B65E372FCD68EF20FA7111F9E4AFF73"
+)
+
+var (
+	srpN, _ = new(big.Int).SetString(srpGroupN, 16)
+	srpG    = big.NewInt(2)
+	srpK    = srpHashInt(srpPad(srpN), srpPad(srpG))
+)
+
+// SRPSecret returns the secret to be stored for a user authenticating with SRP,
+// "srp:" followed by the base64-encoded salt and verifier separated by ":".
+func SRPSecret(identity, password string) (string, error) {
+	salt := make([]byte, srpSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	v := new(big.Int).Exp(srpG, srpX(salt, identity, password), srpN)
+	return srpPrefix + base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(v.Bytes()), nil
+}
+
+func parseSRPSecret(secret string) (salt []byte, v *big.Int, err error) {
+	if !strings.HasPrefix(secret, srpPrefix) {
+		return nil, nil, ErrInvalidCredential
+	}
+	parts := strings.Split(strings.TrimPrefix(secret, srpPrefix), ":")
+	if len(parts) != 2 {
+		return nil, nil, ErrInvalidCredential
+	}
+	salt, err = base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, ErrInvalidCredential
+	}
+	vBytes, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, ErrInvalidCredential
+	}
+	return salt, new(big.Int).SetBytes(vBytes), nil
+}
+
+// SRPClient is the client side of an SRP handshake.
+type SRPClient struct {
+	identity string
+	password string
+	a, A     *big.Int
+	m1, key  []byte
+}
+
+// NewSRPClient starts a handshake and returns the public ephemeral A to be sent to the server.
+func NewSRPClient(identity, password string) (*SRPClient, []byte, error) {
+	a, err := srpRandom()
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &SRPClient{
+		identity: identity,
+		password: password,
+		a:        a,
+		A:        new(big.Int).Exp(srpG, a, srpN),
+	}
+	return c, c.A.Bytes(), nil
+}
+
+// Proof processes the salt and public ephemeral B of the server, and returns the
+// proof M1 to be sent to the server.
+func (c *SRPClient) Proof(salt, B []byte) ([]byte, error) {
+	b := new(big.Int).SetBytes(B)
+	if new(big.Int).Mod(b, srpN).Sign() == 0 {
+		return nil, ErrSRPBadParameter
+	}
+	u := srpHashInt(srpPad(c.A), srpPad(b))
+	if u.Sign() == 0 {
+		return nil, ErrSRPBadParameter
+	}
+
+	// S = (B - k * g^x) ^ (a + u * x) % N
+	x := srpX(salt, c.identity, c.password)
+	kgx := new(big.Int).Mul(srpK, new(big.Int).Exp(srpG, x, srpN))
+	base := new(big.Int).Sub(b, kgx)
+	base.Mod(base, srpN)
+	exp := new(big.Int).Add(c.a, new(big.Int).Mul(u, x))
+	S := new(big.Int).Exp(base, exp, srpN)
+
+	c.key = srpHash(srpPad(S))
+	c.m1 = srpHash(srpPad(c.A), srpPad(b), c.key)
+	return c.m1, nil
+}
+
+// Key verifies the server proof M2 and returns the shared session key.
+func (c *SRPClient) Key(M2 []byte) ([]byte, error) {
+	if c.key == nil || !hmac.Equal(srpHash(srpPad(c.A), c.m1, c.key), M2) {
+		return nil, ErrSRPBadProof
+	}
+	return c.key, nil
+}
+
+// SRPServer is the server side of an SRP handshake.
+type SRPServer struct {
+	v, b, B *big.Int
+	salt    []byte
+}
+
+// NewSRPServer starts a handshake with the stored secret, and returns the salt and
+// the public ephemeral B to be sent to the client.
+func NewSRPServer(secret string) (*SRPServer, []byte, []byte, error) {
+	salt, v, err := parseSRPSecret(secret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	b, err := srpRandom()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// B = (k * v + g^b) % N
+	B := new(big.Int).Mul(srpK, v)
+	B.Add(B, new(big.Int).Exp(srpG, b, srpN))
+	B.Mod(B, srpN)
+
+	return &SRPServer{v: v, b: b, B: B, salt: salt}, salt, B.Bytes(), nil
+}
+
+// Verify checks the public ephemeral A and the proof M1 of the client, and returns
+// the server proof M2 and the shared session key.
+func (s *SRPServer) Verify(A, M1 []byte) (M2, key []byte, err error) {
+	a := new(big.Int).SetBytes(A)
+	if new(big.Int).Mod(a, srpN).Sign() == 0 {
+		return nil, nil, ErrSRPBadParameter
+	}
+	u := srpHashInt(srpPad(a), srpPad(s.B))
+
+	// S = (A * v^u) ^ b % N
+	base := new(big.Int).Mul(a, new(big.Int).Exp(s.v, u, srpN))
+	S := new(big.Int).Exp(base.Mod(base, srpN), s.b, srpN)
+
+	key = srpHash(srpPad(S))
+	if !hmac.Equal(srpHash(srpPad(a), srpPad(s.B), key), M1) {
+		return nil, nil, ErrSRPBadProof
+	}
+	return srpHash(srpPad(a), M1, key), key, nil
+}
+
+func srpX(salt []byte, identity, password string) *big.Int {
+	return srpHashInt(salt, srpHash([]byte(identity+":"+password)))
+}
+
+func srpRandom() (*big.Int, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(buf), nil
+}
+
+// srpPad left-pads the value to the length of N.
+func srpPad(i *big.Int) []byte {
+	return i.FillBytes(make([]byte, (srpN.BitLen()+7)/8))
+}
+
+func srpHash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func srpHashInt(data ...[]byte) *big.Int {
+	return new(big.Int).SetBytes(srpHash(data...))
+}
@@ -0,0 +1,226 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"net"
+)
+
+// CandidatePolicy restricts the ICE candidates advertised in an SDP, for users who
+// must not reveal some of their addresses. The same policy SHOULD be applied by the
+// Client to its offers and by the Edge Server to its answers. The zero value keeps
+// all candidates.
+//
+// The related address of a kept reflexive candidate is redacted to 0.0.0.0 (or ::)
+// if a host candidate of that address would not be allowed, and so are the addresses
+// in "c=" and "a=rtcp:" lines.
+type CandidatePolicy struct {
+	RelayOnly         bool         // keep relay candidates only
+	NoHost            bool         // drop host candidates, i.e., local interface addresses
+	IPv6Only          bool         // drop candidates with an IPv4 address
+	ExcludeNetworks   []*net.IPNet // drop candidates with an address in any of the networks
+	ExcludeInterfaces []string     // drop candidates with an address of any of the local interfaces, e.g. "eth0"
+
+	NoMDNS       bool // drop mDNS obfuscated host candidates, i.e., with a ".local" hostname
+	MDNSOnly     bool // drop host candidates with an IP address, keeping the mDNS obfuscated ones
+	ScrubPrivate bool // drop candidates with a private, loopback or link-local address
+}
+
+// iceCandidate is the part of an "a=candidate:" line a CandidatePolicy acts on.
+type iceCandidate struct {
+	fields  [][]byte
+	address string // IP address or mDNS hostname
+	typ     string // host, srflx, prflx or relay
+	raddr   int    // index of the related address in fields, 0 -> none
+}
+
+// parseCandidate parses an SDP candidate attribute, see RFC 8839:
+// a=candidate:<foundation> <component> <transport> <priority> <address> <port> typ <type> ...
+func parseCandidate(line []byte) (*iceCandidate, bool) {
+	if !bytes.HasPrefix(line, []byte("a=candidate:")) {
+		return nil, false
+	}
+	fields := bytes.Fields(line[len("a=candidate:"):])
+	if len(fields) < 8 || string(fields[6]) != "typ" {
+		return nil, false
+	}
+	c := &iceCandidate{
+		fields:  fields,
+		address: string(fields[4]),
+		typ:     string(fields[7]),
+	}
+	for i := 8; i+1 < len(fields); i += 2 {
+		if string(fields[i]) == "raddr" {
+			c.raddr = i + 1
+		}
+	}
+	return c, true
+}
+
+// Apply removes the candidates not allowed by the policy from the SDP. It returns
+// ErrNoCandidateAllowed if the SDP had candidates and none of them is allowed.
+func (p *CandidatePolicy) Apply(sdp []byte) ([]byte, error) {
+	out, withheld, err := p.Split(sdp)
+	if err != nil {
+		return nil, err
+	}
+	if len(withheld) > 0 && !bytes.Contains(out, []byte("a=candidate:")) {
+		return nil, ErrNoCandidateAllowed
+	}
+	return out, nil
+}
+
+// Split removes the candidates not allowed by the policy from the SDP and returns
+// them, without the "a=" prefix. The withheld candidates MAY be trickled to the peer
+// later over a channel they are allowed on, e.g. once a relayed connection is up,
+// and be added back with AppendCandidates.
+func (p *CandidatePolicy) Split(sdp []byte) (allowed []byte, withheld []string, err error) {
+	excluded, err := p.excludedNetworks()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allowed = make([]byte, 0, len(sdp))
+	for _, line := range bytes.SplitAfter(sdp, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if c, ok := parseCandidate(trimmed); ok {
+			if !p.allows(c, excluded) {
+				withheld = append(withheld, string(trimmed[len("a="):]))
+				continue
+			}
+			if c.raddr > 0 && !p.allowsRelated(string(c.fields[c.raddr]), excluded) {
+				line = c.redactRelated(line)
+			}
+		} else if idx := connectionAddress(trimmed); idx > 0 && !p.allowsRelated(string(trimmed[idx:]), excluded) {
+			line = redactAddress(line, idx)
+		}
+		allowed = append(allowed, line...)
+	}
+	return allowed, withheld, nil
+}
+
+// AppendCandidates adds trickled candidates, e.g. withheld by Split, back to the SDP.
+// They are appended to the last media section, i.e., the data channel of rtcsocks.
+func AppendCandidates(sdp []byte, candidates ...string) []byte {
+	out := make([]byte, 0, len(sdp))
+	out = append(out, sdp...)
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\r', '\n')
+	}
+	for _, c := range candidates {
+		out = append(out, "a="...)
+		out = append(out, c...)
+		out = append(out, '\r', '\n')
+	}
+	return out
+}
+
+func (p *CandidatePolicy) allows(c *iceCandidate, excluded []*net.IPNet) bool {
+	if p.RelayOnly && c.typ != "relay" {
+		return false
+	}
+	if p.NoHost && c.typ == "host" {
+		return false
+	}
+
+	ip := net.ParseIP(c.address)
+	if ip == nil { // mDNS hostname, address unknown
+		return !p.IPv6Only && !p.NoMDNS
+	}
+	if p.MDNSOnly && c.typ == "host" {
+		return false
+	}
+	if p.IPv6Only && ip.To4() != nil {
+		return false
+	}
+	if p.ScrubPrivate && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()) {
+		return false
+	}
+	for _, network := range excluded {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsRelated reports whether the related address of a candidate, i.e., the host
+// address behind a reflexive candidate, may be revealed.
+func (p *CandidatePolicy) allowsRelated(address string, excluded []*net.IPNet) bool {
+	if p.RelayOnly || p.NoHost {
+		return false
+	}
+	return p.allows(&iceCandidate{address: address, typ: "host"}, excluded)
+}
+
+// redactRelated replaces the related address and port of the candidate line like
+// browsers do, keeping the line ending.
+func (c *iceCandidate) redactRelated(line []byte) []byte {
+	fields := make([][]byte, len(c.fields))
+	copy(fields, c.fields)
+	if ip := net.ParseIP(string(fields[c.raddr])); ip != nil && ip.To4() == nil {
+		fields[c.raddr] = []byte("::")
+	} else {
+		fields[c.raddr] = []byte("0.0.0.0")
+	}
+	if c.raddr+2 < len(fields) && string(fields[c.raddr+1]) == "rport" {
+		fields[c.raddr+2] = []byte("0")
+	}
+
+	redacted := append([]byte("a=candidate:"), bytes.Join(fields, []byte(" "))...)
+	return append(redacted, line[len(bytes.TrimRight(line, "\r\n")):]...)
+}
+
+// connectionAddress returns the index of the address in a "c=" or "a=rtcp:" line,
+// e.g. "c=IN IP4 192.0.2.1" or "a=rtcp:9 IN IP4 192.0.2.1", or 0 if there is none.
+func connectionAddress(line []byte) int {
+	if !bytes.HasPrefix(line, []byte("c=")) && !bytes.HasPrefix(line, []byte("a=rtcp:")) {
+		return 0
+	}
+	for _, family := range []string{" IP4 ", " IP6 "} {
+		if idx := bytes.Index(line, []byte(family)); idx > 0 {
+			return idx + len(family)
+		}
+	}
+	return 0
+}
+
+// redactAddress replaces the address starting at idx in the line, keeping the line
+// ending.
+func redactAddress(line []byte, idx int) []byte {
+	trimmed := bytes.TrimRight(line, "\r\n")
+	unspecified := "0.0.0.0"
+	if bytes.Contains(trimmed[:idx], []byte("IP6")) {
+		unspecified = "::"
+	}
+	end := idx
+	for end < len(trimmed) && trimmed[end] != ' ' && trimmed[end] != '/' {
+		end++
+	}
+
+	redacted := append([]byte{}, line[:idx]...)
+	redacted = append(redacted, unspecified...)
+	return append(redacted, line[end:]...)
+}
+
+// excludedNetworks returns ExcludeNetworks and the addresses of ExcludeInterfaces.
+func (p *CandidatePolicy) excludedNetworks() ([]*net.IPNet, error) {
+	excluded := p.ExcludeNetworks
+	for _, name := range p.ExcludeInterfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				// exclude the address itself, not the whole subnet
+				bits := len(ipnet.IP) * 8
+				excluded = append(excluded, &net.IPNet{IP: ipnet.IP, Mask: net.CIDRMask(bits, bits)})
+			}
+		}
+	}
+	return excluded, nil
+}
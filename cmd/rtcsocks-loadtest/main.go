@@ -0,0 +1,156 @@
+// Command rtcsocks-loadtest simulates Clients and Edge Servers against a Negotiator
+// over the HTTP plugin, and reports the match latency percentiles and error rates.
+//
+// Without -addr, it runs against a Negotiator of its own on a loopback port:
+//
+//	rtcsocks-loadtest -users 5000 -servers 20 -groups 1:3,2:1 -rate 500 -duration 1m
+//
+// With -addr, it runs against a deployed Negotiator, which MUST know users 1 to -users
+// with -password and the groups with -secret.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/loadtest"
+	"github.com/gaukas/rtcsocks/plugin/negotiate/http"
+)
+
+func main() {
+	var (
+		addr          = flag.String("addr", "", "address of the Negotiator API, empty -> run one in-process")
+		plain         = flag.Bool("plain", false, "use plain HTTP with -addr")
+		insecure      = flag.Bool("insecure", false, "skip TLS certificate verification with -addr")
+		password      = flag.String("password", "loadtest", "password of the simulated users")
+		secret        = flag.String("secret", "loadtest", "secret of the simulated groups")
+		users         = flag.Int("users", 1000, "simulated users")
+		servers       = flag.Int("servers", 10, "simulated Edge Servers per group")
+		groups        = flag.String("groups", "1", "groups and their weights in the offers, e.g. 1:3,2:1")
+		rate          = flag.Float64("rate", 50, "offers per second")
+		duration      = flag.Duration("duration", 30*time.Second, "how long offers keep arriving")
+		answerLatency = flag.Duration("answer-latency", 100*time.Millisecond, "mean delay of the Edge Servers before answering")
+		poll          = flag.Duration("poll", 500*time.Millisecond, "delay of the Edge Servers between polls when no offer is available")
+		ttl           = flag.Duration("ttl", 30*time.Second, "offer TTL of the in-process Negotiator")
+		timeout       = flag.Duration("timeout", time.Minute, "Clients give up on an offer after this long")
+	)
+	flag.Parse()
+
+	weights, maxGroup, err := parseGroups(*groups)
+	if err != nil {
+		log.Fatalf("-groups: %v", err)
+	}
+
+	if *addr == "" {
+		*addr, err = serveNegotiator(int(maxGroup), *ttl, *users, *password, weights, *secret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		*plain = true
+	}
+
+	var edges []*http.Server
+	cfg := loadtest.Config{
+		NewClient: func(user rtcsocks.UserID) rtcsocks.ClientNegotiator {
+			return &http.Client{
+				UserID:             user,
+				Password:           *password,
+				ServerAddr:         *addr,
+				InsecurePlainHTTP:  *plain,
+				InsecureSkipVerify: *insecure,
+			}
+		},
+		NewServer: func(group rtcsocks.GroupID, _ int) rtcsocks.ServerNegotiator {
+			s := &http.Server{
+				GroupID:            group,
+				Secret:             *secret,
+				ServerAddr:         *addr,
+				InsecurePlainHTTP:  *plain,
+				InsecureSkipVerify: *insecure,
+				WaitAfterPending:   *poll,
+				WaitAfterError:     *poll,
+			}
+			edges = append(edges, s)
+			return s
+		},
+		Users:           *users,
+		ServersPerGroup: *servers,
+		Groups:          weights,
+		ArrivalRate:     *rate,
+		Duration:        *duration,
+		AnswerLatency:   *answerLatency,
+		Timeout:         *timeout,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := loadtest.Run(ctx, cfg)
+	for _, s := range edges {
+		s.Close(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Print(report)
+}
+
+// parseGroups parses "1:3,2:1" into group -> weight. A group without weight weighs 1.
+func parseGroups(s string) (map[rtcsocks.GroupID]int, rtcsocks.GroupID, error) {
+	weights := make(map[rtcsocks.GroupID]int)
+	var maxGroup rtcsocks.GroupID
+	for _, field := range strings.Split(s, ",") {
+		id, weight, found := strings.Cut(strings.TrimSpace(field), ":")
+		group, err := strconv.ParseUint(id, 10, 8)
+		if err != nil || group == 0 {
+			return nil, 0, fmt.Errorf("bad group %q", id)
+		}
+		w := 1
+		if found {
+			if w, err = strconv.Atoi(weight); err != nil || w < 0 {
+				return nil, 0, fmt.Errorf("bad weight %q", weight)
+			}
+		}
+		weights[rtcsocks.GroupID(group)] = w
+		if rtcsocks.GroupID(group) > maxGroup {
+			maxGroup = rtcsocks.GroupID(group)
+		}
+	}
+	return weights, maxGroup, nil
+}
+
+// serveNegotiator serves a Negotiator knowing the simulated users and groups on a
+// loopback port, and returns its address.
+func serveNegotiator(maxGroup int, ttl time.Duration, users int, password string, groups map[rtcsocks.GroupID]int, secret string) (string, error) {
+	userpass := make(map[rtcsocks.UserID]string, users)
+	for i := 1; i <= users; i++ {
+		userpass[rtcsocks.UserID(i)] = password
+	}
+	groupSecret := make(map[rtcsocks.GroupID]string, len(groups))
+	for group := range groups {
+		groupSecret[group] = secret
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	api := http.NewAPI(userpass, groupSecret)
+	api.SetLookupBackoff(0, 0) // lookups by the same users are many, not a scan
+	n := rtcsocks.NewNegotiator(maxGroup, ttl)
+	n.HookToAPI(api)
+	go func() {
+		if err := api.Serve(ln); err != nil {
+			log.Fatalf("negotiator: %v", err)
+		}
+	}()
+	return ln.Addr().String(), nil
+}
@@ -0,0 +1,94 @@
+// Command rtcsocks-replay replays a negotiation recording, made with
+// rtcsocks.Recorder, through a fresh Negotiator and reports the calls ending
+// differently than recorded:
+//
+//	rtcsocks-replay -groups 4 -ttl 30s -realtime recording.jsonl
+//
+// It exits with status 1 if any call diverged. The Negotiator SHOULD be configured
+// like the recorded one for the replay to be meaningful.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+func main() {
+	var (
+		groups   = flag.Int("groups", 255, "max group ID of the Negotiator")
+		ttl      = flag.Duration("ttl", 30*time.Second, "offer TTL of the Negotiator")
+		realtime = flag.Bool("realtime", false, "replay with the recorded delays between calls")
+		verbose  = flag.Bool("v", false, "print every call, not only the diverging ones")
+	)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] recording.jsonl\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	n := rtcsocks.NewNegotiator(*groups, *ttl)
+	var calls, diverged, skipped int
+	err = rtcsocks.Replay(context.Background(), n, f, *realtime, func(r *rtcsocks.ReplayResult) {
+		calls++
+		switch {
+		case r.Skipped:
+			skipped++
+		case r.Diverged():
+			diverged++
+			fmt.Printf("DIVERGED %s\n", describe(r))
+		case *verbose:
+			fmt.Printf("ok       %s\n", describe(r))
+		}
+	})
+	if err != nil {
+		log.Fatalf("%s: %v", flag.Arg(0), err)
+	}
+
+	fmt.Printf("%d calls replayed, %d diverged, %d skipped\n", calls, diverged, skipped)
+	if diverged > 0 {
+		os.Exit(1)
+	}
+}
+
+func describe(r *rtcsocks.ReplayResult) string {
+	rc := &r.Recorded
+	s := fmt.Sprintf("%s %s", rc.Time.Format(time.RFC3339Nano), rc.Method)
+	if rc.User != 0 {
+		s += " user " + rc.User.String()
+	}
+	if rc.Group != 0 {
+		s += " group " + rc.Group.String()
+	}
+	if rc.OfferID != 0 {
+		s += " offer " + rc.OfferID.String()
+	}
+	recorded := rc.Error
+	if recorded == "" {
+		recorded = "ok"
+	}
+	replayed := "ok"
+	if r.Err != nil {
+		replayed = r.Err.Error()
+	}
+	s += fmt.Sprintf(": recorded %q, replayed %q", recorded, replayed)
+	if rc.Method == rtcsocks.MethodNextOffer && r.Expected != 0 && r.OfferID != r.Expected {
+		s += fmt.Sprintf(" with offer %s instead of %s", r.OfferID, r.Expected)
+	}
+	return s
+}
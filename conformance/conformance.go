@@ -0,0 +1,251 @@
+// Package conformance checks that negotiation plugins, i.e., implementations of
+// rtcsocks.NegotiatorAPI with their ClientNegotiator and ServerNegotiator, behave
+// like the HTTP plugin, so Clients and Edge Servers can switch between them.
+//
+// A plugin runs the suite from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		conformance.Run(t, func(t *testing.T, n *rtcsocks.Negotiator, creds rtcsocks.CredentialStore) (*conformance.Plugin, error) {
+//			api := NewAPIWithCredentialStore(creds)
+//			n.HookToAPI(api)
+//			...
+//		})
+//	}
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	offerTTL       = 2 * time.Second
+
+	user     rtcsocks.UserID  = 1
+	password                  = "conformance-password"
+	other    rtcsocks.UserID  = 2
+	group    rtcsocks.GroupID = 1
+	secret                    = "conformance-secret"
+)
+
+var (
+	offerSDP  = []byte("v=0\r\no=- 1 1 IN IP4 0.0.0.0\r\ns=conformance offer\r\n")
+	answerSDP = []byte("v=0\r\no=- 2 2 IN IP4 0.0.0.0\r\ns=conformance answer\r\n")
+)
+
+// Plugin is a plugin instance serving a Negotiator.
+type Plugin struct {
+	// NewClient returns a ClientNegotiator authenticating as the user with the password.
+	NewClient func(user rtcsocks.UserID, password string) rtcsocks.ClientNegotiator
+
+	// NewServer returns a ServerNegotiator of the group authenticating with the secret.
+	// It MUST start receiving offers once the next offer handler is set.
+	NewServer func(group rtcsocks.GroupID, secret string) rtcsocks.ServerNegotiator
+
+	// Close stops the Servers created with NewServer and the NegotiatorAPI. Optional.
+	Close func()
+
+	// Timeout is how long an offer may take to reach the Edge Server, 0 -> 10s.
+	Timeout time.Duration
+}
+
+// MakePlugin hooks a new NegotiatorAPI to the Negotiator, authenticating users and
+// groups against the CredentialStore, and starts serving it.
+type MakePlugin func(t *testing.T, n *rtcsocks.Negotiator, creds rtcsocks.CredentialStore) (*Plugin, error)
+
+// Run runs the conformance suite against the plugin, each check with a new Negotiator
+// and plugin instance.
+func Run(t *testing.T, mp MakePlugin) {
+	t.Run("HappyPath", func(t *testing.T) { testHappyPath(t, mp) })
+	t.Run("Pending", func(t *testing.T) { testPending(t, mp) })
+	t.Run("Expiry", func(t *testing.T) { testExpiry(t, mp) })
+	t.Run("AuthFailure", func(t *testing.T) { testAuthFailure(t, mp) })
+	t.Run("Replay", func(t *testing.T) { testReplay(t, mp) })
+}
+
+// env is a plugin instance set up for one check.
+type env struct {
+	*Plugin
+	t *testing.T
+}
+
+func setup(t *testing.T, mp MakePlugin) *env {
+	n := rtcsocks.NewNegotiator(2, offerTTL)
+	creds := &rtcsocks.MapCredentialStore{
+		Users:  map[rtcsocks.UserID]string{user: password, other: password + "-other"},
+		Groups: map[rtcsocks.GroupID]string{group: secret},
+	}
+	p, err := mp(t, n, creds)
+	if err != nil {
+		t.Fatalf("MakePlugin: %v", err)
+	}
+	if p.Timeout == 0 {
+		p.Timeout = defaultTimeout
+	}
+	if p.Close != nil {
+		t.Cleanup(p.Close)
+	}
+	return &env{Plugin: p, t: t}
+}
+
+type received struct {
+	offerID rtcsocks.OfferID
+	sdp     []byte
+}
+
+// server returns an authenticated ServerNegotiator and the offers it receives.
+func (e *env) server() (rtcsocks.ServerNegotiator, <-chan received) {
+	offers := make(chan received, 8)
+	s := e.NewServer(group, secret)
+	s.SetNextOfferHandler(func(offerID rtcsocks.OfferID, sdp []byte) error {
+		offers <- received{offerID, sdp}
+		return nil
+	})
+	return s, offers
+}
+
+func (e *env) register(c rtcsocks.ClientNegotiator) rtcsocks.OfferID {
+	e.t.Helper()
+	offerID, err := c.RegisterOffer(offerSDP, group)
+	if err != nil {
+		e.t.Fatalf("RegisterOffer: %v", err)
+	}
+	return offerID
+}
+
+func (e *env) receive(offers <-chan received, offerID rtcsocks.OfferID) {
+	e.t.Helper()
+	select {
+	case r := <-offers:
+		if r.offerID != offerID {
+			e.t.Fatalf("Edge Server received offer %s, registered %s", r.offerID, offerID)
+		}
+		if !bytes.Equal(r.sdp, offerSDP) {
+			e.t.Fatalf("Edge Server received offer SDP %q, registered %q", r.sdp, offerSDP)
+		}
+	case <-time.After(e.Timeout):
+		e.t.Fatalf("offer %s not received by the Edge Server within %v", offerID, e.Timeout)
+	}
+}
+
+func (e *env) expectAnswer(c rtcsocks.ClientNegotiator, offerID rtcsocks.OfferID, want []byte) {
+	e.t.Helper()
+	answer, err := c.LookupAnswer(offerID)
+	if err != nil {
+		e.t.Fatalf("LookupAnswer: %v", err)
+	}
+	if !bytes.Equal(answer, want) {
+		e.t.Fatalf("LookupAnswer returned %q, registered %q", answer, want)
+	}
+}
+
+func (e *env) expectError(err, want error, what string) {
+	e.t.Helper()
+	if !errors.Is(err, want) {
+		e.t.Fatalf("%s: got error %v, want %v", what, err, want)
+	}
+}
+
+func testHappyPath(t *testing.T, mp MakePlugin) {
+	e := setup(t, mp)
+	c := e.NewClient(user, password)
+	s, offers := e.server()
+
+	offerID := e.register(c)
+	e.receive(offers, offerID)
+	if err := s.RegisterAnswer(offerID, answerSDP); err != nil {
+		t.Fatalf("RegisterAnswer: %v", err)
+	}
+	e.expectAnswer(c, offerID, answerSDP)
+}
+
+func testPending(t *testing.T, mp MakePlugin) {
+	e := setup(t, mp)
+	c := e.NewClient(user, password)
+
+	offerID := e.register(c)
+	_, err := c.LookupAnswer(offerID)
+	e.expectError(err, rtcsocks.ErrAnswerPending, "LookupAnswer before dispatch")
+
+	s, offers := e.server()
+	e.receive(offers, offerID)
+	_, err = c.LookupAnswer(offerID)
+	e.expectError(err, rtcsocks.ErrAnswerPending, "LookupAnswer before answer")
+
+	if err := s.RegisterAnswer(offerID, answerSDP); err != nil {
+		t.Fatalf("RegisterAnswer: %v", err)
+	}
+	e.expectAnswer(c, offerID, answerSDP)
+}
+
+func testExpiry(t *testing.T, mp MakePlugin) {
+	e := setup(t, mp)
+	c := e.NewClient(user, password)
+
+	offerID := e.register(c)
+	time.Sleep(offerTTL + time.Second)
+	_, err := c.LookupAnswer(offerID)
+	e.expectError(err, rtcsocks.ErrOfferExpired, "LookupAnswer after TTL")
+}
+
+func testAuthFailure(t *testing.T, mp MakePlugin) {
+	e := setup(t, mp)
+
+	if _, err := e.NewClient(user, "wrong-"+password).RegisterOffer(offerSDP, group); err == nil {
+		t.Fatal("RegisterOffer with a wrong password succeeded")
+	}
+	if _, err := e.NewClient(99, password).RegisterOffer(offerSDP, group); err == nil {
+		t.Fatal("RegisterOffer by an unknown user succeeded")
+	}
+
+	c := e.NewClient(user, password)
+	s, offers := e.server()
+	offerID := e.register(c)
+	e.receive(offers, offerID)
+
+	impostor := e.NewServer(group, "wrong-"+secret)
+	if err := impostor.RegisterAnswer(offerID, answerSDP); err == nil {
+		t.Fatal("RegisterAnswer with a wrong group secret succeeded")
+	}
+	_, err := c.LookupAnswer(offerID)
+	e.expectError(err, rtcsocks.ErrAnswerPending, "LookupAnswer after rejected answer")
+
+	if err := s.RegisterAnswer(offerID, answerSDP); err != nil {
+		t.Fatalf("RegisterAnswer: %v", err)
+	}
+	if answer, err := e.NewClient(user, "wrong-"+password).LookupAnswer(offerID); err == nil {
+		t.Fatalf("LookupAnswer with a wrong password returned %q", answer)
+	}
+	e.expectAnswer(c, offerID, answerSDP)
+}
+
+func testReplay(t *testing.T, mp MakePlugin) {
+	e := setup(t, mp)
+	c := e.NewClient(user, password)
+	s, offers := e.server()
+
+	offerID := e.register(c)
+	if again := e.register(c); again != offerID {
+		t.Fatalf("registering the same offer again returned offer %s, first %s", again, offerID)
+	}
+	e.receive(offers, offerID)
+
+	if err := s.RegisterAnswer(offerID, answerSDP); err != nil {
+		t.Fatalf("RegisterAnswer: %v", err)
+	}
+	if err := s.RegisterAnswer(offerID, answerSDP); err != nil {
+		t.Fatalf("RegisterAnswer with the identical answer again: %v", err)
+	}
+	err := s.RegisterAnswer(offerID, append([]byte("a=replayed\r\n"), answerSDP...))
+	e.expectError(err, rtcsocks.ErrAnswerRepeated, "RegisterAnswer with a different answer")
+
+	if answer, err := e.NewClient(other, password+"-other").LookupAnswer(offerID); err == nil {
+		t.Fatalf("LookupAnswer by another user returned %q", answer)
+	}
+	e.expectAnswer(c, offerID, answerSDP)
+}
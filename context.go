@@ -0,0 +1,131 @@
+package rtcsocks
+
+import "context"
+
+// RequestInfo describes the request a callback function is called for.
+type RequestInfo struct {
+	RemoteAddr string // address of the Client or Edge Server, as seen by the NegotiatorAPI
+	Session    string // Edge Server session ID, empty for Client requests
+}
+
+type requestInfoKey struct{}
+
+// ContextWithRequestInfo returns a copy of ctx carrying the RequestInfo.
+// NegotiatorAPIs SHOULD use it for the context passed to the callback functions.
+func ContextWithRequestInfo(ctx context.Context, info RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the RequestInfo carried by ctx, if any.
+func RequestInfoFromContext(ctx context.Context) (RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(RequestInfo)
+	return info, ok
+}
+
+// The callback function signatures without context and with untyped IDs, as used
+// before. The adapters below convert them so existing implementations keep working.
+type (
+	LegacyRegisterOfferCallbackFunction  func(user uint64, sdp []byte, groups ...uint64) (offerID uint64, err error)
+	LegacyNextOfferCallbackFunction      func(group uint64, session string) (offerID uint64, sdp []byte, err error)
+	LegacyRegisterAnswerCallbackFunction func(offerID uint64, sdp []byte) error
+	LegacyLookupAnswerCallbackFunction   func(user, offerID uint64) (sdp []byte, err error)
+	LegacyHeartbeatCallbackFunction      func(group uint64, session string, capabilities []string) error
+	LegacyDeregisterCallbackFunction     func(group uint64, session string) error
+)
+
+// FromLegacyRegisterOffer adapts a callback function ignoring the context.
+func FromLegacyRegisterOffer(f LegacyRegisterOfferCallbackFunction) RegisterOfferCallbackFunction {
+	return func(_ context.Context, user UserID, sdp []byte, groups ...GroupID) (OfferID, error) {
+		legacyGroups := make([]uint64, len(groups))
+		for i, g := range groups {
+			legacyGroups[i] = uint64(g)
+		}
+		offerID, err := f(uint64(user), sdp, legacyGroups...)
+		return OfferID(offerID), err
+	}
+}
+
+// FromLegacyNextOffer adapts a callback function ignoring the context.
+func FromLegacyNextOffer(f LegacyNextOfferCallbackFunction) NextOfferCallbackFunction {
+	return func(_ context.Context, group GroupID, session string) (OfferID, []byte, error) {
+		offerID, sdp, err := f(uint64(group), session)
+		return OfferID(offerID), sdp, err
+	}
+}
+
+// FromLegacyRegisterAnswer adapts a callback function ignoring the context.
+func FromLegacyRegisterAnswer(f LegacyRegisterAnswerCallbackFunction) RegisterAnswerCallbackFunction {
+	return func(_ context.Context, offerID OfferID, sdp []byte) error {
+		return f(uint64(offerID), sdp)
+	}
+}
+
+// FromLegacyLookupAnswer adapts a callback function ignoring the context.
+func FromLegacyLookupAnswer(f LegacyLookupAnswerCallbackFunction) LookupAnswerCallbackFunction {
+	return func(_ context.Context, user UserID, offerID OfferID) ([]byte, error) {
+		return f(uint64(user), uint64(offerID))
+	}
+}
+
+// FromLegacyHeartbeat adapts a callback function ignoring the context.
+func FromLegacyHeartbeat(f LegacyHeartbeatCallbackFunction) HeartbeatCallbackFunction {
+	return func(_ context.Context, group GroupID, session string, capabilities []string) error {
+		return f(uint64(group), session, capabilities)
+	}
+}
+
+// FromLegacyDeregister adapts a callback function ignoring the context.
+func FromLegacyDeregister(f LegacyDeregisterCallbackFunction) DeregisterCallbackFunction {
+	return func(_ context.Context, group GroupID, session string) error {
+		return f(uint64(group), session)
+	}
+}
+
+// Legacy returns the callback function called with context.Background(), for
+// NegotiatorAPIs not having a request context.
+func (f RegisterOfferCallbackFunction) Legacy() LegacyRegisterOfferCallbackFunction {
+	return func(user uint64, sdp []byte, legacyGroups ...uint64) (uint64, error) {
+		groups := make([]GroupID, len(legacyGroups))
+		for i, g := range legacyGroups {
+			groups[i] = GroupID(g)
+		}
+		offerID, err := f(context.Background(), UserID(user), sdp, groups...)
+		return uint64(offerID), err
+	}
+}
+
+// Legacy returns the callback function called with context.Background().
+func (f NextOfferCallbackFunction) Legacy() LegacyNextOfferCallbackFunction {
+	return func(group uint64, session string) (uint64, []byte, error) {
+		offerID, sdp, err := f(context.Background(), GroupID(group), session)
+		return uint64(offerID), sdp, err
+	}
+}
+
+// Legacy returns the callback function called with context.Background().
+func (f RegisterAnswerCallbackFunction) Legacy() LegacyRegisterAnswerCallbackFunction {
+	return func(offerID uint64, sdp []byte) error {
+		return f(context.Background(), OfferID(offerID), sdp)
+	}
+}
+
+// Legacy returns the callback function called with context.Background().
+func (f LookupAnswerCallbackFunction) Legacy() LegacyLookupAnswerCallbackFunction {
+	return func(user, offerID uint64) ([]byte, error) {
+		return f(context.Background(), UserID(user), OfferID(offerID))
+	}
+}
+
+// Legacy returns the callback function called with context.Background().
+func (f HeartbeatCallbackFunction) Legacy() LegacyHeartbeatCallbackFunction {
+	return func(group uint64, session string, capabilities []string) error {
+		return f(context.Background(), GroupID(group), session, capabilities)
+	}
+}
+
+// Legacy returns the callback function called with context.Background().
+func (f DeregisterCallbackFunction) Legacy() LegacyDeregisterCallbackFunction {
+	return func(group uint64, session string) error {
+		return f(context.Background(), GroupID(group), session)
+	}
+}
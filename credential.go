@@ -0,0 +1,72 @@
+package rtcsocks
+
+import "time"
+
+// CredentialStore provides the credentials a NegotiatorAPI authenticates Clients and
+// Edge Servers with. It returns ErrNotAuthenticated if the user or group is unknown.
+type CredentialStore interface {
+	UserSecret(user UserID) (secret string, err error)
+	GroupSecret(group GroupID) (secret string, err error)
+}
+
+// MapCredentialStore is an in-memory CredentialStore. The maps MUST NOT be modified
+// while in use.
+type MapCredentialStore struct {
+	Users  map[UserID]string  // Users[uid] = password
+	Groups map[GroupID]string // Groups[gid] = secret
+}
+
+func (m *MapCredentialStore) UserSecret(user UserID) (string, error) {
+	secret, ok := m.Users[user]
+	if !ok {
+		return "", ErrNotAuthenticated
+	}
+	return secret, nil
+}
+
+func (m *MapCredentialStore) GroupSecret(group GroupID) (string, error) {
+	secret, ok := m.Groups[group]
+	if !ok {
+		return "", ErrNotAuthenticated
+	}
+	return secret, nil
+}
+
+// Validity is the window in which a credential is valid, e.g. for trial users or
+// time-limited volunteer Edge Servers. Zero times leave the window open on that side.
+type Validity struct {
+	NotBefore time.Time // valid from, inclusive
+	NotAfter  time.Time // valid until, exclusive
+}
+
+// Valid reports whether the credential is valid at t.
+func (v Validity) Valid(t time.Time) bool {
+	return (v.NotBefore.IsZero() || !t.Before(v.NotBefore)) &&
+		(v.NotAfter.IsZero() || t.Before(v.NotAfter))
+}
+
+// ValidityCredentialStore enforces validity windows on the credentials of a
+// CredentialStore. Outside its window, a user or group is unknown: the secret is not
+// returned and authentication fails with ErrNotAuthenticated, so credentials expire
+// without manual cleanup. Users and groups without a window are always valid.
+//
+// The maps MUST NOT be modified while in use.
+type ValidityCredentialStore struct {
+	CredentialStore
+	Users  map[UserID]Validity
+	Groups map[GroupID]Validity
+}
+
+func (s *ValidityCredentialStore) UserSecret(user UserID) (string, error) {
+	if v, ok := s.Users[user]; ok && !v.Valid(time.Now()) {
+		return "", ErrNotAuthenticated
+	}
+	return s.CredentialStore.UserSecret(user)
+}
+
+func (s *ValidityCredentialStore) GroupSecret(group GroupID) (string, error) {
+	if v, ok := s.Groups[group]; ok && !v.Valid(time.Now()) {
+		return "", ErrNotAuthenticated
+	}
+	return s.CredentialStore.GroupSecret(group)
+}
@@ -0,0 +1,57 @@
+// Package debug serves the runtime debug endpoints, net/http/pprof and expvar, for
+// diagnosing CPU and memory issues of long-running Negotiators and Edge Servers.
+//
+// The endpoints MUST only be served on a private listener, e.g. a loopback address
+// or one reachable only from the operators' network, never on the address of the
+// API. They are opt-in: importing this package registers them on
+// http.DefaultServeMux as a side effect of net/http/pprof and expvar, so do not
+// import it in binaries serving http.DefaultServeMux publicly.
+package debug
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/reputation"
+)
+
+// Handler returns the handler of the debug endpoints:
+//
+//	/debug/pprof/ the pprof index and profiles, e.g. /debug/pprof/heap
+//	/debug/vars   the expvar variables, including those published by PublishStats
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// ListenAndServe serves the debug endpoints on the private address addr. It blocks
+// until the listener fails, like http.ListenAndServe.
+func ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, Handler())
+}
+
+// PublishStats publishes the Stats of the Negotiator as the expvar variable name,
+// read on every request to /debug/vars. Like expvar.Publish, it panics if the name
+// is already in use.
+func PublishStats(name string, n *rtcsocks.Negotiator) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return n.Stats()
+	}))
+}
+
+// PublishReputation publishes the Latest Report of the Monitor as the expvar variable
+// name, null until the first check. Like expvar.Publish, it panics if the name is
+// already in use.
+func PublishReputation(name string, m *reputation.Monitor) {
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		return m.Latest()
+	}))
+}
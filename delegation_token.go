@@ -0,0 +1,66 @@
+package rtcsocks
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// DelegationToken authorizes an Edge Server to act on behalf of a group until it
+// expires, so the group secret need not be deployed on every Edge Server.
+type DelegationToken struct {
+	ID       string    `json:"id"`  // unique, for capacity accounting and revocation
+	Group    GroupID   `json:"gid"` // scope
+	NotAfter time.Time `json:"exp"` // expiry
+	Capacity int       `json:"cap"` // max offers to be dispatched with the token, 0 -> unlimited
+}
+
+// MintDelegationToken signs the token with the operator key. The encoded token is
+// the base64url-encoded JSON body and signature, separated by ".".
+func MintDelegationToken(key ed25519.PrivateKey, token DelegationToken) (string, error) {
+	body, err := json.Marshal(token)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(key, body)
+	return base64.RawURLEncoding.EncodeToString(body) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// ParseDelegationToken verifies the token against the operator keys and returns it
+// if it is not expired.
+func ParseDelegationToken(keys []ed25519.PublicKey, encoded string) (*DelegationToken, error) {
+	parts := strings.Split(encoded, ".")
+	if len(parts) != 2 {
+		return nil, ErrMalformedToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformedToken
+	}
+
+	verified := false
+	for _, key := range keys {
+		if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, body, sig) { // Verify panics on others
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrTokenSignature
+	}
+
+	var token DelegationToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return nil, ErrMalformedToken
+	}
+	if time.Now().After(token.NotAfter) {
+		return nil, ErrTokenExpired
+	}
+	return &token, nil
+}
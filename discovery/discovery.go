@@ -0,0 +1,196 @@
+// Package discovery finds the current negotiator endpoints of a deployment in DNS,
+// so that operators can move or add negotiators without shipping new Client configs.
+//
+// The endpoints are published as TXT records at _rtcsocks.<domain>, one per endpoint:
+//
+//	v=rtcsocks1 addr=<host:port> sni=<SNI> prio=<priority> exp=<unix time> sig=<signature>
+//
+// sni is optional. The signature is the unpadded base64url Ed25519 signature by an
+// operator key over the domain and the record up to " sig=", see SignRecord. Clients
+// pin the operator keys, so records injected by a resolver or a compromised DNS
+// provider are ignored. SRV records cannot carry a signature, so they are not used.
+package discovery
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+const (
+	recordVersion   = "v=rtcsocks1"
+	recordPrefix    = "_rtcsocks."
+	signatureField  = " sig="
+	signatureDomain = "github.com/gaukas/rtcsocks discovery v1\n"
+)
+
+var (
+	ErrNoEndpoint   = errors.New("discovery: no valid endpoint")
+	ErrBadRecord    = errors.New("discovery: malformed record")
+	ErrBadSignature = errors.New("discovery: record signature mismatch")
+	ErrExpired      = errors.New("discovery: record expired")
+)
+
+// Endpoint is a negotiator endpoint, e.g. the ServerAddr and SNI of an http.Client.
+type Endpoint struct {
+	Addr     string
+	SNI      string // empty -> the host of Addr
+	Priority int    // lower first
+	Expiry   time.Time
+}
+
+// SignRecord returns the TXT record publishing the endpoint under the domain, signed
+// with the operator key.
+func SignRecord(key ed25519.PrivateKey, domain string, e Endpoint) string {
+	record := recordVersion + " addr=" + e.Addr
+	if e.SNI != "" {
+		record += " sni=" + e.SNI
+	}
+	record += " prio=" + strconv.Itoa(e.Priority) + " exp=" + strconv.FormatInt(e.Expiry.Unix(), 10)
+	sig := ed25519.Sign(key, signedMessage(domain, record))
+	return record + signatureField + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// ParseRecord verifies a TXT record published under the domain with any of the
+// keys, and returns its endpoint. Expired records are rejected with ErrExpired.
+func ParseRecord(keys []ed25519.PublicKey, domain, record string) (Endpoint, error) {
+	idx := strings.LastIndex(record, signatureField)
+	if idx < 0 || !strings.HasPrefix(record, recordVersion+" ") {
+		return Endpoint{}, ErrBadRecord
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(record[idx+len(signatureField):])
+	if err != nil {
+		return Endpoint{}, ErrBadRecord
+	}
+	signed := record[:idx]
+	verified := false
+	for _, key := range keys {
+		if ed25519.Verify(key, signedMessage(domain, signed), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Endpoint{}, ErrBadSignature
+	}
+
+	var e Endpoint
+	for _, field := range strings.Fields(signed[len(recordVersion):]) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Endpoint{}, ErrBadRecord
+		}
+		switch name {
+		case "addr":
+			e.Addr = value
+		case "sni":
+			e.SNI = value
+		case "prio":
+			if e.Priority, err = strconv.Atoi(value); err != nil {
+				return Endpoint{}, ErrBadRecord
+			}
+		case "exp":
+			exp, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return Endpoint{}, ErrBadRecord
+			}
+			e.Expiry = time.Unix(exp, 0)
+		} // unknown fields are ignored, for later versions
+	}
+	if e.Addr == "" || e.Expiry.IsZero() {
+		return Endpoint{}, ErrBadRecord
+	}
+	if time.Now().After(e.Expiry) {
+		return Endpoint{}, ErrExpired
+	}
+	return e, nil
+}
+
+func signedMessage(domain, record string) []byte {
+	return []byte(signatureDomain + strings.TrimSuffix(strings.ToLower(domain), ".") + "\n" + record)
+}
+
+// Resolver discovers the negotiator endpoints published under a domain.
+type Resolver struct {
+	Domain string              // e.g. "example.com", records are looked up at _rtcsocks.example.com
+	Keys   []ed25519.PublicKey // pinned operator keys
+
+	// LookupTXT looks up the TXT records of a name, e.g. with DNS over HTTPS where
+	// plain DNS is blocked. nil -> net.DefaultResolver.LookupTXT.
+	LookupTXT func(ctx context.Context, name string) ([]string, error)
+
+	Logger rtcsocks.Logger
+
+	last  []Endpoint // last endpoints discovered, used while the lookup fails
+	mutex sync.Mutex
+}
+
+// Endpoints looks up the valid endpoints, lowest Priority first. If the lookup
+// fails, the endpoints last discovered are returned as long as they are not expired.
+func (r *Resolver) Endpoints(ctx context.Context) ([]Endpoint, error) {
+	endpoints, err := r.lookup(ctx)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err == nil {
+		r.last = endpoints
+		return append([]Endpoint(nil), endpoints...), nil
+	}
+
+	now := time.Now()
+	var cached []Endpoint
+	for _, e := range r.last {
+		if now.Before(e.Expiry) {
+			cached = append(cached, e)
+		}
+	}
+	if len(cached) == 0 {
+		return nil, err
+	}
+	if r.Logger != nil {
+		r.Logger.Warnf("discovery: lookup failed, using %d cached endpoints: %v", len(cached), err)
+	}
+	return cached, nil
+}
+
+func (r *Resolver) lookup(ctx context.Context) ([]Endpoint, error) {
+	lookupTXT := r.LookupTXT
+	if lookupTXT == nil {
+		lookupTXT = net.DefaultResolver.LookupTXT
+	}
+	records, err := lookupTXT(ctx, recordPrefix+r.Domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []Endpoint
+	for _, record := range records {
+		if !strings.HasPrefix(record, recordVersion+" ") {
+			continue // other TXT records
+		}
+		e, err := ParseRecord(r.Keys, r.Domain, record)
+		if err != nil {
+			if r.Logger != nil {
+				r.Logger.Warnf("discovery: record %q ignored: %v", record, err)
+			}
+			continue
+		}
+		endpoints = append(endpoints, e)
+	}
+	if len(endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return endpoints[i].Priority < endpoints[j].Priority
+	})
+	return endpoints, nil
+}
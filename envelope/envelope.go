@@ -0,0 +1,141 @@
+// Package envelope seals negotiation payloads so that they are confidential and of
+// uniform size, even over plain HTTP or a third-party dead drop.
+//
+// A sealed envelope is:
+//
+//	version (1 byte) | nonce (12 bytes) | AES-256-GCM ciphertext and tag
+//
+// The plaintext is the payload length (4 bytes, big-endian), the payload and zero
+// padding, so that the whole envelope is a bucket size: a power of two from 512 bytes
+// to 64 KiB, then a multiple of 64 KiB. The version byte and the associated data,
+// e.g. the ID of the sender, are authenticated along with the payload.
+//
+// The key is derived from the secret of the user or group, so only credentials shared
+// with the Negotiator can be used: passwords and group secrets, not public keys or
+// SRP verifiers.
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/gaukas/rtcsocks/auth"
+	"github.com/zeebo/blake3"
+)
+
+// Version is the version of the envelope format sealed by this package.
+const Version byte = 1
+
+const (
+	userKeyContext  = "github.com/gaukas/rtcsocks envelope v1 user key"
+	groupKeyContext = "github.com/gaukas/rtcsocks envelope v1 group key"
+
+	keySize       = 32
+	nonceSize     = 12
+	tagSize       = 16
+	lengthSize    = 4
+	overhead      = 1 + nonceSize + tagSize + lengthSize
+	minBucket     = 512
+	maxPow2Bucket = 64 << 10
+)
+
+var (
+	ErrPublicSecret       = errors.New("envelope: secret is not shared with the client")
+	ErrUnsupportedVersion = errors.New("envelope: unsupported version")
+	ErrMalformed          = errors.New("envelope: malformed envelope")
+	ErrOpen               = errors.New("envelope: message authentication failed")
+)
+
+// UserKey derives the envelope key of a user from the secret stored for it, which
+// for the keyed-hash schemes is the password.
+func UserKey(secret string) ([]byte, error) {
+	return deriveKey(userKeyContext, secret)
+}
+
+// GroupKey derives the envelope key of a group of Edge Servers from the group secret.
+func GroupKey(secret string) ([]byte, error) {
+	return deriveKey(groupKeyContext, secret)
+}
+
+func deriveKey(context, secret string) ([]byte, error) {
+	if secret == "" || auth.IsPublicSecret(secret) {
+		return nil, ErrPublicSecret
+	}
+	key := make([]byte, keySize)
+	blake3.DeriveKey(context, []byte(secret), key)
+	return key, nil
+}
+
+// SealedSize returns the size of the envelope sealing a payload of n bytes.
+func SealedSize(n int) int {
+	size := n + overhead
+	if size > maxPow2Bucket {
+		return (size + maxPow2Bucket - 1) / maxPow2Bucket * maxPow2Bucket
+	}
+	bucket := minBucket
+	for bucket < size {
+		bucket <<= 1
+	}
+	return bucket
+}
+
+// Seal seals the payload with the key, authenticating ad along with it.
+func Seal(key, payload, ad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	size := SealedSize(len(payload))
+	plaintext := make([]byte, size-1-nonceSize-tagSize)
+	binary.BigEndian.PutUint32(plaintext, uint32(len(payload)))
+	copy(plaintext[lengthSize:], payload)
+
+	sealed := make([]byte, 1+nonceSize, size)
+	sealed[0] = Version
+	if _, err := rand.Read(sealed[1:]); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, sealed[1:], plaintext, additionalData(ad)), nil
+}
+
+// Open opens an envelope sealed with the key and ad, returning the payload.
+func Open(key, sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < overhead {
+		return nil, ErrMalformed
+	}
+	if sealed[0] != Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, sealed[0])
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, sealed[1:1+nonceSize], sealed[1+nonceSize:], additionalData(ad))
+	if err != nil {
+		return nil, ErrOpen
+	}
+
+	n := binary.BigEndian.Uint32(plaintext)
+	if uint64(n) > uint64(len(plaintext)-lengthSize) {
+		return nil, ErrMalformed
+	}
+	return plaintext[lengthSize : lengthSize+n], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func additionalData(ad []byte) []byte {
+	return append([]byte{Version}, ad...)
+}
@@ -0,0 +1,103 @@
+package rtcsocks
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Faults injects faults into the calls of a NegotiatorAPI, to exercise the reconnection
+// and retry logic of Clients, Edge Servers and transports in tests and staging. Wrap
+// the NegotiatorAPI with Faults.Middleware, see WithMiddleware. The faults are
+// deterministic for a Seed and a sequence of calls.
+//
+// The fields MUST NOT be changed once Middleware is called.
+type Faults struct {
+	// DropOffer drops every DropOffer-th offer dispatched by NextOffer: the offer is
+	// dispatched but the Edge Server gets ErrNoOfferAvailable, as if the response was
+	// lost. 0 -> none dropped.
+	DropOffer int
+
+	// AnswerDelay delays RegisterAnswer, as if the answer was slow to reach the
+	// Negotiator.
+	AnswerDelay time.Duration
+
+	// ErrorRate is the probability for a call to fail with ErrInjectedFault, reported
+	// as an internal error by the API, e.g. 500 Internal Server Error over HTTP. The
+	// callback function is not called.
+	ErrorRate float64
+	Methods   []CallbackMethod // calls subject to ErrorRate, nil -> all
+	Seed      int64
+
+	once       sync.Once
+	mutex      sync.Mutex
+	rand       *rand.Rand
+	dispatched int
+}
+
+// Middleware returns the Middleware injecting the faults.
+func (f *Faults) Middleware() Middleware {
+	f.once.Do(func() {
+		f.rand = rand.New(rand.NewSource(f.Seed))
+	})
+	return func(next CallHandler) CallHandler {
+		return func(ctx context.Context, call *Call) error {
+			if f.fail(call.Method) {
+				return ErrInjectedFault
+			}
+
+			switch call.Method {
+			case MethodRegisterAnswer:
+				if f.AnswerDelay > 0 {
+					timer := time.NewTimer(f.AnswerDelay)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						return ctx.Err()
+					}
+				}
+			case MethodNextOffer:
+				if err := next(ctx, call); err != nil {
+					return err
+				}
+				if f.drop() {
+					return ErrNoOfferAvailable
+				}
+				return nil
+			}
+			return next(ctx, call)
+		}
+	}
+}
+
+// fail reports whether a call to the method fails.
+func (f *Faults) fail(method CallbackMethod) bool {
+	if f.ErrorRate <= 0 {
+		return false
+	}
+	if f.Methods != nil {
+		subject := false
+		for _, m := range f.Methods {
+			subject = subject || m == method
+		}
+		if !subject {
+			return false
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.rand.Float64() < f.ErrorRate
+}
+
+// drop reports whether the offer just dispatched is dropped.
+func (f *Faults) drop() bool {
+	if f.DropOffer <= 0 {
+		return false
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.dispatched++
+	return f.dispatched%f.DropOffer == 0
+}
@@ -3,20 +3,22 @@ module github.com/gaukas/rtcsocks
 go 1.19
 
 require (
-	github.com/gaukas/logging v0.0.2
+	github.com/andybalholm/brotli v1.0.4
 	github.com/gofiber/fiber/v2 v2.41.0
 	github.com/imroc/req/v3 v3.30.0
+	github.com/mattn/go-sqlite3 v1.14.16
 	github.com/refraction-networking/utls v1.2.0
+	github.com/zeebo/blake3 v0.2.3
 )
 
 require (
-	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/cheekybits/genny v1.0.0 // indirect
 	github.com/fsnotify/fsnotify v1.6.0 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20210107165309-348f09dbbbc0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/klauspost/compress v1.15.15 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.12 // indirect
 	github.com/marten-seemann/qpack v0.3.0 // indirect
 	github.com/marten-seemann/qtls-go1-16 v0.1.5 // indirect
 	github.com/marten-seemann/qtls-go1-17 v0.1.2 // indirect
@@ -0,0 +1,147 @@
+package rtcsocks
+
+import "time"
+
+// MatchPolicy controls which offers are dispatched to the Edge Servers of a group.
+type MatchPolicy uint8
+
+const (
+	MatchShared    MatchPolicy = iota // accept any offer listing the group
+	MatchExclusive                    // accept only offers listing the group alone
+)
+
+// GroupProfile is the per-group configuration of the Negotiator. Zero values
+// fall back to the Negotiator-wide defaults.
+//
+// When an offer lists multiple groups, the strictest TTL, quota and size limit
+// among the listed groups apply.
+type GroupProfile struct {
+	TTL              time.Duration // time to live for offers to the group, 0 -> Negotiator TTL
+	MaxOffersPerUser int           // max pending offers per user listing the group, 0 -> unlimited
+	MaxOfferSize     int           // max offer SDP size in bytes, 0 -> unlimited
+	MaxSessions      int           // max edge server sessions of the group, 0 -> 1024
+	MatchPolicy      MatchPolicy
+
+	// AllowedUsers restricts the offers listing the group to these users, e.g. for
+	// a private friend-to-friend group. Edge Servers can double-check the user of the
+	// offers they receive, see SetOfferSigningKey. nil -> any user.
+	AllowedUsers []UserID
+}
+
+type quotaKey struct {
+	user  UserID
+	group GroupID
+}
+
+// SetGroupProfile sets the configuration profile for the specified group.
+func (n *Negotiator) SetGroupProfile(group GroupID, profile GroupProfile) error {
+	if group == 0 || group > n.maxGroupID {
+		return ErrBadGroupID
+	}
+
+	n.mutexProfiles.Lock()
+	defer n.mutexProfiles.Unlock()
+	n.profiles[group] = profile
+	return nil
+}
+
+// GroupProfile returns the configuration profile of the specified group.
+func (n *Negotiator) GroupProfile(group GroupID) GroupProfile {
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	return n.profiles[group]
+}
+
+// offerLimits returns the TTL and the max SDP size (0 -> unlimited) for an offer
+// listing the specified groups.
+func (n *Negotiator) offerLimits(groups []GroupID) (ttl time.Duration, maxSize int) {
+	ttl = n.ttl
+	customTTL := false
+
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	for _, group := range groups {
+		profile := n.profiles[group]
+		if profile.TTL > 0 && (!customTTL || profile.TTL < ttl) {
+			ttl = profile.TTL
+			customTTL = true
+		}
+		if profile.MaxOfferSize > 0 && (maxSize == 0 || profile.MaxOfferSize < maxSize) {
+			maxSize = profile.MaxOfferSize
+		}
+	}
+	return ttl, maxSize
+}
+
+// maxSessions returns the max number of edge server sessions of the group.
+func (n *Negotiator) maxSessions(group GroupID) int {
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	if max := n.profiles[group].MaxSessions; max > 0 {
+		return max
+	}
+	return defaultMaxSessionsPerGroup
+}
+
+// allowsUser reports whether all the specified groups allow offers by the user.
+func (n *Negotiator) allowsUser(user UserID, groups []GroupID) bool {
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	for _, group := range groups {
+		allowed := n.profiles[group].AllowedUsers
+		if allowed != nil && !containsUser(allowed, user) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsUser(users []UserID, user UserID) bool {
+	for _, u := range users {
+		if u == user {
+			return true
+		}
+	}
+	return false
+}
+
+// quotaExceeded reports whether the user already has the max number of pending offers
+// in any of the specified groups. The caller MUST hold n.mutexAnswers.
+func (n *Negotiator) quotaExceeded(user UserID, groups []GroupID) bool {
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	for _, group := range groups {
+		quota := n.profiles[group].MaxOffersPerUser
+		if quota > 0 && n.pendingOffers[quotaKey{user, group}] >= quota {
+			return true
+		}
+	}
+	return false
+}
+
+// countPending adds delta to the pending offer count of the user in each of the
+// specified groups. The caller MUST hold n.mutexAnswers.
+func (n *Negotiator) countPending(user UserID, groups []GroupID, delta int) {
+	for _, group := range groups {
+		key := quotaKey{user, group}
+		n.pendingOffers[key] += delta
+		if n.pendingOffers[key] <= 0 {
+			delete(n.pendingOffers, key)
+		}
+	}
+}
+
+// accepts reports whether the group accepts offers from the bin.
+func (n *Negotiator) accepts(group GroupID, binID uint64) bool {
+	binaryGroupID := uint64(1) << (group - 1)
+	if binaryGroupID&binID == 0 {
+		return false
+	}
+
+	n.mutexProfiles.RLock()
+	defer n.mutexProfiles.RUnlock()
+	if n.profiles[group].MatchPolicy == MatchExclusive {
+		return binID == binaryGroupID
+	}
+	return true
+}
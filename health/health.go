@@ -0,0 +1,56 @@
+// Package health serves liveness and readiness endpoints for container orchestrators,
+// e.g. the probes of a Kubernetes pod or the HEALTHCHECK of a Docker image running an
+// Edge Server:
+//
+//	/healthz 200 OK while all the liveness checks pass, 503 otherwise
+//	/readyz  200 OK while all the liveness and readiness checks pass, 503 otherwise
+//
+// For an Edge Server, the checks are http.Server.Healthy and http.Server.Ready. Like
+// the debug endpoints, they SHOULD be served on a listener reachable only by the
+// orchestrator.
+package health
+
+import (
+	"net/http"
+)
+
+// Check reports whether a component is healthy or ready.
+type Check func() bool
+
+// Handler returns the handler of the health endpoints.
+func Handler(live, ready []Check) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, pass(live))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		respond(w, pass(live) && pass(ready))
+	})
+	return mux
+}
+
+// ListenAndServe serves the health endpoints on addr. It blocks until the listener
+// fails, like http.ListenAndServe.
+func ListenAndServe(addr string, live, ready []Check) error {
+	return http.ListenAndServe(addr, Handler(live, ready))
+}
+
+func pass(checks []Check) bool {
+	for _, check := range checks {
+		if !check() {
+			return false
+		}
+	}
+	return true
+}
+
+func respond(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("unavailable\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,49 @@
+package rtcsocks
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// UserID identifies a Client user. It is hex-encoded on the wire.
+type UserID uint64
+
+// GroupID identifies a group of Edge Servers, valid group IDs are 1 to the maximum
+// group ID of the Negotiator. It is hex-encoded on the wire.
+type GroupID uint64
+
+// OfferID identifies an offer registered with the Negotiator. It is hex-encoded on the wire.
+type OfferID uint64
+
+func (id UserID) String() string  { return strconv.FormatUint(uint64(id), 16) }
+func (id GroupID) String() string { return strconv.FormatUint(uint64(id), 16) }
+func (id OfferID) String() string { return strconv.FormatUint(uint64(id), 16) }
+
+// ParseUserID parses a hex-encoded UserID.
+func ParseUserID(s string) (UserID, error) {
+	id, err := parseID(s)
+	return UserID(id), err
+}
+
+// ParseGroupID parses a hex-encoded GroupID. It returns ErrBadGroupID for group 0,
+// which is never valid.
+func ParseGroupID(s string) (GroupID, error) {
+	id, err := parseID(s)
+	if err == nil && id == 0 {
+		err = ErrBadGroupID
+	}
+	return GroupID(id), err
+}
+
+// ParseOfferID parses a hex-encoded OfferID.
+func ParseOfferID(s string) (OfferID, error) {
+	id, err := parseID(s)
+	return OfferID(id), err
+}
+
+func parseID(s string) (uint64, error) {
+	if s == "" || len(s) > 16 {
+		return 0, fmt.Errorf("invalid ID %q", s)
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
@@ -1,18 +1,44 @@
 package utils
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime/multipart"
 	"net"
+	"net/http"
+	"net/url"
 	"strings"
+	"time"
 
 	ctls "crypto/tls"
 
 	tls "github.com/refraction-networking/utls"
 
+	"github.com/andybalholm/brotli"
+
 	req "github.com/imroc/req/v3"
 )
 
+// URL returns the URL of the path on the server address. The address is a hostname
+// or IP literal with an optional port, e.g. "example.com:8443", "[2001:db8::1]:443",
+// or a bare IPv6 literal "2001:db8::1".
+func URL(addr string, https bool, path string) string {
+	if strings.Count(addr, ":") >= 2 && !strings.HasPrefix(addr, "[") {
+		// bare IPv6 literal, the zone MUST be escaped per RFC 6874
+		addr = "[" + strings.Replace(addr, "%", "%25", 1) + "]"
+	}
+	if https {
+		return "https://" + addr + path
+	}
+	return "http://" + addr + path
+}
+
 func IsHTTPS(url string) bool {
 	// check if start with https://
 	return strings.HasPrefix(url, "https://")
@@ -40,50 +66,326 @@ func (conn *TLSConn) ConnectionState() ctls.ConnectionState {
 	}
 }
 
-func reqClient(insecure bool, SNI ...string) *req.Client {
+// DefaultMaxResponseSize is the size limit of response bodies, decompressed, unless
+// set in Options.
+const DefaultMaxResponseSize = 4 << 20
+
+// ErrResponseTooLarge is returned for a response body over the size limit.
+var ErrResponseTooLarge = errors.New("response body too large")
+
+// Options configures a request.
+type Options struct {
+	InsecureSkipVerify bool   // skip TLS certificate verification
+	SNI                string // SNI to use, empty -> the hostname of the URL
+	Profile            string // browser the requests pass for, see Profiles, empty -> DefaultProfile
+
+	Sessions *SessionCache // resumes the TLS sessions, nil -> no resumption
+
+	// Hosts maps hostnames to the IPs dialed in turn in place of resolving them, e.g.
+	// when the DNS of the negotiator is poisoned. The hostname is still sent in the
+	// SNI, unless set, and the Host header.
+	Hosts map[string][]string
+
+	// Compress gzips the request body, for the requests with one which are not
+	// multipart. Responses are decompressed regardless, gzip and deflate are accepted.
+	Compress bool
+
+	Timeout         time.Duration // of the whole request, including reading the response, 0 -> none
+	MaxResponseSize int64         // in bytes, decompressed, 0 -> DefaultMaxResponseSize
+
+	// Doer sends the requests in place of the uTLS client, which InsecureSkipVerify,
+	// SNI, Sessions, Hosts and the ClientHello of the Profile configure. The headers of the Profile,
+	// Compress, Timeout and MaxResponseSize apply regardless.
+	Doer Doer
+}
+
+// Doer sends HTTP requests, e.g. through a proxy or an obfuscating transport. The
+// response body is closed by the caller.
+type Doer interface {
+	Do(ctx context.Context, r *http.Request) (*http.Response, error)
+}
+
+// utlsDoer is the default Doer, sending requests over connections with the TLS
+// fingerprint of a browser.
+type utlsDoer struct {
+	opts        Options
+	clientHello tls.ClientHelloID
+}
+
+func (d utlsDoer) Do(ctx context.Context, r *http.Request) (*http.Response, error) {
+	return reqClient(d.opts, d.clientHello).GetClient().Do(r.WithContext(ctx))
+}
+
+// acceptEncoding is what responses may be compressed with, as browsers accept, see
+// responseBody.
+const acceptEncoding = "gzip, deflate, br"
+
+func reqClient(opts Options, clientHello tls.ClientHelloID) *req.Client {
 	c := req.C()
+	c.SetDial(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dial(ctx, opts, network, addr)
+	})
 	c.SetDialTLS(func(ctx context.Context, network, addr string) (net.Conn, error) {
-		plainConn, err := net.Dial(network, addr)
+		plainConn, err := dial(ctx, opts, network, addr)
 		if err != nil {
 			return nil, err
 		}
-		colonPos := strings.LastIndex(addr, ":")
-		if colonPos == -1 {
-			colonPos = len(addr)
+		hostname, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			hostname = addr
 		}
-		hostname := addr[:colonPos]
-		utlsConfig := &tls.Config{ServerName: hostname, NextProtos: c.GetTLSClientConfig().NextProtos, MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
-		if len(SNI) > 0 && SNI[0] != "" {
-			utlsConfig.ServerName = SNI[0]
+		utlsConfig := &tls.Config{ServerName: hostname, NextProtos: c.GetTLSClientConfig().NextProtos, MinVersion: tls.VersionTLS12, InsecureSkipVerify: opts.InsecureSkipVerify}
+		if opts.SNI != "" {
+			utlsConfig.ServerName = opts.SNI
 		}
-		conn := tls.UClient(plainConn, utlsConfig, tls.HelloChrome_106_Shuffle)
+		utlsConfig.ClientSessionCache = opts.Sessions.endpoint(addr)
+		conn := tls.UClient(plainConn, utlsConfig, clientHello)
 		return &TLSConn{conn}, nil
 	})
 
 	return c
 }
 
-func GET(url string, insecure bool, SNI ...string) (status int, body []byte, err error) {
-	c := reqClient(insecure, SNI...)
+// dial connects to addr, or to the IPs opts.Hosts maps its hostname to, in turn until
+// one connects.
+func dial(ctx context.Context, opts Options, network, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || len(opts.Hosts[host]) == 0 {
+		return dialer.DialContext(ctx, network, addr)
+	}
 
-	resp, err := c.R().Get(url)
+	var firstErr error
+	for _, ip := range opts.Hosts[host] {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// Response is a response being received. Body streams the response body as it
+// arrives, decompressed and within the size limit of the request, and MUST be closed,
+// see ReadAll.
+type Response struct {
+	StatusCode int
+	Body       io.ReadCloser
+}
+
+// ReadAll reads and closes the body of the response returned by a request helper,
+// for the responses small enough to be buffered whole.
+func ReadAll(resp *Response, err error) (status int, body []byte, _ error) {
 	if err != nil {
 		return 0, nil, err
 	}
 	defer resp.Body.Close()
-
 	body, err = io.ReadAll(resp.Body)
 	return resp.StatusCode, body, err
 }
 
-func POST(url string, postform interface{}, insecure bool, SNI ...string) (status int, body []byte, err error) {
-	c := reqClient(insecure, SNI...)
-	resp, err := c.R().SetBodyJsonMarshal(postform).Post(url)
+// do sends the request with the headers of the browser profile, as made in the mode,
+// with opts.Doer or else the uTLS client. The request, including reading the
+// response, is cancelled with ctx or after opts.Timeout.
+func do(ctx context.Context, opts Options, r *http.Request, mode requestMode) (*Response, error) {
+	p, err := profile(opts)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-	defer resp.Body.Close()
+	r.Header.Set("Accept-Encoding", acceptEncoding)
+	p.setHeaders(r, mode)
 
-	body, err = io.ReadAll(resp.Body)
-	return resp.StatusCode, body, err
+	cancel := context.CancelFunc(func() {})
+	if opts.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+	}
+	var doer Doer = utlsDoer{opts, p.ClientHello}
+	if opts.Doer != nil {
+		doer = opts.Doer
+	}
+	resp, err := doer.Do(ctx, r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	body, err := responseBody(resp, opts)
+	if err != nil {
+		resp.Body.Close()
+		cancel()
+		return nil, err
+	}
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Body:       &responseReader{Reader: body, closer: resp.Body, cancel: cancel},
+	}, nil
+}
+
+// newRequest returns a request with the body, gzipped if opts.Compress is set.
+func newRequest(method, url, contentType string, body []byte, opts Options) (*http.Request, error) {
+	if opts.Compress {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	r, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", contentType)
+	if opts.Compress {
+		r.Header.Set("Content-Encoding", "gzip")
+	}
+	return r, nil
+}
+
+// responseBody returns the reader of the response body, decompressed as per its
+// Content-Encoding, which fails with ErrResponseTooLarge past opts.MaxResponseSize.
+func responseBody(resp *http.Response, opts Options) (io.Reader, error) {
+	var r io.Reader = resp.Body
+	switch encoding := strings.ToLower(resp.Header.Get("Content-Encoding")); encoding {
+	case "", "identity":
+	case "gzip":
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "deflate": // zlib, as per RFC 9110
+		zr, err := zlib.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(resp.Body)
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	limit := opts.MaxResponseSize
+	if limit <= 0 {
+		limit = DefaultMaxResponseSize
+	}
+	return &limitedReader{r: r, n: limit}, nil
+}
+
+// limitedReader fails with ErrResponseTooLarge once more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64 // bytes left
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1] // one more to tell a body of exactly the limit
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return 0, ErrResponseTooLarge
+	}
+	return n, err
+}
+
+// responseReader closes the response body and releases the request context.
+type responseReader struct {
+	io.Reader
+	closer io.Closer
+	cancel context.CancelFunc
+}
+
+func (r *responseReader) Close() error {
+	err := r.closer.Close()
+	r.cancel()
+	return err
+}
+
+func GET(ctx context.Context, url string, opts Options) (*Response, error) {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(ctx, opts, r, navigationMode)
+}
+
+func POST(ctx context.Context, url string, postform interface{}, opts Options) (*Response, error) {
+	b, err := json.Marshal(postform)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newRequest(http.MethodPost, url, "application/json; charset=utf-8", b, opts)
+	if err != nil {
+		return nil, err
+	}
+	return do(ctx, opts, r, fetchMode)
+}
+
+// GETQuery sends the fields in the query string of a GET request.
+func GETQuery(ctx context.Context, url string, fields url.Values, opts Options) (*Response, error) {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	r.URL.RawQuery = fields.Encode()
+	return do(ctx, opts, r, fetchMode)
+}
+
+// GETCookies sends the fields as cookies of a GET request, one cookie per value.
+func GETCookies(ctx context.Context, url string, fields url.Values, opts Options) (*Response, error) {
+	r, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range fields {
+		for _, value := range values {
+			r.AddCookie(&http.Cookie{Name: name, Value: value})
+		}
+	}
+	return do(ctx, opts, r, fetchMode)
+}
+
+// POSTForm sends the fields in an application/x-www-form-urlencoded body.
+func POSTForm(ctx context.Context, url string, fields url.Values, opts Options) (*Response, error) {
+	r, err := newRequest(http.MethodPost, url, "application/x-www-form-urlencoded", []byte(fields.Encode()), opts)
+	if err != nil {
+		return nil, err
+	}
+	return do(ctx, opts, r, fetchMode)
+}
+
+// POSTMultipart sends the fields in a multipart/form-data body, never compressed.
+func POSTMultipart(ctx context.Context, url string, fields url.Values, opts Options) (*Response, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for name, values := range fields {
+		for _, value := range values {
+			if err := mw.WriteField(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	r, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return do(ctx, opts, r, fetchMode)
 }
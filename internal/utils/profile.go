@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+
+	tls "github.com/refraction-networking/utls"
+)
+
+// Profile is a browser the requests pass for: the TLS fingerprint of its ClientHello
+// and the headers it sends along, so that the HTTP layer does not contradict the TLS
+// layer.
+type Profile struct {
+	ClientHello    tls.ClientHelloID
+	UserAgent      string
+	AcceptLanguage string
+	AcceptDocument string // Accept of navigations, e.g. of the decoy pages
+
+	// ClientHints are the low-entropy sec-ch-ua headers, sent by Chromium over HTTPS
+	// only, nil for the browsers not supporting them.
+	ClientHints map[string]string
+
+	FetchMetadata bool // the browser sends Sec-Fetch-* over HTTPS
+}
+
+// DefaultProfile is the browser profile of the requests unless set in Options.
+const DefaultProfile = "chrome"
+
+// Profiles are the browser profiles by name, see Options.Profile.
+var Profiles = map[string]*Profile{
+	"chrome": {
+		ClientHello:    tls.HelloChrome_106_Shuffle,
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36",
+		AcceptLanguage: "en-US,en;q=0.9",
+		AcceptDocument: "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.9",
+		ClientHints: map[string]string{
+			"sec-ch-ua":          `"Chromium";v="106", "Google Chrome";v="106", "Not;A=Brand";v="99"`,
+			"sec-ch-ua-mobile":   "?0",
+			"sec-ch-ua-platform": `"Windows"`,
+		},
+		FetchMetadata: true,
+	},
+	"firefox": {
+		ClientHello:    tls.HelloFirefox_105,
+		UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:105.0) Gecko/20100101 Firefox/105.0",
+		AcceptLanguage: "en-US,en;q=0.5",
+		AcceptDocument: "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
+		FetchMetadata:  true,
+	},
+	"safari": {
+		ClientHello:    tls.HelloSafari_16_0,
+		UserAgent:      "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/16.0 Safari/605.1.15",
+		AcceptLanguage: "en-US,en;q=0.9",
+		AcceptDocument: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+	},
+	"ios": {
+		ClientHello:    tls.HelloIOS_14,
+		UserAgent:      "Mozilla/5.0 (iPhone; CPU iPhone OS 14_8 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.1.2 Mobile/15E148 Safari/604.1",
+		AcceptLanguage: "en-US,en;q=0.9",
+		AcceptDocument: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+	},
+}
+
+// requestMode is how a browser would make the request.
+type requestMode int
+
+const (
+	fetchMode      requestMode = iota // by a script with fetch(), e.g. the API requests
+	navigationMode                    // by following a link, e.g. the decoy pages
+)
+
+func profile(opts Options) (*Profile, error) {
+	name := opts.Profile
+	if name == "" {
+		name = DefaultProfile
+	}
+	p, ok := Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown browser profile %q", name)
+	}
+	return p, nil
+}
+
+// setHeaders sets the headers the browser sends with the request, as made from a page
+// of the same origin. Headers set already, e.g. Content-Type, are kept.
+func (p *Profile) setHeaders(r *http.Request, mode requestMode) {
+	set := func(name, value string) {
+		if r.Header.Get(name) == "" {
+			r.Header.Set(name, value)
+		}
+	}
+	secure := r.URL.Scheme == "https" // client hints and fetch metadata need a secure context
+
+	set("User-Agent", p.UserAgent)
+	set("Accept-Language", p.AcceptLanguage)
+	if secure {
+		for name, value := range p.ClientHints {
+			set(name, value)
+		}
+	}
+
+	switch mode {
+	case navigationMode:
+		set("Accept", p.AcceptDocument)
+		set("Upgrade-Insecure-Requests", "1")
+		if secure && p.FetchMetadata {
+			set("Sec-Fetch-Site", "none")
+			set("Sec-Fetch-Mode", "navigate")
+			set("Sec-Fetch-User", "?1")
+			set("Sec-Fetch-Dest", "document")
+		}
+	default:
+		set("Accept", "*/*")
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			set("Origin", r.URL.Scheme+"://"+r.URL.Host)
+		}
+		if secure && p.FetchMetadata {
+			set("Sec-Fetch-Site", "same-origin")
+			set("Sec-Fetch-Mode", "cors")
+			set("Sec-Fetch-Dest", "empty")
+		}
+	}
+}
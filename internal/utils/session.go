@@ -0,0 +1,49 @@
+package utils
+
+import (
+	tls "github.com/refraction-networking/utls"
+)
+
+// sessionCacheSize is the number of TLS sessions a SessionCache keeps, one per
+// negotiator endpoint.
+const sessionCacheSize = 32
+
+// SessionCache keeps the TLS session tickets of the negotiator endpoints, so that
+// repeated requests resume the TLS session as a browser revisiting a site does.
+//
+// Only TLS 1.2 sessions are kept: the uTLS ClientHellos cannot resume TLS 1.3 ones,
+// and some fail the handshake when trying to, so 0-RTT is not available either. The
+// profiles whose ClientHello carries no session ticket extension, e.g. Safari, never
+// resume.
+type SessionCache struct {
+	cache tls.ClientSessionCache
+}
+
+func NewSessionCache() *SessionCache {
+	return &SessionCache{cache: tls.NewLRUClientSessionCache(sessionCacheSize)}
+}
+
+// endpoint returns the cache of the sessions with the server at addr. The sessions
+// are keyed by the address as well as the SNI, since fronted endpoints share it.
+func (s *SessionCache) endpoint(addr string) tls.ClientSessionCache {
+	if s == nil {
+		return nil
+	}
+	return &endpointSessions{cache: s.cache, addr: addr}
+}
+
+type endpointSessions struct {
+	cache tls.ClientSessionCache
+	addr  string
+}
+
+func (e *endpointSessions) Get(sessionKey string) (*tls.ClientSessionState, bool) {
+	return e.cache.Get(e.addr + " " + sessionKey)
+}
+
+func (e *endpointSessions) Put(sessionKey string, cs *tls.ClientSessionState) {
+	if cs != nil && cs.Vers() > tls.VersionTLS12 {
+		return
+	}
+	e.cache.Put(e.addr+" "+sessionKey, cs)
+}
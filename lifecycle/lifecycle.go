@@ -0,0 +1,187 @@
+// Package lifecycle shuts down the components of a daemon in dependency order, e.g.
+// for an Edge Server:
+//
+//	m := &lifecycle.Manager{Logger: logger}
+//	m.Add(lifecycle.PhaseStopAccepting, "socks", 0, lifecycle.Closer(socksListener))
+//	m.Add(lifecycle.PhaseDrain, "tunnels", time.Minute, tunnels.Drain)
+//	m.Add(lifecycle.PhaseDeregister, "edge", 0, func(context.Context) error { return server.Close(10 * time.Second) })
+//	m.Add(lifecycle.PhaseStopAPI, "api", 0, api.Shutdown)
+//	m.Add(lifecycle.PhaseCloseStores, "store", 0, lifecycle.Closer(db))
+//	m.Wait(ctx, syscall.SIGINT, syscall.SIGTERM)
+//
+// Phases run in order, the stages of a phase concurrently. Each stage gets its own
+// timeout, and a stage failing or timing out does not stop the next phases, so that
+// the stores are closed even if the tunnels do not drain in time.
+package lifecycle
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/systemd"
+)
+
+// Phase orders the shutdown stages, lower first.
+type Phase int
+
+const (
+	PhaseStopAccepting Phase = iota * 10 // stop accepting new work, e.g. SOCKS connections
+	PhaseDrain                           // let the work in progress finish, e.g. tunnels
+	PhaseDeregister                      // leave the negotiator, e.g. http.Server.Close
+	PhaseStopAPI                         // stop serving, e.g. http.API.Shutdown
+	PhaseCloseStores                     // close the state stores and databases
+)
+
+const defaultStageTimeout = 10 * time.Second
+
+// Stage is a step of the shutdown.
+type Stage struct {
+	Phase   Phase
+	Name    string
+	Timeout time.Duration // 0 -> 10 seconds
+	Stop    func(ctx context.Context) error
+}
+
+// StageError is the error of the stages which failed or timed out.
+type StageError struct {
+	Errors map[string]error // stage name -> error
+}
+
+func (e *StageError) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + ": " + e.Errors[name].Error()
+	}
+	return "shutdown: " + strings.Join(names, "; ")
+}
+
+// Manager shuts down the stages added to it.
+type Manager struct {
+	Logger rtcsocks.Logger
+
+	stages   []Stage
+	mutex    sync.Mutex
+	shutdown sync.Once
+	err      error
+}
+
+// Add adds a stage to the shutdown.
+func (m *Manager) Add(phase Phase, name string, timeout time.Duration, stop func(ctx context.Context) error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.stages = append(m.stages, Stage{Phase: phase, Name: name, Timeout: timeout, Stop: stop})
+}
+
+// Closer adapts an io.Closer, e.g. a net.Listener or a store, to a Stage.Stop.
+func Closer(c io.Closer) func(context.Context) error {
+	return func(context.Context) error { return c.Close() }
+}
+
+// Wait blocks until ctx is done or one of the signals is received, then shuts down.
+func (m *Manager) Wait(ctx context.Context, signals ...os.Signal) error {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+	select {
+	case sig := <-ch:
+		if m.Logger != nil {
+			m.Logger.Infof("lifecycle: %v received, shutting down", sig)
+		}
+	case <-ctx.Done():
+	}
+	return m.Shutdown(context.Background())
+}
+
+// Shutdown runs the stages, once, phase by phase. The stages are also bound by ctx.
+// It returns a *StageError if any stage failed or timed out.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.shutdown.Do(func() {
+		systemd.Stopping()
+
+		m.mutex.Lock()
+		stages := append([]Stage(nil), m.stages...)
+		m.mutex.Unlock()
+		sort.SliceStable(stages, func(i, j int) bool {
+			return stages[i].Phase < stages[j].Phase
+		})
+
+		errs := make(map[string]error)
+		var mutexErrs sync.Mutex
+		for start := 0; start < len(stages); {
+			end := start
+			for end < len(stages) && stages[end].Phase == stages[start].Phase {
+				end++
+			}
+
+			var wg sync.WaitGroup
+			for _, stage := range stages[start:end] {
+				wg.Add(1)
+				go func(stage Stage) {
+					defer wg.Done()
+					if err := m.run(ctx, stage); err != nil {
+						mutexErrs.Lock()
+						errs[stage.Name] = err
+						mutexErrs.Unlock()
+					}
+				}(stage)
+			}
+			wg.Wait()
+			start = end
+		}
+
+		if len(errs) > 0 {
+			m.err = &StageError{Errors: errs}
+		}
+	})
+	return m.err
+}
+
+// run runs a stage within its timeout. A stage still running after its timeout is
+// left behind.
+func (m *Manager) run(ctx context.Context, stage Stage) (err error) {
+	timeout := stage.Timeout
+	if timeout <= 0 {
+		timeout = defaultStageTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if m.Logger != nil {
+		m.Logger.Debugf("lifecycle: stopping %s", stage.Name)
+	}
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		defer rtcsocks.Recover("lifecycle: "+stage.Name, m.Logger, func(c *rtcsocks.Crash) {
+			done <- c
+		})
+		done <- stage.Stop(ctx)
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		if m.Logger != nil {
+			m.Logger.Warnf("lifecycle: %s failed after %v: %v", stage.Name, time.Since(start).Round(time.Millisecond), err)
+		}
+		return err
+	}
+	if m.Logger != nil {
+		m.Logger.Debugf("lifecycle: %s stopped in %v", stage.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
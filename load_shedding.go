@@ -0,0 +1,87 @@
+package rtcsocks
+
+import (
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"time"
+)
+
+const (
+	defaultRetryAfter = 5 * time.Second
+	maxRetryAfterLoad = 8 // the suggested delay grows with the load up to this many times RetryAfter
+)
+
+// LoadShedding configures the watermarks above which the Negotiator rejects new
+// offers with an OverloadError, protecting itself during flash crowds. Offers already
+// registered are still dispatched and answered.
+type LoadShedding struct {
+	MaxQueuedOffers int           // offers waiting for an Edge Server, across all bins, 0 -> no limit
+	MaxAnswers      int           // offers registered and not purged yet, answered or not, 0 -> no limit
+	RetryAfter      time.Duration // delay suggested at the watermark, 0 -> defaultRetryAfter
+}
+
+// OverloadError is returned in place of accepting an offer while the Negotiator sheds
+// load. It unwraps to ErrOverloaded.
+type OverloadError struct {
+	RetryAfter time.Duration // suggested delay before retrying
+}
+
+func (e *OverloadError) Error() string {
+	return fmt.Sprintf("%v, retry after %v", ErrOverloaded, e.RetryAfter)
+}
+
+func (e *OverloadError) Unwrap() error {
+	return ErrOverloaded
+}
+
+// RetryAfter returns the delay suggested by the OverloadError in the chain of err,
+// 0 if there is none.
+func RetryAfter(err error) time.Duration {
+	var overload *OverloadError
+	if errors.As(err, &overload) {
+		return overload.RetryAfter
+	}
+	return 0
+}
+
+// SetLoadShedding sets the watermarks above which new offers are rejected.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetLoadShedding(ls LoadShedding) {
+	if ls.RetryAfter <= 0 {
+		ls.RetryAfter = defaultRetryAfter
+	}
+	n.loadShedding = ls
+}
+
+// shedLoad returns an OverloadError if a watermark is exceeded. The suggested delay
+// grows with the load above the watermark, with jitter so that the rejected Clients do
+// not come back at once. The caller MUST hold n.mutexAnswers.
+func (n *Negotiator) shedLoad() error {
+	ls := n.loadShedding
+	load := 0.0
+	if ls.MaxAnswers > 0 {
+		load = float64(len(n.answers)) / float64(ls.MaxAnswers)
+	}
+	if ls.MaxQueuedOffers > 0 {
+		queued := 0
+		for _, bin := range n.offerBins {
+			queued += bin.len()
+		}
+		if l := float64(queued) / float64(ls.MaxQueuedOffers); l > load {
+			load = l
+		}
+	}
+	if load < 1 {
+		return nil
+	}
+
+	if load > maxRetryAfterLoad {
+		load = maxRetryAfterLoad
+	}
+	jitter := 0.75 + mrand.Float64()/2 // 0.75 to 1.25
+	return &OverloadError{
+		RetryAfter: time.Duration(float64(ls.RetryAfter) * load * jitter),
+	}
+}
@@ -0,0 +1,257 @@
+// Package loadtest simulates Clients and Edge Servers against a Negotiator through a
+// negotiation plugin, and reports how fast and how often offers are matched. It is
+// run by cmd/rtcsocks-loadtest, or from the benchmarks of a plugin.
+package loadtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+const (
+	defaultLookupInterval = 200 * time.Millisecond
+	defaultTimeout        = time.Minute
+)
+
+// Config is a load test scenario.
+type Config struct {
+	// NewClient returns the ClientNegotiator of a simulated user, called once per user.
+	NewClient func(user rtcsocks.UserID) rtcsocks.ClientNegotiator
+
+	// NewServer returns the ServerNegotiator of a simulated Edge Server of the group,
+	// called once per Edge Server. It MUST start receiving offers once the next offer
+	// handler is set. Stopping it after Run returns is up to the caller.
+	NewServer func(group rtcsocks.GroupID, index int) rtcsocks.ServerNegotiator
+
+	Users           int                      // simulated users, offers are spread among them
+	ServersPerGroup int                      // simulated Edge Servers per group
+	Groups          map[rtcsocks.GroupID]int // group -> weight in the offers, e.g. {1: 3, 2: 1}
+
+	ArrivalRate   float64       // offers per second, Poisson arrivals
+	Duration      time.Duration // how long offers keep arriving
+	AnswerLatency time.Duration // mean delay of the Edge Servers before answering, exponential
+
+	LookupInterval time.Duration // how often Clients look up their answer, 0 -> defaultLookupInterval
+	Timeout        time.Duration // Clients give up on an offer after this long, 0 -> defaultTimeout
+}
+
+// Report is the outcome of a load test.
+type Report struct {
+	Offers   int            // offers registered or attempted
+	Matched  int            // offers answered and looked up
+	Failures map[string]int // offers not matched, by reason, see Reason
+	Latency  []time.Duration
+
+	Elapsed time.Duration
+}
+
+// Percentile returns the match latency at p, from 0 to 100, or 0 without matches.
+func (r *Report) Percentile(p float64) time.Duration {
+	if len(r.Latency) == 0 {
+		return 0
+	}
+	i := int(p / 100 * float64(len(r.Latency)-1))
+	return r.Latency[i]
+}
+
+// ErrorRate returns the fraction of offers not matched.
+func (r *Report) ErrorRate() float64 {
+	if r.Offers == 0 {
+		return 0
+	}
+	return float64(r.Offers-r.Matched) / float64(r.Offers)
+}
+
+func (r *Report) String() string {
+	s := fmt.Sprintf("%d offers in %v, %d matched (error rate %.2f%%)\n", r.Offers, r.Elapsed.Round(time.Millisecond), r.Matched, 100*r.ErrorRate())
+	s += fmt.Sprintf("match latency: p50 %v, p90 %v, p99 %v, max %v\n",
+		r.Percentile(50).Round(time.Millisecond), r.Percentile(90).Round(time.Millisecond),
+		r.Percentile(99).Round(time.Millisecond), r.Percentile(100).Round(time.Millisecond))
+	reasons := make([]string, 0, len(r.Failures))
+	for reason := range r.Failures {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		s += fmt.Sprintf("failed: %s: %d\n", reason, r.Failures[reason])
+	}
+	return s
+}
+
+// Reason names the failure of an offer for Report.Failures.
+func Reason(err error) string {
+	for _, known := range []struct {
+		err    error
+		reason string
+	}{
+		{rtcsocks.ErrOverloaded, "overloaded"},
+		{rtcsocks.ErrQuotaExceeded, "quota_exceeded"},
+		{rtcsocks.ErrOfferBinFull, "queue_full"},
+		{rtcsocks.ErrOfferExpired, "expired"},
+		{rtcsocks.ErrServerSilent, "server_silent"},
+		{rtcsocks.ErrInvalidOfferID, "invalid_offer"},
+		{context.DeadlineExceeded, "timeout"},
+	} {
+		if errors.Is(err, known.err) {
+			return known.reason
+		}
+	}
+	return "other"
+}
+
+// Run runs the load test until the offers arrived within Duration are matched, failed
+// or timed out, or ctx is done.
+func Run(ctx context.Context, cfg Config) (*Report, error) {
+	if cfg.NewClient == nil || cfg.NewServer == nil {
+		return nil, errors.New("loadtest: NewClient and NewServer are required")
+	}
+	if cfg.Users <= 0 || cfg.ServersPerGroup <= 0 || len(cfg.Groups) == 0 || cfg.ArrivalRate <= 0 {
+		return nil, errors.New("loadtest: Users, ServersPerGroup, Groups and ArrivalRate MUST be positive")
+	}
+	total := 0
+	for _, weight := range cfg.Groups {
+		total += weight
+	}
+	if total <= 0 {
+		return nil, errors.New("loadtest: no group has a positive weight")
+	}
+	if cfg.LookupInterval <= 0 {
+		cfg.LookupInterval = defaultLookupInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultTimeout
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for group := range cfg.Groups {
+		for i := 0; i < cfg.ServersPerGroup; i++ {
+			startServer(ctx, cfg, group, i)
+		}
+	}
+	clients := make([]rtcsocks.ClientNegotiator, cfg.Users)
+	for i := range clients {
+		clients[i] = cfg.NewClient(rtcsocks.UserID(i + 1))
+	}
+	pick := groupPicker(cfg.Groups)
+
+	r := &Report{Failures: make(map[string]int)}
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	result := func(latency time.Duration, err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			r.Failures[Reason(err)]++
+			return
+		}
+		r.Matched++
+		r.Latency = append(r.Latency, latency)
+	}
+
+	start := time.Now()
+	deadline := time.NewTimer(cfg.Duration)
+	defer deadline.Stop()
+ARRIVALS:
+	for n := 0; ; n++ {
+		wait := time.NewTimer(time.Duration(rand.ExpFloat64() / cfg.ArrivalRate * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			wait.Stop()
+			break ARRIVALS
+		case <-deadline.C:
+			wait.Stop()
+			break ARRIVALS
+		case <-wait.C:
+		}
+
+		r.Offers++
+		wg.Add(1)
+		go func(c rtcsocks.ClientNegotiator, group rtcsocks.GroupID, n int) {
+			defer wg.Done()
+			result(negotiate(ctx, cfg, c, group, n))
+		}(clients[rand.Intn(len(clients))], pick(), n)
+	}
+	wg.Wait()
+	r.Elapsed = time.Since(start)
+
+	sort.Slice(r.Latency, func(i, j int) bool { return r.Latency[i] < r.Latency[j] })
+	return r, nil
+}
+
+// negotiate registers an offer and looks up the answer until it is found, and returns
+// the match latency.
+func negotiate(ctx context.Context, cfg Config, c rtcsocks.ClientNegotiator, group rtcsocks.GroupID, n int) (time.Duration, error) {
+	start := time.Now()
+	// unique, so that they are not deduplicated
+	sdp := []byte(fmt.Sprintf("v=0\r\no=- %d %d IN IP4 0.0.0.0\r\ns=loadtest offer\r\n", n, start.UnixNano()))
+	offerID, err := c.RegisterOffer(sdp, group)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	ticker := time.NewTicker(cfg.LookupInterval)
+	defer ticker.Stop()
+	for {
+		_, err := c.LookupAnswer(offerID)
+		if err == nil {
+			return time.Since(start), nil
+		}
+		if !errors.Is(err, rtcsocks.ErrAnswerPending) {
+			return 0, err
+		}
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func startServer(ctx context.Context, cfg Config, group rtcsocks.GroupID, index int) {
+	s := cfg.NewServer(group, index)
+	answer := []byte(fmt.Sprintf("v=0\r\no=- %d %d IN IP4 0.0.0.0\r\ns=loadtest answer\r\n", group, index))
+	s.SetNextOfferHandler(func(offerID rtcsocks.OfferID, _ []byte) error {
+		go func() {
+			timer := time.NewTimer(time.Duration(rand.ExpFloat64() * float64(cfg.AnswerLatency)))
+			defer timer.Stop()
+			select {
+			case <-ctx.Done():
+			case <-timer.C:
+				s.RegisterAnswer(offerID, answer) // the Client tells if it fails
+			}
+		}()
+		return nil
+	})
+}
+
+// groupPicker returns a function picking a group at random by weight.
+func groupPicker(weights map[rtcsocks.GroupID]int) func() rtcsocks.GroupID {
+	var groups []rtcsocks.GroupID
+	var cumulative []int
+	total := 0
+	for group, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		total += weight
+		groups = append(groups, group)
+		cumulative = append(cumulative, total)
+	}
+	return func() rtcsocks.GroupID {
+		if total == 0 {
+			return 0
+		}
+		x := rand.Intn(total)
+		return groups[sort.SearchInts(cumulative, x+1)]
+	}
+}
@@ -0,0 +1,69 @@
+package rtcsocks
+
+import "sync/atomic"
+
+// Logger is the logging interface used throughout rtcsocks and its plugins. It is
+// satisfied by github.com/gaukas/logging.Logger, and SlogLogger adapts a *slog.Logger.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// LogLevel is the minimum level of the messages logged by a leveled Logger.
+type LogLevel uint8
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+	LogLevelNone // nothing is logged
+)
+
+// LeveledLogger drops the messages below Level and passes the others to Logger.
+// Level may be changed at any time with SetLevel.
+type LeveledLogger struct {
+	Logger Logger
+	level  uint32 // LogLevel, accessed atomically
+}
+
+// NewLeveledLogger returns a LeveledLogger logging to l at level and above.
+func NewLeveledLogger(l Logger, level LogLevel) *LeveledLogger {
+	ll := &LeveledLogger{Logger: l}
+	ll.SetLevel(level)
+	return ll
+}
+
+func (l *LeveledLogger) SetLevel(level LogLevel) {
+	atomic.StoreUint32(&l.level, uint32(level))
+}
+
+func (l *LeveledLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadUint32(&l.level))
+}
+
+func (l *LeveledLogger) Debugf(format string, args ...interface{}) {
+	if l.Level() <= LogLevelDebug {
+		l.Logger.Debugf(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Infof(format string, args ...interface{}) {
+	if l.Level() <= LogLevelInfo {
+		l.Logger.Infof(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Warnf(format string, args ...interface{}) {
+	if l.Level() <= LogLevelWarn {
+		l.Logger.Warnf(format, args...)
+	}
+}
+
+func (l *LeveledLogger) Errorf(format string, args ...interface{}) {
+	if l.Level() <= LogLevelError {
+		l.Logger.Errorf(format, args...)
+	}
+}
@@ -0,0 +1,40 @@
+//go:build go1.21
+
+package rtcsocks
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// SlogLogger adapts a *slog.Logger to the Logger interface. The messages are formatted
+// with fmt.Sprintf and logged at the matching slog level, so the level of the handler
+// applies.
+func SlogLogger(l *slog.Logger) Logger {
+	return &slogLogger{l}
+}
+
+type slogLogger struct {
+	l *slog.Logger
+}
+
+func (s *slogLogger) log(level slog.Level, format string, args ...interface{}) {
+	ctx := context.Background()
+	if s.l.Enabled(ctx, level) {
+		s.l.Log(ctx, level, fmt.Sprintf(format, args...))
+	}
+}
+
+func (s *slogLogger) Debugf(format string, args ...interface{}) {
+	s.log(slog.LevelDebug, format, args...)
+}
+func (s *slogLogger) Infof(format string, args ...interface{}) {
+	s.log(slog.LevelInfo, format, args...)
+}
+func (s *slogLogger) Warnf(format string, args ...interface{}) {
+	s.log(slog.LevelWarn, format, args...)
+}
+func (s *slogLogger) Errorf(format string, args ...interface{}) {
+	s.log(slog.LevelError, format, args...)
+}
@@ -0,0 +1,73 @@
+package rtcsocks
+
+import (
+	"context"
+	"time"
+)
+
+const defaultMailboxCapacity = 8
+
+type CollectAnswersCallbackFunction func(ctx context.Context, user UserID) (answers map[OfferID][]byte, err error)
+
+// MailboxAPI is implemented by the NegotiatorAPIs supporting the offer mailbox, where
+// Clients leave offers for later and collect the answers on their next connection.
+// HookToAPI sets the mailbox callbacks if the API implements it.
+type MailboxAPI interface {
+	// SetRegisterMailboxOfferCallback sets the callback function for mailbox offers,
+	// which are answered by Edge Servers like any other offer but kept until the
+	// mailbox TTL, even if the Client is offline.
+	SetRegisterMailboxOfferCallback(RegisterOfferCallbackFunction)
+
+	// SetCollectAnswersCallback sets the callback function returning the answered
+	// mailbox offers of the user, offer_id -> answer SDP. Collected answers are removed.
+	SetCollectAnswersCallback(CollectAnswersCallbackFunction)
+}
+
+// SetMailbox enables the offer mailbox. Mailbox offers live for the ttl instead of the
+// group TTL, and a user may have up to capacity of them (0 -> defaultMailboxCapacity).
+// They count towards GroupProfile.MaxOffersPerUser until answered.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetMailbox(ttl time.Duration, capacity int) {
+	if capacity <= 0 {
+		capacity = defaultMailboxCapacity
+	}
+	n.mailboxTTL = ttl
+	n.mailboxCapacity = capacity
+}
+
+func (n *Negotiator) registerMailboxOffer(ctx context.Context, user UserID, sdp []byte, groups ...GroupID) (offerID OfferID, err error) {
+	if n.mailboxTTL <= 0 {
+		return 0, ErrMailboxDisabled
+	}
+	return n.register(ctx, user, sdp, groups, true)
+}
+
+func (n *Negotiator) collectAnswers(_ context.Context, user UserID) (map[OfferID][]byte, error) {
+	if n.mailboxTTL <= 0 {
+		return nil, ErrMailboxDisabled
+	}
+
+	answers := make(map[OfferID][]byte)
+	n.mutexAnswers.Lock()
+	for offerID := range n.mailboxes[user] {
+		answer := n.answers[offerID]
+		answer.mutex.Lock()
+		collect := answer.body != nil
+		body := answer.body
+		answer.mutex.Unlock()
+		if collect {
+			answers[offerID] = body
+			n.deleteAnswer(offerID)
+		}
+	}
+	n.mutexAnswers.Unlock()
+
+	for offerID := range answers {
+		n.replicate(ReplicationEvent{
+			Type:    EventAnswerCollected,
+			OfferID: offerID,
+		})
+	}
+	return answers, nil
+}
@@ -0,0 +1,235 @@
+package rtcsocks
+
+import "context"
+
+// CallbackMethod names the callback function a Call is made to.
+type CallbackMethod string
+
+const (
+	MethodRegisterOffer        CallbackMethod = "RegisterOffer"
+	MethodNextOffer            CallbackMethod = "NextOffer"
+	MethodRegisterAnswer       CallbackMethod = "RegisterAnswer"
+	MethodLookupAnswer         CallbackMethod = "LookupAnswer"
+	MethodHeartbeat            CallbackMethod = "Heartbeat"
+	MethodDeregister           CallbackMethod = "Deregister"
+	MethodRegisterMailboxOffer CallbackMethod = "RegisterMailboxOffer"
+	MethodCollectAnswers       CallbackMethod = "CollectAnswers"
+	MethodReplicationEvent     CallbackMethod = "ReplicationEvent"
+	MethodWaitAnswer           CallbackMethod = "WaitAnswer"
+	MethodDeclineOffer         CallbackMethod = "DeclineOffer"
+	MethodReportRendezvous     CallbackMethod = "ReportRendezvous"
+)
+
+// Call describes a call to a callback function, as seen by a Middleware. Only the
+// fields relevant to the Method are set. OfferID and SDP of NextOffer, and OfferID of
+// RegisterOffer and RegisterMailboxOffer are set once the callback function returned.
+type Call struct {
+	Method  CallbackMethod
+	User    UserID
+	Group   GroupID   // NextOffer, Heartbeat, Deregister, DeclineOffer
+	Groups  []GroupID // RegisterOffer, RegisterMailboxOffer
+	Session string
+	OfferID OfferID
+	SDP     []byte
+
+	Capabilities []string // Heartbeat
+}
+
+// CallHandler handles a Call, eventually by calling the callback function.
+type CallHandler func(ctx context.Context, call *Call) error
+
+// Middleware wraps the callback functions of a NegotiatorAPI, e.g. for metrics,
+// rate limiting or auditing. It may return an error without calling next to reject
+// the call, and the error is returned by the callback function.
+type Middleware func(next CallHandler) CallHandler
+
+// WithMiddleware returns a NegotiatorAPI wrapping the callback functions set on it with
+// the middlewares before passing them to api. The first middleware is the outermost.
+//
+// Hook the Negotiator to the returned NegotiatorAPI, and keep using api for the rest.
+// The returned NegotiatorAPI implements HeartbeatAPI, DeregisterAPI, ReplicationAPI,
+// MailboxAPI, AnswerPushAPI, DeclineAPI, TelemetryAPI and StatsAPI, the callbacks are
+// dropped if api does not.
+// The StatsAPI callback is not wrapped, as it is not called on behalf of a Client or
+// Edge Server.
+func WithMiddleware(api NegotiatorAPI, middlewares ...Middleware) NegotiatorAPI {
+	return &middlewareAPI{
+		api:         api,
+		middlewares: middlewares,
+	}
+}
+
+type middlewareAPI struct {
+	api         NegotiatorAPI
+	middlewares []Middleware
+}
+
+func (m *middlewareAPI) run(ctx context.Context, call *Call, callback CallHandler) error {
+	h := callback
+	for i := len(m.middlewares) - 1; i >= 0; i-- {
+		h = m.middlewares[i](h)
+	}
+	return h(ctx, call)
+}
+
+func (m *middlewareAPI) SetRegisterOfferCallback(f RegisterOfferCallbackFunction) {
+	m.api.SetRegisterOfferCallback(m.wrapRegisterOffer(MethodRegisterOffer, f))
+}
+
+func (m *middlewareAPI) wrapRegisterOffer(method CallbackMethod, f RegisterOfferCallbackFunction) RegisterOfferCallbackFunction {
+	return func(ctx context.Context, user UserID, sdp []byte, groups ...GroupID) (offerID OfferID, err error) {
+		call := &Call{Method: method, User: user, Groups: groups, SDP: sdp}
+		err = m.run(ctx, call, func(ctx context.Context, call *Call) error {
+			var err error
+			offerID, err = f(ctx, user, sdp, groups...)
+			call.OfferID = offerID
+			return err
+		})
+		return offerID, err
+	}
+}
+
+func (m *middlewareAPI) SetNextOfferCallback(f NextOfferCallbackFunction) {
+	m.api.SetNextOfferCallback(func(ctx context.Context, group GroupID, session string) (offerID OfferID, sdp []byte, err error) {
+		call := &Call{Method: MethodNextOffer, Group: group, Session: session}
+		err = m.run(ctx, call, func(ctx context.Context, call *Call) error {
+			var err error
+			offerID, sdp, err = f(ctx, group, session)
+			call.OfferID, call.SDP = offerID, sdp
+			return err
+		})
+		return offerID, sdp, err
+	})
+}
+
+func (m *middlewareAPI) SetRegisterAnswerCallback(f RegisterAnswerCallbackFunction) {
+	m.api.SetRegisterAnswerCallback(func(ctx context.Context, offerID OfferID, sdp []byte) error {
+		call := &Call{Method: MethodRegisterAnswer, OfferID: offerID, SDP: sdp}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, offerID, sdp)
+		})
+	})
+}
+
+func (m *middlewareAPI) SetLookupAnswerCallback(f LookupAnswerCallbackFunction) {
+	m.api.SetLookupAnswerCallback(func(ctx context.Context, user UserID, offerID OfferID) (sdp []byte, err error) {
+		call := &Call{Method: MethodLookupAnswer, User: user, OfferID: offerID}
+		err = m.run(ctx, call, func(ctx context.Context, call *Call) error {
+			var err error
+			sdp, err = f(ctx, user, offerID)
+			call.SDP = sdp
+			return err
+		})
+		return sdp, err
+	})
+}
+
+func (m *middlewareAPI) SetHeartbeatCallback(f HeartbeatCallbackFunction) {
+	hapi, ok := m.api.(HeartbeatAPI)
+	if !ok {
+		return
+	}
+	hapi.SetHeartbeatCallback(func(ctx context.Context, group GroupID, session string, capabilities []string) error {
+		call := &Call{Method: MethodHeartbeat, Group: group, Session: session, Capabilities: capabilities}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, group, session, capabilities)
+		})
+	})
+}
+
+func (m *middlewareAPI) SetDeregisterCallback(f DeregisterCallbackFunction) {
+	dapi, ok := m.api.(DeregisterAPI)
+	if !ok {
+		return
+	}
+	dapi.SetDeregisterCallback(func(ctx context.Context, group GroupID, session string) error {
+		call := &Call{Method: MethodDeregister, Group: group, Session: session}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, group, session)
+		})
+	})
+}
+
+func (m *middlewareAPI) SetRegisterMailboxOfferCallback(f RegisterOfferCallbackFunction) {
+	if mapi, ok := m.api.(MailboxAPI); ok {
+		mapi.SetRegisterMailboxOfferCallback(m.wrapRegisterOffer(MethodRegisterMailboxOffer, f))
+	}
+}
+
+func (m *middlewareAPI) SetCollectAnswersCallback(f CollectAnswersCallbackFunction) {
+	mapi, ok := m.api.(MailboxAPI)
+	if !ok {
+		return
+	}
+	mapi.SetCollectAnswersCallback(func(ctx context.Context, user UserID) (answers map[OfferID][]byte, err error) {
+		call := &Call{Method: MethodCollectAnswers, User: user}
+		err = m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			var err error
+			answers, err = f(ctx, user)
+			return err
+		})
+		return answers, err
+	})
+}
+
+func (m *middlewareAPI) SetReplicationCallback(f ReplicationCallbackFunction) {
+	rapi, ok := m.api.(ReplicationAPI)
+	if !ok {
+		return
+	}
+	rapi.SetReplicationCallback(func(ctx context.Context, event ReplicationEvent) error {
+		call := &Call{Method: MethodReplicationEvent, OfferID: event.OfferID}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, event)
+		})
+	})
+}
+
+func (m *middlewareAPI) SetWaitAnswerCallback(f WaitAnswerCallbackFunction) {
+	papi, ok := m.api.(AnswerPushAPI)
+	if !ok {
+		return
+	}
+	papi.SetWaitAnswerCallback(func(ctx context.Context, user UserID, offerID OfferID) (sdp []byte, err error) {
+		call := &Call{Method: MethodWaitAnswer, User: user, OfferID: offerID}
+		err = m.run(ctx, call, func(ctx context.Context, call *Call) error {
+			var err error
+			sdp, err = f(ctx, user, offerID)
+			call.SDP = sdp
+			return err
+		})
+		return sdp, err
+	})
+}
+
+func (m *middlewareAPI) SetDeclineOfferCallback(f DeclineOfferCallbackFunction) {
+	dapi, ok := m.api.(DeclineAPI)
+	if !ok {
+		return
+	}
+	dapi.SetDeclineOfferCallback(func(ctx context.Context, group GroupID, session string, offerID OfferID) error {
+		call := &Call{Method: MethodDeclineOffer, Group: group, Session: session, OfferID: offerID}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, group, session, offerID)
+		})
+	})
+}
+
+func (m *middlewareAPI) SetStatsCallback(f StatsCallbackFunction) {
+	if sapi, ok := m.api.(StatsAPI); ok {
+		sapi.SetStatsCallback(f)
+	}
+}
+
+func (m *middlewareAPI) SetTelemetryCallback(f TelemetryCallbackFunction) {
+	tapi, ok := m.api.(TelemetryAPI)
+	if !ok {
+		return
+	}
+	tapi.SetTelemetryCallback(func(ctx context.Context, report RendezvousReport) error {
+		call := &Call{Method: MethodReportRendezvous}
+		return m.run(ctx, call, func(ctx context.Context, _ *Call) error {
+			return f(ctx, report)
+		})
+	})
+}
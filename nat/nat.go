@@ -0,0 +1,164 @@
+// Package nat classifies the NAT in front of the local host with STUN, to tell
+// whether a direct WebRTC connection is likely to succeed.
+package nat
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	ErrNoServer    = errors.New("at least one STUN server is required")
+	ErrBadResponse = errors.New("bad STUN response")
+	ErrTimeout     = errors.New("no STUN response before timeout")
+)
+
+const (
+	initialRTO       = 500 * time.Millisecond // initial retransmission timeout
+	defaultTimeout   = 5 * time.Second
+	hairpinTimeout   = time.Second
+	hairpinProbeData = "rtcsocks-hairpin"
+)
+
+// Mapping is the NAT mapping behavior, see RFC 4787.
+type Mapping int
+
+const (
+	MappingUnknown Mapping = iota
+	MappingNone            // no NAT, the local address is public
+	// MappingEndpointIndependent reuses the mapping for all destinations, i.e., a
+	// cone NAT.
+	MappingEndpointIndependent
+	// MappingEndpointDependent allocates a mapping per destination, i.e., a
+	// symmetric NAT.
+	MappingEndpointDependent
+)
+
+func (m Mapping) String() string {
+	switch m {
+	case MappingNone:
+		return "none"
+	case MappingEndpointIndependent:
+		return "cone"
+	case MappingEndpointDependent:
+		return "symmetric"
+	default:
+		return "unknown"
+	}
+}
+
+// Result of the NAT detection.
+type Result struct {
+	LocalAddr        *net.UDPAddr
+	MappedAddr       *net.UDPAddr // address seen by the first STUN server
+	Mapping          Mapping      // MappingUnknown if only one STUN server responded
+	PortPreservation bool         // the mapped port is the local port
+	Hairpinning      bool         // the NAT forwards packets sent to its own mapped address
+}
+
+// DirectLikely reports whether a direct WebRTC connection is likely to succeed, i.e.,
+// the local host is not behind a symmetric NAT. Otherwise a relay-capable Edge
+// Server SHOULD be demanded.
+func (r *Result) DirectLikely() bool {
+	return r.Mapping == MappingNone || r.Mapping == MappingEndpointIndependent
+}
+
+// Detect classifies the NAT with the STUN servers, e.g. "stun.l.google.com:19302".
+// Mapping behavior is only determined with at least two servers of different IP
+// addresses. Zero timeout means defaultTimeout per server.
+func Detect(servers []string, timeout time.Duration) (*Result, error) {
+	if len(servers) == 0 {
+		return nil, ErrNoServer
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	result := &Result{
+		LocalAddr: conn.LocalAddr().(*net.UDPAddr),
+	}
+
+	var mapped []*net.UDPAddr
+	var lastErr error
+	for _, server := range servers {
+		serverAddr, err := net.ResolveUDPAddr("udp", server)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		addr, err := binding(conn, serverAddr, timeout)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		mapped = append(mapped, addr)
+		if len(mapped) == 2 {
+			break
+		}
+	}
+	if len(mapped) == 0 {
+		return nil, lastErr
+	}
+
+	result.MappedAddr = mapped[0]
+	result.PortPreservation = mapped[0].Port == result.LocalAddr.Port
+	if isLocal(mapped[0].IP) {
+		result.Mapping = MappingNone
+	} else if len(mapped) == 2 {
+		if mapped[0].IP.Equal(mapped[1].IP) && mapped[0].Port == mapped[1].Port {
+			result.Mapping = MappingEndpointIndependent
+		} else {
+			result.Mapping = MappingEndpointDependent
+		}
+	}
+	result.Hairpinning = hairpinning(conn, mapped[0])
+
+	return result, nil
+}
+
+// hairpinning sends a probe from another socket to the mapped address of conn and
+// reports whether it arrives.
+func hairpinning(conn *net.UDPConn, mapped *net.UDPAddr) bool {
+	probe, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return false
+	}
+	defer probe.Close()
+
+	if _, err := probe.WriteToUDP([]byte(hairpinProbeData), mapped); err != nil {
+		return false
+	}
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(hairpinTimeout))
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return false
+		}
+		if string(buf[:n]) == hairpinProbeData {
+			return true
+		}
+	}
+}
+
+// isLocal reports whether the IP is assigned to a local interface.
+func isLocal(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
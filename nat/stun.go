@@ -0,0 +1,156 @@
+package nat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// STUN (RFC 5389) message types and attributes used for the binding test.
+const (
+	stunBindingRequest  uint16 = 0x0001
+	stunBindingResponse uint16 = 0x0101
+	stunMagicCookie     uint32 = 0x2112A442
+	stunHeaderSize             = 20
+
+	attrMappedAddress    uint16 = 0x0001
+	attrXORMappedAddress uint16 = 0x0020
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+)
+
+// bindingRequest returns a STUN binding request and its transaction ID.
+func bindingRequest() (msg []byte, txID []byte, err error) {
+	msg = make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(msg[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint16(msg[2:4], 0) // no attribute
+	binary.BigEndian.PutUint32(msg[4:8], stunMagicCookie)
+	if _, err := rand.Read(msg[8:20]); err != nil {
+		return nil, nil, err
+	}
+	return msg, msg[8:20], nil
+}
+
+// parseBindingResponse returns the mapped address in a binding response to the
+// transaction.
+func parseBindingResponse(msg, txID []byte) (*net.UDPAddr, error) {
+	if len(msg) < stunHeaderSize ||
+		binary.BigEndian.Uint16(msg[0:2]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:8]) != stunMagicCookie ||
+		!bytes.Equal(msg[8:20], txID) {
+		return nil, ErrBadResponse
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:4]))
+	if stunHeaderSize+length > len(msg) {
+		return nil, ErrBadResponse
+	}
+
+	var mapped *net.UDPAddr
+	attrs := msg[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:2])
+		attrLen := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if 4+attrLen > len(attrs) {
+			return nil, ErrBadResponse
+		}
+		value := attrs[4 : 4+attrLen]
+
+		switch attrType {
+		case attrXORMappedAddress:
+			addr, err := parseAddress(value, msg[4:20])
+			if err != nil {
+				return nil, err
+			}
+			return addr, nil // preferred over MAPPED-ADDRESS
+		case attrMappedAddress:
+			addr, err := parseAddress(value, nil)
+			if err != nil {
+				return nil, err
+			}
+			mapped = addr
+		}
+
+		// attributes are padded to 4 bytes
+		next := 4 + (attrLen+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+
+	if mapped == nil {
+		return nil, ErrBadResponse
+	}
+	return mapped, nil
+}
+
+// parseAddress parses a (XOR-)MAPPED-ADDRESS value. For XOR-MAPPED-ADDRESS, xor is
+// the magic cookie followed by the transaction ID.
+func parseAddress(value, xor []byte) (*net.UDPAddr, error) {
+	if len(value) < 4 {
+		return nil, ErrBadResponse
+	}
+
+	var ipLen int
+	switch value[1] {
+	case familyIPv4:
+		ipLen = net.IPv4len
+	case familyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil, ErrBadResponse
+	}
+	if len(value) < 4+ipLen {
+		return nil, ErrBadResponse
+	}
+
+	port := binary.BigEndian.Uint16(value[2:4])
+	ip := make(net.IP, ipLen)
+	copy(ip, value[4:4+ipLen])
+	if xor != nil {
+		port ^= uint16(stunMagicCookie >> 16)
+		for i := range ip {
+			ip[i] ^= xor[i]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// binding sends a binding request to the STUN server from conn and returns the
+// mapped address, retransmitting until the timeout.
+func binding(conn *net.UDPConn, server *net.UDPAddr, timeout time.Duration) (*net.UDPAddr, error) {
+	req, txID, err := bindingRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for rto := initialRTO; time.Now().Before(deadline); rto *= 2 {
+		if _, err := conn.WriteToUDP(req, server); err != nil {
+			return nil, err
+		}
+
+		wait := time.Now().Add(rto)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				break // retransmit on timeout
+			}
+			if !from.IP.Equal(server.IP) || from.Port != server.Port {
+				continue
+			}
+			if addr, err := parseBindingResponse(buf[:n], txID); err == nil {
+				return addr, nil
+			}
+		}
+	}
+	return nil, ErrTimeout
+}
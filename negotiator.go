@@ -1,64 +1,186 @@
 package rtcsocks
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"math"
 	"math/big"
 	"sync"
 	"time"
+
+	"github.com/gaukas/rtcsocks/sdputil"
 )
 
 var (
-	ErrNotAuthenticated = fmt.Errorf("not authenticated")
-	ErrBadGroupID       = fmt.Errorf("bad group ID")
-	ErrRNGError         = fmt.Errorf("random number generation error")
-	ErrInvalidOfferID   = fmt.Errorf("invalid offer ID")
-	ErrNoOfferAvailable = fmt.Errorf("no offer available yet")
-	ErrAnswerPending    = fmt.Errorf("answer is pending for the specified offer")
-	ErrAnswerRepeated   = fmt.Errorf("answer is already registered for the specified offer")
-	ErrNoAccess         = fmt.Errorf("no access to the specified offer")
+	ErrNotAuthenticated    = fmt.Errorf("not authenticated")
+	ErrBadGroupID          = fmt.Errorf("bad group ID")
+	ErrRNGError            = fmt.Errorf("random number generation error")
+	ErrInvalidOfferID      = fmt.Errorf("invalid offer ID")
+	ErrNoOfferAvailable    = fmt.Errorf("no offer available yet")
+	ErrAnswerPending       = fmt.Errorf("answer is pending for the specified offer")
+	ErrAnswerRepeated      = fmt.Errorf("answer is already registered for the specified offer")
+	ErrNoAccess            = fmt.Errorf("no access to the specified offer")
+	ErrOfferBinFull        = fmt.Errorf("offer bin is full")
+	ErrServerSilent        = fmt.Errorf("edge server went silent after accepting the offer")
+	ErrInvalidSessionID    = fmt.Errorf("invalid session ID")
+	ErrQuotaExceeded       = fmt.Errorf("too many pending offers")
+	ErrOfferTooLarge       = fmt.Errorf("offer is too large")
+	ErrOfferExpired        = fmt.Errorf("offer expired before being answered")
+	ErrBadReplicationEvent = fmt.Errorf("bad replication event")
+	ErrSDPTooSmall         = fmt.Errorf("SDP is too small")
+	ErrSDPTooLarge         = fmt.Errorf("SDP is too large")
+	ErrMalformedSDP        = fmt.Errorf("malformed SDP")
+	ErrAnswerNotSigned     = fmt.Errorf("answer is not signed by the edge server")
+	ErrBadAnswerSignature  = fmt.Errorf("answer signature mismatch")
+	ErrNoCandidateAllowed  = fmt.Errorf("no ICE candidate allowed by the policy")
+	ErrMailboxDisabled     = fmt.Errorf("offer mailbox is disabled")
+	ErrOverloaded          = fmt.Errorf("negotiator is overloaded")
+	ErrOfferDeclined       = fmt.Errorf("offer declined by the edge server")
+	ErrInjectedFault       = fmt.Errorf("injected fault")
+	ErrSDPNotAllowed       = fmt.Errorf("SDP not allowed by the policy")
+	ErrTelemetryDisabled   = fmt.Errorf("telemetry is disabled")
+	ErrBadReport           = fmt.Errorf("bad rendezvous report")
+	ErrUserNotAllowed      = fmt.Errorf("user not allowed in the group")
+	ErrOfferNotSigned      = fmt.Errorf("offer is not signed by the negotiator")
+	ErrBadOfferSignature   = fmt.Errorf("offer signature mismatch")
+	ErrTooManySessions     = fmt.Errorf("too many edge server sessions in the group")
+	ErrMalformedToken      = fmt.Errorf("malformed delegation token")
+	ErrTokenSignature      = fmt.Errorf("delegation token signature mismatch")
+	ErrTokenExpired        = fmt.Errorf("delegation token expired")
+)
+
+const (
+	offerBinCapacity           = 1024 // max number of queued offers per bin
+	defaultMaxSessionsPerGroup = 1024 // max number of edge server sessions per group, see GroupProfile.MaxSessions
 )
 
 // Negotiator isolates the Client and the Edge Server and provides a way for them to
 // communicate without knowing each other's IP address beforehand.
 type Negotiator struct {
-	maxGroupID uint64                 // maximum group ID, >= 1
-	offerBins  map[uint64]chan *offer // bin_id -> chan offer
-	answers    map[uint64]*answer     // offer_id -> answer_sdp
+	maxGroupID GroupID                // maximum group ID, >= 1
+	offerBins  map[uint64]*offerQueue // bin_id -> offers, soonest expiry first
+	answers    map[OfferID]*answer    // offer_id -> answer_sdp
+	offerIDs   map[offerKey]OfferID   // (user, offer_sdp_hash) -> offer_id, for deduplication
 	ttl        time.Duration          // time to live for an offer/answer pair
 
-	mutexAnswers sync.Mutex
+	mutexAnswers  sync.Mutex
+	pendingOffers map[quotaKey]int       // (user, group_id) -> number of pending offers, guarded by mutexAnswers
+	expired       map[OfferID]*tombstone // offer_id -> offer expired unanswered, guarded by mutexAnswers
+	expiryGrace   time.Duration          // how long expired offers are remembered, 0 -> ttl
+	answerExpiry  *expiryIndex           // answers by expiry, guarded by mutexAnswers
+	expiredExpiry *expiryIndex           // tombstones by expiry, guarded by mutexAnswers
+
+	offersRegistered  uint64             // guarded by mutexAnswers, see Stats
+	answersRegistered uint64             // guarded by mutexAnswers, see Stats
+	answersEvicted    uint64             // guarded by mutexAnswers, see Stats
+	maxAnswers        int                // guarded by mutexAnswers, see SetMaxAnswers
+	answeredBy        map[GroupID]uint64 // group_id -> answers registered, guarded by mutexAnswers
+
+	profiles      map[GroupID]GroupProfile // group_id -> profile
+	mutexProfiles sync.RWMutex
+
+	replicaID  string     // identifies this Negotiator among its peer replicas
+	replicator Replicator // nil -> replication disabled
+	store      StateStore // nil -> state is not persisted
+
+	sdpValidation SDPValidation
+	sdpPolicy     *sdputil.Policy // nil -> any SDP passing sdpValidation
+	sdpHook       SDPHookFunction // nil -> SDPs are queued and delivered as registered
+	loadShedding  LoadShedding
+	accountant    Accountant // nil -> usage is not recorded
+	telemetry     *telemetry // nil -> telemetry disabled, see SetTelemetry
+
+	offerSigningKey ed25519.PrivateKey // signs the metadata of dispatched offers, nil -> not signed
+
+	logger        Logger         // nil -> nothing is logged
+	restartPolicy *RestartPolicy // of the purge loop, nil -> DefaultRestartPolicy
+
+	mailboxTTL      time.Duration                   // time to live for mailbox offers, 0 -> mailbox disabled
+	mailboxCapacity int                             // max mailbox offers per user
+	mailboxes       map[UserID]map[OfferID]struct{} // user -> mailbox offers, guarded by mutexAnswers
+
+	livenessTimeout time.Duration               // edge server considered silent if not seen for this long, 0 -> disabled
+	lastSeen        map[GroupID]time.Time       // group_id -> last time a member of the group polled
+	sessions        map[sessionKey]*SessionInfo // (group_id, session_id) -> edge server session
+	sessionCount    map[GroupID]int             // group_id -> number of sessions
+	mutexLastSeen   sync.Mutex                  // for lastSeen, sessions and sessionCount
 }
 
 type offer struct {
-	id   uint64
-	user uint64 // user ID
-	sdp  []byte // offer SDP
+	id     OfferID
+	key    offerKey
+	user   UserID
+	sdp    []byte    // offer SDP
+	expiry time.Time // dispatch order, see offerQueue
+}
+
+// tombstone remembers an offer which expired without being answered.
+type tombstone struct {
+	user  UserID
+	until time.Time
+}
+
+type offerKey struct {
+	user UserID
+	hash [sha256.Size]byte // SHA-256 of offer SDP
 }
 
 type answer struct {
-	body   []byte
-	expiry time.Time  // garbage collection
-	user   uint64     // offer owner
-	mutex  sync.Mutex // for concurrent read(ReadAnswer) and write(Answer)
+	body    []byte
+	created time.Time     // registration time, resolves replication conflicts
+	expiry  time.Time     // garbage collection
+	user    UserID        // offer owner
+	key     offerKey      // deduplication key of the offer
+	groups  []GroupID     // groups listed in the offer
+	mutex   sync.Mutex    // for concurrent read(ReadAnswer) and write(Answer)
+	ready   chan struct{} // closed once the answer is registered, see WaitAnswer
+
+	dispatched time.Time // when the offer was handed out to an edge server, zero if not yet
+	group      GroupID   // group of the edge server the offer was dispatched to
+	session    string    // session of the edge server the offer was dispatched to, empty if unknown
+	byPeer     bool      // dispatched by a peer replica, liveness unknown locally
+	offer      *offer    // the offer while dispatched and unanswered, to be requeued if the edge server leaves
+	mailbox    bool      // answer is kept until collected, see RegisterMailboxOffer
+}
+
+// setBody registers the answer SDP and wakes up the waiters. The caller MUST hold a.mutex.
+func (a *answer) setBody(sdp []byte) {
+	a.body = sdp
+	a.offer = nil
+	close(a.ready)
 }
 
 func NewNegotiator(maxGroupID int, ttl time.Duration) *Negotiator {
-	offerBins := make(map[uint64]chan *offer)
+	offerBins := make(map[uint64]*offerQueue)
 	// 1~2^(numGroup)-1
 	maxBinIdx := uint64(math.Pow(2, float64(maxGroupID))) - 1
 	var i uint64
 	for i = 1; i <= maxBinIdx; i++ {
-		offerBins[i] = make(chan *offer)
+		offerBins[i] = newOfferQueue(offerBinCapacity)
 	}
 
 	n := &Negotiator{
-		maxGroupID:   uint64(maxGroupID),
+		maxGroupID:   GroupID(maxGroupID),
 		offerBins:    offerBins,
-		answers:      make(map[uint64]*answer),
+		answers:      make(map[OfferID]*answer),
+		offerIDs:     make(map[offerKey]OfferID),
 		ttl:          ttl,
 		mutexAnswers: sync.Mutex{},
+		lastSeen:     make(map[GroupID]time.Time),
+		sessions:     make(map[sessionKey]*SessionInfo),
+		sessionCount: make(map[GroupID]int),
+
+		pendingOffers: make(map[quotaKey]int),
+		expired:       make(map[OfferID]*tombstone),
+		answeredBy:    make(map[GroupID]uint64),
+		answerExpiry:  newExpiryIndex(),
+		expiredExpiry: newExpiryIndex(),
+		profiles:      make(map[GroupID]GroupProfile),
+		mailboxes:     make(map[UserID]map[OfferID]struct{}),
 	}
 
 	go n.autoPurge()
@@ -66,116 +188,385 @@ func NewNegotiator(maxGroupID int, ttl time.Duration) *Negotiator {
 	return n
 }
 
+// SetLivenessTimeout enables dead-server detection. If the edge server an offer was
+// dispatched to has not polled for longer than timeout, LookupAnswer returns
+// ErrServerSilent instead of ErrAnswerPending so the client can retry early.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetLivenessTimeout(timeout time.Duration) {
+	n.livenessTimeout = timeout
+}
+
+// SetExpiryGrace sets how long an offer which expired without being answered is
+// remembered, during which LookupAnswer returns ErrOfferExpired instead of
+// ErrInvalidOfferID. Defaults to the TTL.
+func (n *Negotiator) SetExpiryGrace(grace time.Duration) {
+	n.expiryGrace = grace
+}
+
+// SetLogger sets the Logger for the events of the Negotiator, e.g. offers registered
+// and dispatched at LogLevelDebug and offers dropped at LogLevelWarn.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetLogger(logger Logger) {
+	n.logger = logger
+}
+
+// LastSeen returns the last time a member of the specified group polled for offers
+// or sent a heartbeat.
+func (n *Negotiator) LastSeen(group GroupID) time.Time {
+	return n.seen(group, "")
+}
+
 func (n *Negotiator) HookToAPI(api NegotiatorAPI) {
 	api.SetRegisterOfferCallback(n.registerOffer)
 	api.SetNextOfferCallback(n.nextOffer)
 	api.SetRegisterAnswerCallback(n.registerAnswer)
 	api.SetLookupAnswerCallback(n.lookupAnswer)
+	if hapi, ok := api.(HeartbeatAPI); ok {
+		hapi.SetHeartbeatCallback(n.heartbeat)
+	}
+	if dapi, ok := api.(DeregisterAPI); ok {
+		dapi.SetDeregisterCallback(n.deregister)
+	}
+	if rapi, ok := api.(ReplicationAPI); ok {
+		rapi.SetReplicationCallback(n.applyReplicationEvent)
+	}
+	if mapi, ok := api.(MailboxAPI); ok {
+		mapi.SetRegisterMailboxOfferCallback(n.registerMailboxOffer)
+		mapi.SetCollectAnswersCallback(n.collectAnswers)
+	}
+	if papi, ok := api.(AnswerPushAPI); ok {
+		papi.SetWaitAnswerCallback(n.waitAnswer)
+	}
+	if dapi, ok := api.(DeclineAPI); ok {
+		dapi.SetDeclineOfferCallback(n.declineOffer)
+	}
+	if sapi, ok := api.(StatsAPI); ok {
+		sapi.SetStatsCallback(n.stats)
+	}
+	if tapi, ok := api.(TelemetryAPI); ok {
+		tapi.SetTelemetryCallback(n.reportRendezvous)
+	}
 }
 
-func (n *Negotiator) registerOffer(user uint64, sdp []byte, groups ...uint64) (offerID uint64, err error) {
-	// calculate binID
-	binID := uint64(0)
-	for _, groupID := range groups {
-		if groupID <= uint64(n.maxGroupID) {
-			binID |= uint64(math.Pow(2, float64(groupID-1)))
-		}
+func (n *Negotiator) registerOffer(ctx context.Context, user UserID, sdp []byte, groups ...GroupID) (offerID OfferID, err error) {
+	return n.register(ctx, user, sdp, groups, false)
+}
+
+func (n *Negotiator) register(ctx context.Context, user UserID, sdp []byte, groups []GroupID, mailbox bool) (offerID OfferID, err error) {
+	if err := n.checkSDP(sdp); err != nil {
+		return 0, err
 	}
+
+	binID, validGroups := n.binOf(groups)
 	if binID == 0 {
 		return 0, ErrBadGroupID
 	}
 
+	ttl, maxSize := n.offerLimits(validGroups)
+	if maxSize > 0 && len(sdp) > maxSize {
+		return 0, ErrOfferTooLarge
+	}
+	if !n.allowsUser(user, validGroups) {
+		return 0, ErrUserNotAllowed
+	}
+	if mailbox {
+		ttl = n.mailboxTTL
+	}
+
+	if err := n.allowOffer(ctx, user); err != nil {
+		return 0, err
+	}
+	// retries are deduplicated by the offer as registered, as the hook may not be
+	// deterministic
+	registered := sdp
+	if sdp, err = n.hookSDP(ctx, SDPInfo{Kind: SDPOffer, User: user, Groups: validGroups}, sdp); err != nil {
+		return 0, err
+	}
+
 	// Generate Random Offer ID
 	bigN := new(big.Int)
 	randID, err := rand.Int(rand.Reader, bigN.SetUint64(math.MaxUint64))
 	if err != nil {
 		return 0, ErrRNGError
 	}
-	offerID = randID.Uint64()
+	offerID = OfferID(randID.Uint64())
 
-	// Save offer to Offer Bin
-	n.offerBins[binID] <- &offer{
-		id:   offerID,
+	key := offerKey{
 		user: user,
-		sdp:  sdp,
+		hash: sha256.Sum256(registered),
 	}
 
-	// Store Answer
+	// Store Answer, before the offer becomes visible to edge servers
 	n.mutexAnswers.Lock()
-	n.answers[offerID] = &answer{
-		body:   nil,
-		expiry: time.Now().Add(n.ttl),
+	// A retrying client may register the same offer again, reuse the existing one
+	// unless it is expired or stuck with a silent edge server.
+	if existingID, ok := n.offerIDs[key]; ok {
+		if existing, ok := n.answers[existingID]; ok {
+			existing.mutex.Lock()
+			reusable := existing.expiry.After(time.Now()) && !n.serverSilent(existing)
+			existing.mutex.Unlock()
+			if reusable {
+				n.mutexAnswers.Unlock()
+				return existingID, nil
+			}
+		}
+	}
+	if err := n.shedLoad(); err != nil {
+		n.mutexAnswers.Unlock()
+		if n.logger != nil {
+			n.logger.Debugf("Negotiator: offer by user %s rejected: %v", user, err)
+		}
+		return 0, err
+	}
+	if n.quotaExceeded(user, validGroups) || (mailbox && len(n.mailboxes[user]) >= n.mailboxCapacity) {
+		n.mutexAnswers.Unlock()
+		return 0, ErrQuotaExceeded
+	}
+	created := time.Now()
+	n.insertAnswer(offerID, key, validGroups, created, created.Add(ttl), mailbox)
+	n.offerIDs[key] = offerID // replaces the offer not reusable, if any
+	n.mutexAnswers.Unlock()
+
+	// replicated before the offer can be dispatched, so that the peers never learn of
+	// the dispatch first
+	n.replicate(ReplicationEvent{
+		Type:    EventOfferRegistered,
+		OfferID: offerID,
+		User:    user,
+		Groups:  validGroups,
+		SDP:     sdp,
+		Created: created,
+		Expiry:  created.Add(ttl),
+		Mailbox: mailbox,
+	})
+	if err := n.enqueueOffer(binID, &offer{
+		id:     offerID,
+		key:    key,
 		user:   user,
-		mutex:  sync.Mutex{},
+		sdp:    sdp,
+		expiry: created.Add(ttl),
+	}); err != nil {
+		n.replicate(ReplicationEvent{
+			Type:    EventOfferDropped,
+			OfferID: offerID,
+		})
+		return 0, err
 	}
+	n.mutexAnswers.Lock()
+	n.offersRegistered++ // once queued only, an offer dropped is not registered
 	n.mutexAnswers.Unlock()
+	n.account(ctx, user, Usage{Offers: 1, OfferBytes: uint64(len(sdp))})
 
+	if n.logger != nil {
+		n.logger.Debugf("Negotiator: offer %s registered by user %s for groups %v, expires in %v", offerID, user, validGroups, ttl)
+	}
 	return offerID, nil
 }
 
-func (n *Negotiator) nextOffer(group uint64) (offerID uint64, sdp []byte, err error) {
+// binOf calculates the offer bin for the specified groups, and returns the valid
+// groups without duplicates. binID is 0 if no group is valid.
+func (n *Negotiator) binOf(groups []GroupID) (binID uint64, validGroups []GroupID) {
+	validGroups = make([]GroupID, 0, len(groups))
+	for _, groupID := range groups {
+		if groupID >= 1 && groupID <= n.maxGroupID {
+			binaryGroupID := uint64(1) << (groupID - 1)
+			if binID&binaryGroupID == 0 {
+				validGroups = append(validGroups, groupID)
+			}
+			binID |= binaryGroupID
+		}
+	}
+	return binID, validGroups
+}
+
+// insertAnswer stores a pending answer for the offer. The caller MUST hold n.mutexAnswers.
+func (n *Negotiator) insertAnswer(offerID OfferID, key offerKey, groups []GroupID, created, expiry time.Time, mailbox bool) {
+	n.makeRoom()
+	n.answers[offerID] = &answer{
+		body:    nil,
+		created: created,
+		expiry:  expiry,
+		user:    key.user,
+		key:     key,
+		groups:  groups,
+		mutex:   sync.Mutex{},
+		ready:   make(chan struct{}),
+		mailbox: mailbox,
+	}
+	if _, ok := n.offerIDs[key]; !ok { // register replaces a stale one itself
+		n.offerIDs[key] = offerID
+	}
+	n.answerExpiry.add(offerID, expiry)
+	n.countPending(key.user, groups, 1)
+	if mailbox {
+		if n.mailboxes[key.user] == nil {
+			n.mailboxes[key.user] = make(map[OfferID]struct{})
+		}
+		n.mailboxes[key.user][offerID] = struct{}{}
+	}
+}
+
+// enqueueOffer saves the offer to the offer bin, or drops its answer if the bin is full.
+func (n *Negotiator) enqueueOffer(binID uint64, o *offer) error {
+	if !n.offerBins[binID].push(o) {
+		n.mutexAnswers.Lock()
+		n.deleteAnswer(o.id)
+		n.mutexAnswers.Unlock()
+		if n.logger != nil {
+			n.logger.Warnf("Negotiator: offer bin %x full, offer %s of user %s dropped", binID, o.id, o.user)
+		}
+		return ErrOfferBinFull
+	}
+	return nil
+}
+
+func (n *Negotiator) nextOffer(_ context.Context, group GroupID, session string) (offerID OfferID, sdp []byte, err error) {
+	if group == 0 || group > n.maxGroupID {
+		return 0, nil, ErrBadGroupID
+	}
+
 	// calculate binIDs to receive from
-	// binaryGroupID = 2^(groupID-1). e.g. groupID=3 => binaryGroupID=4/
-	binaryGroupID := uint64(math.Pow(2, float64(group-1)))
+	if err := n.touch(group, session); err != nil {
+		return 0, nil, err
+	}
 	binIDs := make([]uint64, 0)
 	for binID := range n.offerBins {
-		if binaryGroupID&binID > 0 {
+		if n.accepts(group, binID) {
 			binIDs = append(binIDs, binID)
 		}
 	}
 
-LOOP_ALL_BINS:
-	for _, binID := range binIDs {
-	LOOP_CURRENT_BIN:
-		for {
-			select {
-			case offerObj := <-n.offerBins[binID]:
-				// check if offer is expired
-				n.mutexAnswers.Lock()
-				answer, ok := n.answers[offerObj.id]
-				if !ok {
-					n.mutexAnswers.Unlock()
-					continue LOOP_CURRENT_BIN
-				}
-				answer.mutex.Lock()
-				if answer.expiry.Before(time.Now()) {
-					answer.mutex.Unlock()
-					n.mutexAnswers.Unlock()
-					continue LOOP_CURRENT_BIN
-				}
-				answer.mutex.Unlock()
-				n.mutexAnswers.Unlock()
-				return offerObj.id, offerObj.sdp, nil
-			default: // if not readily available, try next bin
-				continue LOOP_ALL_BINS
+	for {
+		// the offer expiring soonest among the bins
+		var bin *offerQueue
+		var soonest time.Time
+		for _, binID := range binIDs {
+			if expiry, ok := n.offerBins[binID].peek(); ok && (bin == nil || expiry.Before(soonest)) {
+				bin, soonest = n.offerBins[binID], expiry
 			}
 		}
+		if bin == nil {
+			break
+		}
+		offerObj, ok := bin.pop()
+		if !ok {
+			continue // taken by another edge server meanwhile
+		}
+
+		// check if offer is expired
+		n.mutexAnswers.Lock()
+		answer, ok := n.answers[offerObj.id]
+		if !ok {
+			n.mutexAnswers.Unlock()
+			continue
+		}
+		answer.mutex.Lock()
+		// skip expired offers, offers replaced after an ID conflict and
+		// offers already dispatched by a peer replica
+		if answer.expiry.Before(time.Now()) || answer.key != offerObj.key || !answer.dispatched.IsZero() {
+			answer.mutex.Unlock()
+			n.mutexAnswers.Unlock()
+			continue
+		}
+		answer.dispatched = time.Now()
+		answer.group = group
+		answer.session = session
+		answer.offer = offerObj
+		answer.mutex.Unlock()
+		n.mutexAnswers.Unlock()
+
+		n.replicate(ReplicationEvent{
+			Type:    EventOfferDispatched,
+			OfferID: offerObj.id,
+			Group:   group,
+			Session: session,
+		})
+		if n.logger != nil {
+			n.logger.Debugf("Negotiator: offer %s dispatched to group %s, session %q", offerObj.id, group, session)
+		}
+		return offerObj.id, n.dispatchedSDP(offerObj), nil
 	}
 
 	return 0, nil, ErrNoOfferAvailable
 }
 
-func (n *Negotiator) registerAnswer(offerID uint64, sdp []byte) error {
+func (n *Negotiator) registerAnswer(ctx context.Context, offerID OfferID, sdp []byte) error {
+	if err := n.checkSDP(sdp); err != nil {
+		return err
+	}
+	if n.sdpHook != nil {
+		info, err := n.answerInfo(offerID)
+		if err != nil {
+			return err
+		}
+		if sdp, err = n.hookSDP(ctx, info, sdp); err != nil {
+			return err
+		}
+	}
+
 	n.mutexAnswers.Lock()
-	defer n.mutexAnswers.Unlock()
 	answer, ok := n.answers[offerID]
 	if !ok {
+		n.mutexAnswers.Unlock()
 		return ErrInvalidOfferID
 	}
 	answer.mutex.Lock()
-	defer answer.mutex.Unlock()
 	if answer.body != nil {
+		answer.mutex.Unlock()
+		n.mutexAnswers.Unlock()
+		// a retry of the same answer, e.g. after a network error, is not a conflict
+		if bytes.Equal(answer.body, sdp) {
+			return nil
+		}
 		return ErrAnswerRepeated
 	}
-	answer.body = sdp
+	answer.setBody(sdp)
+	n.countPending(answer.user, answer.groups, -1)
+	n.answersRegistered++
+	n.answeredBy[answer.group]++
+	user := answer.user
+	answer.mutex.Unlock()
+	n.mutexAnswers.Unlock()
+
+	n.replicate(ReplicationEvent{
+		Type:    EventAnswerRegistered,
+		OfferID: offerID,
+		SDP:     sdp,
+	})
+	n.account(ctx, user, Usage{Answers: 1, AnswerBytes: uint64(len(sdp))})
+	if n.logger != nil {
+		n.logger.Debugf("Negotiator: answer to offer %s registered", offerID)
+	}
 	return nil
 }
 
-func (n *Negotiator) lookupAnswer(user, offerID uint64) ([]byte, error) {
+// answerInfo returns what the SDP hook is told of an answer to the offer.
+func (n *Negotiator) answerInfo(offerID OfferID) (SDPInfo, error) {
 	n.mutexAnswers.Lock()
 	defer n.mutexAnswers.Unlock()
 	answer, ok := n.answers[offerID]
 	if !ok {
+		return SDPInfo{}, ErrInvalidOfferID
+	}
+	answer.mutex.Lock()
+	defer answer.mutex.Unlock()
+	info := SDPInfo{Kind: SDPAnswer, User: answer.user, OfferID: offerID}
+	if answer.group != 0 {
+		info.Groups = []GroupID{answer.group}
+	}
+	return info, nil
+}
+
+func (n *Negotiator) lookupAnswer(_ context.Context, user UserID, offerID OfferID) ([]byte, error) {
+	n.mutexAnswers.Lock()
+	defer n.mutexAnswers.Unlock()
+	answer, ok := n.answers[offerID]
+	if !ok {
+		if t, ok := n.expired[offerID]; ok && t.user == user {
+			return nil, ErrOfferExpired
+		}
 		return nil, ErrInvalidOfferID
 	}
 	answer.mutex.Lock()
@@ -185,20 +576,46 @@ func (n *Negotiator) lookupAnswer(user, offerID uint64) ([]byte, error) {
 	}
 
 	if answer.body == nil {
+		if answer.expiry.Before(time.Now()) {
+			return nil, ErrOfferExpired
+		}
+		if n.serverSilent(answer) {
+			return nil, ErrServerSilent
+		}
 		return nil, ErrAnswerPending
 	}
 	return answer.body, nil
 }
 
-func (n *Negotiator) autoPurge() {
-	for {
-		time.Sleep(n.ttl / 2)
-		n.mutexAnswers.Lock()
-		for offerID, answer := range n.answers {
-			if time.Now().After(answer.expiry) {
-				delete(n.answers, offerID)
-			}
+// serverSilent reports whether the edge server the answer is pending on has not
+// been seen for longer than the liveness timeout. If the edge server did not identify
+// itself with a session, the whole group is considered. The caller MUST hold answer.mutex.
+func (n *Negotiator) serverSilent(a *answer) bool {
+	if n.livenessTimeout <= 0 || a.dispatched.IsZero() || a.byPeer {
+		return false
+	}
+
+	return time.Since(n.seen(a.group, a.session)) > n.livenessTimeout
+}
+
+func (n *Negotiator) deleteAnswer(offerID OfferID) {
+	answer, ok := n.answers[offerID]
+	if !ok {
+		return
+	}
+	if n.offerIDs[answer.key] == offerID {
+		delete(n.offerIDs, answer.key)
+	}
+	answer.mutex.Lock()
+	if answer.body == nil {
+		n.countPending(answer.user, answer.groups, -1)
+	}
+	if answer.mailbox {
+		delete(n.mailboxes[answer.user], offerID)
+		if len(n.mailboxes[answer.user]) == 0 {
+			delete(n.mailboxes, answer.user)
 		}
-		n.mutexAnswers.Unlock()
 	}
+	answer.mutex.Unlock()
+	delete(n.answers, offerID)
 }
@@ -1,9 +1,13 @@
 package rtcsocks
 
-type RegisterOfferCallbackFunction func(user uint64, sdp []byte, groups ...uint64) (offerID uint64, err error)
-type NextOfferCallbackFunction func(group uint64) (offerID uint64, sdp []byte, err error)
-type RegisterAnswerCallbackFunction func(offerID uint64, sdp []byte) error
-type LookupAnswerCallbackFunction func(user, offerID uint64) (sdp []byte, err error)
+import "context"
+
+// The callback functions are called by the NegotiatorAPI once per request. The context
+// carries the deadline of the request and its RequestInfo, see RequestInfoFromContext.
+type RegisterOfferCallbackFunction func(ctx context.Context, user UserID, sdp []byte, groups ...GroupID) (offerID OfferID, err error)
+type NextOfferCallbackFunction func(ctx context.Context, group GroupID, session string) (offerID OfferID, sdp []byte, err error)
+type RegisterAnswerCallbackFunction func(ctx context.Context, offerID OfferID, sdp []byte) error
+type LookupAnswerCallbackFunction func(ctx context.Context, user UserID, offerID OfferID) (sdp []byte, err error)
 
 // NegotiatorAPI is the API for the Negotiator. It provides a customizable way for
 // the Client and the Edge Server to access the Negotiator.
@@ -14,6 +18,7 @@ type NegotiatorAPI interface {
 
 	// SetNextOfferCallback sets the callback function for the next offer.
 	// It returns ErrNoOfferAvailable if there is no offer available for the specified group.
+	// The session identifies the polling Edge Server within the group, empty if unknown.
 	SetNextOfferCallback(NextOfferCallbackFunction)
 	SetRegisterAnswerCallback(RegisterAnswerCallbackFunction)
 	SetLookupAnswerCallback(LookupAnswerCallbackFunction)
@@ -24,15 +29,20 @@ type ClientNegotiator interface {
 	// RegisterOffer registers an offer with the Negotiator to be accepted by 1(one)
 	// Edge Server from one of the groups specified by groupID. It returns an offerID
 	// assigned by the Negotiator to be used in the subsequent LookupAnswer call.
-	RegisterOffer(sdp []byte, groupID ...uint64) (offerID uint64, err error)
+	RegisterOffer(sdp []byte, groupID ...GroupID) (offerID OfferID, err error)
 
 	// LookupAnswer looks up the answer for the offer identified with the specified offerID.
-	LookupAnswer(offerID uint64) (sdp []byte, err error)
+	// It returns ErrAnswerPending if the answer is not yet available, or ErrServerSilent if
+	// the edge server the offer was dispatched to stopped responding and the offer should
+	// be registered again. It returns ErrOfferExpired if the offer expired unanswered.
+	LookupAnswer(offerID OfferID) (sdp []byte, err error)
 }
 
 // NextOfferHandlerFunction is the handler function to be called when the Edge Server receives a new offer
-// from the Negotiator. It SHOULD NOT block the caller.
-type NextOfferHandlerFunction func(offerID uint64, sdp []byte) error
+// from the Negotiator. It SHOULD NOT block the caller. It MAY return ErrOfferDeclined to
+// hand the offer back to the Negotiator for other Edge Servers, if the ServerNegotiator
+// supports declining offers.
+type NextOfferHandlerFunction func(offerID OfferID, sdp []byte) error
 
 // ServerNegotiator is the helper interface for the Edge Server to access the Negotiator via NegotiatorAPI.
 type ServerNegotiator interface {
@@ -40,5 +50,7 @@ type ServerNegotiator interface {
 	SetNextOfferHandler(NextOfferHandlerFunction)
 
 	// RegisterAnswer registers the answer for the offer identified with the specified offerID.
-	RegisterAnswer(offerID uint64, sdp []byte) error
+	// Registering the identical answer again succeeds, so it is safe to retry. A different
+	// answer for the same offer fails with ErrAnswerRepeated.
+	RegisterAnswer(offerID OfferID, sdp []byte) error
 }
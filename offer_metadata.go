@@ -0,0 +1,102 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"strconv"
+	"strings"
+)
+
+// offerMetadataAttribute carries the metadata signed by the Negotiator in the offer
+// SDP dispatched to Edge Servers, see SetOfferSigningKey.
+const offerMetadataAttribute = "a=rtcsocks-meta:"
+
+// SignOfferMetadata appends the Negotiator signature binding the offer SDP to its
+// offer ID and to the user who registered it:
+//
+//	a=rtcsocks-meta:<user ID, hex> <SDP length, decimal> <signature, base64>
+//
+// terminating the last line of the SDP with CRLF if needed. The length lets Edge
+// Servers recover the SDP exactly as registered, e.g. for SignAnswer, with
+// VerifyOfferMetadata.
+func SignOfferMetadata(key ed25519.PrivateKey, offerID OfferID, user UserID, sdp []byte) []byte {
+	signed := make([]byte, 0, len(sdp)+2+len(offerMetadataAttribute)+40+ed25519.SignatureSize*2)
+	signed = append(signed, sdp...)
+	if len(signed) > 0 && signed[len(signed)-1] != '\n' {
+		signed = append(signed, '\r', '\n')
+	}
+	sig := ed25519.Sign(key, offerMetadataMessage(offerID, user, sdp))
+
+	signed = append(signed, offerMetadataAttribute...)
+	signed = append(signed, user.String()...)
+	signed = append(signed, ' ')
+	signed = strconv.AppendInt(signed, int64(len(sdp)), 10)
+	signed = append(signed, ' ')
+	signed = append(signed, base64.StdEncoding.EncodeToString(sig)...)
+	signed = append(signed, '\r', '\n')
+	return signed
+}
+
+// VerifyOfferMetadata checks the offer SDP was signed for the offer ID by any of the
+// keys, and returns the offer as registered, without the metadata attribute, and the
+// user who registered it.
+func VerifyOfferMetadata(keys []ed25519.PublicKey, offerID OfferID, signed []byte) ([]byte, UserID, error) {
+	idx := bytes.LastIndex(signed, []byte(offerMetadataAttribute))
+	if idx < 0 {
+		return nil, 0, ErrOfferNotSigned
+	}
+	fields := strings.Fields(string(signed[idx+len(offerMetadataAttribute):]))
+	if len(fields) != 3 {
+		return nil, 0, ErrBadOfferSignature
+	}
+	user, err := ParseUserID(fields[0])
+	if err != nil {
+		return nil, 0, ErrBadOfferSignature
+	}
+	length, err := strconv.Atoi(fields[1])
+	if err != nil || length < 0 || length > idx {
+		return nil, 0, ErrBadOfferSignature
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, 0, ErrBadOfferSignature
+	}
+
+	sdp := signed[:length]
+
+	msg := offerMetadataMessage(offerID, user, sdp)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			return sdp, user, nil
+		}
+	}
+	return nil, 0, ErrBadOfferSignature
+}
+
+func offerMetadataMessage(offerID OfferID, user UserID, sdp []byte) []byte {
+	msg := make([]byte, 16, 16+sha256.Size)
+	binary.BigEndian.PutUint64(msg, uint64(offerID))
+	binary.BigEndian.PutUint64(msg[8:], uint64(user))
+	sdpHash := sha256.Sum256(sdp)
+	return append(msg, sdpHash[:]...)
+}
+
+// SetOfferSigningKey signs the metadata of the offers dispatched to Edge Servers,
+// so that they can check who registered an offer, e.g. against the allowed users
+// of their group, see SignOfferMetadata. nil -> offers are dispatched as registered.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetOfferSigningKey(key ed25519.PrivateKey) {
+	n.offerSigningKey = key
+}
+
+// dispatchedSDP returns the offer SDP as dispatched to Edge Servers.
+func (n *Negotiator) dispatchedSDP(o *offer) []byte {
+	if n.offerSigningKey == nil {
+		return o.sdp
+	}
+	return SignOfferMetadata(n.offerSigningKey, o.id, o.user, o.sdp)
+}
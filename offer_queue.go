@@ -0,0 +1,78 @@
+package rtcsocks
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// offerQueue is an offer bin: the offers queued for the groups of the bin, dispatched
+// soonest expiry first so that fewer of them expire unmatched under load.
+type offerQueue struct {
+	offers   offerHeap
+	capacity int
+	mutex    sync.Mutex
+}
+
+func newOfferQueue(capacity int) *offerQueue {
+	return &offerQueue{capacity: capacity}
+}
+
+// push queues the offer, and returns false if the queue is full. Expired offers are
+// dropped first to make room.
+func (q *offerQueue) push(o *offer) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.offers) >= q.capacity {
+		now := time.Now()
+		for len(q.offers) > 0 && q.offers[0].expiry.Before(now) {
+			heap.Pop(&q.offers)
+		}
+		if len(q.offers) >= q.capacity {
+			return false
+		}
+	}
+	heap.Push(&q.offers, o)
+	return true
+}
+
+// pop dequeues the offer expiring soonest.
+func (q *offerQueue) pop() (*offer, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.offers) == 0 {
+		return nil, false
+	}
+	return heap.Pop(&q.offers).(*offer), true
+}
+
+// peek returns the expiry of the offer expiring soonest.
+func (q *offerQueue) peek() (time.Time, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.offers) == 0 {
+		return time.Time{}, false
+	}
+	return q.offers[0].expiry, true
+}
+
+func (q *offerQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.offers)
+}
+
+// offerHeap implements heap.Interface, ordered by expiry.
+type offerHeap []*offer
+
+func (h offerHeap) Len() int            { return len(h) }
+func (h offerHeap) Less(i, j int) bool  { return h[i].expiry.Before(h[j].expiry) }
+func (h offerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *offerHeap) Push(x interface{}) { *h = append(*h, x.(*offer)) }
+func (h *offerHeap) Pop() interface{} {
+	old := *h
+	o := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return o
+}
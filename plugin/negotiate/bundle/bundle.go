@@ -0,0 +1,143 @@
+// Package bundle implements access bundles: everything a Client needs to reach a
+// deployment, signed by its operator and encoded as a single string short enough
+// for a QR code, the equivalent of a Tor bridge line:
+//
+//	rtcsocks1:<base64url of the JSON bundle and its Ed25519 signature>
+//
+// Bundles carry no credentials, which are distributed separately, so that a bundle
+// can be shared freely among the users of a deployment.
+package bundle
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/discovery"
+	"github.com/gaukas/rtcsocks/plugin/negotiate/fallback"
+	"github.com/gaukas/rtcsocks/plugin/negotiate/http"
+)
+
+const (
+	bundlePrefix    = "rtcsocks1:"
+	signatureDomain = "github.com/gaukas/rtcsocks access bundle v1\n"
+)
+
+var (
+	ErrMalformed    = errors.New("bundle: malformed access bundle")
+	ErrBadSignature = errors.New("bundle: signature mismatch")
+	ErrExpired      = errors.New("bundle: access bundle expired")
+	ErrNoEndpoint   = errors.New("bundle: no endpoint")
+)
+
+// Endpoint is a way to reach the negotiator, tried in order by the Client.
+type Endpoint struct {
+	Addr  string `json:"a"`           // server address, e.g. "cdn.example.com"
+	Front string `json:"f,omitempty"` // fronting domain sent as the SNI, empty -> the host of Addr
+}
+
+// Bundle is an access bundle. Field names are kept short on the wire.
+type Bundle struct {
+	Name      string             `json:"n,omitempty"` // of the deployment, for display
+	Endpoints []Endpoint         `json:"e"`
+	Groups    []rtcsocks.GroupID `json:"g,omitempty"` // groups to register offers for
+
+	// AnswerKeys verify the answers of the Edge Servers, see http.Client.AnswerVerifyKeys.
+	AnswerKeys []ed25519.PublicKey `json:"k,omitempty"`
+
+	// DiscoveryDomain publishes the current endpoints in DNS, signed with one of the
+	// DiscoveryKeys, for when the Endpoints of the bundle move, see package discovery.
+	DiscoveryDomain string              `json:"d,omitempty"`
+	DiscoveryKeys   []ed25519.PublicKey `json:"dk,omitempty"`
+
+	Expiry int64  `json:"x,omitempty"` // unix time, 0 -> never expires
+	Serial uint64 `json:"s,omitempty"` // increases with each bundle of the deployment, see Updater
+}
+
+// Seal encodes the bundle signed with the operator key.
+func Seal(key ed25519.PrivateKey, b *Bundle) (string, error) {
+	if len(b.Endpoints) == 0 && b.DiscoveryDomain == "" {
+		return "", ErrNoEndpoint
+	}
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return "", err
+	}
+	sig := ed25519.Sign(key, append([]byte(signatureDomain), payload...))
+	return bundlePrefix + base64.RawURLEncoding.EncodeToString(append(payload, sig...)), nil
+}
+
+// Open decodes a bundle signed with any of the operator keys, ignoring the spaces
+// and line breaks picked up when it is copied around.
+func Open(keys []ed25519.PublicKey, s string) (*Bundle, error) {
+	return open(keys, s, false)
+}
+
+// open decodes a bundle, expired or not if expiredOK is set.
+func open(keys []ed25519.PublicKey, s string, expiredOK bool) (*Bundle, error) {
+	s = strings.Join(strings.Fields(s), "")
+	if !strings.HasPrefix(s, bundlePrefix) {
+		return nil, ErrMalformed
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(s[len(bundlePrefix):])
+	if err != nil || len(raw) < ed25519.SignatureSize {
+		return nil, ErrMalformed
+	}
+	payload, sig := raw[:len(raw)-ed25519.SignatureSize], raw[len(raw)-ed25519.SignatureSize:]
+
+	verified := false
+	msg := append([]byte(signatureDomain), payload...)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrBadSignature
+	}
+
+	var b Bundle
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return nil, ErrMalformed
+	}
+	if !expiredOK && b.Expiry != 0 && time.Now().Unix() > b.Expiry {
+		return nil, ErrExpired
+	}
+	return &b, nil
+}
+
+// Client returns a Client reaching the negotiator over the Endpoints in order, as
+// the user with the password. Offers SHOULD be registered for the Groups.
+func (b *Bundle) Client(uid rtcsocks.UserID, password string) *fallback.Client {
+	c := &fallback.Client{}
+	for _, e := range b.Endpoints {
+		c.Transports = append(c.Transports, fallback.Transport{
+			Name: e.Addr,
+			Negotiator: &http.Client{
+				UserID:           uid,
+				Password:         password,
+				ServerAddr:       e.Addr,
+				SNI:              e.Front,
+				AnswerVerifyKeys: b.AnswerKeys,
+			},
+		})
+	}
+	return c
+}
+
+// Resolver returns the Resolver of the endpoints published in DNS, nil if the
+// bundle has no DiscoveryDomain.
+func (b *Bundle) Resolver() *discovery.Resolver {
+	if b.DiscoveryDomain == "" {
+		return nil
+	}
+	return &discovery.Resolver{
+		Domain: b.DiscoveryDomain,
+		Keys:   b.DiscoveryKeys,
+	}
+}
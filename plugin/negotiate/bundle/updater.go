@@ -0,0 +1,149 @@
+package bundle
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/plugin/negotiate/http"
+)
+
+const defaultUpdateInterval = 6 * time.Hour
+
+var ErrNotUpdated = errors.New("bundle: no endpoint served an update")
+
+// Fetcher fetches the sealed access bundle served by a negotiator, e.g. http.Client.
+type Fetcher interface {
+	FetchAccessBundle() (string, error)
+}
+
+// Updater keeps an access bundle up to date with the one served by the negotiator,
+// see http.API.SetAccessBundle, so that blocked endpoints can be rotated without user
+// action. It fetches it over whichever endpoint of the current bundle works, or
+// those published in DNS, and accepts only bundles signed with the pinned Keys and
+// of a higher Serial, so that an old bundle cannot be replayed.
+type Updater struct {
+	Keys    []ed25519.PublicKey // pinned operator keys
+	Current string              // sealed bundle in use, updated by Update
+
+	UserID   rtcsocks.UserID
+	Password string
+
+	Interval time.Duration // between updates, 0 -> 6 hours
+
+	// OnUpdate is called with each new bundle, e.g. to store it and reconfigure the
+	// Client. It MUST NOT block.
+	OnUpdate func(b *Bundle, sealed string)
+
+	// Fetchers returns the ways to fetch the bundle, tried in order. nil -> an
+	// http.Client per endpoint of the bundle, then per endpoint discovered in DNS.
+	Fetchers func(b *Bundle) []Fetcher
+
+	Logger rtcsocks.Logger
+
+	mutex sync.Mutex
+}
+
+// Update fetches the bundle once, and returns the new bundle if there is one.
+func (u *Updater) Update() (*Bundle, error) {
+	u.mutex.Lock()
+	current := u.Current
+	u.mutex.Unlock()
+
+	b, err := open(u.Keys, current, true) // an expired bundle still has endpoints to try
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range u.fetchers(b) {
+		sealed, err := f.FetchAccessBundle()
+		if err != nil {
+			if u.Logger != nil {
+				u.Logger.Debugf("bundle: fetch failed: %v", err)
+			}
+			continue
+		}
+		latest, err := Open(u.Keys, sealed)
+		if err != nil {
+			if u.Logger != nil {
+				u.Logger.Warnf("bundle: fetched bundle rejected: %v", err)
+			}
+			continue
+		}
+		if latest.Serial <= b.Serial {
+			return nil, nil // up to date
+		}
+
+		u.mutex.Lock()
+		u.Current = sealed
+		u.mutex.Unlock()
+		if u.Logger != nil {
+			u.Logger.Infof("bundle: updated to serial %d", latest.Serial)
+		}
+		if u.OnUpdate != nil {
+			u.OnUpdate(latest, sealed)
+		}
+		return latest, nil
+	}
+	return nil, ErrNotUpdated
+}
+
+// Start updates the bundle every Interval until stop is called.
+func (u *Updater) Start() (stop func()) {
+	interval := u.Interval
+	if interval <= 0 {
+		interval = defaultUpdateInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		defer rtcsocks.Recover("bundle: updater", u.Logger, nil)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := u.Update(); err != nil && u.Logger != nil {
+				u.Logger.Warnf("bundle: update failed: %v", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (u *Updater) fetchers(b *Bundle) []Fetcher {
+	if u.Fetchers != nil {
+		return u.Fetchers(b)
+	}
+
+	var fetchers []Fetcher
+	for _, e := range b.Endpoints {
+		fetchers = append(fetchers, u.client(e.Addr, e.Front))
+	}
+	if r := b.Resolver(); r != nil {
+		r.Logger = u.Logger
+		endpoints, err := r.Endpoints(context.Background())
+		if err != nil && u.Logger != nil {
+			u.Logger.Debugf("bundle: discovery failed: %v", err)
+		}
+		for _, e := range endpoints {
+			fetchers = append(fetchers, u.client(e.Addr, e.SNI))
+		}
+	}
+	return fetchers
+}
+
+func (u *Updater) client(addr, sni string) *http.Client {
+	return &http.Client{
+		UserID:     u.UserID,
+		Password:   u.Password,
+		ServerAddr: addr,
+		SNI:        sni,
+	}
+}
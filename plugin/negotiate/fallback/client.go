@@ -0,0 +1,264 @@
+// Package fallback implements a ClientNegotiator reaching the Negotiator over an
+// ordered list of transports, e.g. HTTPS direct, domain-fronted, AMP or DNS. It
+// remembers which transports work on the current network and falls back to the next
+// one when the preferred transport is blocked.
+package fallback
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/plugin/negotiate/http"
+)
+
+// Transport is a way of reaching the Negotiator.
+type Transport struct {
+	Name       string
+	Negotiator rtcsocks.ClientNegotiator
+
+	// Probe checks cheaply whether the transport is usable, before it is first used on
+	// a network or after it was blocked. Optional, the transport is tried directly if nil.
+	Probe func() error
+}
+
+// Client is a ClientNegotiator trying its Transports in order. All Transports MUST
+// reach the same Negotiator (or replicas of it), as an offer registered over one
+// Transport may be looked up over another.
+type Client struct {
+	Transports []Transport
+
+	// BlockedFor is how long a failed transport is skipped on a network, 0 -> 10 minutes.
+	// If all transports are skipped, all are tried again.
+	BlockedFor time.Duration
+
+	// NetworkID identifies the current network, e.g. by the default gateway or SSID,
+	// so that what works is remembered per network. nil -> one network.
+	NetworkID func() string
+
+	// IsNegotiatorError reports whether an error was returned by the Negotiator, i.e.,
+	// the transport works. Other errors mark the transport failed. nil -> the rtcsocks
+	// errors and http.ResponseError are Negotiator errors.
+	IsNegotiatorError func(error) bool
+
+	Logger rtcsocks.Logger
+
+	networks map[string]*network
+	offers   map[rtcsocks.OfferID]int // offer_id -> index of the transport registered with
+	mutex    sync.Mutex
+}
+
+// network is what is known about the transports on a network.
+type network struct {
+	preferred    int         // index of the last transport that worked
+	blockedUntil []time.Time // per transport
+	probed       []bool      // per transport, probed successfully since last blocked
+}
+
+func (c *Client) RegisterOffer(sdp []byte, groupID ...rtcsocks.GroupID) (offerID rtcsocks.OfferID, err error) {
+	var registerErr error
+	err = c.try(-1, func(t Transport) error {
+		offerID, registerErr = t.Negotiator.RegisterOffer(sdp, groupID...)
+		return registerErr
+	}, func(i int) {
+		if registerErr == nil {
+			c.offers[offerID] = i
+		}
+	})
+	return offerID, err
+}
+
+func (c *Client) LookupAnswer(offerID rtcsocks.OfferID) (sdp []byte, err error) {
+	c.mutex.Lock()
+	first, ok := c.offers[offerID]
+	c.mutex.Unlock()
+	if !ok {
+		first = -1
+	}
+
+	var lookupErr error
+	err = c.try(first, func(t Transport) error {
+		sdp, lookupErr = t.Negotiator.LookupAnswer(offerID)
+		return lookupErr
+	}, func(int) {
+		if lookupErr == nil || errors.Is(lookupErr, rtcsocks.ErrOfferExpired) || errors.Is(lookupErr, rtcsocks.ErrInvalidOfferID) || errors.Is(lookupErr, rtcsocks.ErrServerSilent) {
+			delete(c.offers, offerID) // no more lookups expected
+		}
+	})
+	return sdp, err
+}
+
+// try calls f with the transports in order, starting from first (-1 -> the preferred
+// one), until one of them reaches the Negotiator. done is called with the index of
+// that transport while holding c.mutex.
+func (c *Client) try(first int, f func(Transport) error, done func(int)) error {
+	if len(c.Transports) == 0 {
+		return ErrNoTransport
+	}
+
+	netID := ""
+	if c.NetworkID != nil {
+		netID = c.NetworkID()
+	}
+
+	var lastErr error
+	for _, i := range c.order(netID, first) {
+		t := c.Transports[i]
+		if t.Probe != nil && !c.isProbed(netID, i) {
+			if err := t.Probe(); err != nil {
+				c.block(netID, i, err)
+				lastErr = err
+				continue
+			}
+			c.setProbed(netID, i)
+		}
+
+		err := f(t)
+		if err != nil && !c.isNegotiatorError(err) {
+			c.block(netID, i, err)
+			lastErr = err
+			continue
+		}
+
+		c.mutex.Lock()
+		c.network(netID).preferred = i
+		if c.offers == nil {
+			c.offers = make(map[rtcsocks.OfferID]int)
+		}
+		done(i)
+		c.mutex.Unlock()
+		return err
+	}
+	return fmt.Errorf("%w, last error: %v", ErrAllTransportsFailed, lastErr)
+}
+
+// order returns the indexes of the transports to try: first, then the preferred
+// one, then the rest in order. Blocked transports are skipped unless all are blocked.
+func (c *Client) order(netID string, first int) []int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	n := c.network(netID)
+	now := time.Now()
+
+	order := make([]int, 0, len(c.Transports))
+	var blocked []int
+	add := func(i int) {
+		for _, j := range order {
+			if j == i {
+				return
+			}
+		}
+		for _, j := range blocked {
+			if j == i {
+				return
+			}
+		}
+		if now.Before(n.blockedUntil[i]) {
+			blocked = append(blocked, i)
+		} else {
+			order = append(order, i)
+		}
+	}
+
+	if first >= 0 && first < len(c.Transports) {
+		add(first)
+	}
+	add(n.preferred)
+	for i := range c.Transports {
+		add(i)
+	}
+	if len(order) == 0 {
+		return blocked
+	}
+	return order
+}
+
+// network returns the state of the network, creating it if needed. The caller MUST
+// hold c.mutex.
+func (c *Client) network(netID string) *network {
+	if c.networks == nil {
+		c.networks = make(map[string]*network)
+	}
+	n, ok := c.networks[netID]
+	if !ok || len(n.blockedUntil) != len(c.Transports) {
+		n = &network{
+			blockedUntil: make([]time.Time, len(c.Transports)),
+			probed:       make([]bool, len(c.Transports)),
+		}
+		c.networks[netID] = n
+	}
+	return n
+}
+
+func (c *Client) block(netID string, i int, err error) {
+	blockedFor := c.BlockedFor
+	if blockedFor <= 0 {
+		blockedFor = defaultBlockedFor
+	}
+
+	c.mutex.Lock()
+	n := c.network(netID)
+	n.blockedUntil[i] = time.Now().Add(blockedFor)
+	n.probed[i] = false
+	c.mutex.Unlock()
+
+	if c.Logger != nil {
+		c.Logger.Warnf("fallback: transport %s failed, skipped for %v: %v", c.Transports[i].Name, blockedFor, err)
+	}
+}
+
+func (c *Client) isProbed(netID string, i int) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.network(netID).probed[i]
+}
+
+func (c *Client) setProbed(netID string, i int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.network(netID).probed[i] = true
+}
+
+func (c *Client) isNegotiatorError(err error) bool {
+	if c.IsNegotiatorError != nil {
+		return c.IsNegotiatorError(err)
+	}
+	return IsNegotiatorError(err)
+}
+
+var negotiatorErrors = []error{
+	rtcsocks.ErrNotAuthenticated,
+	rtcsocks.ErrBadGroupID,
+	rtcsocks.ErrInvalidOfferID,
+	rtcsocks.ErrNoOfferAvailable,
+	rtcsocks.ErrAnswerPending,
+	rtcsocks.ErrAnswerRepeated,
+	rtcsocks.ErrNoAccess,
+	rtcsocks.ErrOfferBinFull,
+	rtcsocks.ErrServerSilent,
+	rtcsocks.ErrQuotaExceeded,
+	rtcsocks.ErrOfferTooLarge,
+	rtcsocks.ErrOfferExpired,
+	rtcsocks.ErrSDPTooSmall,
+	rtcsocks.ErrSDPTooLarge,
+	rtcsocks.ErrMalformedSDP,
+	rtcsocks.ErrSDPNotAllowed,
+	rtcsocks.ErrMailboxDisabled,
+	rtcsocks.ErrUserNotAllowed,
+}
+
+// IsNegotiatorError is the default Client.IsNegotiatorError.
+func IsNegotiatorError(err error) bool {
+	var respErr *http.ResponseError
+	if errors.As(err, &respErr) {
+		return true
+	}
+	for _, e := range negotiatorErrors {
+		if errors.Is(err, e) {
+			return true
+		}
+	}
+	return false
+}
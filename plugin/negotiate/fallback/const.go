@@ -0,0 +1,15 @@
+package fallback
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoTransport         = errors.New("no transport configured")
+	ErrAllTransportsFailed = errors.New("all transports failed")
+)
+
+const (
+	defaultBlockedFor = 10 * time.Minute // how long a failed transport is skipped
+)
@@ -0,0 +1,18 @@
+package federation
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoLink         = errors.New("no link configured")
+	ErrNoLocalGroup   = errors.New("link without local groups")
+	ErrAnswerTimedOut = errors.New("no local answer in time")
+)
+
+const (
+	defaultMaxPending    = 64
+	defaultPollInterval  = time.Second
+	defaultAnswerTimeout = time.Minute
+)
@@ -0,0 +1,227 @@
+// Package federation lets independent Negotiator operators federate: offers registered
+// at a peer negotiator are answered by the Edge Servers registered locally.
+//
+// Federation needs nothing but the Client and Edge Server protocols. The peer lends
+// a group of its negotiator, and a Peer polls it for offers like an Edge Server of
+// that group would. Each offer is registered with the local negotiator as a Client,
+// for the local groups the link is mapped to, and the local answer is registered
+// back with the peer:
+//
+//	peer Client -> peer negotiator -> Peer -> local negotiator -> local Edge Server
+//
+// The Peer authenticates to the local negotiator as a user of its own, so that the
+// quotas, allow-lists and accounting configured for that user apply to the peer as
+// a whole. Offers are federated one hop only: a local group SHOULD NOT be lent to
+// another peer if it is answered by a Peer itself.
+//
+// Answer signatures, see rtcsocks.SignAnswer, are made with the keys of the local
+// Edge Servers, which the peer distributes to its Clients if they verify answers.
+package federation
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/sdputil"
+)
+
+// Link maps a group lent by the peer to the local groups answering its offers.
+type Link struct {
+	// Remote receives the offers dispatched to the lent group, e.g. an http.Server
+	// configured with the GroupID and Secret given by the peer operator.
+	Remote rtcsocks.ServerNegotiator
+	Groups []rtcsocks.GroupID // local groups the offers are registered for
+}
+
+// Peer federates a peer negotiator, answering the offers of its Links locally.
+type Peer struct {
+	Name  string // for logging
+	Links []Link
+
+	// Local is the local negotiator, as the Client user of the peer, e.g. an
+	// http.Client with the UserID and Password the peer is given locally.
+	Local rtcsocks.ClientNegotiator
+
+	// MaxPending is the max offers of the peer being answered at once. More offers
+	// are declined back to the peer negotiator if the Remote supports it, or else
+	// dropped. 0 -> 64.
+	MaxPending int
+
+	// SDPPolicy checks the offers of the peer before they are registered locally,
+	// see sdputil.Policy.Check. nil -> offers are checked by the local negotiator only.
+	SDPPolicy *sdputil.Policy
+
+	PollInterval  time.Duration // between lookups of a local answer, 0 -> 1 second
+	AnswerTimeout time.Duration // for a local answer before the offer is given up, 0 -> 1 minute
+
+	Logger rtcsocks.Logger
+
+	pending   chan struct{} // semaphore of the offers being answered
+	closing   chan struct{}
+	wg        sync.WaitGroup
+	startOnce sync.Once
+	closeOnce sync.Once
+}
+
+// decliner is implemented by the ServerNegotiators able to hand an offer back to
+// their negotiator, e.g. http.Server.
+type decliner interface {
+	DeclineOffer(offerID rtcsocks.OfferID) error
+}
+
+// Start starts receiving the offers of the peer on every link.
+func (p *Peer) Start() error {
+	if len(p.Links) == 0 {
+		return ErrNoLink
+	}
+	for _, link := range p.Links {
+		if len(link.Groups) == 0 {
+			return ErrNoLocalGroup
+		}
+	}
+
+	p.startOnce.Do(func() {
+		maxPending := p.MaxPending
+		if maxPending <= 0 {
+			maxPending = defaultMaxPending
+		}
+		p.pending = make(chan struct{}, maxPending)
+		p.closing = make(chan struct{})
+		for i := range p.Links {
+			link := &p.Links[i]
+			link.Remote.SetNextOfferHandler(func(offerID rtcsocks.OfferID, sdp []byte) error {
+				return p.handleOffer(link, offerID, sdp)
+			})
+		}
+	})
+	return nil
+}
+
+// Close stops answering the offers of the peer, and waits for the offers being
+// answered to be given up. The Remotes are left to their owner to close.
+func (p *Peer) Close() {
+	p.closeOnce.Do(func() {
+		if p.closing != nil {
+			close(p.closing)
+		}
+	})
+	p.wg.Wait()
+}
+
+// handleOffer admits an offer of the peer and answers it in the background, as the
+// NextOfferHandlerFunction SHOULD NOT block.
+func (p *Peer) handleOffer(link *Link, remoteID rtcsocks.OfferID, sdp []byte) error {
+	select {
+	case <-p.closing:
+		return rtcsocks.ErrOfferDeclined
+	case p.pending <- struct{}{}:
+	default:
+		if p.Logger != nil {
+			p.Logger.Debugf("federation: peer %s: too many pending offers, offer %s declined", p.Name, remoteID)
+		}
+		return rtcsocks.ErrOfferDeclined
+	}
+
+	if p.SDPPolicy != nil {
+		if err := p.checkSDP(sdp); err != nil {
+			<-p.pending
+			if p.Logger != nil {
+				p.Logger.Warnf("federation: peer %s: offer %s refused: %v", p.Name, remoteID, err)
+			}
+			return nil // would be refused by any of our Edge Servers too
+		}
+	}
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer func() { <-p.pending }()
+		defer rtcsocks.Recover("federation: peer "+p.Name, p.Logger, nil)
+		p.answer(link, remoteID, sdp)
+	}()
+	return nil
+}
+
+func (p *Peer) checkSDP(sdp []byte) error {
+	s, err := sdputil.Parse(sdp)
+	if err != nil {
+		return err
+	}
+	return p.SDPPolicy.Check(s)
+}
+
+// answer registers the offer locally, waits for the local answer and registers it
+// with the peer, or declines the offer back to the peer if there is none.
+func (p *Peer) answer(link *Link, remoteID rtcsocks.OfferID, sdp []byte) {
+	localID, err := p.Local.RegisterOffer(sdp, link.Groups...)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Warnf("federation: peer %s: offer %s not registered locally: %v", p.Name, remoteID, err)
+		}
+		p.decline(link, remoteID)
+		return
+	}
+
+	answer, err := p.waitAnswer(localID)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Infof("federation: peer %s: offer %s unanswered locally: %v", p.Name, remoteID, err)
+		}
+		p.decline(link, remoteID)
+		return
+	}
+
+	if err := link.Remote.RegisterAnswer(remoteID, answer); err != nil {
+		if p.Logger != nil {
+			p.Logger.Warnf("federation: peer %s: failed to register answer to offer %s: %v", p.Name, remoteID, err)
+		}
+		return
+	}
+	if p.Logger != nil {
+		p.Logger.Debugf("federation: peer %s: offer %s answered as local offer %s", p.Name, remoteID, localID)
+	}
+}
+
+// decline hands the offer back to the peer negotiator for its other Edge Servers, if
+// the Remote supports it.
+func (p *Peer) decline(link *Link, remoteID rtcsocks.OfferID) {
+	d, ok := link.Remote.(decliner)
+	if !ok {
+		return
+	}
+	if err := d.DeclineOffer(remoteID); err != nil && p.Logger != nil {
+		p.Logger.Warnf("federation: peer %s: failed to decline offer %s: %v", p.Name, remoteID, err)
+	}
+}
+
+// waitAnswer polls the local negotiator for the answer to the offer.
+func (p *Peer) waitAnswer(localID rtcsocks.OfferID) ([]byte, error) {
+	interval := p.PollInterval
+	if interval <= 0 {
+		interval = defaultPollInterval
+	}
+	timeout := p.AnswerTimeout
+	if timeout <= 0 {
+		timeout = defaultAnswerTimeout
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		answer, err := p.Local.LookupAnswer(localID)
+		if !errors.Is(err, rtcsocks.ErrAnswerPending) {
+			return answer, err
+		}
+		select {
+		case <-ticker.C:
+		case <-deadline.C:
+			return nil, ErrAnswerTimedOut
+		case <-p.closing:
+			return nil, ErrAnswerTimedOut
+		}
+	}
+}
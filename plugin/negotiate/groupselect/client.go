@@ -0,0 +1,228 @@
+// Package groupselect implements a ClientNegotiator choosing the groups of Edge Servers
+// each offer is registered for, for Clients belonging to several groups. Groups are
+// picked at random, weighted by their configured priority, the time of day and how
+// often their offers were answered recently, so that the match rate improves without
+// manual tuning while every group keeps being tried.
+package groupselect
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"math"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// Group is a group the Client may register offers for.
+type Group struct {
+	ID     rtcsocks.GroupID
+	Weight float64 // relative priority, 0 -> 1
+
+	// Schedule multiplies the weight depending on the time, e.g. to prefer a group
+	// whose Edge Servers are mostly online at night. nil -> 1 at all times.
+	Schedule func(t time.Time) float64
+}
+
+// Client is a ClientNegotiator registering the offers without groups for PerOffer of
+// the Groups. Offers registered with explicit groups are passed as is, and count
+// towards the success of those groups too.
+type Client struct {
+	Negotiator rtcsocks.ClientNegotiator
+	Groups     []Group
+	PerOffer   int // groups listed in each offer, 0 -> 1
+
+	// HalfLife is how fast the measured success of a group is forgotten: an outcome
+	// weighs half as much after HalfLife. 0 -> 1 hour.
+	HalfLife time.Duration
+
+	Logger rtcsocks.Logger
+
+	outcomes map[rtcsocks.GroupID]*outcome
+	offers   map[rtcsocks.OfferID]*pendingOffer // offer_id -> offer waiting for an outcome
+	rand     *mrand.Rand
+	mutex    sync.Mutex
+}
+
+// outcome is the decayed count of the offers listing a group, and of those answered.
+type outcome struct {
+	answered float64
+	total    float64
+	updated  time.Time
+}
+
+type pendingOffer struct {
+	groups     []rtcsocks.GroupID
+	registered time.Time
+}
+
+func (c *Client) RegisterOffer(sdp []byte, groupID ...rtcsocks.GroupID) (offerID rtcsocks.OfferID, err error) {
+	if len(groupID) == 0 {
+		if groupID, err = c.Select(); err != nil {
+			return 0, err
+		}
+	}
+
+	offerID, err = c.Negotiator.RegisterOffer(sdp, groupID...)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	now := time.Now()
+	for id, o := range c.offers {
+		if now.Sub(o.registered) > offerMemory {
+			delete(c.offers, id)
+		}
+	}
+	c.offers[offerID] = &pendingOffer{groups: groupID, registered: now}
+	return offerID, nil
+}
+
+func (c *Client) LookupAnswer(offerID rtcsocks.OfferID) (sdp []byte, err error) {
+	sdp, err = c.Negotiator.LookupAnswer(offerID)
+	switch {
+	case err == nil:
+		c.record(offerID, true)
+	case errors.Is(err, rtcsocks.ErrOfferExpired), errors.Is(err, rtcsocks.ErrServerSilent):
+		c.record(offerID, false)
+	}
+	return sdp, err
+}
+
+// Select returns the groups for the next offer.
+func (c *Client) Select() ([]rtcsocks.GroupID, error) {
+	if len(c.Groups) == 0 {
+		return nil, ErrNoGroup
+	}
+	perOffer := c.PerOffer
+	if perOffer <= 0 {
+		perOffer = 1
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	now := time.Now()
+	scores := make([]float64, len(c.Groups))
+	for i, g := range c.Groups {
+		scores[i] = c.score(g, now)
+	}
+
+	// weighted sampling without replacement
+	var selected []rtcsocks.GroupID
+	for len(selected) < perOffer && len(selected) < len(c.Groups) {
+		var sum float64
+		for _, s := range scores {
+			sum += s
+		}
+		if sum <= 0 {
+			break // the others are all scheduled off
+		}
+		pick, chosen := c.rand.Float64()*sum, -1
+		for i, s := range scores {
+			if s > 0 {
+				chosen = i // the last one left if rounding ends past it
+			}
+			if pick -= s; pick < 0 && s > 0 {
+				break
+			}
+		}
+		selected = append(selected, c.Groups[chosen].ID)
+		scores[chosen] = 0
+	}
+	if len(selected) == 0 {
+		return nil, ErrNoGroup
+	}
+	return selected, nil
+}
+
+// SuccessRate returns the estimated share of the offers listing the group that are
+// answered, 0.5 for a group not tried yet.
+func (c *Client) SuccessRate(group rtcsocks.GroupID) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	return c.successRate(group, time.Now())
+}
+
+// score is the weight of the group in the selection. c.mutex MUST be held.
+func (c *Client) score(g Group, now time.Time) float64 {
+	weight := g.Weight
+	if weight <= 0 {
+		weight = 1
+	}
+	if g.Schedule != nil {
+		weight *= math.Max(g.Schedule(now), 0)
+	}
+	return weight * c.successRate(g.ID, now)
+}
+
+// successRate is the decayed rate of answered offers, with one answered and one
+// unanswered offer assumed so that untried groups get a fair chance. c.mutex MUST be
+// held.
+func (c *Client) successRate(group rtcsocks.GroupID, now time.Time) float64 {
+	o, ok := c.outcomes[group]
+	if !ok {
+		return 0.5
+	}
+	c.decay(o, now)
+	return (o.answered + 1) / (o.total + 2)
+}
+
+func (c *Client) decay(o *outcome, now time.Time) {
+	halfLife := c.HalfLife
+	if halfLife <= 0 {
+		halfLife = defaultHalfLife
+	}
+	factor := math.Exp2(-float64(now.Sub(o.updated)) / float64(halfLife))
+	o.answered *= factor
+	o.total *= factor
+	o.updated = now
+}
+
+// record credits the outcome of the offer to the groups it listed.
+func (c *Client) record(offerID rtcsocks.OfferID, answered bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+	offer, ok := c.offers[offerID]
+	if !ok {
+		return
+	}
+	delete(c.offers, offerID)
+
+	now := time.Now()
+	for _, group := range offer.groups {
+		o, ok := c.outcomes[group]
+		if !ok {
+			o = &outcome{updated: now}
+			c.outcomes[group] = o
+		}
+		c.decay(o, now)
+		o.total++
+		if answered {
+			o.answered++
+		}
+	}
+	if c.Logger != nil {
+		c.Logger.Debugf("groupselect: offer %s answered: %t, groups %v", offerID, answered, offer.groups)
+	}
+}
+
+// init initializes the state of the Client. c.mutex MUST be held.
+func (c *Client) init() {
+	if c.outcomes != nil {
+		return
+	}
+	c.outcomes = make(map[rtcsocks.GroupID]*outcome)
+	c.offers = make(map[rtcsocks.OfferID]*pendingOffer)
+	var seed [8]byte
+	rand.Read(seed[:])
+	c.rand = mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+}
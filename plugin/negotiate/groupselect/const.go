@@ -0,0 +1,15 @@
+package groupselect
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNoGroup = errors.New("no group configured")
+)
+
+const (
+	defaultHalfLife = time.Hour        // of the measured success of a group
+	offerMemory     = 10 * time.Minute // offers not looked up to an outcome for this long are forgotten
+)
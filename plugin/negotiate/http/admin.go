@@ -0,0 +1,243 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gofiber/fiber/v2"
+)
+
+//go:embed admin.html
+var adminPage []byte
+
+const adminCookie = "rtcsocks_admin"
+
+// SetAdminToken enables the admin console at /rtcsocks/admin/, showing the queue
+// depths, match rate, per-group activity and recent errors of the Negotiator, live.
+// Requests are authorized by the token, either as a bearer token in the Authorization
+// header or, for browsers, once with ?token= which is then kept in a cookie. Requests
+// without it get 404 Not Found like the rest of the API. Mutual TLS, if required, is
+// left to the TLS terminating proxy.
+//
+// The token SHOULD be long and random, and the API served over HTTPS. It MUST be set
+// before Listen is called.
+func (a *API) SetAdminToken(token string) {
+	a.adminToken = token
+	if token != "" && a.recentErrors == nil {
+		a.recentErrors = newErrorLog(maxRecentErrors)
+	}
+}
+
+func (a *API) SetStatsCallback(f rtcsocks.StatsCallbackFunction) {
+	a.statsCallback = f
+}
+
+// routeAdmin registers the admin console on the router if enabled.
+func (a *API) routeAdmin(router fiber.Router) {
+	if a.adminToken == "" {
+		return
+	}
+	admin := router.Group("/admin", a.authorizeAdmin)
+	admin.Get("/", a.adminConsole)
+	admin.Get("/stats", a.adminStats)
+	admin.Get("/events", a.adminEvents)
+}
+
+func (a *API) authorizeAdmin(c *fiber.Ctx) error {
+	token := c.Query("token")
+	fromQuery := token != ""
+	if !fromQuery {
+		token = strings.TrimPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+	}
+	if token == "" {
+		token = c.Cookies(adminCookie)
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.adminToken)) != 1 {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if fromQuery {
+		// keep the token out of the address bar and the history
+		c.Cookie(&fiber.Cookie{
+			Name:     adminCookie,
+			Value:    token,
+			Path:     "/rtcsocks/admin",
+			Secure:   c.Protocol() == "https",
+			HTTPOnly: true,
+			SameSite: fiber.CookieSameSiteStrictMode,
+		})
+		return c.Redirect(c.Path(), fiber.StatusSeeOther)
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Next()
+}
+
+func (a *API) adminConsole(c *fiber.Ctx) error {
+	if !strings.HasSuffix(c.Path(), "/") {
+		// the console refers to the other endpoints relatively
+		return c.Redirect(c.Path()+"/", fiber.StatusMovedPermanently)
+	}
+	c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	return c.Status(fiber.StatusOK).Send(adminPage)
+}
+
+func (a *API) adminStats(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(a.adminSnapshot(c.UserContext()))
+}
+
+// adminEvents streams snapshots as server-sent events, every adminRefreshInterval
+// until the console is closed.
+func (a *API) adminEvents(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	ctx := c.UserContext()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		ticker := time.NewTicker(adminRefreshInterval)
+		defer ticker.Stop()
+		for {
+			data, err := json.Marshal(a.adminSnapshot(ctx))
+			if err != nil {
+				return
+			}
+			w.WriteString("data: ")
+			w.Write(data)
+			w.WriteString("\n\n")
+			if w.Flush() != nil {
+				return // console closed
+			}
+			<-ticker.C
+		}
+	})
+	return nil
+}
+
+// adminSnapshot is what the admin console shows.
+type adminSnapshot struct {
+	Time              time.Time         `json:"time"`
+	QueuedOffers      int               `json:"queued_offers"`
+	DispatchedOffers  int               `json:"dispatched_offers"`
+	AnsweredOffers    int               `json:"answered_offers"`
+	OffersRegistered  uint64            `json:"offers_registered"`
+	AnswersRegistered uint64            `json:"answers_registered"`
+	AnswersEvicted    uint64            `json:"answers_evicted"`
+	Groups            []adminGroupStats `json:"groups"`
+	RecentErrors      []loggedError     `json:"recent_errors"`
+	Telemetry         []adminTelemetry  `json:"telemetry"` // empty if disabled
+}
+
+type adminTelemetry struct {
+	Transport string `json:"transport"`
+	Stage     string `json:"stage"`
+	Duration  int    `json:"duration"` // seconds, coarse
+	Count     int    `json:"count"`    // with noise
+}
+
+type adminGroupStats struct {
+	Group             string     `json:"gid"` // hex
+	QueuedOffers      int        `json:"queued_offers"`
+	DispatchedOffers  int        `json:"dispatched_offers"`
+	AnswersRegistered uint64     `json:"answers_registered"`
+	Sessions          int        `json:"sessions"`
+	LastSeen          *time.Time `json:"last_seen"` // null if never seen
+}
+
+func (a *API) adminSnapshot(ctx context.Context) *adminSnapshot {
+	var stats rtcsocks.Stats
+	if a.statsCallback != nil {
+		stats = a.statsCallback(ctx)
+	} else {
+		stats.Time = time.Now()
+	}
+
+	snapshot := &adminSnapshot{
+		Time:              stats.Time,
+		QueuedOffers:      stats.QueuedOffers,
+		DispatchedOffers:  stats.DispatchedOffers,
+		AnsweredOffers:    stats.AnsweredOffers,
+		OffersRegistered:  stats.OffersRegistered,
+		AnswersRegistered: stats.AnswersRegistered,
+		AnswersEvicted:    stats.AnswersEvicted,
+		Groups:            make([]adminGroupStats, 0, len(stats.Groups)),
+		RecentErrors:      a.recentErrors.list(),
+		Telemetry:         make([]adminTelemetry, 0, len(stats.Telemetry)),
+	}
+	for _, tc := range stats.Telemetry {
+		snapshot.Telemetry = append(snapshot.Telemetry, adminTelemetry{
+			Transport: tc.Transport,
+			Stage:     string(tc.Stage),
+			Duration:  int(tc.Duration / time.Second),
+			Count:     tc.Count,
+		})
+	}
+	for _, gs := range stats.Groups {
+		g := adminGroupStats{
+			Group:             gs.Group.String(),
+			QueuedOffers:      gs.QueuedOffers,
+			DispatchedOffers:  gs.DispatchedOffers,
+			AnswersRegistered: gs.AnswersRegistered,
+			Sessions:          gs.Sessions,
+		}
+		if !gs.LastSeen.IsZero() {
+			lastSeen := gs.LastSeen
+			g.LastSeen = &lastSeen
+		}
+		snapshot.Groups = append(snapshot.Groups, g)
+	}
+	return snapshot
+}
+
+// errorLog keeps the last errors reported by the API, for the admin console.
+type errorLog struct {
+	errors []loggedError // ring buffer
+	next   int
+	mutex  sync.Mutex
+}
+
+type loggedError struct {
+	Time      time.Time `json:"time"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Code      ErrorCode `json:"code"`
+	Reference string    `json:"reference"`
+}
+
+func newErrorLog(capacity int) *errorLog {
+	return &errorLog{errors: make([]loggedError, 0, capacity)}
+}
+
+// record logs an error. A nil *errorLog logs nothing.
+func (l *errorLog) record(e loggedError) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.errors) < cap(l.errors) {
+		l.errors = append(l.errors, e)
+		return
+	}
+	l.errors[l.next] = e
+	l.next = (l.next + 1) % len(l.errors)
+}
+
+// list returns the errors logged, most recent first.
+func (l *errorLog) list() []loggedError {
+	if l == nil {
+		return []loggedError{}
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	list := make([]loggedError, 0, len(l.errors))
+	for i := len(l.errors) - 1; i >= 0; i-- {
+		list = append(list, l.errors[(l.next+i)%len(l.errors)])
+	}
+	return list
+}
@@ -0,0 +1,98 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+)
+
+// DeclineOffer hands the offer received by this Edge Server back to the negotiator
+// for other Edge Servers, e.g. if no peer connection can be admitted for it. The
+// offer handler may return rtcsocks.ErrOfferDeclined instead.
+func (s *Server) DeclineOffer(offerID rtcsocks.OfferID) error {
+	return s.DeclineOfferContext(context.Background(), offerID)
+}
+
+// DeclineOfferContext is DeclineOffer, cancelled with ctx.
+func (s *Server) DeclineOfferContext(ctx context.Context, offerID rtcsocks.OfferID) error {
+	if s.ServerAddr == "" {
+		return ErrInvalidServerAddr
+	}
+
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/offer/decline")
+
+	session := s.Session()
+	postForm := map[string]interface{}{
+		"gid":      s.GroupID.String(), // hex string
+		"session":  session,
+		"offer_id": offerID.String(), // hex string
+	}
+	if err := s.authorize(ctx, postForm, groupRequest("offer/decline", session, offerID.String())); err != nil {
+		return err
+	}
+	if s.Logger != nil {
+		s.Logger.Debugf("Server: POST %s, form: %v", serverUrl, postForm)
+	}
+
+	seal, err := s.sealer()
+	if err != nil {
+		return err
+	}
+	_, resp, err := send(
+		ctx,
+		s.Carrier,
+		seal,
+		serverUrl,
+		postForm,
+		s.httpOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return ErrInvalidResponseFormat
+	}
+
+	if responseData.Status != "success" {
+		return responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+
+	s.mutexOffers.Lock()
+	delete(s.offers, offerID)
+	s.mutexOffers.Unlock()
+	return nil
+}
+
+// waitAfterDecline is how long the Server waits before polling again while it
+// declines offers, as long as when there is none.
+func (s *Server) waitAfterDecline() time.Duration {
+	if s.WaitAfterPending > 0 {
+		return s.WaitAfterPending
+	}
+	return defaultWaitAfterPending
+}
+
+// declineOffer declines an offer refused by the offer handler.
+func (s *Server) declineOffer(offerID rtcsocks.OfferID) {
+	err := s.DeclineOfferContext(s.pollContext(), offerID)
+	if s.Logger == nil {
+		return
+	}
+	if err != nil {
+		// the offer stays dispatched to this Edge Server until the client gives up
+		s.Logger.Errorf("Server: failed to decline offer %s: %v", offerID, err)
+	} else {
+		s.Logger.Debugf("Server: offer %s declined", offerID)
+	}
+}
@@ -1,58 +1,210 @@
 package http
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
-	"fmt"
+	"encoding/json"
+	"net"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
+	"github.com/gaukas/rtcsocks/envelope"
 	"github.com/gofiber/fiber/v2"
 )
 
 type API struct {
 	fiberApp *fiber.App
 
-	userpass    map[uint64]string // userpass[uid] = password
-	groupSecret map[uint64]string // groupSecret[gid] = secret
+	credentials    rtcsocks.CredentialStore
+	authSchemes    *auth.Registry
+	pake           *pakeStore
+	challenges     *challengeStore
+	delegation     *delegation
+	lookupGuard    *lookupGuard
+	offerTokenKey  []byte
+	pollTokenKey   []byte // empty -> poll sessions disabled, see SetPollSessions
+	pollTokenTTL   time.Duration
+	sdpValidation  rtcsocks.SDPValidation
+	geoPolicy      *GeoPolicy // nil -> requests admitted regardless of their address
+	proxyHeader    string     // carries the remote address, empty -> from the connection
+	trustedProxies []string   // allowed to set proxyHeader
+
+	requestTimeout    time.Duration         // deadline of the callback context, 0 -> none
+	challengeRequired bool                  // see SetChallengeRequired
+	powBits           int                   // proof of work required for offers, 0 -> none
+	debugErrors       bool                  // see SetDebugErrors
+	logger            rtcsocks.Logger       // nil -> nothing is logged
+	crashHandler      func(*rtcsocks.Crash) // see SetCrashHandler, nil -> crashes are only logged
+	carriers          map[Carrier]bool      // accepted in addition to CarrierJSON
+	compression       bool                  // see SetCompression
+
+	registerOfferCallback        rtcsocks.RegisterOfferCallbackFunction
+	nextOfferCallback            rtcsocks.NextOfferCallbackFunction
+	registerAnswerCallback       rtcsocks.RegisterAnswerCallbackFunction
+	lookupAnswerCallback         rtcsocks.LookupAnswerCallbackFunction
+	heartbeatCallback            rtcsocks.HeartbeatCallbackFunction
+	registerMailboxOfferCallback rtcsocks.RegisterOfferCallbackFunction
+	collectAnswersCallback       rtcsocks.CollectAnswersCallbackFunction
+	deregisterCallback           rtcsocks.DeregisterCallbackFunction
+	declineOfferCallback         rtcsocks.DeclineOfferCallbackFunction
+	waitAnswerCallback           rtcsocks.WaitAnswerCallbackFunction
+	telemetryCallback            rtcsocks.TelemetryCallbackFunction
+
+	replicaSecret       string // shared by all replicas, empty -> replication disabled
+	replicationCallback rtcsocks.ReplicationCallbackFunction
+	replicas            *replicaWindow
+
+	accessBundle atomic.Value // string, see SetAccessBundle
+
+	adminToken    string    // empty -> admin console disabled
+	recentErrors  *errorLog // nil if the admin console is disabled
+	statsCallback rtcsocks.StatsCallbackFunction
+}
+
+func NewAPI(userpass map[rtcsocks.UserID]string, groupSecret map[rtcsocks.GroupID]string) *API {
+	if userpass == nil {
+		userpass = make(map[rtcsocks.UserID]string)
+	}
 
-	registerOfferCallback  rtcsocks.RegisterOfferCallbackFunction
-	nextOfferCallback      rtcsocks.NextOfferCallbackFunction
-	registerAnswerCallback rtcsocks.RegisterAnswerCallbackFunction
-	lookupAnswerCallback   rtcsocks.LookupAnswerCallbackFunction
+	if groupSecret == nil {
+		groupSecret = make(map[rtcsocks.GroupID]string)
+	}
+
+	return NewAPIWithCredentialStore(&rtcsocks.MapCredentialStore{
+		Users:  userpass,
+		Groups: groupSecret,
+	})
 }
 
-func NewAPI(userpass, groupSecret map[uint64]string) *API {
+// NewAPIWithCredentialStore creates an API authenticating users and groups against
+// the specified CredentialStore.
+func NewAPIWithCredentialStore(credentials rtcsocks.CredentialStore) *API {
 	return &API{
-		userpass:    userpass,
-		groupSecret: groupSecret,
+		credentials: credentials,
+		authSchemes: auth.Default,
+		pake:        newPAKEStore(),
+		challenges:  newChallengeStore(),
+		delegation:  newDelegation(),
+		lookupGuard: newLookupGuard(),
+		replicas:    newReplicaWindow(),
 	}
 }
 
+// SetAuthSchemes sets the schemes accepted to authenticate users, defaults to auth.Default.
+func (a *API) SetAuthSchemes(r *auth.Registry) {
+	a.authSchemes = r
+}
+
+// SetLogger sets the Logger for the requests failing, at LogLevelDebug for errors
+// reported to the caller and LogLevelError for internal errors.
+func (a *API) SetLogger(logger rtcsocks.Logger) {
+	a.logger = logger
+}
+
+// SetCrashHandler sets a function called with the panics recovered in the request
+// handlers and callback functions, e.g. to alert. They are logged at LogLevelError
+// regardless, and the request fails with 500 Internal Server Error.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetCrashHandler(f func(*rtcsocks.Crash)) {
+	a.crashHandler = f
+}
+
 func (a *API) Listen(addr string) error {
+	a.setup()
+	return a.fiberApp.Listen(addr)
+}
+
+// Serve serves the API on a listener created by the caller, e.g. one passed by systemd
+// socket activation, see the systemd package. It is an alternative to Listen.
+func (a *API) Serve(ln net.Listener) error {
+	a.setup()
+	return a.fiberApp.Listener(ln)
+}
+
+// Shutdown stops serving the API: it closes the listener and waits for the requests
+// in progress to finish until the deadline of ctx, if any. Listen or Serve returns
+// once it is called.
+func (a *API) Shutdown(ctx context.Context) error {
 	if a.fiberApp == nil {
-		a.fiberApp = fiber.New()
+		return nil // never served
 	}
-
-	if a.userpass == nil {
-		a.userpass = make(map[uint64]string)
+	if deadline, ok := ctx.Deadline(); ok {
+		return a.fiberApp.ShutdownWithTimeout(time.Until(deadline))
 	}
+	return a.fiberApp.Shutdown()
+}
+
+// recoverPanic fails the requests whose handler panicked, without telling why.
+func (a *API) recoverPanic(c *fiber.Ctx) (err error) {
+	defer rtcsocks.Recover("API: "+c.Path(), a.logger, func(crash *rtcsocks.Crash) {
+		if a.crashHandler != nil {
+			a.crashHandler(crash)
+		}
+		err = a.sendError(c, fiber.StatusInternalServerError, ErrHandlerPanic)
+	})
+	return c.Next()
+}
+
+// setup creates the fiber app and registers the routes.
+func (a *API) setup() {
+	if a.fiberApp == nil {
+		config := fiber.Config{
+			Network:     fiber.NetworkTCP, // dual-stack, fiber defaults to IPv4 only
+			ProxyHeader: a.proxyHeader,
 
-	if a.groupSecret == nil {
-		a.groupSecret = make(map[uint64]string)
+			// c.IP() takes the raw header, see remoteIP
+			EnableTrustedProxyCheck: true,
+			TrustedProxies:          a.trustedProxies,
+		}
+		if a.sdpValidation.MaxSize > 0 {
+			// base64-encoded SDP plus room for the other fields
+			config.BodyLimit = base64.StdEncoding.EncodedLen(a.sdpValidation.MaxSize) + maxFormOverhead
+			// or the same, sealed in an envelope
+			config.BodyLimit = base64.StdEncoding.EncodedLen(envelope.SealedSize(config.BodyLimit)) + maxFormOverhead
+		}
+		a.fiberApp = fiber.New(config)
 	}
 
-	rtcsocks := a.fiberApp.Group("/rtcsocks")
+	a.fiberApp.Use(a.recoverPanic)
+	a.routeCompression(a.fiberApp)
+	rtcsocks := a.fiberApp.Group("/rtcsocks", a.sealResponse, a.bindResponse)
 	offer := rtcsocks.Group("/offer")
-	offer.Post("/new", a.registerOffer)
-	offer.Post("/next", a.nextOffer)
+	a.route(offer, "/new", a.registerOffer)
+	a.route(offer, "/next", a.nextOffer)
+	a.route(offer, "/decline", a.declineOffer)
 
 	answer := rtcsocks.Group("/answer")
-	answer.Post("/new", a.registerAnswer)
-	answer.Post("/lookup", a.lookupAnswer)
+	a.route(answer, "/new", a.registerAnswer)
+	a.route(answer, "/lookup", a.lookupAnswer)
 
-	return a.fiberApp.Listen(addr)
+	server := rtcsocks.Group("/server")
+	a.route(server, "/heartbeat", a.heartbeat)
+	a.route(server, "/deregister", a.deregister)
+
+	a.route(rtcsocks, "/auth/challenge", a.issueChallenge)
+
+	pake := rtcsocks.Group("/auth/pake")
+	a.route(pake, "/init", a.pakeInit)
+	a.route(pake, "/verify", a.pakeVerify)
+
+	mailbox := rtcsocks.Group("/mailbox")
+	a.route(mailbox, "/new", a.registerMailboxOffer)
+	a.route(mailbox, "/collect", a.collectAnswers)
+
+	a.route(rtcsocks, "/telemetry/report", a.reportRendezvous)
+	a.route(rtcsocks, "/bundle/latest", a.latestBundle)
+
+	replica := rtcsocks.Group("/replica")
+	replica.Post("/event", a.replicaEvent)
+
+	a.routeAdmin(rtcsocks)
 }
 
 func (a *API) SetRegisterOfferCallback(f rtcsocks.RegisterOfferCallbackFunction) {
@@ -71,19 +223,60 @@ func (a *API) SetLookupAnswerCallback(f rtcsocks.LookupAnswerCallbackFunction) {
 	a.lookupAnswerCallback = f
 }
 
+// SetSDPValidation sets the checks performed on offers and answers before they are
+// passed to the Negotiator. It also limits the request body size if MaxSize is set.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetSDPValidation(v rtcsocks.SDPValidation) {
+	a.sdpValidation = v
+}
+
+func (a *API) SetHeartbeatCallback(f rtcsocks.HeartbeatCallbackFunction) {
+	a.heartbeatCallback = f
+}
+
+func (a *API) SetDeregisterCallback(f rtcsocks.DeregisterCallbackFunction) {
+	a.deregisterCallback = f
+}
+
+func (a *API) SetDeclineOfferCallback(f rtcsocks.DeclineOfferCallbackFunction) {
+	a.declineOfferCallback = f
+}
+
+func (a *API) SetReplicationCallback(f rtcsocks.ReplicationCallbackFunction) {
+	a.replicationCallback = f
+}
+
+// SetReplicaSecret enables receiving ReplicationEvents from peer replicas, which
+// MUST be configured with the same secret in their Replicator.
+func (a *API) SetReplicaSecret(secret string) {
+	a.replicaSecret = secret
+}
+
 func (a *API) registerOffer(c *fiber.Ctx) error {
+	return a.handleOffer(c, a.registerOfferCallback, true)
+}
+
+// handleOffer authenticates an offer and registers it with the callback. If push is
+// set, the answer is included in the response if registered within the wait requested.
+func (a *API) handleOffer(c *fiber.Ctx, register rtcsocks.RegisterOfferCallbackFunction, push bool) error {
 	var postForm struct {
-		SDP    string   `json:"offer"` // Offer SDP body, base64
-		HMAC   string   `json:"hmac"`  // HMAC, base64
-		UID    string   `json:"uid"`   // User ID, hex
-		Groups []uint64 `json:"gid"`   // Group ID, int array
+		SDP    string             `json:"offer" validate:"required,base64"` // Offer SDP body, base64
+		HMAC   string             `json:"hmac" validate:"base64"`           // HMAC or signature, base64
+		Scheme string             `json:"scheme"`                           // authentication scheme, empty -> auth.DefaultScheme
+		PAKE   string             `json:"pake_session"`                     // PAKE session ID, if Scheme is PAKEScheme
+		Chal   string             `json:"challenge" validate:"base64"`      // challenge included in the HMAC, optional
+		UID    string             `json:"uid" validate:"required,id"`       // User ID, hex
+		Groups []rtcsocks.GroupID `json:"gid" validate:"max=64"`            // Group ID, int array
+		Wait   string             `json:"wait" validate:"decimal"`          // seconds to wait for the answer, decimal, optional
+		PoW    string             `json:"pow" validate:"max=16"`            // proof of work nonce for the challenge, if required
 	}
 
-	if err := c.BodyParser(&postForm); err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
 	}
 
-	uid, err := strconv.ParseUint(postForm.UID, 16, 64)
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
@@ -93,92 +286,144 @@ func (a *API) registerOffer(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
+	if err := a.sdpValidation.Validate(offer); err != nil {
+		return a.sendError(c, fiber.StatusBadRequest, err)
+	}
+
 	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	if !a.verifyHMAC(uid, offer, hmac) {
+	if !a.checkProofOfWork(postForm.Chal, postForm.PoW) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !a.verifyAuth(uid, postForm.Scheme, postForm.PAKE, postForm.Chal, offer, hmac) {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	offerID, err := a.registerOfferCallback(uid, offer, postForm.Groups...)
+	groups := admitGroups(c, postForm.Groups)
+	if len(groups) == 0 && len(postForm.Groups) > 0 {
+		return a.sendError(c, fiber.StatusBadRequest, rtcsocks.ErrBadGroupID) // none for this region
+	}
+
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	offerID, err := register(ctx, uid, offer, groups...)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":    "error",
-			"reference": err.Error(),
-		})
+		return a.sendError(c, fiber.StatusInternalServerError, err)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+	resp := fiber.Map{
 		"status":   "success",
-		"offer_id": fmt.Sprintf("%x", offerID),
-	})
+		"offer_id": offerID.String(),
+	}
+	if len(a.offerTokenKey) > 0 {
+		resp["offer_token"] = a.offerToken(uid, offerID)
+	}
+	if push {
+		if answer, ok := a.waitAnswer(ctx, uid, offerID, postForm.Wait); ok {
+			resp["answer"] = base64.StdEncoding.EncodeToString(answer)
+		}
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
 }
 
 func (a *API) nextOffer(c *fiber.Ctx) error {
 	var postForm struct {
-		GID    string `json:"gid"`    // Group ID, hex
-		Secret string `json:"secret"` // Group Secret, plaintext
+		GID     string `json:"gid" validate:"required,id"`   // Group ID, hex
+		Secret  string `json:"secret"`                       // Group Secret, plaintext
+		Token   string `json:"token"`                        // Delegation token, in place of the Group Secret
+		Chal    string `json:"challenge" validate:"base64"`  // challenge, in place of the Group Secret
+		HMAC    string `json:"hmac" validate:"base64"`       // HMAC of the request with the challenge, base64
+		Session string `json:"session" validate:"max=64"`    // Session ID, optional
+		Poll    string `json:"poll_token" validate:"max=64"` // poll token of the session, in place of the Group Secret
 	}
 
-	if err := c.BodyParser(&postForm); err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
 	}
 
-	gid, err := strconv.ParseUint(postForm.GID, 16, 64)
+	gid, err := rtcsocks.ParseGroupID(postForm.GID)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	if secret, ok := a.groupSecret[gid]; !ok || secret != postForm.Secret {
+	var token *rtcsocks.DelegationToken
+	pollToken := ""
+	if postForm.Poll != "" {
+		if !a.verifyPollToken(gid, postForm.Session, postForm.Poll) {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+	} else {
+		var ok bool
+		token, ok = a.authorizeGroup(gid, postForm.Secret, postForm.Token, postForm.Chal, postForm.HMAC, groupRequest("offer/next", postForm.Session))
+		if !ok {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		if token == nil {
+			pollToken = a.pollToken(gid, postForm.Session)
+		}
+	}
+
+	if len(postForm.Session) > maxSessionIDLen {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	offerID, offer, err := a.nextOfferCallback(gid)
+	if !a.delegation.reserve(token) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"status": "pending",
+		})
+	}
+
+	ctx, cancel := a.requestContext(c, postForm.Session)
+	defer cancel()
+	offerID, offer, err := a.nextOfferCallback(ctx, gid, postForm.Session)
 	if err != nil {
+		a.delegation.release(token)
 		if err == rtcsocks.ErrNoOfferAvailable {
-			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			return c.Status(fiber.StatusNotFound).JSON(a.addPollToken(fiber.Map{
 				"status": "pending",
-			})
+			}, pollToken))
 		}
 
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":    "error",
-			"reference": err.Error(),
-		})
+		return a.sendError(c, fiber.StatusInternalServerError, err)
 	}
 
-	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+	return c.Status(fiber.StatusOK).JSON(a.addPollToken(fiber.Map{
 		"status":   "success",
-		"offer_id": fmt.Sprintf("%x", offerID),
+		"offer_id": offerID.String(),
 		"offer":    base64.StdEncoding.EncodeToString(offer),
-	})
+	}, pollToken))
 }
 
 func (a *API) registerAnswer(c *fiber.Ctx) error {
 	var postForm struct {
-		GID     string `json:"gid"` // Group ID, hex
+		GID     string `json:"gid" validate:"required,id"` // Group ID, hex
 		Secret  string `json:"secret"`
-		OfferID string `json:"offer_id"` // Offer ID, hex
-		SDP     string `json:"answer"`   // Answer SDP body, base64
+		Token   string `json:"token"`                             // Delegation token, in place of the Group Secret
+		Chal    string `json:"challenge" validate:"base64"`       // challenge, in place of the Group Secret
+		HMAC    string `json:"hmac" validate:"base64"`            // HMAC of the request with the challenge, base64
+		OfferID string `json:"offer_id" validate:"required,id"`   // Offer ID, hex
+		SDP     string `json:"answer" validate:"required,base64"` // Answer SDP body, base64
 	}
 
-	if err := c.BodyParser(&postForm); err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
 	}
 
-	gid, err := strconv.ParseUint(postForm.GID, 16, 64)
+	gid, err := rtcsocks.ParseGroupID(postForm.GID)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
 	// Authenticate the server per group
-	if secret, ok := a.groupSecret[gid]; !ok || secret != postForm.Secret {
+	if _, ok := a.authorizeGroup(gid, postForm.Secret, postForm.Token, postForm.Chal, postForm.HMAC, groupRequest("answer/new", postForm.OfferID, postForm.SDP)); !ok {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	offerID, err := strconv.ParseUint(postForm.OfferID, 16, 64)
+	offerID, err := rtcsocks.ParseOfferID(postForm.OfferID)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
@@ -188,11 +433,14 @@ func (a *API) registerAnswer(c *fiber.Ctx) error {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	if err := a.registerAnswerCallback(offerID, answer); err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"status":    "error",
-			"reference": err.Error(),
-		})
+	if err := a.sdpValidation.Validate(answer); err != nil {
+		return a.sendError(c, fiber.StatusBadRequest, err)
+	}
+
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	if err := a.registerAnswerCallback(ctx, offerID, answer); err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
 	}
 
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
@@ -202,45 +450,67 @@ func (a *API) registerAnswer(c *fiber.Ctx) error {
 
 func (a *API) lookupAnswer(c *fiber.Ctx) error {
 	var postForm struct {
-		OfferID string `json:"offer_id"` // Offer ID, hex
-		UID     string `json:"uid"`      // User ID, hex
-		HMAC    string `json:"hmac"`     // HMAC, base64
+		OfferID string `json:"offer_id" validate:"required,hex,max=32"` // Offer ID or token, hex
+		UID     string `json:"uid" validate:"required,id"`              // User ID, hex
+		HMAC    string `json:"hmac" validate:"base64"`                  // HMAC or signature, base64
+		Scheme  string `json:"scheme"`                                  // authentication scheme, empty -> auth.DefaultScheme
+		PAKE    string `json:"pake_session"`                            // PAKE session ID, if Scheme is PAKEScheme
+		Chal    string `json:"challenge" validate:"base64"`             // challenge included in the HMAC, optional
 	}
 
-	if err := c.BodyParser(&postForm); err != nil {
-		return c.SendStatus(fiber.StatusNotFound)
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
 	}
 
-	offerID, err := strconv.ParseUint(postForm.OfferID, 16, 64)
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	uid, err := strconv.ParseUint(postForm.UID, 16, 64)
+	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
 	if err != nil {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
-	if err != nil {
+	if !a.verifyAuth(uid, postForm.Scheme, postForm.PAKE, postForm.Chal, []byte(postForm.OfferID), hmac) {
 		return c.SendStatus(fiber.StatusNotFound)
 	}
 
-	if !a.verifyHMAC(uid, []byte(postForm.OfferID), hmac) {
-		return c.SendStatus(fiber.StatusNotFound)
+	if wait := a.lookupGuard.blocked(uid); wait > 0 {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(wait.Seconds())+1))
+		return a.sendError(c, fiber.StatusTooManyRequests, ErrRateLimited)
 	}
 
-	answer, err := a.lookupAnswerCallback(offerID, uid)
+	offerID, ok := a.parseOfferID(uid, postForm.OfferID)
+	if !ok {
+		a.lookupGuard.fail(uid)
+		return a.sendError(c, fiber.StatusNotFound, rtcsocks.ErrInvalidOfferID)
+	}
+
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	answer, err := a.lookupAnswerCallback(ctx, uid, offerID)
+	if err == rtcsocks.ErrInvalidOfferID || err == rtcsocks.ErrNoAccess {
+		// do not tell offers of other users from nonexistent ones
+		a.lookupGuard.fail(uid)
+		return a.sendError(c, fiber.StatusNotFound, rtcsocks.ErrInvalidOfferID)
+	}
+	a.lookupGuard.succeed(uid)
 	if err != nil {
 		if err == rtcsocks.ErrAnswerPending {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"status": "pending",
 			})
-		} else {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"status":    "error",
-				"reference": err.Error(),
+		} else if err == rtcsocks.ErrServerSilent {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status": "retry",
 			})
+		} else if err == rtcsocks.ErrOfferExpired {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"status": "expired",
+			})
+		} else {
+			return a.sendError(c, fiber.StatusInternalServerError, err)
 		}
 	}
 
@@ -250,20 +520,243 @@ func (a *API) lookupAnswer(c *fiber.Ctx) error {
 	})
 }
 
-// constant-time verification of HMAC
-func (a *API) verifyHMAC(uid uint64, offer []byte, mac []byte) bool {
-	secret, ok := a.userpass[uid]
-	if !ok {
+func (a *API) heartbeat(c *fiber.Ctx) error {
+	var postForm struct {
+		GID          string   `json:"gid" validate:"required,id"`     // Group ID, hex
+		Secret       string   `json:"secret"`                         // Group Secret, plaintext
+		Token        string   `json:"token"`                          // Delegation token, in place of the Group Secret
+		Chal         string   `json:"challenge" validate:"base64"`    // challenge, in place of the Group Secret
+		HMAC         string   `json:"hmac" validate:"base64"`         // HMAC of the request with the challenge, base64
+		Session      string   `json:"session" validate:"max=64"`      // Session ID
+		Capabilities []string `json:"capabilities" validate:"max=64"` // Edge Server capabilities, string array
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	gid, err := rtcsocks.ParseGroupID(postForm.GID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if _, ok := a.authorizeGroup(gid, postForm.Secret, postForm.Token, postForm.Chal, postForm.HMAC, groupRequest("server/heartbeat", append([]string{postForm.Session}, postForm.Capabilities...)...)); !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if postForm.Session == "" || len(postForm.Session) > maxSessionIDLen {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ctx, cancel := a.requestContext(c, postForm.Session)
+	defer cancel()
+	if err := a.heartbeatCallback(ctx, gid, postForm.Session, postForm.Capabilities); err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func (a *API) deregister(c *fiber.Ctx) error {
+	var postForm struct {
+		GID     string `json:"gid" validate:"required,id"`  // Group ID, hex
+		Secret  string `json:"secret"`                      // Group Secret, plaintext
+		Token   string `json:"token"`                       // Delegation token, in place of the Group Secret
+		Chal    string `json:"challenge" validate:"base64"` // challenge, in place of the Group Secret
+		HMAC    string `json:"hmac" validate:"base64"`      // HMAC of the request with the challenge, base64
+		Session string `json:"session" validate:"max=64"`   // Session ID
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	gid, err := rtcsocks.ParseGroupID(postForm.GID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if _, ok := a.authorizeGroup(gid, postForm.Secret, postForm.Token, postForm.Chal, postForm.HMAC, groupRequest("server/deregister", postForm.Session)); !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if postForm.Session == "" || len(postForm.Session) > maxSessionIDLen {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ctx, cancel := a.requestContext(c, postForm.Session)
+	defer cancel()
+	if err := a.deregisterCallback(ctx, gid, postForm.Session); err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func (a *API) declineOffer(c *fiber.Ctx) error {
+	if a.declineOfferCallback == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	var postForm struct {
+		GID     string `json:"gid" validate:"required,id"`      // Group ID, hex
+		Secret  string `json:"secret"`                          // Group Secret, plaintext
+		Token   string `json:"token"`                           // Delegation token, in place of the Group Secret
+		Chal    string `json:"challenge" validate:"base64"`     // challenge, in place of the Group Secret
+		HMAC    string `json:"hmac" validate:"base64"`          // HMAC of the request with the challenge, base64
+		Session string `json:"session" validate:"max=64"`       // Session ID
+		OfferID string `json:"offer_id" validate:"required,id"` // Offer ID, hex
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	gid, err := rtcsocks.ParseGroupID(postForm.GID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if _, ok := a.authorizeGroup(gid, postForm.Secret, postForm.Token, postForm.Chal, postForm.HMAC, groupRequest("offer/decline", postForm.Session, postForm.OfferID)); !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if postForm.Session == "" || len(postForm.Session) > maxSessionIDLen {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	offerID, err := rtcsocks.ParseOfferID(postForm.OfferID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ctx, cancel := a.requestContext(c, postForm.Session)
+	defer cancel()
+	if err := a.declineOfferCallback(ctx, gid, postForm.Session, offerID); err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+func (a *API) replicaEvent(c *fiber.Ctx) error {
+	if a.replicaSecret == "" || a.replicationCallback == nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	var postForm struct {
+		Event  string `json:"event"`  // JSON-encoded rtcsocks.ReplicationEvent
+		Sender string `json:"sender"` // ID of the Replicator
+		Seq    string `json:"seq"`    // sequence number of the event from the sender, decimal
+		TS     string `json:"ts"`     // time the event is sent at, Unix milliseconds
+		HMAC   string `json:"hmac"`   // HMAC of the event with sender, seq and ts, base64
+	}
+
+	if err := c.BodyParser(&postForm); err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	mac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	seq, err := strconv.ParseUint(postForm.Seq, 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	ts, err := strconv.ParseInt(postForm.TS, 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !hmac.Equal(replicaMAC(a.replicaSecret, postForm.Sender, seq, ts, []byte(postForm.Event)), mac) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	var event rtcsocks.ReplicationEvent
+	if err := json.Unmarshal([]byte(postForm.Event), &event); err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	if err := a.replicas.apply(postForm.Sender, seq, time.UnixMilli(ts), func() error {
+		return a.replicationCallback(ctx, event)
+	}); err == rtcsocks.ErrBadReplicationEvent {
+		return a.sendError(c, fiber.StatusBadRequest, err)
+	} else if err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// verifyAuth verifies the HMAC or signature of the user with the requested scheme.
+// With PAKEScheme, the HMAC-SHA256 is keyed by the key of the PAKE session. With a
+// challenge, the message authenticated is prefixed with it, see challengeMessage.
+//
+// Unknown users and sessions are verified against a dummy secret so that they are
+// indistinguishable by timing from known ones.
+func (a *API) verifyAuth(uid rtcsocks.UserID, scheme, pakeSession, challenge string, msg []byte, mac []byte) bool {
+	if challenge != "" {
+		msg = challengeMessage(challenge, msg)
+	}
+	// consumed once verified only, a forged request must not burn the challenge
+	return a.verifyUserMAC(uid, scheme, pakeSession, msg, mac) && a.checkChallenge(kidUserPrefix+uid.String(), challenge)
+}
+
+func (a *API) verifyUserMAC(uid rtcsocks.UserID, scheme, pakeSession string, msg []byte, mac []byte) bool {
+	if scheme == PAKEScheme {
+		key, known := a.pake.sessionKey(uid, pakeSession)
+		if !known {
+			key = a.pake.fakeKey
+		}
+		h := hmac.New(sha256.New, key)
+		h.Write(msg)
+		return hmac.Equal(h.Sum(nil), mac) && known
+	}
+
+	authScheme, err := a.authSchemes.Get(scheme)
+	if err != nil {
 		return false
 	}
 
-	h := hmac.New(sha256.New, []byte(secret))
-	// Write Data to it
-	h.Write([]byte(offer))
+	secret, err := a.credentials.UserSecret(uid)
+	known := err == nil
+	if !known {
+		secret = auth.DummySecret(authScheme.Name())
+	}
 
-	if !ok {
-		return hmac.Equal([]byte{0x00}, mac)
+	return authScheme.Verify(secret, msg, mac) && known
+}
+
+// authorizeGroup authenticates an Edge Server of the group with either the group
+// secret, the MAC of the request with a challenge or a delegation token, returning
+// the token if one is used.
+func (a *API) authorizeGroup(gid rtcsocks.GroupID, secret, token, challenge, mac string, request []byte) (*rtcsocks.DelegationToken, bool) {
+	if token != "" {
+		return a.delegation.verify(gid, token)
 	}
+	if challenge != "" || a.challengeRequired {
+		// consumed once verified only, a forged request must not burn the challenge
+		return nil, a.verifyGroupMAC(gid, challenge, mac, request) && a.checkChallenge(kidGroupPrefix+gid.String(), challenge)
+	}
+	return nil, a.verifyGroupSecret(gid, secret)
+}
 
-	return hmac.Equal(h.Sum(nil), mac)
+func (a *API) verifyGroupSecret(gid rtcsocks.GroupID, secret string) bool {
+	groupSecret, err := a.credentials.GroupSecret(gid)
+	known := err == nil
+	if !known {
+		groupSecret = secret
+	}
+	return subtle.ConstantTimeCompare([]byte(groupSecret), []byte(secret)) == 1 && known
 }
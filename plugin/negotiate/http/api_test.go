@@ -0,0 +1,153 @@
+package http
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
+)
+
+func TestVerifyAuth(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api := NewAPI(map[rtcsocks.UserID]string{
+		1: "password",
+		2: auth.Ed25519Secret(pub),
+	}, nil)
+	msg := []byte("v=0\r\noffer")
+
+	sign := func(scheme auth.Scheme, credential []byte) []byte {
+		mac, err := scheme.Sign(credential, msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mac
+	}
+	hmacMAC := sign(auth.HMACSHA256{}, []byte("password"))
+	blake3MAC := sign(auth.BLAKE3{}, []byte("password"))
+	ed25519Sig := sign(auth.Ed25519{}, priv)
+
+	for _, tc := range []struct {
+		name   string
+		uid    rtcsocks.UserID
+		scheme string
+		mac    []byte
+		want   bool
+	}{
+		{"default scheme", 1, "", hmacMAC, true},
+		{"hmac-sha256", 1, "hmac-sha256", hmacMAC, true},
+		{"blake3", 1, "blake3", blake3MAC, true},
+		{"ed25519", 2, "ed25519", ed25519Sig, true},
+		{"wrong scheme", 1, "blake3", hmacMAC, false},
+		{"unknown scheme", 1, "md5", hmacMAC, false},
+		{"wrong MAC", 1, "hmac-sha256", blake3MAC, false},
+		{"empty MAC", 1, "hmac-sha256", nil, false},
+		{"password of a public key", 2, "hmac-sha256", sign(auth.HMACSHA256{}, []byte(auth.Ed25519Secret(pub))), false},
+		{"unknown uid hmac-sha256", 3, "hmac-sha256", hmacMAC, false},
+		{"unknown uid blake3", 3, "blake3", blake3MAC, false},
+		{"unknown uid ed25519", 3, "ed25519", ed25519Sig, false},
+		{"unknown uid unknown scheme", 3, "md5", hmacMAC, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.verifyAuth(tc.uid, tc.scheme, "", "", msg, tc.mac); got != tc.want {
+				t.Errorf("verifyAuth() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyAuthPAKE(t *testing.T) {
+	api := NewAPI(map[rtcsocks.UserID]string{1: "password", 2: "other"}, nil)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	api.pake.sessions.add("session", "u:1", "192.0.2.1", time.Now().Add(time.Minute), &pakeSession{uid: 1, key: key})
+	api.pake.sessions.add("expired", "u:1", "192.0.2.1", time.Now().Add(-time.Second), &pakeSession{uid: 1, key: key})
+	msg := []byte("v=0\r\noffer")
+
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	mac := h.Sum(nil)
+	fake := hmac.New(sha256.New, api.pake.fakeKey)
+	fake.Write(msg)
+	fakeMAC := fake.Sum(nil)
+
+	for _, tc := range []struct {
+		name    string
+		uid     rtcsocks.UserID
+		session string
+		mac     []byte
+		want    bool
+	}{
+		{"known session", 1, "session", mac, true},
+		{"wrong MAC", 1, "session", fakeMAC, false},
+		{"session of another uid", 2, "session", mac, false},
+		{"unknown uid", 3, "session", mac, false},
+		{"expired session", 1, "expired", mac, false},
+		{"unknown session", 1, "unknown", mac, false},
+		{"unknown session with the fake key", 1, "unknown", fakeMAC, false},
+		{"no session", 1, "", fakeMAC, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.verifyAuth(tc.uid, PAKEScheme, tc.session, "", msg, tc.mac); got != tc.want {
+				t.Errorf("verifyAuth() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestVerifyAuthChallenge(t *testing.T) {
+	api := NewAPI(map[rtcsocks.UserID]string{1: "password"}, nil)
+	msg := []byte("v=0\r\noffer")
+	challenge, ok := api.challenges.issue(kidUserPrefix+rtcsocks.UserID(1).String(), "192.0.2.1")
+	if !ok {
+		t.Fatal("challenge not issued")
+	}
+	mac, _ := auth.HMACSHA256{}.Sign([]byte("password"), challengeMessage(challenge, msg))
+
+	if api.verifyAuth(1, "", "", challenge, msg, []byte("forged")) {
+		t.Fatal("forged MAC accepted")
+	}
+	if !api.verifyAuth(1, "", "", challenge, msg, mac) {
+		t.Fatal("challenge burnt by the forged request")
+	}
+	if api.verifyAuth(1, "", "", challenge, msg, mac) {
+		t.Fatal("challenge reused")
+	}
+	if api.verifyAuth(1, "", "", "", msg, mac) {
+		t.Fatal("challenge MAC accepted without the challenge")
+	}
+
+	api.SetChallengeRequired(true)
+	plain, _ := auth.HMACSHA256{}.Sign([]byte("password"), msg)
+	if api.verifyAuth(1, "", "", "", msg, plain) {
+		t.Fatal("required challenge missing")
+	}
+}
+
+func TestVerifyGroupSecret(t *testing.T) {
+	api := NewAPI(nil, map[rtcsocks.GroupID]string{1: "secret"})
+	for _, tc := range []struct {
+		name   string
+		gid    rtcsocks.GroupID
+		secret string
+		want   bool
+	}{
+		{"known group", 1, "secret", true},
+		{"wrong secret", 1, "secret2", false},
+		{"prefix of the secret", 1, "secre", false},
+		{"empty secret", 1, "", false},
+		{"unknown group", 2, "secret", false},
+		{"unknown group empty secret", 2, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := api.verifyGroupSecret(tc.gid, tc.secret); got != tc.want {
+				t.Errorf("verifyGroupSecret() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetAccessBundle sets the access bundle served to authenticated users, who keep
+// their configuration up to date with it, see package bundle. It MAY be called at
+// any time, e.g. when a blocked domain is rotated. Empty -> none is served.
+func (a *API) SetAccessBundle(sealed string) {
+	a.accessBundle.Store(sealed)
+}
+
+// latestBundle serves the access bundle to an authenticated user.
+func (a *API) latestBundle(c *fiber.Ctx) error {
+	var postForm struct {
+		UID       string `json:"uid" validate:"required,id"`     // User ID, hex
+		Timestamp string `json:"ts" validate:"required,decimal"` // Unix time in seconds, decimal
+		HMAC      string `json:"hmac" validate:"base64"`         // HMAC or signature of "bundle:" and the timestamp, base64
+		Scheme    string `json:"scheme"`                         // authentication scheme, empty -> auth.DefaultScheme
+		PAKE      string `json:"pake_session"`                   // PAKE session ID, if Scheme is PAKEScheme
+		Chal      string `json:"challenge" validate:"base64"`    // challenge included in the HMAC, optional
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ts, err := strconv.ParseInt(postForm.Timestamp, 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxCollectSkew || skew < -maxCollectSkew {
+		return c.SendStatus(fiber.StatusNotFound) // limits replay of the request
+	}
+
+	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !a.verifyAuth(uid, postForm.Scheme, postForm.PAKE, postForm.Chal, []byte("bundle:"+postForm.Timestamp), hmac) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	sealed, _ := a.accessBundle.Load().(string)
+	if sealed == "" {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+		"bundle": sealed,
+	})
+}
+
+// FetchAccessBundle fetches the access bundle served by the negotiator, still sealed,
+// see API.SetAccessBundle. It is verified by the caller, see bundle.Open.
+func (c *Client) FetchAccessBundle() (string, error) {
+	if c.ServerAddr == "" {
+		return "", ErrInvalidServerAddr
+	}
+
+	ctx := context.Background()
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/bundle/latest")
+
+	uid, err := c.userID()
+	if err != nil {
+		return "", err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	postForm := map[string]interface{}{
+		"uid": uid.String(), // hex string
+		"ts":  ts,
+	}
+	if err := c.authenticate(ctx, postForm, uid, []byte("bundle:"+ts), false); err != nil {
+		return "", err
+	}
+	s, err := c.sealer(uid)
+	if err != nil {
+		return "", err
+	}
+
+	_, resp, err := send(
+		ctx,
+		c.Carrier,
+		s,
+		serverUrl,
+		postForm,
+		c.httpOptions(),
+	)
+	if err != nil {
+		return "", fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Bundle     string `json:"bundle"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return "", ErrInvalidResponseFormat
+	}
+	if responseData.Status != "success" {
+		return "", responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+	return responseData.Bundle, nil
+}
@@ -0,0 +1,413 @@
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gaukas/rtcsocks/envelope"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Carrier is how the fields of a request are carried, so that the traffic shape can
+// match the cover story of the fronting site. Responses are JSON regardless.
+//
+// With CarrierForm and CarrierMultipart, clients without a JSON library, e.g. curl,
+// can negotiate too: binary values are base64, arrays are one value per element.
+type Carrier uint8
+
+const (
+	CarrierJSON      Carrier = iota // POST with a JSON body, the default
+	CarrierQuery                    // GET with the fields in the query string
+	CarrierMultipart                // POST with a multipart/form-data body
+	CarrierCookie                   // GET with the fields in cookies
+	CarrierForm                     // POST with an application/x-www-form-urlencoded body
+)
+
+func (carrier Carrier) String() string {
+	switch carrier {
+	case CarrierJSON:
+		return "json"
+	case CarrierQuery:
+		return "query"
+	case CarrierMultipart:
+		return "multipart"
+	case CarrierCookie:
+		return "cookie"
+	case CarrierForm:
+		return "form"
+	default:
+		return "carrier(" + strconv.Itoa(int(carrier)) + ")"
+	}
+}
+
+// SetCarriers sets the carriers accepted by the API in addition to CarrierJSON.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetCarriers(carriers ...Carrier) {
+	a.carriers = make(map[Carrier]bool, len(carriers))
+	for _, carrier := range carriers {
+		a.carriers[carrier] = true
+	}
+}
+
+// route registers the handler for the methods of the accepted carriers.
+func (a *API) route(router fiber.Router, path string, handler fiber.Handler) {
+	router.Post(path, a.admitRemote, handler)
+	if a.carriers[CarrierQuery] || a.carriers[CarrierCookie] {
+		router.Get(path, a.admitRemote, handler)
+	}
+}
+
+// parseForm parses the fields of the request carried by any accepted carrier into
+// the struct pointed to by form, by their json tags, and validates them against their
+// validate tags, see validateForm. A request form sealed in an envelope is opened
+// first. A sealed form failing to open is fiber.ErrNotFound.
+func (a *API) parseForm(c *fiber.Ctx, form interface{}) error {
+	var sealed sealedForm
+	var nonce requestNonce
+	if err := a.parseFields(c, &sealed); err != nil || sealed.Box == "" {
+		if err := a.parseFields(c, form); err != nil {
+			return err
+		}
+		if err := a.parseFields(c, &nonce); err != nil {
+			return err
+		}
+		if err := a.keepNonce(c, &nonce); err != nil {
+			return err
+		}
+		return validateForm(form)
+	}
+	payload, ok := a.openForm(c, &sealed)
+	if !ok {
+		return fiber.ErrNotFound
+	}
+	if err := json.Unmarshal(payload, form); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(payload, &nonce); err != nil {
+		return err
+	}
+	if err := a.keepNonce(c, &nonce); err != nil {
+		return err
+	}
+	return validateForm(form)
+}
+
+// parseFields parses the fields of the request as carried, see parseForm.
+func (a *API) parseFields(c *fiber.Ctx, form interface{}) error {
+	if c.Method() == fiber.MethodGet {
+		fields := make(url.Values)
+		if a.carriers[CarrierQuery] {
+			c.Context().QueryArgs().VisitAll(func(key, value []byte) {
+				fields.Add(string(key), string(value))
+			})
+		}
+		if len(fields) == 0 && a.carriers[CarrierCookie] {
+			c.Request().Header.VisitAllCookie(func(key, value []byte) {
+				fields.Add(string(key), string(value))
+			})
+		}
+		if len(fields) == 0 {
+			return fiber.ErrBadRequest
+		}
+		return decodeFields(fields, form)
+	}
+
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		if !a.carriers[CarrierMultipart] {
+			return fiber.ErrUnsupportedMediaType
+		}
+		mf, err := c.MultipartForm()
+		if err != nil {
+			return err
+		}
+		return decodeFields(mf.Value, form)
+	}
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEApplicationForm) {
+		if !a.carriers[CarrierForm] {
+			return fiber.ErrUnsupportedMediaType
+		}
+		fields := make(url.Values)
+		c.Request().PostArgs().VisitAll(func(key, value []byte) {
+			fields.Add(string(key), string(value))
+		})
+		return decodeFields(fields, form)
+	}
+	return c.BodyParser(form)
+}
+
+// decodeFields sets the string, string slice and integer slice fields of the struct
+// pointed to by form from the values named by their json tags.
+func decodeFields(fields url.Values, form interface{}) error {
+	v := reflect.ValueOf(form).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		values, ok := fields[name]
+		if name == "" || !ok {
+			continue
+		}
+
+		f := v.Field(i)
+		switch {
+		case f.Kind() == reflect.String:
+			f.SetString(values[0])
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			f.Set(reflect.ValueOf(values).Convert(f.Type()))
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Uint64:
+			s := reflect.MakeSlice(f.Type(), len(values), len(values))
+			for j, value := range values {
+				n, err := strconv.ParseUint(value, 10, 64)
+				if err != nil {
+					return &ValidationError{Field: name, Reason: "not a decimal integer"}
+				}
+				s.Index(j).SetUint(n)
+			}
+			f.Set(s)
+		default:
+			return fmt.Errorf("field %s: unsupported type %s", name, f.Type())
+		}
+	}
+	return nil
+}
+
+// encodeFields converts a JSON request form into the fields of the other carriers.
+// []byte is base64-encoded like encoding/json does, slices have one value per element.
+func encodeFields(form map[string]interface{}) (url.Values, error) {
+	fields := make(url.Values, len(form))
+	for name, value := range form {
+		switch value := value.(type) {
+		case string:
+			fields.Set(name, value)
+		case []byte:
+			fields.Set(name, base64.StdEncoding.EncodeToString(value))
+		case []string:
+			fields[name] = value
+		default:
+			rv := reflect.ValueOf(value)
+			if rv.Kind() != reflect.Slice {
+				// numbers and the like, as encoding/json would put them
+				b, err := json.Marshal(value)
+				if err != nil {
+					return nil, fmt.Errorf("field %s: %w", name, err)
+				}
+				fields.Set(name, strings.Trim(string(b), `"`))
+				continue
+			}
+			switch rv.Type().Elem().Kind() {
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			default:
+				return nil, fmt.Errorf("field %s: unsupported type %T", name, value)
+			}
+			for i := 0; i < rv.Len(); i++ {
+				fields.Add(name, strconv.FormatUint(rv.Index(i).Uint(), 10))
+			}
+		}
+	}
+	return fields, nil
+}
+
+// requestOptions configures the requests of a Client or Server.
+type requestOptions struct {
+	utils.Options
+	bindResponse bool // see Client.BindResponses
+}
+
+// send sends the request form to the URL with the carrier, sealed in an envelope
+// unless the sealer is nil, and reads the response.
+func send(ctx context.Context, carrier Carrier, s *sealer, url string, form map[string]interface{}, opts requestOptions) (status int, body []byte, err error) {
+	form, nonce, err := withNonce(form, opts)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if s == nil {
+		status, body, err = utils.ReadAll(sendForm(ctx, carrier, url, form, opts.Options))
+	} else {
+		var sealed map[string]interface{}
+		sealed, err = s.seal(form)
+		if err != nil {
+			return 0, nil, err
+		}
+		status, body, err = utils.ReadAll(sendForm(ctx, carrier, url, sealed, opts.Options))
+		if err == nil {
+			body, err = s.open(body, nonce)
+			if nonce != "" && errors.Is(err, envelope.ErrOpen) {
+				err = fmt.Errorf("%w: %v", ErrResponseNotBound, err) // or forged
+			}
+		}
+	}
+	if err != nil {
+		return status, nil, err
+	}
+	if nonce != "" {
+		if err := checkNonce(body, nonce); err != nil {
+			return status, nil, err
+		}
+	}
+	return status, body, nil
+}
+
+// withNonce returns the form with a new nonce to bind the response to, if opts bind
+// responses, and the nonce.
+func withNonce(form map[string]interface{}, opts requestOptions) (map[string]interface{}, string, error) {
+	if !opts.bindResponse {
+		return form, "", nil
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, "", err
+	}
+	bound := make(map[string]interface{}, len(form)+1)
+	for name, value := range form {
+		bound[name] = value
+	}
+	bound["nonce"] = nonce
+	return bound, nonce, nil
+}
+
+// sendStream is send for large responses, which are decoded as they arrive rather
+// than buffered. A sealed response is still buffered, since an envelope is only
+// authenticated as a whole. The response body MUST be closed.
+func sendStream(ctx context.Context, carrier Carrier, s *sealer, url string, form map[string]interface{}, opts requestOptions) (*utils.Response, error) {
+	if s == nil {
+		form, nonce, err := withNonce(form, opts)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := sendForm(ctx, carrier, url, form, opts.Options)
+		if err != nil || nonce == "" {
+			return resp, err
+		}
+		return checkNonceStream(resp, nonce)
+	}
+
+	status, body, err := send(ctx, carrier, s, url, form, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &utils.Response{StatusCode: status, Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+// decodeObject decodes a JSON object from the stream, calling member for each key
+// with dec positioned at its value, which member MUST decode. null is an empty
+// object. Malformed responses fail with ErrInvalidResponseFormat, failures to read
+// the response as they are.
+func decodeObject(dec *json.Decoder, member func(key string) error) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return streamError(err)
+	}
+	if tok == nil {
+		return nil
+	}
+	if tok != json.Delim('{') {
+		return ErrInvalidResponseFormat
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return streamError(err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return ErrInvalidResponseFormat
+		}
+		if err := member(key); err != nil {
+			return streamError(err)
+		}
+	}
+	if _, err := dec.Token(); err != nil { // '}', as More returned false
+		return streamError(err)
+	}
+	return nil
+}
+
+// streamError tells malformed JSON from failures to read the response.
+func streamError(err error) error {
+	var syntaxError *json.SyntaxError
+	var typeError *json.UnmarshalTypeError
+	if errors.As(err, &syntaxError) || errors.As(err, &typeError) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return ErrInvalidResponseFormat
+	}
+	return err
+}
+
+func sendForm(ctx context.Context, carrier Carrier, url string, form map[string]interface{}, opts utils.Options) (*utils.Response, error) {
+	if carrier == CarrierJSON {
+		return utils.POST(ctx, url, form, opts)
+	}
+
+	fields, err := encodeFields(form)
+	if err != nil {
+		return nil, err
+	}
+	switch carrier {
+	case CarrierQuery:
+		return utils.GETQuery(ctx, url, fields, opts)
+	case CarrierMultipart:
+		return utils.POSTMultipart(ctx, url, fields, opts)
+	case CarrierCookie:
+		return utils.GETCookies(ctx, url, fields, opts)
+	case CarrierForm:
+		return utils.POSTForm(ctx, url, fields, opts)
+	default:
+		return nil, fmt.Errorf("unknown carrier %s", carrier)
+	}
+}
+
+func (c *Client) httpOptions() requestOptions {
+	return requestOptions{bindResponse: c.BindResponses, Options: utils.Options{
+		InsecureSkipVerify: c.InsecureSkipVerify,
+		SNI:                c.SNI,
+		Profile:            c.Profile,
+		Sessions:           c.sessionCache(),
+		Hosts:              c.Hosts,
+		Compress:           c.Compress,
+		Timeout:            c.Timeout,
+		MaxResponseSize:    c.MaxResponseSize,
+		Doer:               c.RoundTripper,
+	}}
+}
+
+func (s *Server) httpOptions() requestOptions {
+	return requestOptions{bindResponse: s.BindResponses, Options: utils.Options{
+		InsecureSkipVerify: s.InsecureSkipVerify,
+		SNI:                s.SNI,
+		Profile:            s.Profile,
+		Sessions:           s.sessionCache(),
+		Hosts:              s.Hosts,
+		Compress:           s.Compress,
+		Timeout:            s.Timeout,
+		MaxResponseSize:    s.MaxResponseSize,
+		Doer:               s.RoundTripper,
+	}}
+}
+
+// sessionCache returns the cache of the TLS sessions with the negotiator, nil unless
+// ResumeTLS is set.
+func (c *Client) sessionCache() *utils.SessionCache {
+	if !c.ResumeTLS {
+		return nil
+	}
+	c.tlsSessionsOnce.Do(func() { c.tlsSessions = utils.NewSessionCache() })
+	return c.tlsSessions
+}
+
+func (s *Server) sessionCache() *utils.SessionCache {
+	if !s.ResumeTLS {
+		return nil
+	}
+	s.tlsSessionsOnce.Do(func() { s.tlsSessions = utils.NewSessionCache() })
+	return s.tlsSessions
+}
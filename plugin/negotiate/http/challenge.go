@@ -0,0 +1,224 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// challengeStore keeps the challenges issued and not used yet. A challenge is used
+// at most once, by the user or group it is issued to.
+type challengeStore struct {
+	issued *issuance // challenge -> issued to the kid, kidUserPrefix or kidGroupPrefix followed by the hex ID
+	mutex  sync.Mutex
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{
+		issued: newIssuance(maxChallenges, maxChallengesPerKid, maxChallengesPerAddress),
+	}
+}
+
+// issue returns a new challenge for the kid requested from the remote address, see
+// addressKey, or false if too many are outstanding.
+func (s *challengeStore) issue(kid, addr string) (string, bool) {
+	var buf [challengeSize]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", false
+	}
+	challenge := base64.StdEncoding.EncodeToString(buf[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.issued.add(challenge, kid, addr, time.Now().Add(challengeTTL), nil) {
+		return "", false
+	}
+	return challenge, true
+}
+
+// consume reports whether the challenge was issued to the kid and has not expired.
+// The challenge cannot be used again either way.
+func (s *challengeStore) consume(kid, challenge string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	issued, ok := s.issued.take(challenge)
+	return ok && issued.kid == kid
+}
+
+// challengeMessage is the message authenticated in place of msg with a challenge.
+func challengeMessage(challenge string, msg []byte) []byte {
+	return append([]byte("challenge:"+challenge+":"), msg...)
+}
+
+// groupMAC authenticates the request with the challenge for the group with the group
+// secret, see groupRequest.
+func groupMAC(secret string, challenge string, gid rtcsocks.GroupID, request []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(challengeMessage(challenge, append([]byte(gid.String()+":"), request...)))
+	return h.Sum(nil)
+}
+
+// groupRequest is the part of a request of an Edge Server its group MAC covers: the
+// endpoint and the fields of the form, so that a hop on the way cannot swap them and
+// keep the MAC.
+func groupRequest(endpoint string, fields ...string) []byte {
+	request, _ := json.Marshal(append([]string{endpoint}, fields...)) // cannot fail
+	return request
+}
+
+// SetChallengeRequired requires users to include a challenge in their MACs and groups
+// to authenticate with the MAC of a challenge instead of the group secret, see
+// Client.Challenge and Server.Challenge. Delegation tokens are accepted regardless.
+// Requests with a challenge are accepted even if not required.
+func (a *API) SetChallengeRequired(required bool) {
+	a.challengeRequired = required
+}
+
+// issueChallenge issues a challenge to a user or group. Unknown users and groups get
+// one too, so that it does not tell them from known ones. A remote address with too
+// many challenges outstanding is told to retry later, see issuance.
+func (a *API) issueChallenge(c *fiber.Ctx) error {
+	var postForm struct {
+		UID string `json:"uid" validate:"id"` // User ID, hex, for a user
+		GID string `json:"gid" validate:"id"` // Group ID, hex, for a group
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	var kid string
+	powBits := 0
+	if postForm.UID != "" {
+		uid, err := rtcsocks.ParseUserID(postForm.UID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		kid = kidUserPrefix + uid.String()
+		powBits = a.powBits
+	} else {
+		gid, err := rtcsocks.ParseGroupID(postForm.GID)
+		if err != nil {
+			return c.SendStatus(fiber.StatusNotFound)
+		}
+		kid = kidGroupPrefix + gid.String()
+	}
+
+	challenge, ok := a.challenges.issue(kid, addressKey(a.remoteIP(c)))
+	if !ok {
+		return a.sendError(c, fiber.StatusServiceUnavailable, &rtcsocks.OverloadError{RetryAfter: challengeTTL})
+	}
+	resp := fiber.Map{
+		"status":     "success",
+		"challenge":  challenge,
+		"expires_in": int(challengeTTL.Seconds()),
+	}
+	if powBits > 0 {
+		resp["pow_bits"] = powBits
+	}
+	return c.Status(fiber.StatusOK).JSON(resp)
+}
+
+// checkChallenge consumes the challenge of a request by the kid. A request without
+// a challenge passes unless challenges are required.
+func (a *API) checkChallenge(kid, challenge string) bool {
+	if challenge == "" {
+		return !a.challengeRequired
+	}
+	return a.challenges.consume(kid, challenge)
+}
+
+// verifyGroupMAC verifies the MAC of the request with the challenge by an Edge Server
+// of the group.
+func (a *API) verifyGroupMAC(gid rtcsocks.GroupID, challenge, macB64 string, request []byte) bool {
+	mac, err := base64.StdEncoding.DecodeString(macB64)
+	if err != nil {
+		return false
+	}
+	groupSecret, err := a.credentials.GroupSecret(gid)
+	known := err == nil
+	return hmac.Equal(groupMAC(groupSecret, challenge, gid, request), mac) && known
+}
+
+// fetchChallenge requests a challenge for the user or group named by field and id,
+// returning it with the proof of work required for offers, if any.
+func fetchChallenge(ctx context.Context, carrier Carrier, s *sealer, serverUrl string, field, id string, opts requestOptions) (string, int, error) {
+	_, resp, err := send(
+		ctx,
+		carrier,
+		s,
+		serverUrl,
+		map[string]interface{}{field: id},
+		opts,
+	)
+	if err != nil {
+		return "", 0, fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Challenge  string `json:"challenge"`
+		PoWBits    int    `json:"pow_bits"`    // proof of work required for offers, see API.SetProofOfWork
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return "", 0, ErrInvalidResponseFormat
+	}
+	if responseData.Status != "success" || responseData.Challenge == "" {
+		return "", 0, responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+	if responseData.PoWBits > maxProofOfWorkBits {
+		return "", 0, ErrInvalidResponseFormat
+	}
+	return responseData.Challenge, responseData.PoWBits, nil
+}
+
+// challenge fetches a challenge for the user, with the proof of work required for
+// offers.
+func (c *Client) challenge(ctx context.Context, uid rtcsocks.UserID) (string, int, error) {
+	s, err := c.sealer(uid)
+	if err != nil {
+		return "", 0, err
+	}
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/auth/challenge")
+	return fetchChallenge(ctx, c.Carrier, s, serverUrl, "uid", uid.String(), c.httpOptions())
+}
+
+// authorize adds the credential of the group to the request form: the Token, the
+// MAC of the request with a fresh challenge if Challenge is set, see groupRequest, or
+// else the Secret.
+func (s *Server) authorize(ctx context.Context, postForm map[string]interface{}, request []byte) error {
+	if s.Token != "" {
+		postForm["token"] = s.Token
+		return nil
+	}
+	if !s.Challenge {
+		postForm["secret"] = s.Secret
+		return nil
+	}
+
+	seal, err := s.sealer()
+	if err != nil {
+		return err
+	}
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/auth/challenge")
+	challenge, _, err := fetchChallenge(ctx, s.Carrier, seal, serverUrl, "gid", s.GroupID.String(), s.httpOptions())
+	if err != nil {
+		return err
+	}
+	postForm["challenge"] = challenge
+	postForm["hmac"] = groupMAC(s.Secret, challenge, s.GroupID, request) // byte array as base64 string (auto-encoded)
+	return nil
+}
@@ -1,6 +1,8 @@
 package http
 
 import (
+	"context"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -8,31 +10,118 @@ import (
 	"fmt"
 	"strconv"
 	"sync"
+	"time"
 
-	"github.com/gaukas/logging"
 	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
 	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gaukas/rtcsocks/sdputil"
 )
 
 // Client helps the RTCSocks Client to talk to the negotiator server.
 // It uses two endpoints: /offer/new and /offer/accept to create offers and lookup answers.
 type Client struct {
-	UserID   uint64
+	UserID   rtcsocks.UserID
 	Password string
 
-	ServerAddr         string // server address, e.g. "www.google.com"
-	SNI                string // SNI to use, e.g. "example.com"
-	InsecureSkipVerify bool   // skip TLS certificate verification for HTTPS
-	InsecurePlainHTTP  bool   // use plain HTTP instead of HTTPS, when enabled, InsecureSkipVerify is ignored
+	// AliasPeriod enables rotating aliases: the UserID is replaced by its alias in
+	// the current epoch of the period, see auth.Alias and rtcsocks.AliasCredentialStore.
+	// Not supported with PAKE.
+	AliasPeriod time.Duration
+	AliasSecret string // user secret as stored by the negotiator, defaults to the Password or Ed25519 public key
+
+	// AnswerVerifyKeys are the public keys of the Edge Servers, the answers MUST be
+	// signed with one of them, see Server.AnswerSigningKey. Empty -> answers are not verified.
+	AnswerVerifyKeys []ed25519.PublicKey
+
+	CandidatePolicy *rtcsocks.CandidatePolicy // candidates allowed in offers, nil -> all
+	SDPPolicy       *sdputil.Policy           // sanitizes offers, see sdputil.Policy.Sanitize, nil -> sent as is
+
+	// AnswerWait is how long RegisterOffer waits for the negotiator to push the answer
+	// in its response, which the next LookupAnswer returns without a request. If the
+	// offer is not answered in time, LookupAnswer polls as usual. 0 -> no push.
+	AnswerWait time.Duration
+
+	// Challenge fetches a single-use challenge from the negotiator before each request
+	// and includes it in the HMAC, so that captured requests cannot be replayed, e.g.
+	// over InsecurePlainHTTP or untrusted CDN hops. It costs a round trip per request.
+	Challenge bool
+
+	// ProofOfWork fetches a challenge for offers even if Challenge is not set, and
+	// solves the proof of work the negotiator requires for them, if any, see
+	// API.SetProofOfWork.
+	ProofOfWork bool
+
+	// Envelope seals the requests and their responses in an envelope keyed by the
+	// Password, see package envelope. Not supported with PAKE or the Ed25519 scheme.
+	Envelope bool
+
+	// BindResponses sends a fresh nonce with each request, and rejects the successful
+	// responses not bound to it with ErrResponseNotBound, e.g. replayed or served from
+	// a cache by a middlebox. Only sealed responses are authenticated; in the clear, a
+	// middlebox could still forge a fresh one.
+	BindResponses bool
+
+	AuthScheme string // authentication scheme, see package auth, empty -> auth.DefaultScheme
+	Credential []byte // credential for AuthScheme if not the Password, e.g. the Ed25519 private key
+
+	// PAKE enables the SRP handshake with the Password, after which requests are
+	// authenticated with the session key. AuthScheme and Credential are ignored.
+	PAKE      bool
+	pake      *clientPAKESession
+	mutexPAKE sync.Mutex
+
+	offers      map[rtcsocks.OfferID]clientOffer // offer_id -> offer registered
+	mutexOffers sync.Mutex
+
+	retryAt    time.Time // no offer is registered before, as requested by an overloaded negotiator
+	mutexRetry sync.Mutex
+
+	ServerAddr         string              // server address, e.g. "www.google.com"
+	SNI                string              // SNI to use, e.g. "example.com"
+	Hosts              map[string][]string // IPs to dial in turn for the hostnames, in place of resolving them, e.g. when DNS is poisoned
+	Profile            string              // browser the requests pass for: "chrome" (default), "firefox", "safari" or "ios"
+	InsecureSkipVerify bool                // skip TLS certificate verification for HTTPS
+	InsecurePlainHTTP  bool                // use plain HTTP instead of HTTPS, when enabled, InsecureSkipVerify is ignored
+	Carrier            Carrier             // how the request fields are carried, MUST be accepted by the API, see API.SetCarriers
+	Compress           bool                // gzip the request bodies, see API.SetCompression
+	ResumeTLS          bool                // resume TLS 1.2 sessions with the negotiator, as a browser revisiting a site
+	tlsSessions        *utils.SessionCache
+	tlsSessionsOnce    sync.Once
 	insecureWarnOnce   sync.Once
 
-	Logger logging.Logger
+	Timeout         time.Duration // of each request to the negotiator, extended by AnswerWait, 0 -> none
+	MaxResponseSize int64         // of the responses of the negotiator, in bytes, 0 -> 4 MiB
+	RoundTripper    RoundTripper  // sends the requests, nil -> the uTLS client, see RoundTripper
+
+	Logger rtcsocks.Logger
+}
+
+// clientOffer is what the Client needs to look up the answer to an offer.
+type clientOffer struct {
+	uid    rtcsocks.UserID // UserID or alias the offer is registered with
+	token  string          // 128-bit token to look up the answer with, if returned by the negotiator
+	sdp    []byte          // offer SDP, if the answer is to be verified
+	answer []byte          // answer pushed with the response to the offer, if any
+}
+
+func (c *Client) RegisterOffer(offer []byte, groupID ...rtcsocks.GroupID) (offerID rtcsocks.OfferID, err error) {
+	return c.RegisterOfferContext(context.Background(), offer, groupID...)
+}
+
+// RegisterOfferContext is RegisterOffer, cancelled with ctx, including while waiting
+// for the answer to be pushed, see AnswerWait.
+func (c *Client) RegisterOfferContext(ctx context.Context, offer []byte, groupID ...rtcsocks.GroupID) (offerID rtcsocks.OfferID, err error) {
+	return c.registerOffer(ctx, "/rtcsocks/offer/new", offer, groupID, c.AnswerWait)
 }
 
-func (c *Client) RegisterOffer(offer []byte, groupID ...uint64) (offerID uint64, err error) {
+func (c *Client) registerOffer(ctx context.Context, path string, offer []byte, groupID []rtcsocks.GroupID, wait time.Duration) (offerID rtcsocks.OfferID, err error) {
 	if c.ServerAddr == "" {
 		return 0, ErrInvalidServerAddr
 	}
+	if err := c.overloaded(); err != nil {
+		return 0, err
+	}
 
 	c.insecureWarnOnce.Do(func() {
 		if c.InsecureSkipVerify || c.InsecurePlainHTTP {
@@ -42,33 +131,58 @@ func (c *Client) RegisterOffer(offer []byte, groupID ...uint64) (offerID uint64,
 		}
 	})
 
-	serverUrl := c.ServerAddr + "/rtcsocks/offer/new"
-	if !c.InsecurePlainHTTP {
-		serverUrl = "https://" + serverUrl
-	} else {
-		serverUrl = "http://" + serverUrl
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, path)
+
+	if c.SDPPolicy != nil {
+		offer, err = c.SDPPolicy.Sanitize(offer)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if c.CandidatePolicy != nil {
+		offer, err = c.CandidatePolicy.Apply(offer)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	mac := hmac.New(sha256.New, []byte(c.Password))
-	mac.Write(offer)
-	sum := mac.Sum(nil)
+	uid, err := c.userID()
+	if err != nil {
+		return 0, err
+	}
 
 	postForm := map[string]interface{}{
-		"offer": offer,                       // byte array as base64 string (auto-encoded)
-		"hmac":  sum,                         // byte array as base64 string (auto-encoded)
-		"uid":   fmt.Sprintf("%x", c.UserID), // uint64 as hex string
-		"gid":   groupID,                     // array of uint64
+		"offer": offer,        // byte array as base64 string (auto-encoded)
+		"uid":   uid.String(), // hex string
+		"gid":   groupID,      // array of integers
+	}
+	if wait > 0 {
+		postForm["wait"] = strconv.Itoa(int((wait + time.Second - 1) / time.Second)) // seconds, rounded up
+	}
+	if err := c.authenticate(ctx, postForm, uid, offer, true); err != nil {
+		return 0, err
 	}
 	if c.Logger != nil {
 		c.Logger.Debugf("Client: POST %s, form: %v", serverUrl, postForm)
 	}
+	s, err := c.sealer(uid)
+	if err != nil {
+		return 0, err
+	}
+
+	opts := c.httpOptions()
+	if opts.Timeout > 0 {
+		opts.Timeout += wait // for the answer to be pushed
+	}
 
 	// POST offer to negotiator server
-	_, resp, err := utils.POST(
+	_, resp, err := send(
+		ctx,
+		c.Carrier,
+		s,
 		serverUrl,
 		postForm,
-		c.InsecureSkipVerify,
-		c.SNI,
+		opts,
 	)
 	if err != nil {
 		return 0, fmt.Errorf("POST %s: %w", serverUrl, err)
@@ -78,26 +192,60 @@ func (c *Client) RegisterOffer(offer []byte, groupID ...uint64) (offerID uint64,
 	var responseData struct {
 		Status     string `json:"status"`
 		OfferIDHex string `json:"offer_id"`
-		Reference  string `json:"reference"` // reference for debugging or error reporting
+		OfferToken string `json:"offer_token"` // 128-bit token to look up the answer with, optional
+		AnswerB64  string `json:"answer"`      // answer pushed if registered in time, optional
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
 	}
 	if json.Unmarshal(resp, &responseData) != nil {
 		return 0, ErrInvalidResponseFormat
 	}
 
 	if responseData.Status != "success" {
-		return 0, fmt.Errorf("POST %s returned status: %s, reference: %s", serverUrl, responseData.Status, responseData.Reference)
+		c.retryAfter(responseData.RetryAfter)
+		return 0, responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
 	}
 
-	// hex string to uint64
-	offerID, err = strconv.ParseUint(responseData.OfferIDHex, 16, 64)
+	offerID, err = rtcsocks.ParseOfferID(responseData.OfferIDHex)
 	if err != nil {
 		return 0, fmt.Errorf("non-Hex offer_id returned by negotiator: %s", responseData.OfferIDHex)
 	}
 
+	var answer []byte
+	if responseData.AnswerB64 != "" {
+		answer, err = base64.StdEncoding.DecodeString(responseData.AnswerB64)
+		if err != nil {
+			return 0, fmt.Errorf("base64 decode error: %w", err)
+		}
+	}
+
+	if uid != c.UserID || responseData.OfferToken != "" || len(c.AnswerVerifyKeys) > 0 || answer != nil {
+		registered := clientOffer{
+			uid:    uid,
+			token:  responseData.OfferToken,
+			answer: answer,
+		}
+		if len(c.AnswerVerifyKeys) > 0 {
+			registered.sdp = offer
+		}
+		c.mutexOffers.Lock()
+		if c.offers == nil {
+			c.offers = make(map[rtcsocks.OfferID]clientOffer)
+		}
+		c.offers[offerID] = registered
+		c.mutexOffers.Unlock()
+	}
+
 	return offerID, nil
 }
 
-func (c *Client) LookupAnswer(offerID uint64) (answer []byte, err error) {
+func (c *Client) LookupAnswer(offerID rtcsocks.OfferID) (answer []byte, err error) {
+	return c.LookupAnswerContext(context.Background(), offerID)
+}
+
+// LookupAnswerContext is LookupAnswer, cancelled with ctx.
+func (c *Client) LookupAnswerContext(ctx context.Context, offerID rtcsocks.OfferID) (answer []byte, err error) {
 	if c.ServerAddr == "" {
 		return nil, ErrInvalidServerAddr
 	}
@@ -110,30 +258,41 @@ func (c *Client) LookupAnswer(offerID uint64) (answer []byte, err error) {
 		}
 	})
 
-	serverUrl := c.ServerAddr + "/rtcsocks/answer/lookup"
-	if !c.InsecurePlainHTTP {
-		serverUrl = "https://" + serverUrl
-	} else {
-		serverUrl = "http://" + serverUrl
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/answer/lookup")
+
+	c.mutexOffers.Lock()
+	registered, ok := c.offers[offerID]
+	c.mutexOffers.Unlock()
+	if registered.answer != nil {
+		return c.acceptAnswer(offerID, registered, registered.answer)
+	}
+	if !ok {
+		registered.uid = c.UserID
+	}
+	if registered.token == "" {
+		registered.token = offerID.String()
 	}
 
 	postForm := map[string]interface{}{
-		"offer_id": fmt.Sprintf("%x", offerID), // uint64 as hex string
-		"uid":      fmt.Sprintf("%x", c.UserID),
+		"offer_id": registered.token,
+		"uid":      registered.uid.String(),
+	}
+	if err := c.authenticate(ctx, postForm, registered.uid, []byte(postForm["offer_id"].(string)), false); err != nil {
+		return nil, err
+	}
+	s, err := c.sealer(registered.uid)
+	if err != nil {
+		return nil, err
 	}
-
-	mac := hmac.New(sha256.New, []byte(c.Password))
-	mac.Write([]byte(postForm["offer_id"].(string)))
-	sum := mac.Sum(nil)
-
-	postForm["hmac"] = sum
 
 	// POST offer to server
-	_, resp, err := utils.POST(
+	_, resp, err := send(
+		ctx,
+		c.Carrier,
+		s,
 		serverUrl,
 		postForm,
-		c.InsecureSkipVerify,
-		c.SNI,
+		c.httpOptions(),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("POST %s: %w", serverUrl, err)
@@ -141,9 +300,11 @@ func (c *Client) LookupAnswer(offerID uint64) (answer []byte, err error) {
 
 	// parse response
 	var responseData struct {
-		Status    string `json:"status"`
-		AnswerB64 string `json:"answer"`
-		Reference string `json:"reference"` // reference for debugging or error reporting
+		Status     string `json:"status"`
+		AnswerB64  string `json:"answer"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
 	}
 	if json.Unmarshal(resp, &responseData) != nil {
 		return nil, ErrInvalidResponseFormat
@@ -155,10 +316,134 @@ func (c *Client) LookupAnswer(offerID uint64) (answer []byte, err error) {
 		if err != nil {
 			return nil, fmt.Errorf("base64 decode error: %w", err)
 		}
-		return answer, nil
+		return c.acceptAnswer(offerID, registered, answer)
 	} else if responseData.Status == "pending" {
 		return nil, rtcsocks.ErrAnswerPending
+	} else if responseData.Status == "retry" {
+		return nil, rtcsocks.ErrServerSilent
+	} else if responseData.Status == "expired" {
+		c.forgetOffer(offerID)
+		return nil, rtcsocks.ErrOfferExpired
+	}
+
+	return nil, responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+}
+
+// acceptAnswer verifies the answer to the registered offer if required, and forgets
+// the offer.
+func (c *Client) acceptAnswer(offerID rtcsocks.OfferID, registered clientOffer, answer []byte) ([]byte, error) {
+	defer c.forgetOffer(offerID) // answers never change
+	if len(c.AnswerVerifyKeys) > 0 {
+		if registered.sdp == nil {
+			return nil, rtcsocks.ErrInvalidOfferID // not registered by this Client, cannot verify
+		}
+		return rtcsocks.VerifyAnswer(c.AnswerVerifyKeys, registered.sdp, answer)
 	}
+	return answer, nil
+}
+
+func (c *Client) forgetOffer(offerID rtcsocks.OfferID) {
+	c.mutexOffers.Lock()
+	defer c.mutexOffers.Unlock()
+	delete(c.offers, offerID)
+}
+
+// userID returns the UID to register offers with, i.e., the UserID or its alias.
+func (c *Client) userID() (rtcsocks.UserID, error) {
+	if c.AliasPeriod <= 0 || c.PAKE {
+		return c.UserID, nil
+	}
+
+	secret := c.AliasSecret
+	if secret == "" {
+		secret = c.Password
+		if c.AuthScheme == "ed25519" {
+			pub, err := auth.Ed25519PublicKey(c.Credential)
+			if err != nil {
+				return 0, err
+			}
+			secret = auth.Ed25519Secret(pub)
+		}
+	}
+	return rtcsocks.UserID(auth.Alias(secret, auth.Epoch(time.Now(), c.AliasPeriod))), nil
+}
 
-	return nil, fmt.Errorf("POST %s returned status: %s, reference: %s", serverUrl, responseData.Status, responseData.Reference)
+// overloaded returns an OverloadError until the delay requested by the negotiator
+// elapsed, without sending anything.
+func (c *Client) overloaded() error {
+	c.mutexRetry.Lock()
+	defer c.mutexRetry.Unlock()
+	if wait := time.Until(c.retryAt); wait > 0 {
+		return &rtcsocks.OverloadError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// retryAfter holds off registering offers for the seconds requested by the negotiator.
+func (c *Client) retryAfter(seconds int) {
+	if seconds <= 0 {
+		return
+	}
+	c.mutexRetry.Lock()
+	defer c.mutexRetry.Unlock()
+	c.retryAt = time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// sealer returns the sealer of the requests made as uid, nil if Envelope is disabled.
+func (c *Client) sealer(uid rtcsocks.UserID) (*sealer, error) {
+	if !c.Envelope {
+		return nil, nil
+	}
+	if c.PAKE {
+		return nil, ErrEnvelopeUnsupported
+	}
+	return userSealer(uid, c.Password)
+}
+
+// authenticate adds the HMAC or signature of msg by uid to the form, with the
+// configured scheme and credential, and a challenge if enabled. For offers, the
+// proof of work is added too if enabled.
+func (c *Client) authenticate(ctx context.Context, postForm map[string]interface{}, uid rtcsocks.UserID, msg []byte, offer bool) error {
+	work := offer && c.ProofOfWork
+	if c.Challenge || work {
+		challenge, powBits, err := c.challenge(ctx, uid)
+		if err != nil {
+			return fmt.Errorf("challenge: %w", err)
+		}
+		postForm["challenge"] = challenge
+		if work && powBits > 0 {
+			postForm["pow"] = solvePoW(challenge, powBits)
+		}
+		msg = challengeMessage(challenge, msg)
+	}
+
+	if c.PAKE {
+		session, key, err := c.pakeSession(ctx)
+		if err != nil {
+			return fmt.Errorf("PAKE handshake: %w", err)
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write(msg)
+		postForm["hmac"] = mac.Sum(nil) // byte array as base64 string (auto-encoded)
+		postForm["scheme"] = PAKEScheme
+		postForm["pake_session"] = session
+		return nil
+	}
+
+	scheme, err := auth.Default.Get(c.AuthScheme)
+	if err != nil {
+		return err
+	}
+
+	credential := c.Credential
+	if credential == nil {
+		credential = []byte(c.Password)
+	}
+	sum, err := scheme.Sign(credential, msg)
+	if err != nil {
+		return err
+	}
+	postForm["hmac"] = sum // byte array as base64 string (auto-encoded)
+	postForm["scheme"] = scheme.Name()
+	return nil
 }
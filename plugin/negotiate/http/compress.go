@@ -0,0 +1,68 @@
+package http
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/compress"
+)
+
+// SetCompression compresses responses with gzip, deflate or brotli as accepted by
+// the client, which matters when offers and answers are polled over metered or slow
+// links. The admin console is never compressed. Requests compressed with gzip or
+// deflate are accepted regardless, see Client.Compress.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetCompression(enabled bool) {
+	a.compression = enabled
+}
+
+// routeCompression registers the (de)compression of requests and responses.
+func (a *API) routeCompression(app *fiber.App) {
+	app.Use(a.decompressRequest)
+	if a.compression {
+		app.Use(compress.New(compress.Config{
+			Next: func(c *fiber.Ctx) bool {
+				// server-sent events are flushed as they go
+				return strings.HasPrefix(c.Path(), "/rtcsocks/admin")
+			},
+		}))
+	}
+}
+
+// decompressRequest replaces a compressed request body with the decompressed one, up
+// to the body limit of the app.
+func (a *API) decompressRequest(c *fiber.Ctx) error {
+	encoding := strings.ToLower(c.Get(fiber.HeaderContentEncoding))
+	if encoding == "" || encoding == "identity" {
+		return c.Next()
+	}
+
+	var r io.Reader
+	var err error
+	body := bytes.NewReader(c.Request().Body())
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(body)
+	case "deflate": // zlib, as per RFC 9110
+		r, err = zlib.NewReader(body)
+	default:
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	limit := c.App().Config().BodyLimit
+	decoded, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil || len(decoded) > limit {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	c.Request().SetBody(decoded)
+	c.Request().Header.Del(fiber.HeaderContentEncoding)
+	return c.Next()
+}
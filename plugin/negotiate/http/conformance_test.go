@@ -0,0 +1,62 @@
+package http
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/conformance"
+)
+
+func TestConformance(t *testing.T) {
+	conformance.Run(t, func(t *testing.T, n *rtcsocks.Negotiator, creds rtcsocks.CredentialStore) (*conformance.Plugin, error) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, err
+		}
+		api := NewAPIWithCredentialStore(creds)
+		n.HookToAPI(api)
+		go api.Serve(ln)
+		addr := ln.Addr().String()
+
+		var mutex sync.Mutex
+		var servers []*Server
+		return &conformance.Plugin{
+			NewClient: func(user rtcsocks.UserID, password string) rtcsocks.ClientNegotiator {
+				return &Client{
+					UserID:            user,
+					Password:          password,
+					ServerAddr:        addr,
+					InsecurePlainHTTP: true,
+				}
+			},
+			NewServer: func(group rtcsocks.GroupID, secret string) rtcsocks.ServerNegotiator {
+				s := &Server{
+					GroupID:           group,
+					Secret:            secret,
+					ServerAddr:        addr,
+					InsecurePlainHTTP: true,
+					WaitAfterPending:  100 * time.Millisecond,
+					WaitAfterError:    100 * time.Millisecond,
+				}
+				mutex.Lock()
+				servers = append(servers, s)
+				mutex.Unlock()
+				return s
+			},
+			Close: func() {
+				mutex.Lock()
+				defer mutex.Unlock()
+				for _, s := range servers {
+					s.Close(time.Second)
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				api.Shutdown(ctx)
+			},
+		}, nil
+	})
+}
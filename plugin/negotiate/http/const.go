@@ -8,8 +8,61 @@ import (
 var (
 	ErrInvalidServerAddr     = errors.New("invalid server address")
 	ErrInvalidResponseFormat = errors.New("invalid response format")
+	ErrRateLimited           = errors.New("too many failed requests, retry later")
+	ErrEnvelopeUnsupported   = errors.New("envelope not supported with PAKE or delegation tokens")
+	ErrHandlerPanic          = errors.New("request handler panicked")
+	ErrDuplicateGroup        = errors.New("group served by more than one Server")
+	ErrInvalidRequest        = errors.New("invalid request")                                       // see API.SetDebugErrors
+	ErrResponseNotBound      = errors.New("response not bound to the request, replayed or cached") // see Client.BindResponses
+	ErrInvalidDelegationKey  = errors.New("invalid delegation key")
 )
 
 const (
-	defaultWaitAfterPending = 5 * time.Second
+	defaultWaitAfterPending     = 5 * time.Second
+	defaultMaxBackoff           = 5 * time.Minute
+	defaultLookupBackoff        = 250 * time.Millisecond // delay after a failed answer lookup
+	defaultMaxLookupBackoff     = time.Minute
+	maxSessionIDLen             = 64   // max length of an Edge Server session ID
+	maxFormOverhead             = 4096 // max size of a request body excluding the SDP
+	pakeHandshakeTTL            = time.Minute
+	pakeSessionTTL              = time.Hour
+	maxPAKEHandshakes           = 1 << 14 // max SRP handshakes in progress
+	maxPAKEHandshakesPerUser    = 4       // the oldest give way, see issuance
+	maxPAKEHandshakesPerAddress = 16      // see addressKey
+	maxPAKESessions             = 1 << 16
+	maxPAKESessionsPerUser      = 8               // the oldest expire early
+	pakeRenewBefore             = time.Minute     // client renews the PAKE session this long before expiry
+	defaultDecoyInterval        = 3 * time.Minute // mean pause between decoy visits
+	defaultDecoyMaxRequests     = 5
+	decoyMinThink               = 500 * time.Millisecond
+	decoyMaxThink               = 8 * time.Second
+	maxCollectSkew              = 5 * time.Minute  // max clock skew of a mailbox collect or telemetry request
+	unansweredOfferTTL          = 10 * time.Minute // Server forgets offers not answered for this long
+	challengeSize               = 32
+	challengeTTL                = time.Minute
+	maxChallenges               = 1 << 16     // max challenges outstanding
+	maxChallengesPerKid         = 8           // max challenges outstanding per user or group, the oldest give way
+	maxChallengesPerAddress     = 64          // max challenges outstanding per remote address, see addressKey
+	issuanceBucketWidth         = time.Second // granularity of the expiry of challenges and PAKE handshakes
+	maxProofOfWorkBits          = 32          // max difficulty, see API.SetProofOfWork
+	maxNonceLen                 = 16          // max length of a proof of work nonce
+	maxAnswerWait               = time.Minute // max wait for the answer to be pushed, see Client.AnswerWait
+	maxRecentErrors             = 100         // errors shown on the admin console
+	adminRefreshInterval        = time.Second
+	readyPolls                  = 3 // polls missed before a Server is not ready, see Server.Ready
+	defaultPollTokenTTL         = 10 * time.Minute
+	pollTokenRenewBefore        = 10 * time.Second // Server authenticates again this long before its poll token expires
+	pollTokenTagSize            = 16
+	requestNonceSize            = 16   // bytes, see Client.BindResponses
+	replicationQueueSize        = 4096 // events queued per peer, see Replicator
+	replicationAttempts         = 8
+	replicationBackoff          = 100 * time.Millisecond
+	replicationMaxBackoff       = 10 * time.Second
+	replicationTimeout          = 10 * time.Second // of an attempt to send an event
+	replicationSkew             = 30 * time.Second // max clock difference between replicas
+	delegationPurgeInterval     = time.Minute      // of the expired delegation tokens, see delegation.purge
+
+	// PAKEScheme is the authentication scheme of requests MACed with the key of a
+	// PAKE session, see Client.PAKE.
+	PAKEScheme = "pake"
 )
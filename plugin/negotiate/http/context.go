@@ -0,0 +1,28 @@
+package http
+
+import (
+	"context"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetRequestTimeout sets the deadline of the context passed to the callback functions,
+// 0 -> no deadline.
+func (a *API) SetRequestTimeout(timeout time.Duration) {
+	a.requestTimeout = timeout
+}
+
+// requestContext returns the context for the callback functions called for the request,
+// carrying the remote address and the Edge Server session, if any.
+func (a *API) requestContext(c *fiber.Ctx, session string) (context.Context, context.CancelFunc) {
+	ctx := rtcsocks.ContextWithRequestInfo(c.UserContext(), rtcsocks.RequestInfo{
+		RemoteAddr: a.remoteAddr(c),
+		Session:    session,
+	})
+	if a.requestTimeout > 0 {
+		return context.WithTimeout(ctx, a.requestTimeout)
+	}
+	return context.WithCancel(ctx)
+}
@@ -0,0 +1,149 @@
+package http
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
+	"github.com/gaukas/rtcsocks/internal/utils"
+)
+
+// DecoyConfig configures the cover traffic generated by a Client, so that the actual
+// rendezvous requests are not the only traffic to the negotiator host.
+//
+// Cover traffic comes in visits, with exponentially distributed pauses in between
+// like a person browsing the site. A visit fetches a page and some of the other
+// pages shortly after, and MAY include a bogus answer lookup indistinguishable from
+// a real one on the wire.
+type DecoyConfig struct {
+	Pages        []string      // paths fetched in a visit, e.g. "/", "/about", empty -> "/"
+	MeanInterval time.Duration // mean pause between visits, 0 -> defaultDecoyInterval
+	MaxRequests  int           // max requests per visit, 0 -> defaultDecoyMaxRequests
+	PollRatio    float64       // probability of a bogus lookup in a visit, 0 to 1
+}
+
+// StartDecoy generates cover traffic to ServerAddr in the background until stop is
+// called.
+func (c *Client) StartDecoy(config DecoyConfig) (stop func()) {
+	if len(config.Pages) == 0 {
+		config.Pages = []string{"/"}
+	}
+	if config.MeanInterval <= 0 {
+		config.MeanInterval = defaultDecoyInterval
+	}
+	if config.MaxRequests <= 0 {
+		config.MaxRequests = defaultDecoyMaxRequests
+	}
+
+	var seed [8]byte
+	rand.Read(seed[:])
+	rng := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+
+	done := make(chan struct{})
+	go rtcsocks.Supervise("Client: decoy traffic", nil, c.Logger, func() {
+		for {
+			pause := time.Duration(rng.ExpFloat64() * float64(config.MeanInterval))
+			select {
+			case <-done:
+				return
+			case <-time.After(pause):
+			}
+			c.decoyVisit(config, rng, done)
+		}
+	})
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// decoyVisit fetches a few pages with human-like think times in between.
+func (c *Client) decoyVisit(config DecoyConfig, rng *mrand.Rand, done chan struct{}) {
+	requests := 1 + rng.Intn(config.MaxRequests)
+	poll := rng.Float64() < config.PollRatio
+	for i := 0; i < requests; i++ {
+		if i > 0 {
+			think := decoyMinThink + time.Duration(rng.Int63n(int64(decoyMaxThink-decoyMinThink)))
+			select {
+			case <-done:
+				return
+			case <-time.After(think):
+			}
+		}
+
+		if poll && i == requests-1 {
+			c.decoyPoll()
+			continue
+		}
+
+		serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, config.Pages[rng.Intn(len(config.Pages))])
+		if _, _, err := utils.ReadAll(utils.GET(context.Background(), serverUrl, c.httpOptions().Options)); err != nil {
+			if c.Logger != nil {
+				c.Logger.Debugf("Client: decoy GET %s: %v", serverUrl, err)
+			}
+		}
+	}
+}
+
+// decoyPoll looks up a random offer as a random user, which the negotiator rejects
+// without counting it against any real user.
+func (c *Client) decoyPoll() {
+	var ids [16]byte
+	rand.Read(ids[:])
+
+	ctx := context.Background()
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/answer/lookup")
+
+	postForm := map[string]interface{}{
+		"offer_id": fmt.Sprintf("%x", binary.BigEndian.Uint64(ids[:8])),
+		"uid":      fmt.Sprintf("%x", binary.BigEndian.Uint64(ids[8:])),
+	}
+
+	// look like a request of the configured scheme
+	macSize := sha256.Size
+	if c.PAKE {
+		postForm["scheme"] = PAKEScheme
+		postForm["pake_session"] = randomID()
+	} else if scheme, err := auth.Default.Get(c.AuthScheme); err == nil {
+		postForm["scheme"] = scheme.Name()
+		if scheme.Name() == "ed25519" {
+			macSize = ed25519.SignatureSize
+		}
+	}
+	mac := make([]byte, macSize)
+	rand.Read(mac)
+	postForm["hmac"] = mac // byte array as base64 string (auto-encoded)
+
+	var s *sealer
+	if c.Envelope {
+		// sealed with a random key, which is opaque on the wire as a real one
+		s = &sealer{kid: kidUserPrefix + postForm["uid"].(string), key: make([]byte, 32)}
+		rand.Read(s.key)
+	}
+	if c.Challenge {
+		// fetch a challenge like a real lookup would, the negotiator issues it to any user
+		challengeUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/auth/challenge")
+		challenge, _, err := fetchChallenge(ctx, c.Carrier, s, challengeUrl, "uid", postForm["uid"].(string), c.httpOptions())
+		if err != nil {
+			var buf [challengeSize]byte
+			rand.Read(buf[:])
+			challenge = base64.StdEncoding.EncodeToString(buf[:])
+		}
+		postForm["challenge"] = challenge
+	}
+	if _, _, err := send(ctx, c.Carrier, s, serverUrl, postForm, c.httpOptions()); err != nil {
+		if c.Logger != nil {
+			c.Logger.Debugf("Client: decoy POST %s: %v", serverUrl, err)
+		}
+	}
+}
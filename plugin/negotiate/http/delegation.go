@@ -0,0 +1,133 @@
+package http
+
+import (
+	"crypto/ed25519"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// delegation tracks the usage of the delegation tokens presented to the API.
+type delegation struct {
+	keys    []ed25519.PublicKey    // operator keys, empty -> delegation tokens disabled
+	used    map[string]*tokenUsage // token_id -> usage
+	revoked map[string]time.Time   // token_id -> token expiry
+	purged  time.Time              // last time used and revoked were purged
+	mutex   sync.Mutex
+}
+
+type tokenUsage struct {
+	dispatched int
+	expiry     time.Time
+}
+
+func newDelegation() *delegation {
+	return &delegation{
+		used:    make(map[string]*tokenUsage),
+		revoked: make(map[string]time.Time),
+		purged:  time.Now(),
+	}
+}
+
+// SetDelegationKeys enables delegation tokens signed by any of the operator keys, to
+// be accepted in place of the group secret. See rtcsocks.MintDelegationToken. It returns
+// ErrInvalidDelegationKey, leaving the keys unchanged, if any is not an Ed25519 public
+// key.
+func (a *API) SetDelegationKeys(keys ...ed25519.PublicKey) error {
+	for _, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			return ErrInvalidDelegationKey
+		}
+	}
+
+	a.delegation.mutex.Lock()
+	defer a.delegation.mutex.Unlock()
+	a.delegation.keys = keys
+	return nil
+}
+
+// RevokeDelegationToken rejects the token with the specified ID from now on.
+func (a *API) RevokeDelegationToken(id string, notAfter time.Time) {
+	a.delegation.mutex.Lock()
+	defer a.delegation.mutex.Unlock()
+	a.delegation.revoked[id] = notAfter
+}
+
+// verify returns the token if it is valid for the group and not revoked.
+func (d *delegation) verify(gid rtcsocks.GroupID, encoded string) (*rtcsocks.DelegationToken, bool) {
+	d.mutex.Lock()
+	keys := d.keys
+	d.mutex.Unlock()
+	if len(keys) == 0 || encoded == "" {
+		return nil, false
+	}
+
+	token, err := rtcsocks.ParseDelegationToken(keys, encoded)
+	if err != nil || token.Group != gid {
+		return nil, false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.purge()
+	if _, ok := d.revoked[token.ID]; ok {
+		return nil, false
+	}
+	return token, true
+}
+
+// reserve counts an offer to be dispatched with the token, and reports false if the
+// token capacity is exhausted. A reservation not followed by a dispatch is released
+// with release.
+func (d *delegation) reserve(token *rtcsocks.DelegationToken) bool {
+	if token == nil || token.Capacity <= 0 {
+		return true
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.purge()
+	usage, ok := d.used[token.ID]
+	if !ok {
+		usage = &tokenUsage{expiry: token.NotAfter}
+		d.used[token.ID] = usage
+	}
+	if usage.dispatched >= token.Capacity {
+		return false
+	}
+	usage.dispatched++
+	return true
+}
+
+func (d *delegation) release(token *rtcsocks.DelegationToken) {
+	if token == nil || token.Capacity <= 0 {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if usage, ok := d.used[token.ID]; ok && usage.dispatched > 0 {
+		usage.dispatched--
+	}
+}
+
+// purge forgets tokens past their expiry, at most every delegationPurgeInterval. The
+// caller MUST hold d.mutex.
+func (d *delegation) purge() {
+	now := time.Now()
+	if now.Sub(d.purged) < delegationPurgeInterval {
+		return
+	}
+	d.purged = now
+	for id, usage := range d.used {
+		if now.After(usage.expiry) {
+			delete(d.used, id)
+		}
+	}
+	for id, expiry := range d.revoked {
+		if now.After(expiry) {
+			delete(d.revoked, id)
+		}
+	}
+}
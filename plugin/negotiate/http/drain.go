@@ -0,0 +1,131 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gaukas/rtcsocks/internal/utils"
+)
+
+func (s *Server) initClose() {
+	s.closing = make(chan struct{})
+	s.pollCtx, s.cancelPoll = context.WithCancel(context.Background())
+}
+
+// pollContext returns the context of the requests of the offer and heartbeat loops,
+// cancelled by Close.
+func (s *Server) pollContext() context.Context {
+	s.closeOnce.Do(s.initClose)
+	return s.pollCtx
+}
+
+// sleep waits for d, and returns false if the Server is closed in the meantime.
+func (s *Server) sleep(d time.Duration) bool {
+	if d <= 0 {
+		select {
+		case <-s.closing:
+			return false
+		default:
+			return true
+		}
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-s.closing:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Close drains the Edge Server: it stops polling for new offers, calls OnDrain, waits
+// for the offer being handled to finish for up to grace, and deregisters from the
+// negotiator, which hands out the offers not answered yet to other Edge Servers.
+//
+// Existing connections are not affected, the caller is responsible for keeping them
+// alive for its own grace period.
+func (s *Server) Close(grace time.Duration) error {
+	s.closeOnce.Do(s.initClose)
+
+	select {
+	case <-s.closing:
+		return nil // already closed
+	default:
+	}
+	close(s.closing)
+	s.cancelPoll() // a poll in flight would only dispatch an offer to be handed out again
+
+	if s.OnDrain != nil {
+		s.OnDrain()
+	}
+
+	s.startLoopOnce.Do(func() {}) // never start the loops from now on
+	if s.loopDone != nil {
+		select {
+		case <-s.loopDone:
+		case <-time.After(grace):
+			if s.Logger != nil {
+				s.Logger.Warnf("Server: offer still being handled after grace period, deregistering anyway")
+			}
+		}
+	}
+
+	return s.Deregister()
+}
+
+// Deregister removes the session of this Edge Server from the negotiator.
+func (s *Server) Deregister() error {
+	if s.ServerAddr == "" {
+		return ErrInvalidServerAddr
+	}
+
+	ctx := context.Background()
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/server/deregister")
+
+	session := s.Session()
+	postForm := map[string]interface{}{
+		"gid":     s.GroupID.String(), // hex string
+		"session": session,
+	}
+	if err := s.authorize(ctx, postForm, groupRequest("server/deregister", session)); err != nil {
+		return err
+	}
+	if s.Logger != nil {
+		s.Logger.Debugf("Server: POST %s, form: %v", serverUrl, postForm)
+	}
+
+	seal, err := s.sealer()
+	if err != nil {
+		return err
+	}
+	_, resp, err := send(
+		ctx,
+		s.Carrier,
+		seal,
+		serverUrl,
+		postForm,
+		s.httpOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return ErrInvalidResponseFormat
+	}
+
+	if responseData.Status != "success" {
+		return responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package http
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
+	"github.com/gaukas/rtcsocks/envelope"
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	kidUserPrefix  = "u:"
+	kidGroupPrefix = "g:"
+
+	envelopeKeyLocal = "rtcsocks_envelope_key" // fiber.Ctx.Locals key of the request envelope
+)
+
+// sealedForm is a request form sealed in an envelope. KID tells the API which
+// credential the envelope key is derived from, and is authenticated by the envelope.
+type sealedForm struct {
+	KID string `json:"kid"` // "u:" or "g:" followed by the hex user or group ID
+	Box string `json:"box"` // envelope of the JSON request form, base64
+}
+
+// sealer seals the requests of a Client or Server, and opens the responses to them.
+// A nil *sealer sends requests in the clear.
+type sealer struct {
+	kid string
+	key []byte
+}
+
+func userSealer(uid rtcsocks.UserID, password string) (*sealer, error) {
+	key, err := envelope.UserKey(password)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{kid: kidUserPrefix + uid.String(), key: key}, nil
+}
+
+func groupSealer(gid rtcsocks.GroupID, secret string) (*sealer, error) {
+	key, err := envelope.GroupKey(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{kid: kidGroupPrefix + gid.String(), key: key}, nil
+}
+
+// seal returns the form to send in place of the request form.
+func (s *sealer) seal(form map[string]interface{}) (map[string]interface{}, error) {
+	payload, err := json.Marshal(form)
+	if err != nil {
+		return nil, err
+	}
+	box, err := envelope.Seal(s.key, payload, requestAD(s.kid))
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"kid": s.kid,
+		"box": box, // byte array as base64 string (auto-encoded)
+	}, nil
+}
+
+// open returns the response in the envelope, bound to the nonce of the request if
+// any. Responses in the clear are rejected.
+func (s *sealer) open(body []byte, nonce string) ([]byte, error) {
+	var resp sealedForm
+	if json.Unmarshal(body, &resp) != nil || resp.Box == "" {
+		return nil, ErrInvalidResponseFormat
+	}
+	box, err := base64.StdEncoding.DecodeString(resp.Box)
+	if err != nil {
+		return nil, ErrInvalidResponseFormat
+	}
+	return envelope.Open(s.key, box, responseAD(s.kid, nonce))
+}
+
+func requestAD(kid string) []byte { return []byte("request " + kid) }
+
+// responseAD binds the response to the nonce of the request, see bindResponse.
+func responseAD(kid, nonce string) []byte {
+	if nonce == "" {
+		return []byte("response " + kid)
+	}
+	return []byte("response " + kid + " " + nonce)
+}
+
+// openForm opens the request form if it is sealed, returning the JSON request form
+// and true. The envelope key is kept to seal the response with, see sealResponse.
+//
+// Envelopes of unknown users and groups are opened with a key derived from a dummy
+// secret, so that they are indistinguishable by timing from known ones.
+func (a *API) openForm(c *fiber.Ctx, sealed *sealedForm) ([]byte, bool) {
+	key, known, ok := a.envelopeKey(sealed.KID)
+	if !ok {
+		return nil, false
+	}
+	box, err := base64.StdEncoding.DecodeString(sealed.Box)
+	if err != nil {
+		return nil, false
+	}
+	payload, err := envelope.Open(key, box, requestAD(sealed.KID))
+	if err != nil || !known {
+		return nil, false
+	}
+	c.Locals(envelopeKeyLocal, &sealer{kid: sealed.KID, key: key})
+	return payload, true
+}
+
+// envelopeKey derives the envelope key from the credential identified by the kid,
+// or from a dummy secret if there is no such credential or it cannot key envelopes,
+// returning false as known. It returns false as ok for a malformed kid.
+func (a *API) envelopeKey(kid string) (key []byte, known bool, ok bool) {
+	var secret string
+	var err error
+	derive := envelope.UserKey
+	if id := strings.TrimPrefix(kid, kidUserPrefix); id != kid {
+		uid, perr := rtcsocks.ParseUserID(id)
+		if perr != nil {
+			return nil, false, false
+		}
+		secret, err = a.credentials.UserSecret(uid)
+	} else if id := strings.TrimPrefix(kid, kidGroupPrefix); id != kid {
+		gid, perr := rtcsocks.ParseGroupID(id)
+		if perr != nil {
+			return nil, false, false
+		}
+		secret, err = a.credentials.GroupSecret(gid)
+		derive = envelope.GroupKey
+	} else {
+		return nil, false, false
+	}
+
+	known = err == nil
+	if known {
+		key, err = derive(secret)
+		known = err == nil
+	}
+	if !known {
+		key, _ = derive(auth.DummySecret(auth.DefaultScheme))
+	}
+	return key, known, true
+}
+
+// sealResponse seals the response to a sealed request. Sealed responses are always
+// 200 OK, the status is in the envelope as for responses in the clear.
+func (a *API) sealResponse(c *fiber.Ctx) error {
+	err := c.Next()
+	s, ok := c.Locals(envelopeKeyLocal).(*sealer)
+	if !ok || err != nil {
+		return err
+	}
+
+	nonce, _ := c.Locals(nonceLocal).(string)
+	box, err := envelope.Seal(s.key, c.Response().Body(), responseAD(s.kid, nonce))
+	if err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+	c.Response().Header.Del(fiber.HeaderRetryAfter)
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"box": base64.StdEncoding.EncodeToString(box),
+	})
+}
@@ -0,0 +1,186 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// ErrorCode is a stable, machine-readable error code returned by the API in the
+// "code" field of a response with status "error".
+type ErrorCode string
+
+const (
+	CodeInternal          ErrorCode = "internal"
+	CodeUnauthorized      ErrorCode = "unauthorized"
+	CodeNoAccess          ErrorCode = "no_access"
+	CodeBadGroup          ErrorCode = "bad_group"
+	CodeInvalidOffer      ErrorCode = "invalid_offer"
+	CodeInvalidSession    ErrorCode = "invalid_session"
+	CodeQueueFull         ErrorCode = "queue_full"
+	CodeQuotaExceeded     ErrorCode = "quota_exceeded"
+	CodeExpired           ErrorCode = "expired"
+	CodeServerSilent      ErrorCode = "server_silent"
+	CodeAnswerRepeated    ErrorCode = "answer_repeated"
+	CodeSDPTooSmall       ErrorCode = "sdp_too_small"
+	CodeSDPTooLarge       ErrorCode = "sdp_too_large"
+	CodeMalformedSDP      ErrorCode = "malformed_sdp"
+	CodeBadEvent          ErrorCode = "bad_event"
+	CodeNoOfferAvailable  ErrorCode = "no_offer"
+	CodeAnswerPending     ErrorCode = "pending"
+	CodeRandomnessFailure ErrorCode = "rng_error"
+	CodeRateLimited       ErrorCode = "rate_limited"
+	CodeMailboxDisabled   ErrorCode = "mailbox_disabled"
+	CodeOverloaded        ErrorCode = "overloaded"
+	CodeSDPNotAllowed     ErrorCode = "sdp_not_allowed"
+	CodeTelemetryDisabled ErrorCode = "telemetry_disabled"
+	CodeBadReport         ErrorCode = "bad_report"
+	CodeUserNotAllowed    ErrorCode = "user_not_allowed"
+	CodeTooManySessions   ErrorCode = "too_many_sessions"
+	CodeInvalidRequest    ErrorCode = "invalid_request" // only in debug mode, see API.SetDebugErrors
+)
+
+var errorCodes = map[error]ErrorCode{
+	rtcsocks.ErrNotAuthenticated:    CodeUnauthorized,
+	rtcsocks.ErrNoAccess:            CodeNoAccess,
+	rtcsocks.ErrBadGroupID:          CodeBadGroup,
+	rtcsocks.ErrInvalidOfferID:      CodeInvalidOffer,
+	rtcsocks.ErrInvalidSessionID:    CodeInvalidSession,
+	rtcsocks.ErrOfferBinFull:        CodeQueueFull,
+	rtcsocks.ErrQuotaExceeded:       CodeQuotaExceeded,
+	rtcsocks.ErrOfferExpired:        CodeExpired,
+	rtcsocks.ErrServerSilent:        CodeServerSilent,
+	rtcsocks.ErrAnswerRepeated:      CodeAnswerRepeated,
+	rtcsocks.ErrSDPTooSmall:         CodeSDPTooSmall,
+	rtcsocks.ErrSDPTooLarge:         CodeSDPTooLarge,
+	rtcsocks.ErrOfferTooLarge:       CodeSDPTooLarge,
+	rtcsocks.ErrMalformedSDP:        CodeMalformedSDP,
+	rtcsocks.ErrBadReplicationEvent: CodeBadEvent,
+	rtcsocks.ErrNoOfferAvailable:    CodeNoOfferAvailable,
+	rtcsocks.ErrAnswerPending:       CodeAnswerPending,
+	rtcsocks.ErrRNGError:            CodeRandomnessFailure,
+	ErrRateLimited:                  CodeRateLimited,
+	rtcsocks.ErrMailboxDisabled:     CodeMailboxDisabled,
+	rtcsocks.ErrOverloaded:          CodeOverloaded,
+	rtcsocks.ErrSDPNotAllowed:       CodeSDPNotAllowed,
+	rtcsocks.ErrTelemetryDisabled:   CodeTelemetryDisabled,
+	rtcsocks.ErrBadReport:           CodeBadReport,
+	rtcsocks.ErrUserNotAllowed:      CodeUserNotAllowed,
+	rtcsocks.ErrTooManySessions:     CodeTooManySessions,
+}
+
+var codeErrors = map[ErrorCode]error{
+	CodeUnauthorized:      rtcsocks.ErrNotAuthenticated,
+	CodeNoAccess:          rtcsocks.ErrNoAccess,
+	CodeBadGroup:          rtcsocks.ErrBadGroupID,
+	CodeInvalidOffer:      rtcsocks.ErrInvalidOfferID,
+	CodeInvalidSession:    rtcsocks.ErrInvalidSessionID,
+	CodeQueueFull:         rtcsocks.ErrOfferBinFull,
+	CodeQuotaExceeded:     rtcsocks.ErrQuotaExceeded,
+	CodeExpired:           rtcsocks.ErrOfferExpired,
+	CodeServerSilent:      rtcsocks.ErrServerSilent,
+	CodeAnswerRepeated:    rtcsocks.ErrAnswerRepeated,
+	CodeSDPTooSmall:       rtcsocks.ErrSDPTooSmall,
+	CodeSDPTooLarge:       rtcsocks.ErrSDPTooLarge,
+	CodeMalformedSDP:      rtcsocks.ErrMalformedSDP,
+	CodeBadEvent:          rtcsocks.ErrBadReplicationEvent,
+	CodeNoOfferAvailable:  rtcsocks.ErrNoOfferAvailable,
+	CodeAnswerPending:     rtcsocks.ErrAnswerPending,
+	CodeRandomnessFailure: rtcsocks.ErrRNGError,
+	CodeRateLimited:       ErrRateLimited,
+	CodeMailboxDisabled:   rtcsocks.ErrMailboxDisabled,
+	CodeOverloaded:        rtcsocks.ErrOverloaded,
+	CodeSDPNotAllowed:     rtcsocks.ErrSDPNotAllowed,
+	CodeTelemetryDisabled: rtcsocks.ErrTelemetryDisabled,
+	CodeBadReport:         rtcsocks.ErrBadReport,
+	CodeUserNotAllowed:    rtcsocks.ErrUserNotAllowed,
+	CodeTooManySessions:   rtcsocks.ErrTooManySessions,
+	CodeInvalidRequest:    ErrInvalidRequest,
+}
+
+// codeOf returns the ErrorCode of an error returned by a Negotiator callback.
+func codeOf(err error) ErrorCode {
+	if code, ok := errorCodes[err]; ok {
+		return code
+	}
+	if errors.Is(err, rtcsocks.ErrOverloaded) {
+		return CodeOverloaded // an OverloadError
+	}
+	if errors.Is(err, ErrInvalidRequest) {
+		return CodeInvalidRequest // a ValidationError
+	}
+	return CodeInternal
+}
+
+// ResponseError is an error reported by the API. It unwraps to the matching
+// rtcsocks error, so that callers may use errors.Is(err, rtcsocks.ErrQuotaExceeded).
+// With a RetryAfter, it unwraps to a rtcsocks.OverloadError, see rtcsocks.RetryAfter.
+type ResponseError struct {
+	Code       ErrorCode
+	Reference  string        // human-readable reference for debugging
+	RetryAfter time.Duration // delay suggested by the negotiator before retrying, if any
+}
+
+func (e *ResponseError) Error() string {
+	return fmt.Sprintf("negotiator error %s: %s", e.Code, e.Reference)
+}
+
+func (e *ResponseError) Unwrap() error {
+	if e.RetryAfter > 0 {
+		return &rtcsocks.OverloadError{RetryAfter: e.RetryAfter}
+	}
+	return codeErrors[e.Code]
+}
+
+// responseError converts a non-successful response into an error. retryAfter is in seconds.
+func responseError(serverUrl, status, code, reference string, retryAfter int) error {
+	if status == "error" && code != "" {
+		return fmt.Errorf("POST %s: %w", serverUrl, &ResponseError{
+			Code:       ErrorCode(code),
+			Reference:  reference,
+			RetryAfter: time.Duration(retryAfter) * time.Second,
+		})
+	}
+	return fmt.Errorf("POST %s returned status: %s, reference: %s", serverUrl, status, reference)
+}
+
+// sendError responds with status "error", the code of the error and a reference.
+func (a *API) sendError(c *fiber.Ctx, status int, err error) error {
+	if a.logger != nil {
+		if code := codeOf(err); code == CodeInternal {
+			a.logger.Errorf("API: %s %s from %v: %v", c.Method(), c.Path(), a.remoteIP(c), err)
+		} else {
+			a.logger.Debugf("API: %s %s from %v: %s", c.Method(), c.Path(), a.remoteIP(c), code)
+		}
+	}
+	a.recentErrors.record(loggedError{
+		Time:      time.Now(),
+		Method:    utils.CopyString(c.Method()), // fiber reuses the buffers of the request
+		Path:      utils.CopyString(c.Path()),
+		Code:      codeOf(err),
+		Reference: err.Error(),
+	})
+	resp := fiber.Map{
+		"status":    "error",
+		"code":      codeOf(err),
+		"reference": err.Error(),
+	}
+	if wait := rtcsocks.RetryAfter(err); wait > 0 {
+		// in the body too, the header is dropped from sealed responses
+		seconds := int((wait + time.Second - 1) / time.Second)
+		resp["retry_after"] = seconds
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+		status = fiber.StatusServiceUnavailable
+	}
+	var invalid *ValidationError
+	if errors.As(err, &invalid) {
+		resp["field"] = invalid.Field
+		resp["reason"] = invalid.Reason
+	}
+	return c.Status(status).JSON(resp)
+}
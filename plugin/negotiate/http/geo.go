@@ -0,0 +1,169 @@
+package http
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gofiber/fiber/v2"
+)
+
+// GeoInfo is what a GeoResolver knows about an IP address.
+type GeoInfo struct {
+	Country    string // ISO 3166-1 alpha-2 code, e.g. "IR", empty if unknown
+	ASN        uint32 // 0 if unknown
+	Datacenter bool   // the address belongs to a hosting or cloud provider
+}
+
+// GeoResolver looks up IP addresses in a GeoIP/ASN database, e.g. a MaxMind reader
+// wrapped by the operator. It MUST be safe for concurrent use.
+type GeoResolver interface {
+	Resolve(ip net.IP) (GeoInfo, error)
+}
+
+// GeoRule is an admission rule of a GeoPolicy. A rule matches a remote address if all
+// of its set conditions do.
+type GeoRule struct {
+	Countries  []string // nil -> any country
+	ASNs       []uint32 // nil -> any AS
+	Datacenter bool     // match datacenter addresses only
+
+	Deny   bool               // refuse the requests with 404 Not Found, like unauthenticated ones
+	Groups []rtcsocks.GroupID // dispatch the offers only to these of the groups they list, nil -> any
+}
+
+// GeoPolicy admits the requests to the API by the location and AS of their remote
+// address, e.g. to dispatch the offers from censored regions only to volunteer groups,
+// or to refuse datacenter ASes likely to be scanners. The first matching rule applies;
+// requests matching none are admitted as is.
+type GeoPolicy struct {
+	Resolver GeoResolver
+	Rules    []GeoRule
+
+	DenyUnresolved bool // refuse the requests whose address cannot be resolved, false -> no rule matches them
+}
+
+const geoRuleLocal = "rtcsocks.geoRule"
+
+// SetGeoPolicy sets the GeoPolicy enforced on the requests of Clients and Edge
+// Servers, nil -> none. The remote address is the one of the connection, see
+// SetProxyHeader behind a proxy.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetGeoPolicy(p *GeoPolicy) {
+	a.geoPolicy = p
+}
+
+// SetProxyHeader sets the header carrying the remote address of the requests, e.g.
+// "X-Forwarded-For", for an API behind reverse proxies at the trustedProxies, IP
+// addresses or CIDR ranges. The rightmost address of the header is the remote one, the
+// others are added by the Clients or the proxies before them. The header of requests
+// from other addresses is ignored, and requests whose header has no valid rightmost
+// address are refused by the GeoPolicy.
+//
+// It MUST be set before Listen is called.
+func (a *API) SetProxyHeader(header string, trustedProxies ...string) {
+	a.proxyHeader = header
+	a.trustedProxies = trustedProxies
+}
+
+// remoteIP returns the remote address of the request, see SetProxyHeader, or nil if
+// the proxy header has no valid one.
+func (a *API) remoteIP(c *fiber.Ctx) net.IP {
+	if a.proxyHeader == "" || !c.IsProxyTrusted() {
+		return c.Context().RemoteIP()
+	}
+	value := c.Get(a.proxyHeader)
+	if i := strings.LastIndexByte(value, ','); i >= 0 {
+		value = value[i+1:]
+	}
+	return net.ParseIP(strings.TrimSpace(value))
+}
+
+// remoteAddr returns the remote address of the request as a string, empty if invalid.
+func (a *API) remoteAddr(c *fiber.Ctx) string {
+	if ip := a.remoteIP(c); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// admitRemote enforces the GeoPolicy, leaving the matching rule to the handler.
+func (a *API) admitRemote(c *fiber.Ctx) error {
+	if a.geoPolicy == nil {
+		return c.Next()
+	}
+	ip := a.remoteIP(c)
+	rule, ok := a.geoPolicy.match(ip)
+	if ip == nil || !ok || (rule != nil && rule.Deny) {
+		if a.logger != nil {
+			a.logger.Debugf("API: %s %s from %v: refused by the GeoPolicy", c.Method(), c.Path(), ip)
+		}
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if rule != nil {
+		c.Locals(geoRuleLocal, rule)
+	}
+	return c.Next()
+}
+
+// admitGroups returns the groups of an offer the matching rule allows.
+func admitGroups(c *fiber.Ctx, groups []rtcsocks.GroupID) []rtcsocks.GroupID {
+	rule, ok := c.Locals(geoRuleLocal).(*GeoRule)
+	if !ok || rule.Groups == nil {
+		return groups
+	}
+	var allowed []rtcsocks.GroupID
+	for _, g := range groups {
+		for _, r := range rule.Groups {
+			if g == r {
+				allowed = append(allowed, g)
+				break
+			}
+		}
+	}
+	return allowed
+}
+
+// match returns the first rule matching the address, nil if none, and false if the
+// request is refused for being unresolved.
+func (p *GeoPolicy) match(ip net.IP) (*GeoRule, bool) {
+	if ip == nil || p.Resolver == nil {
+		return nil, !p.DenyUnresolved
+	}
+	info, err := p.Resolver.Resolve(ip)
+	if err != nil {
+		return nil, !p.DenyUnresolved
+	}
+	for i := range p.Rules {
+		if p.Rules[i].matches(info) {
+			return &p.Rules[i], true
+		}
+	}
+	return nil, true
+}
+
+func (r *GeoRule) matches(info GeoInfo) bool {
+	if r.Datacenter && !info.Datacenter {
+		return false
+	}
+	if r.Countries != nil {
+		found := false
+		for _, country := range r.Countries {
+			found = found || country == info.Country
+		}
+		if !found {
+			return false
+		}
+	}
+	if r.ASNs != nil {
+		found := false
+		for _, asn := range r.ASNs {
+			found = found || asn == info.ASN
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
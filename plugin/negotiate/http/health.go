@@ -0,0 +1,42 @@
+package http
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Healthy reports whether the offer loop of the Edge Server is running, e.g. for a
+// liveness probe, see package health. It is false before SetNextOfferHandler is
+// called and once the loop stopped or the Server is closed.
+func (s *Server) Healthy() bool {
+	if s.loopDone == nil {
+		return false
+	}
+	select {
+	case <-s.loopDone:
+		return false
+	case <-s.closing:
+		return false
+	default:
+		return true
+	}
+}
+
+// Ready reports whether the Edge Server is healthy and the negotiator answered one of
+// its last polls, e.g. for a readiness probe, see package health. Polls are expected
+// every WaitAfterPending at least while there is no offer, so a Server which has not
+// reached the negotiator for readyPolls times that long is not ready.
+func (s *Server) Ready() bool {
+	if !s.Healthy() {
+		return false
+	}
+	last := atomic.LoadInt64(&s.lastPoll)
+	if last == 0 {
+		return false
+	}
+	wait := s.WaitAfterPending
+	if wait <= 0 {
+		wait = defaultWaitAfterPending
+	}
+	return time.Since(time.Unix(0, last)) < readyPolls*wait+s.WaitAfterError
+}
@@ -0,0 +1,139 @@
+package http
+
+import (
+	"net"
+	"time"
+)
+
+// issuance keeps what the API issues and expects back, e.g. challenges or PAKE
+// handshakes. Entries are capped in total and per remote address, so that no one can
+// take them all up, and per kid, the oldest of a kid giving way to a new one so that
+// requests for a kid cannot lock it out. Expiry is bucketed to look at the expired
+// entries only. The caller MUST serialize the calls.
+type issuance struct {
+	max        int // max entries outstanding
+	maxPerKid  int
+	maxPerAddr int
+
+	entries map[string]*issuedEntry // id -> entry
+	byKid   map[string][]string     // kid -> ids, oldest first
+	byAddr  map[string]int          // remote address -> number of entries
+	buckets map[int64][]string      // expiry / issuanceBucketWidth -> ids
+	oldest  int64                   // no bucket before it
+}
+
+type issuedEntry struct {
+	kid    string
+	addr   string
+	expiry time.Time
+	value  interface{}
+}
+
+func newIssuance(max, maxPerKid, maxPerAddr int) *issuance {
+	return &issuance{
+		max:        max,
+		maxPerKid:  maxPerKid,
+		maxPerAddr: maxPerAddr,
+		entries:    make(map[string]*issuedEntry),
+		byKid:      make(map[string][]string),
+		byAddr:     make(map[string]int),
+		buckets:    make(map[int64][]string),
+		oldest:     time.Now().UnixNano() / int64(issuanceBucketWidth),
+	}
+}
+
+// available reports whether an entry from the address would be accepted now, for
+// callers to check before the work of issuing it.
+func (s *issuance) available(addr string) bool {
+	s.expire(time.Now())
+	return len(s.entries) < s.max && s.byAddr[addr] < s.maxPerAddr
+}
+
+// add issues the entry with the id to the kid and the remote address, or returns
+// false if there are too many outstanding.
+func (s *issuance) add(id, kid, addr string, expiry time.Time, value interface{}) bool {
+	if !s.available(addr) {
+		return false
+	}
+	if ids := s.byKid[kid]; len(ids) >= s.maxPerKid {
+		s.remove(ids[0])
+	}
+
+	s.entries[id] = &issuedEntry{kid: kid, addr: addr, expiry: expiry, value: value}
+	s.byKid[kid] = append(s.byKid[kid], id)
+	s.byAddr[addr]++
+	bucket := expiry.UnixNano()/int64(issuanceBucketWidth) + 1 // round up, so due means expired
+	if bucket < s.oldest {
+		bucket = s.oldest
+	}
+	s.buckets[bucket] = append(s.buckets[bucket], id)
+	return true
+}
+
+// get returns the entry with the id if it has not expired.
+func (s *issuance) get(id string) (*issuedEntry, bool) {
+	e, ok := s.entries[id]
+	if !ok || !time.Now().Before(e.expiry) {
+		return nil, false
+	}
+	return e, true
+}
+
+// take removes the entry with the id, returning it if it has not expired.
+func (s *issuance) take(id string) (*issuedEntry, bool) {
+	e, ok := s.entries[id]
+	if !ok {
+		return nil, false
+	}
+	s.remove(id)
+	return e, time.Now().Before(e.expiry)
+}
+
+// expire removes the entries of the buckets ended by now. An entry taken before is
+// left in its bucket and skipped.
+func (s *issuance) expire(now time.Time) {
+	current := now.UnixNano() / int64(issuanceBucketWidth)
+	for ; s.oldest <= current; s.oldest++ {
+		for _, id := range s.buckets[s.oldest] {
+			s.remove(id)
+		}
+		delete(s.buckets, s.oldest)
+	}
+}
+
+func (s *issuance) remove(id string) {
+	e, ok := s.entries[id]
+	if !ok {
+		return
+	}
+	delete(s.entries, id)
+
+	ids := s.byKid[e.kid]
+	for i, other := range ids {
+		if other == id {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.byKid, e.kid)
+	} else {
+		s.byKid[e.kid] = ids
+	}
+
+	if s.byAddr[e.addr]--; s.byAddr[e.addr] <= 0 {
+		delete(s.byAddr, e.addr)
+	}
+}
+
+// addressKey returns the remote address entries are counted by: the IPv6 addresses
+// by /64, which is usually what one host gets.
+func addressKey(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	if ip.To4() == nil {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
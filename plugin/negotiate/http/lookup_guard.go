@@ -0,0 +1,141 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// lookupGuard delays users failing to look up answers, exponentially in the number
+// of consecutive failures, so that offer IDs of other users cannot be scanned for.
+type lookupGuard struct {
+	base      time.Duration // delay after the first failure, 0 -> disabled
+	max       time.Duration
+	failures  map[rtcsocks.UserID]*lookupFailures // uid -> failures
+	lastPurge time.Time
+	mutex     sync.Mutex
+}
+
+type lookupFailures struct {
+	count        int
+	blockedUntil time.Time
+}
+
+func newLookupGuard() *lookupGuard {
+	return &lookupGuard{
+		base:     defaultLookupBackoff,
+		max:      defaultMaxLookupBackoff,
+		failures: make(map[rtcsocks.UserID]*lookupFailures),
+	}
+}
+
+// SetLookupBackoff sets the delay imposed on a user after a failed answer lookup,
+// i.e., one for an offer ID that does not exist or is not owned by the user. The
+// delay doubles on every consecutive failure up to max. Zero base disables it.
+func (a *API) SetLookupBackoff(base, max time.Duration) {
+	a.lookupGuard.mutex.Lock()
+	defer a.lookupGuard.mutex.Unlock()
+	a.lookupGuard.base = base
+	a.lookupGuard.max = max
+}
+
+// SetOfferTokenKey enables 128-bit offer tokens: the offer ID returned to the user is
+// extended with a tag derived from the key, and answers may only be looked up with
+// the full token. The key SHOULD be shared by all replicas.
+func (a *API) SetOfferTokenKey(key []byte) {
+	a.offerTokenKey = key
+}
+
+// blocked returns how long the user must wait before the next lookup.
+func (g *lookupGuard) blocked(uid rtcsocks.UserID) time.Duration {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if f, ok := g.failures[uid]; ok {
+		if wait := time.Until(f.blockedUntil); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
+
+func (g *lookupGuard) fail(uid rtcsocks.UserID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.base <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(g.lastPurge) > g.max {
+		for u, f := range g.failures {
+			if now.Sub(f.blockedUntil) > g.max {
+				delete(g.failures, u)
+			}
+		}
+		g.lastPurge = now
+	}
+
+	f, ok := g.failures[uid]
+	if !ok {
+		f = &lookupFailures{}
+		g.failures[uid] = f
+	}
+	f.count++
+
+	delay := g.base
+	for i := 1; i < f.count && delay < g.max; i++ {
+		delay *= 2
+	}
+	if g.max > 0 && delay > g.max {
+		delay = g.max
+	}
+	f.blockedUntil = now.Add(delay)
+}
+
+func (g *lookupGuard) succeed(uid rtcsocks.UserID) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.failures, uid)
+}
+
+// offerToken returns the 128-bit token of an offer ID, as 32 hex digits.
+func (a *API) offerToken(uid rtcsocks.UserID, offerID rtcsocks.OfferID) string {
+	return fmt.Sprintf("%016x", uint64(offerID)) + hex.EncodeToString(a.offerTag(uid, offerID))
+}
+
+func (a *API) offerTag(uid rtcsocks.UserID, offerID rtcsocks.OfferID) []byte {
+	var msg [16]byte
+	binary.BigEndian.PutUint64(msg[:8], uint64(uid))
+	binary.BigEndian.PutUint64(msg[8:], uint64(offerID))
+	mac := hmac.New(sha256.New, a.offerTokenKey)
+	mac.Write(msg[:])
+	return mac.Sum(nil)[:8]
+}
+
+// parseOfferID parses the offer ID looked up by the user, which MUST be an offer
+// token if offer tokens are enabled.
+func (a *API) parseOfferID(uid rtcsocks.UserID, s string) (rtcsocks.OfferID, bool) {
+	if len(a.offerTokenKey) == 0 {
+		offerID, err := rtcsocks.ParseOfferID(s)
+		return offerID, err == nil
+	}
+
+	if len(s) != 32 {
+		return 0, false
+	}
+	offerID, err := rtcsocks.ParseOfferID(s[:16])
+	if err != nil {
+		return 0, false
+	}
+	tag, err := hex.DecodeString(s[16:])
+	if err != nil {
+		return 0, false
+	}
+	return offerID, hmac.Equal(tag, a.offerTag(uid, offerID))
+}
@@ -0,0 +1,219 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+func (a *API) SetRegisterMailboxOfferCallback(f rtcsocks.RegisterOfferCallbackFunction) {
+	a.registerMailboxOfferCallback = f
+}
+
+func (a *API) SetCollectAnswersCallback(f rtcsocks.CollectAnswersCallbackFunction) {
+	a.collectAnswersCallback = f
+}
+
+func (a *API) registerMailboxOffer(c *fiber.Ctx) error {
+	if a.registerMailboxOfferCallback == nil {
+		return a.sendError(c, fiber.StatusNotFound, rtcsocks.ErrMailboxDisabled)
+	}
+	return a.handleOffer(c, a.registerMailboxOfferCallback, false)
+}
+
+func (a *API) collectAnswers(c *fiber.Ctx) error {
+	var postForm struct {
+		UID       string `json:"uid" validate:"required,id"`     // User ID, hex
+		Timestamp string `json:"ts" validate:"required,decimal"` // Unix time in seconds, decimal, the message authenticated
+		HMAC      string `json:"hmac" validate:"base64"`         // HMAC or signature, base64
+		Scheme    string `json:"scheme"`                         // authentication scheme, empty -> auth.DefaultScheme
+		PAKE      string `json:"pake_session"`                   // PAKE session ID, if Scheme is PAKEScheme
+		Chal      string `json:"challenge" validate:"base64"`    // challenge included in the HMAC, optional
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ts, err := strconv.ParseInt(postForm.Timestamp, 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxCollectSkew || skew < -maxCollectSkew {
+		return c.SendStatus(fiber.StatusNotFound) // limits replay of the request
+	}
+
+	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if !a.verifyAuth(uid, postForm.Scheme, postForm.PAKE, postForm.Chal, []byte("collect:"+postForm.Timestamp), hmac) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if a.collectAnswersCallback == nil {
+		return a.sendError(c, fiber.StatusNotFound, rtcsocks.ErrMailboxDisabled)
+	}
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	answers, err := a.collectAnswersCallback(ctx, uid)
+	if err != nil {
+		return a.sendError(c, fiber.StatusInternalServerError, err)
+	}
+
+	encoded := make(map[string]string, len(answers))
+	for offerID, answer := range answers {
+		encoded[offerID.String()] = base64.StdEncoding.EncodeToString(answer)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":  "success",
+		"answers": encoded,
+	})
+}
+
+// RegisterMailboxOffer leaves an offer for later: Edge Servers answer it while the
+// Client may be offline, and the answer is collected with CollectAnswers.
+func (c *Client) RegisterMailboxOffer(offer []byte, groupID ...rtcsocks.GroupID) (offerID rtcsocks.OfferID, err error) {
+	return c.registerOffer(context.Background(), "/rtcsocks/mailbox/new", offer, groupID, 0)
+}
+
+// CollectAnswers returns the answers to the mailbox offers of the user, offer_id ->
+// answer SDP. If AnswerVerifyKeys is set, answers to offers not registered by this
+// Client cannot be verified and are skipped.
+func (c *Client) CollectAnswers() (answers map[rtcsocks.OfferID][]byte, err error) {
+	return c.CollectAnswersContext(context.Background())
+}
+
+// CollectAnswersContext is CollectAnswers, cancelled with ctx.
+func (c *Client) CollectAnswersContext(ctx context.Context) (answers map[rtcsocks.OfferID][]byte, err error) {
+	if c.ServerAddr == "" {
+		return nil, ErrInvalidServerAddr
+	}
+
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/mailbox/collect")
+
+	uid, err := c.userID()
+	if err != nil {
+		return nil, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	postForm := map[string]interface{}{
+		"uid": uid.String(), // hex string
+		"ts":  ts,
+	}
+	if err := c.authenticate(ctx, postForm, uid, []byte("collect:"+ts), false); err != nil {
+		return nil, err
+	}
+	s, err := c.sealer(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// a user may have many answers waiting, decoded as they arrive
+	resp, err := sendStream(
+		ctx,
+		c.Carrier,
+		s,
+		serverUrl,
+		postForm,
+		c.httpOptions(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+	defer resp.Body.Close()
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	answers = make(map[rtcsocks.OfferID][]byte)
+	var rejected []rtcsocks.OfferID // answers failing verification
+	dec := json.NewDecoder(resp.Body)
+	err = decodeObject(dec, func(key string) error {
+		switch key {
+		case "status":
+			return dec.Decode(&responseData.Status)
+		case "code":
+			return dec.Decode(&responseData.Code)
+		case "reference":
+			return dec.Decode(&responseData.Reference)
+		case "retry_after":
+			return dec.Decode(&responseData.RetryAfter)
+		case "answers": // offer_id (hex) -> answer (base64)
+			return decodeObject(dec, func(offerIDHex string) error {
+				var answerB64 string
+				if err := dec.Decode(&answerB64); err != nil {
+					return err
+				}
+				offerID, err := rtcsocks.ParseOfferID(offerIDHex)
+				if err != nil {
+					return fmt.Errorf("non-Hex offer_id returned by negotiator: %s", offerIDHex)
+				}
+				answer, err := base64.StdEncoding.DecodeString(answerB64)
+				if err != nil {
+					return fmt.Errorf("base64 decode error: %w", err)
+				}
+
+				if len(c.AnswerVerifyKeys) > 0 {
+					c.mutexOffers.Lock()
+					registered, ok := c.offers[offerID]
+					c.mutexOffers.Unlock()
+					if !ok || registered.sdp == nil {
+						if c.Logger != nil {
+							c.Logger.Warnf("Client: answer to unknown offer %s cannot be verified, skipped", offerID)
+						}
+						return nil
+					}
+					answer, err = rtcsocks.VerifyAnswer(c.AnswerVerifyKeys, registered.sdp, answer)
+					if err != nil {
+						if c.Logger != nil {
+							c.Logger.Warnf("Client: answer to offer %s: %v, skipped", offerID, err)
+						}
+						rejected = append(rejected, offerID)
+						return nil
+					}
+				}
+				answers[offerID] = answer
+				return nil
+			})
+		default:
+			return dec.Decode(&json.RawMessage{})
+		}
+	})
+	if err != nil {
+		if errors.Is(err, ErrInvalidResponseFormat) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	if responseData.Status != "success" {
+		return nil, responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+
+	for _, offerID := range rejected {
+		c.forgetOffer(offerID)
+	}
+	for offerID := range answers {
+		c.forgetOffer(offerID)
+	}
+	return answers, nil
+}
@@ -0,0 +1,157 @@
+package http
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// MultiServer serves several groups from one Edge Server. Each group is polled and
+// answered by its own Server, with its own GroupID and credentials, and the answers
+// are routed to the Server of the group the offer came from.
+//
+// Each Server MAY have its own concurrency budget in Admit, e.g. with its own
+// rtcsocks.ConcurrencyLimit, and its own handler, see SetGroupOfferHandler.
+type MultiServer struct {
+	servers  []*Server
+	handlers map[rtcsocks.GroupID]rtcsocks.NextOfferHandlerFunction
+
+	offers map[rtcsocks.OfferID]*multiServerOffer // offer_id -> offer being answered
+	mutex  sync.Mutex
+}
+
+type multiServerOffer struct {
+	server   *Server
+	received time.Time
+}
+
+// NewMultiServer returns a MultiServer serving the groups of the servers, which MUST
+// NOT be started yet. It returns ErrDuplicateGroup if a group has more than one Server.
+func NewMultiServer(servers ...*Server) (*MultiServer, error) {
+	m := &MultiServer{
+		handlers: make(map[rtcsocks.GroupID]rtcsocks.NextOfferHandlerFunction),
+		offers:   make(map[rtcsocks.OfferID]*multiServerOffer),
+	}
+	seen := make(map[rtcsocks.GroupID]bool)
+	for _, s := range servers {
+		if seen[s.GroupID] {
+			return nil, ErrDuplicateGroup
+		}
+		seen[s.GroupID] = true
+		m.servers = append(m.servers, s)
+	}
+	return m, nil
+}
+
+// Server returns the Server of the group, nil if the group is not served.
+func (m *MultiServer) Server(group rtcsocks.GroupID) *Server {
+	for _, s := range m.servers {
+		if s.GroupID == group {
+			return s
+		}
+	}
+	return nil
+}
+
+// SetGroupOfferHandler sets the handler of the offers of one group, in place of the
+// one set by SetNextOfferHandler.
+//
+// It MUST be called before SetNextOfferHandler.
+func (m *MultiServer) SetGroupOfferHandler(group rtcsocks.GroupID, handler rtcsocks.NextOfferHandlerFunction) {
+	m.handlers[group] = handler
+}
+
+// SetNextOfferHandler sets the handler of the offers of the groups without their own,
+// and starts polling for all groups.
+func (m *MultiServer) SetNextOfferHandler(handler rtcsocks.NextOfferHandlerFunction) {
+	for _, s := range m.servers {
+		s := s
+		h, ok := m.handlers[s.GroupID]
+		if !ok {
+			h = handler
+		}
+		s.SetNextOfferHandler(func(offerID rtcsocks.OfferID, sdp []byte) error {
+			m.remember(offerID, s)
+			err := h(offerID, sdp)
+			if err != nil {
+				m.forget(offerID) // declined or failed, not answered by this Edge Server
+			}
+			return err
+		})
+	}
+}
+
+// RegisterAnswer registers the answer with the Server of the group the offer came from.
+// It returns rtcsocks.ErrInvalidOfferID if the offer was not received by any of them.
+func (m *MultiServer) RegisterAnswer(offerID rtcsocks.OfferID, answer []byte) error {
+	return m.RegisterAnswerContext(context.Background(), offerID, answer)
+}
+
+// RegisterAnswerContext is RegisterAnswer, cancelled with ctx.
+func (m *MultiServer) RegisterAnswerContext(ctx context.Context, offerID rtcsocks.OfferID, answer []byte) error {
+	m.mutex.Lock()
+	offer, ok := m.offers[offerID]
+	m.mutex.Unlock()
+	if !ok {
+		return rtcsocks.ErrInvalidOfferID
+	}
+	if err := offer.server.RegisterAnswerContext(ctx, offerID, answer); err != nil {
+		return err // kept for a retry
+	}
+	m.forget(offerID)
+	return nil
+}
+
+// DeclineOffer hands the offer back to the negotiator, see Server.DeclineOffer.
+func (m *MultiServer) DeclineOffer(offerID rtcsocks.OfferID) error {
+	m.mutex.Lock()
+	offer, ok := m.offers[offerID]
+	m.mutex.Unlock()
+	if !ok {
+		return rtcsocks.ErrInvalidOfferID
+	}
+	m.forget(offerID)
+	return offer.server.DeclineOffer(offerID)
+}
+
+// Close drains all the Servers at once, see Server.Close, and returns the first error.
+func (m *MultiServer) Close(grace time.Duration) error {
+	errs := make(chan error, len(m.servers))
+	for _, s := range m.servers {
+		go func(s *Server) {
+			errs <- s.Close(grace)
+		}(s)
+	}
+	var first error
+	for range m.servers {
+		if err := <-errs; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// remember routes the answer to the offer to the Server, and forgets offers never
+// answered.
+func (m *MultiServer) remember(offerID rtcsocks.OfferID, s *Server) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for id, o := range m.offers {
+		if now.Sub(o.received) > unansweredOfferTTL {
+			delete(m.offers, id)
+		}
+	}
+	m.offers[offerID] = &multiServerOffer{
+		server:   s,
+		received: now,
+	}
+}
+
+func (m *MultiServer) forget(offerID rtcsocks.OfferID) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.offers, offerID)
+}
@@ -0,0 +1,129 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// Responses are bound to a nonce the Client or Server picks for each request, see
+// Client.BindResponses: the API puts the nonce of the request first in the response
+// and, for a sealed request, in the data the response envelope authenticates. A
+// response replayed or served from a cache by a middlebox carries another nonce.
+//
+// A response in the clear is only as authentic as the transport, the nonce tells
+// stale responses from fresh ones. Only the sealed ones cannot be forged.
+
+const nonceLocal = "rtcsocks_nonce" // fiber.Ctx.Locals key of the request nonce
+
+// requestNonce is the nonce field of a request form.
+type requestNonce struct {
+	Nonce string `json:"nonce" validate:"base64,max=24"` // base64, see bindResponse
+}
+
+func newNonce() (string, error) {
+	var buf [requestNonceSize]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf[:]), nil
+}
+
+// keepNonce keeps the nonce of the request, if any, to bind the response to.
+func (a *API) keepNonce(c *fiber.Ctx, n *requestNonce) error {
+	if err := validateForm(n); err != nil {
+		return err
+	}
+	if n.Nonce != "" {
+		c.Locals(nonceLocal, n.Nonce)
+	}
+	return nil
+}
+
+// bindResponse puts the nonce of the request first in the JSON response.
+func (a *API) bindResponse(c *fiber.Ctx) error {
+	err := c.Next()
+	nonce, ok := c.Locals(nonceLocal).(string)
+	if !ok || err != nil {
+		return err
+	}
+	body := c.Response().Body()
+	if len(body) < 2 || body[0] != '{' {
+		return nil
+	}
+
+	member, err := json.Marshal(nonce)
+	if err != nil {
+		return err
+	}
+	bound := make([]byte, 0, len(body)+len(member)+len(`"nonce":,`))
+	bound = append(bound, `{"nonce":`...)
+	bound = append(bound, member...)
+	if rest := bytes.TrimSpace(body[1:]); len(rest) > 0 && rest[0] != '}' {
+		bound = append(bound, ',')
+	}
+	c.Response().SetBody(append(bound, body[1:]...))
+	return nil
+}
+
+// checkNonce fails with ErrResponseNotBound a successful response not bound to the
+// nonce. Failures may be unbound, a middlebox may fail requests anyway.
+func checkNonce(body []byte, nonce string) error {
+	var responseData struct {
+		Status string `json:"status"`
+		Nonce  string `json:"nonce"`
+	}
+	if json.Unmarshal(body, &responseData) != nil {
+		return nil // left to the caller to reject
+	}
+	if responseData.Nonce == nonce || (responseData.Nonce == "" && responseData.Status != "success") {
+		return nil
+	}
+	return ErrResponseNotBound
+}
+
+// checkNonceStream checks the nonce of a streamed response, which the API puts first
+// so that the rest is streamed past it. Others are buffered to be checked whole.
+func checkNonceStream(resp *utils.Response, nonce string) (*utils.Response, error) {
+	member, err := json.Marshal(nonce)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	prefix := append([]byte(`{"nonce":`), member...)
+
+	br := bufio.NewReaderSize(resp.Body, len(prefix)+1)
+	head, err := br.Peek(len(prefix) + 1)
+	if err == nil && bytes.Equal(head[:len(prefix)], prefix) {
+		skip := len(prefix)
+		if head[skip] == ',' {
+			skip++
+		}
+		br.Discard(skip)
+		return &utils.Response{
+			StatusCode: resp.StatusCode,
+			Body:       &streamedBody{Reader: io.MultiReader(bytes.NewReader([]byte("{")), br), Closer: resp.Body},
+		}, nil
+	}
+
+	body, err := io.ReadAll(br)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkNonce(body, nonce); err != nil {
+		return nil, err
+	}
+	return &utils.Response{StatusCode: resp.StatusCode, Body: io.NopCloser(bytes.NewReader(body))}, nil
+}
+
+type streamedBody struct {
+	io.Reader
+	io.Closer
+}
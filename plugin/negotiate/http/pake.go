@@ -0,0 +1,286 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/auth"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+)
+
+// pakeStore keeps the SRP handshakes in progress and the established PAKE sessions,
+// capped like the challenges, see issuance.
+type pakeStore struct {
+	handshakes   *issuance // handshake_id -> *pakeHandshake in progress
+	sessions     *issuance // session_id -> established *pakeSession
+	fakeKey      []byte    // derives fake salts for unknown users
+	fakeVerifier []byte    // SRP verifier of all unknown users
+	mutex        sync.Mutex
+}
+
+type pakeHandshake struct {
+	uid    rtcsocks.UserID
+	server *auth.SRPServer // of a fake secret for unknown users
+	known  bool
+	A      []byte
+}
+
+type pakeSession struct {
+	uid rtcsocks.UserID
+	key []byte
+}
+
+func newPAKEStore() *pakeStore {
+	fakeKey := make([]byte, 32)
+	rand.Read(fakeKey)
+	fakeVerifier := make([]byte, 256)
+	rand.Read(fakeVerifier)
+	return &pakeStore{
+		handshakes:   newIssuance(maxPAKEHandshakes, maxPAKEHandshakesPerUser, maxPAKEHandshakesPerAddress),
+		sessions:     newIssuance(maxPAKESessions, maxPAKESessionsPerUser, maxPAKESessions),
+		fakeKey:      fakeKey,
+		fakeVerifier: fakeVerifier,
+	}
+}
+
+// sessionKey returns the key of an established session of the user.
+func (p *pakeStore) sessionKey(uid rtcsocks.UserID, session string) ([]byte, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	e, ok := p.sessions.get(session)
+	if !ok {
+		return nil, false
+	}
+	s := e.value.(*pakeSession)
+	if s.uid != uid {
+		return nil, false
+	}
+	return s.key, true
+}
+
+// fakeSecret returns a consistent but unusable SRP secret for an unknown user, so
+// the handshake does not reveal whether the user exists.
+func (p *pakeStore) fakeSecret(uid rtcsocks.UserID) string {
+	h := hmac.New(sha256.New, p.fakeKey)
+	h.Write([]byte(uid.String()))
+	salt := h.Sum(nil)[:16]
+	return "srp:" + base64.StdEncoding.EncodeToString(salt) + ":" + base64.StdEncoding.EncodeToString(p.fakeVerifier)
+}
+
+func randomID() string {
+	var buf [16]byte
+	rand.Read(buf[:])
+	return hex.EncodeToString(buf[:])
+}
+
+func (a *API) pakeInit(c *fiber.Ctx) error {
+	var postForm struct {
+		UID string `json:"uid" validate:"required,id"`   // User ID, hex
+		A   string `json:"A" validate:"required,base64"` // client public ephemeral, base64
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	A, err := base64.StdEncoding.DecodeString(postForm.A)
+	if err != nil || len(A) == 0 {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	// checked before the modular exponentiation too, a flood of handshakes from an
+	// address costs nothing more
+	addr := addressKey(a.remoteIP(c))
+	a.pake.mutex.Lock()
+	available := a.pake.handshakes.available(addr)
+	a.pake.mutex.Unlock()
+	if !available {
+		return a.sendError(c, fiber.StatusServiceUnavailable, &rtcsocks.OverloadError{RetryAfter: pakeHandshakeTTL})
+	}
+
+	secret, err := a.credentials.UserSecret(uid)
+	known := err == nil
+	if !known {
+		secret = a.pake.fakeSecret(uid)
+	}
+
+	server, salt, B, err := auth.NewSRPServer(secret)
+	if err != nil {
+		// the user does not authenticate with SRP, behave as unknown
+		known = false
+		if server, salt, B, err = auth.NewSRPServer(a.pake.fakeSecret(uid)); err != nil {
+			return a.sendError(c, fiber.StatusInternalServerError, err)
+		}
+	}
+
+	handshakeID := randomID()
+	a.pake.mutex.Lock()
+	added := a.pake.handshakes.add(handshakeID, kidUserPrefix+uid.String(), addr, time.Now().Add(pakeHandshakeTTL), &pakeHandshake{
+		uid:    uid,
+		server: server,
+		known:  known,
+		A:      A,
+	})
+	a.pake.mutex.Unlock()
+	if !added {
+		return a.sendError(c, fiber.StatusServiceUnavailable, &rtcsocks.OverloadError{RetryAfter: pakeHandshakeTTL})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":    "success",
+		"handshake": handshakeID,
+		"salt":      base64.StdEncoding.EncodeToString(salt),
+		"B":         base64.StdEncoding.EncodeToString(B),
+	})
+}
+
+func (a *API) pakeVerify(c *fiber.Ctx) error {
+	var postForm struct {
+		Handshake string `json:"handshake" validate:"required"` // handshake ID returned by pakeInit
+		M1        string `json:"M1" validate:"required,base64"` // client proof, base64
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	M1, err := base64.StdEncoding.DecodeString(postForm.M1)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	a.pake.mutex.Lock()
+	e, ok := a.pake.handshakes.take(postForm.Handshake) // single attempt per handshake
+	a.pake.mutex.Unlock()
+	if !ok {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	h := e.value.(*pakeHandshake)
+
+	// verified for unknown users too, failing as slowly as for a wrong password
+	M2, key, err := h.server.Verify(h.A, M1)
+	if err != nil || !h.known {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	sessionID := randomID()
+	a.pake.mutex.Lock()
+	added := a.pake.sessions.add(sessionID, e.kid, e.addr, time.Now().Add(pakeSessionTTL), &pakeSession{
+		uid: h.uid,
+		key: key,
+	})
+	a.pake.mutex.Unlock()
+	if !added {
+		return a.sendError(c, fiber.StatusServiceUnavailable, &rtcsocks.OverloadError{RetryAfter: pakeHandshakeTTL})
+	}
+
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status":     "success",
+		"session":    sessionID,
+		"M2":         base64.StdEncoding.EncodeToString(M2),
+		"expires_in": int(pakeSessionTTL.Seconds()),
+	})
+}
+
+type clientPAKESession struct {
+	id     string
+	key    []byte
+	expiry time.Time
+}
+
+// pakeSession returns the established PAKE session, or performs a new SRP handshake
+// if there is none or it is about to expire.
+func (c *Client) pakeSession(ctx context.Context) (session string, key []byte, err error) {
+	c.mutexPAKE.Lock()
+	defer c.mutexPAKE.Unlock()
+	if c.pake != nil && time.Now().Add(pakeRenewBefore).Before(c.pake.expiry) {
+		return c.pake.id, c.pake.key, nil
+	}
+
+	identity := c.UserID.String()
+	srp, A, err := auth.NewSRPClient(identity, c.Password)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var initResp struct {
+		Status    string `json:"status"`
+		Handshake string `json:"handshake"`
+		Salt      []byte `json:"salt"`
+		B         []byte `json:"B"`
+	}
+	if err := c.postPAKE(ctx, "/rtcsocks/auth/pake/init", map[string]interface{}{
+		"uid": identity,
+		"A":   A, // byte array as base64 string (auto-encoded)
+	}, &initResp); err != nil {
+		return "", nil, err
+	}
+
+	M1, err := srp.Proof(initResp.Salt, initResp.B)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var verifyResp struct {
+		Status    string `json:"status"`
+		Session   string `json:"session"`
+		M2        []byte `json:"M2"`
+		ExpiresIn int    `json:"expires_in"`
+	}
+	if err := c.postPAKE(ctx, "/rtcsocks/auth/pake/verify", map[string]interface{}{
+		"handshake": initResp.Handshake,
+		"M1":        M1,
+	}, &verifyResp); err != nil {
+		return "", nil, err
+	}
+
+	key, err = srp.Key(verifyResp.M2)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c.pake = &clientPAKESession{
+		id:     verifyResp.Session,
+		key:    key,
+		expiry: time.Now().Add(time.Duration(verifyResp.ExpiresIn) * time.Second),
+	}
+	return c.pake.id, c.pake.key, nil
+}
+
+func (c *Client) postPAKE(ctx context.Context, path string, postForm map[string]interface{}, responseData interface{}) error {
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, path)
+
+	status, resp, err := send(
+		ctx,
+		c.Carrier,
+		nil, // no secret shared with the negotiator before the handshake
+		serverUrl,
+		postForm,
+		c.httpOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+	if status != fiber.StatusOK {
+		return fmt.Errorf("POST %s returned HTTP status: %d", serverUrl, status)
+	}
+	if json.Unmarshal(resp, responseData) != nil {
+		return ErrInvalidResponseFormat
+	}
+	return nil
+}
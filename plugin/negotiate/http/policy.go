@@ -0,0 +1,62 @@
+package http
+
+import (
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// ErrorAction is the action the Server takes after failing to read the next offer.
+type ErrorAction uint8
+
+const (
+	ActionRetry   ErrorAction = iota // retry after ErrorPolicy.Wait
+	ActionBackoff                    // retry after an exponentially growing wait, starting from ErrorPolicy.Wait
+	ActionNotify                     // call Server.ErrorNotifier, then retry after ErrorPolicy.Wait
+	ActionAbort                      // stop reading offers
+)
+
+// ErrorPolicy describes how the Server reacts to an error returned by readNextOffer.
+type ErrorPolicy struct {
+	Action  ErrorAction
+	Wait    time.Duration // sleep duration before retrying, base duration for ActionBackoff
+	MaxWait time.Duration // upper bound of the wait for ActionBackoff, 0 -> defaultMaxBackoff
+}
+
+// ErrorClassifierFunction classifies an error returned by readNextOffer into an ErrorPolicy.
+type ErrorClassifierFunction func(err error) ErrorPolicy
+
+// defaultErrorClassifier keeps the behavior configured via WaitAfterPending and WaitAfterError.
+func (s *Server) defaultErrorClassifier(err error) ErrorPolicy {
+	if wait := rtcsocks.RetryAfter(err); wait > 0 {
+		return ErrorPolicy{Action: ActionRetry, Wait: wait}
+	}
+	if err == rtcsocks.ErrNoOfferAvailable {
+		if s.WaitAfterPending > 0 {
+			return ErrorPolicy{Action: ActionRetry, Wait: s.WaitAfterPending}
+		}
+		return ErrorPolicy{Action: ActionRetry, Wait: defaultWaitAfterPending}
+	}
+
+	if s.WaitAfterError > 0 {
+		return ErrorPolicy{Action: ActionRetry, Wait: s.WaitAfterError}
+	}
+	return ErrorPolicy{Action: ActionAbort}
+}
+
+// backoff returns the wait duration for the n-th consecutive failure (n >= 1).
+func (p ErrorPolicy) backoff(n int) time.Duration {
+	maxWait := p.MaxWait
+	if maxWait <= 0 {
+		maxWait = defaultMaxBackoff
+	}
+
+	wait := p.Wait
+	for i := 1; i < n && wait < maxWait; i++ {
+		wait *= 2
+	}
+	if wait > maxWait {
+		wait = maxWait
+	}
+	return wait
+}
@@ -0,0 +1,106 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gofiber/fiber/v2"
+)
+
+// SetPollSessions issues poll tokens to the Edge Servers polling for offers with a
+// session ID, once authenticated with the group secret or the MAC of a challenge.
+// The token is accepted in place of them for the next polls of the same session,
+// until it expires after ttl, 0 -> defaultPollTokenTTL. Polls with a token do not
+// send the group secret or fetch a challenge again, and are tied to the session.
+//
+// Edge Servers authenticating with a delegation token get no poll token, so that the
+// limits of the delegation token keep applying. Rotating a group secret does not
+// revoke the tokens issued already, which expire within ttl. The key SHOULD be shared
+// by all replicas: Servers authenticate again when their token is rejected.
+func (a *API) SetPollSessions(key []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = defaultPollTokenTTL
+	}
+	a.pollTokenKey = key
+	a.pollTokenTTL = ttl
+}
+
+// pollToken returns a poll token for the session of the group, expiring after
+// the ttl set, or "" if poll sessions are disabled or the session ID is empty.
+func (a *API) pollToken(gid rtcsocks.GroupID, session string) string {
+	if len(a.pollTokenKey) == 0 || session == "" {
+		return ""
+	}
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(time.Now().Add(a.pollTokenTTL).Unix()))
+	token := append(buf[:], a.pollTokenTag(gid, session, buf[:])...)
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// verifyPollToken reports whether the poll token was issued to the session of the
+// group and has not expired.
+func (a *API) verifyPollToken(gid rtcsocks.GroupID, session, token string) bool {
+	if len(a.pollTokenKey) == 0 || session == "" {
+		return false
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 8+pollTokenTagSize {
+		return false
+	}
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(b[:8])), 0)
+	return hmac.Equal(a.pollTokenTag(gid, session, b[:8]), b[8:]) && time.Now().Before(expiry)
+}
+
+func (a *API) pollTokenTag(gid rtcsocks.GroupID, session string, expiry []byte) []byte {
+	mac := hmac.New(sha256.New, a.pollTokenKey)
+	mac.Write([]byte("poll:" + gid.String() + ":" + session + ":"))
+	mac.Write(expiry)
+	return mac.Sum(nil)[:pollTokenTagSize]
+}
+
+// addPollToken adds the poll token, if any, to a nextOffer response.
+func (a *API) addPollToken(resp fiber.Map, token string) fiber.Map {
+	if token != "" {
+		resp["poll_token"] = token
+		resp["poll_token_ttl"] = int(a.pollTokenTTL / time.Second)
+	}
+	return resp
+}
+
+// setPollToken keeps the poll token returned by the negotiator for the next polls,
+// see API.SetPollSessions. ttl is in seconds.
+func (s *Server) setPollToken(token string, ttl int) {
+	if token == "" || ttl <= 0 {
+		return
+	}
+	s.mutexPollToken.Lock()
+	defer s.mutexPollToken.Unlock()
+	s.pollToken = token
+	// renewed a little early, rather than rejected in flight
+	s.pollTokenExpiry = time.Now().Add(time.Duration(ttl)*time.Second - pollTokenRenewBefore)
+}
+
+// usePollToken returns the poll token to authorize the next poll with, if any.
+func (s *Server) usePollToken() (string, bool) {
+	s.mutexPollToken.Lock()
+	defer s.mutexPollToken.Unlock()
+	if s.pollToken == "" || time.Now().After(s.pollTokenExpiry) {
+		s.pollToken = ""
+		return "", false
+	}
+	return s.pollToken, true
+}
+
+// dropPollToken forgets a poll token rejected or not answered by the negotiator,
+// the next poll authenticates again.
+func (s *Server) dropPollToken(token string) {
+	s.mutexPollToken.Lock()
+	defer s.mutexPollToken.Unlock()
+	if s.pollToken == token {
+		s.pollToken = ""
+	}
+}
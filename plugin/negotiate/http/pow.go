@@ -0,0 +1,62 @@
+package http
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// SetProofOfWork requires offers, including mailbox offers, to come with a proof of
+// work: a nonce such that the SHA-256 of powMessage has at least the given number of
+// leading zero bits, for a challenge issued to the user, see Client.ProofOfWork. Each
+// additional bit doubles the work, which makes flooding an open deployment with
+// offers, or scanning it with many credentials, expensive. Offers without a valid
+// proof get 404 Not Found like unauthorized ones. Other requests are not affected.
+//
+// 0 disables it, the default. At most maxProofOfWorkBits are required. It MUST be
+// set before Listen is called.
+func (a *API) SetProofOfWork(bits int) {
+	if bits > maxProofOfWorkBits {
+		bits = maxProofOfWorkBits
+	}
+	a.powBits = bits
+}
+
+// powMessage is the message hashed for a proof of work with the nonce.
+func powMessage(challenge, nonce string) []byte {
+	return []byte("pow:" + challenge + ":" + nonce)
+}
+
+// powSolved reports whether the nonce is a proof of work of the difficulty for the
+// challenge.
+func powSolved(challenge, nonce string, difficulty int) bool {
+	sum := sha256.Sum256(powMessage(challenge, nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 || zeros >= difficulty {
+			break
+		}
+	}
+	return zeros >= difficulty
+}
+
+// solvePoW returns a nonce proving the work for the challenge.
+func solvePoW(challenge string, difficulty int) string {
+	for i := uint64(0); ; i++ {
+		nonce := strconv.FormatUint(i, 36)
+		if powSolved(challenge, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
+
+// checkProofOfWork reports whether an offer with the challenge and nonce passes,
+// which it does regardless if no proof of work is required. The challenge itself is
+// consumed when the request is authenticated.
+func (a *API) checkProofOfWork(challenge, nonce string) bool {
+	if a.powBits <= 0 {
+		return true
+	}
+	return challenge != "" && len(nonce) <= maxNonceLen && powSolved(challenge, nonce, a.powBits)
+}
@@ -0,0 +1,37 @@
+package http
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+func (a *API) SetWaitAnswerCallback(f rtcsocks.WaitAnswerCallbackFunction) {
+	a.waitAnswerCallback = f
+}
+
+// waitAnswer waits up to the wait requested with the offer, in seconds, for its answer.
+func (a *API) waitAnswer(ctx context.Context, uid rtcsocks.UserID, offerID rtcsocks.OfferID, wait string) ([]byte, bool) {
+	if a.waitAnswerCallback == nil || wait == "" {
+		return nil, false
+	}
+	seconds, err := strconv.Atoi(wait)
+	if err != nil || seconds <= 0 {
+		return nil, false
+	}
+	timeout := time.Duration(seconds) * time.Second
+	if timeout > maxAnswerWait {
+		timeout = maxAnswerWait
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	answer, err := a.waitAnswerCallback(ctx, uid, offerID)
+	if err != nil {
+		// pending or failed, the Client looks it up as usual
+		return nil, false
+	}
+	return answer, true
+}
@@ -0,0 +1,258 @@
+package http
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+)
+
+// Replicator broadcasts the ReplicationEvents of a Negotiator to the APIs of its
+// peer replicas, using the /rtcsocks/replica/event endpoint. The events are sent to
+// each peer in order, by a worker per peer retrying with backoff, so that a peer does
+// not apply the dispatch of an offer before its registration.
+//
+// Each event carries the time it is sent at and its sequence number from this
+// Replicator, authenticated with the event, so that the peers do not apply an event
+// replayed to them, see replicaWindow.
+type Replicator struct {
+	Peers  []string // peer server addresses, e.g. "negotiator-2.example.com"
+	Secret string   // shared by all replicas, authenticates the events
+
+	SNI                string       // SNI to use, e.g. "example.com"
+	InsecureSkipVerify bool         // skip TLS certificate verification for HTTPS
+	InsecurePlainHTTP  bool         // use plain HTTP instead of HTTPS, when enabled, InsecureSkipVerify is ignored
+	RoundTripper       RoundTripper // sends the events, nil -> the uTLS client, see RoundTripper
+
+	Logger rtcsocks.Logger
+
+	sender    string              // random ID of this Replicator, the sequence numbers are its own
+	seq       uint64              // of the last event queued
+	queues    []chan replicaEvent // per peer, in the order of Peers
+	done      chan struct{}       // closed by Close
+	startOnce sync.Once
+	mutex     sync.Mutex // for seq, queues and done, against Close
+}
+
+type replicaEvent struct {
+	offerID rtcsocks.OfferID
+	seq     uint64
+	body    []byte // JSON-encoded rtcsocks.ReplicationEvent
+}
+
+// replicaMAC returns the HMAC of the event sent by the sender with the sequence number
+// at the time, Unix milliseconds.
+func replicaMAC(secret, sender string, seq uint64, ts int64, event []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%d:%d:", sender, seq, ts)
+	mac.Write(event)
+	return mac.Sum(nil)
+}
+
+// Broadcast queues the event for every peer. If the queue of a peer is full, e.g. it
+// has been down for long, the event is dropped for that peer.
+func (r *Replicator) Broadcast(event rtcsocks.ReplicationEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		if r.Logger != nil {
+			r.Logger.Errorf("Replicator: failed to marshal event: %v", err)
+		}
+		return
+	}
+
+	r.startOnce.Do(r.start)
+	r.mutex.Lock() // queued in the same order for all peers
+	defer r.mutex.Unlock()
+	if r.queues == nil {
+		return // closed
+	}
+	r.seq++
+	ev := replicaEvent{offerID: event.OfferID, seq: r.seq, body: body}
+	for i, queue := range r.queues {
+		select {
+		case queue <- ev:
+		default:
+			if r.Logger != nil {
+				r.Logger.Errorf("Replicator: queue of %s full, event of offer %s dropped", r.Peers[i], event.OfferID)
+			}
+		}
+	}
+}
+
+// Close stops the workers, dropping the events not sent yet.
+func (r *Replicator) Close() {
+	r.startOnce.Do(func() {})
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.queues == nil {
+		return
+	}
+	close(r.done)
+	r.queues = nil
+}
+
+func (r *Replicator) start() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.sender = randomID()
+	r.done = make(chan struct{})
+	for _, peer := range r.Peers {
+		queue := make(chan replicaEvent, replicationQueueSize)
+		r.queues = append(r.queues, queue)
+		go r.run(peer, queue, r.done)
+	}
+}
+
+// run sends the events queued for the peer in order, retrying each with backoff up
+// to replicationAttempts times on network errors and overload.
+func (r *Replicator) run(peer string, queue <-chan replicaEvent, done <-chan struct{}) {
+	for {
+		var ev replicaEvent
+		select {
+		case ev = <-queue:
+		case <-done:
+			return
+		}
+
+		backoff := replicationBackoff
+		for attempt := 1; ; attempt++ {
+			retry, err := r.send(peer, ev)
+			if err == nil {
+				break
+			}
+			if !retry || attempt == replicationAttempts {
+				if r.Logger != nil {
+					r.Logger.Errorf("Replicator: event of offer %s dropped for %s: %v", ev.offerID, peer, err)
+				}
+				break
+			}
+			if r.Logger != nil {
+				r.Logger.Warnf("Replicator: event of offer %s to %s, retrying in %v: %v", ev.offerID, peer, backoff, err)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-done:
+				return
+			}
+			if backoff *= 2; backoff > replicationMaxBackoff {
+				backoff = replicationMaxBackoff
+			}
+		}
+	}
+}
+
+// send posts the event to the peer, reporting whether it is worth retrying if it fails.
+func (r *Replicator) send(peer string, ev replicaEvent) (retry bool, err error) {
+	defer rtcsocks.Recover("Replicator: send", r.Logger, func(crash *rtcsocks.Crash) {
+		retry, err = true, crash // not delivered, retried like a network error
+	})
+	serverUrl := utils.URL(peer, !r.InsecurePlainHTTP, "/rtcsocks/replica/event")
+
+	ts := time.Now().UnixMilli() // of this attempt, the event may have waited long in queue
+	postForm := map[string]interface{}{
+		"event":  string(ev.body), // JSON-encoded rtcsocks.ReplicationEvent
+		"sender": r.sender,
+		"seq":    strconv.FormatUint(ev.seq, 10),
+		"ts":     strconv.FormatInt(ts, 10),
+		"hmac":   replicaMAC(r.Secret, r.sender, ev.seq, ts, ev.body), // byte array as base64 string (auto-encoded)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), replicationTimeout)
+	defer cancel()
+	_, resp, err := utils.ReadAll(utils.POST(
+		ctx,
+		serverUrl,
+		postForm,
+		utils.Options{InsecureSkipVerify: r.InsecureSkipVerify, SNI: r.SNI, Doer: r.RoundTripper},
+	))
+	if err != nil {
+		return true, fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		// e.g. 404 Not Found of a peer not accepting events yet or a proxy in between
+		return true, fmt.Errorf("POST %s: %w", serverUrl, ErrInvalidResponseFormat)
+	}
+	if responseData.Status != "success" {
+		err := responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+		return errors.Is(err, rtcsocks.ErrOverloaded), err
+	}
+	return false, nil
+}
+
+// replicaWindow keeps the sequence number of the last event applied from each sender,
+// to reject the events replayed. Senders not heard from for longer than the skew are
+// forgotten, their events replayed since are too old anyway.
+type replicaWindow struct {
+	senders   map[string]*replicaSender
+	lastPurge time.Time
+	mutex     sync.Mutex // for senders and lastPurge
+}
+
+type replicaSender struct {
+	seq      uint64 // of the last event applied
+	lastSeen time.Time
+	mutex    sync.Mutex // held while an event of the sender is applied
+}
+
+func newReplicaWindow() *replicaWindow {
+	return &replicaWindow{
+		senders:   make(map[string]*replicaSender),
+		lastPurge: time.Now(),
+	}
+}
+
+// apply calls f with an event of the sender, sent at ts, unless it is replayed. It
+// returns ErrBadReplicationEvent if the event is out of the skew window, and
+// nothing without calling f if an event with the same or a later sequence number was
+// applied already, e.g. when the response to the sender was lost.
+func (w *replicaWindow) apply(sender string, seq uint64, ts time.Time, f func() error) error {
+	now := time.Now()
+	if ts.Before(now.Add(-replicationSkew)) || ts.After(now.Add(replicationSkew)) {
+		return rtcsocks.ErrBadReplicationEvent
+	}
+
+	w.mutex.Lock()
+	if now.Sub(w.lastPurge) > replicationSkew {
+		for id, s := range w.senders {
+			s.mutex.Lock()
+			if now.Sub(s.lastSeen) > replicationSkew {
+				delete(w.senders, id)
+			}
+			s.mutex.Unlock()
+		}
+		w.lastPurge = now
+	}
+	s, ok := w.senders[sender]
+	if !ok {
+		s = &replicaSender{}
+		w.senders[sender] = s
+	}
+	s.mutex.Lock() // before unlocking w, so that the purge does not forget it meanwhile
+	s.lastSeen = now
+	w.mutex.Unlock()
+	defer s.mutex.Unlock()
+
+	if seq <= s.seq {
+		return nil // applied already
+	}
+	if err := f(); err != nil {
+		return err // for the sender to retry
+	}
+	s.seq = seq
+	return nil
+}
@@ -0,0 +1,30 @@
+package http
+
+import (
+	"context"
+	gohttp "net/http"
+)
+
+// RoundTripper sends the HTTP requests of a Client, Server or Replicator in place of
+// the default uTLS client, e.g. through a proxy, a domain front or a meek-like
+// obfuscating transport. The request carries the fields and the Accept-Encoding
+// header already, and the response body is closed by the caller. SNI, Hosts,
+// InsecureSkipVerify, ResumeTLS and the TLS fingerprint of the Profile only
+// configure the default client; the headers of the Profile, Compress, Timeout and
+// MaxResponseSize apply regardless.
+//
+// RoundTripperFunc adapts a function, e.g. the Do method of an *http.Client:
+//
+//	client.RoundTripper = RoundTripperFunc(func(ctx context.Context, r *http.Request) (*http.Response, error) {
+//		return proxied.Do(r.WithContext(ctx))
+//	})
+type RoundTripper interface {
+	Do(ctx context.Context, req *gohttp.Request) (*gohttp.Response, error)
+}
+
+// RoundTripperFunc is a function sending HTTP requests, see RoundTripper.
+type RoundTripperFunc func(ctx context.Context, req *gohttp.Request) (*gohttp.Response, error)
+
+func (f RoundTripperFunc) Do(ctx context.Context, req *gohttp.Request) (*gohttp.Response, error) {
+	return f(ctx, req)
+}
@@ -1,46 +1,216 @@
 package http
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/gaukas/logging"
 	"github.com/gaukas/rtcsocks"
 	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gaukas/rtcsocks/sdputil"
 )
 
 // Server helps the RTCSocks Server to talk to the negotiator server.
 type Server struct {
 	Secret  string
-	GroupID uint64 // set by SetNewOfferHandler
+	Token   string           // delegation token minted by the operator, used in place of Secret if set
+	GroupID rtcsocks.GroupID // set by SetNewOfferHandler
 
-	ServerAddr         string // server address, e.g. "www.google.com"
-	SNI                string // SNI to use, e.g. "example.com"
-	InsecureSkipVerify bool   // skip TLS certificate verification for HTTPS
-	InsecurePlainHTTP  bool   // use plain HTTP instead of HTTPS, when enabled, InsecureSkipVerify is ignored
+	ServerAddr         string              // server address, e.g. "www.google.com"
+	SNI                string              // SNI to use, e.g. "example.com"
+	Hosts              map[string][]string // IPs to dial in turn for the hostnames, in place of resolving them, e.g. when DNS is poisoned
+	Profile            string              // browser the requests pass for: "chrome" (default), "firefox", "safari" or "ios"
+	InsecureSkipVerify bool                // skip TLS certificate verification for HTTPS
+	InsecurePlainHTTP  bool                // use plain HTTP instead of HTTPS, when enabled, InsecureSkipVerify is ignored
+	Carrier            Carrier             // how the request fields are carried, MUST be accepted by the API, see API.SetCarriers
+	Compress           bool                // gzip the request bodies, see API.SetCompression
+	ResumeTLS          bool                // resume TLS 1.2 sessions with the negotiator, as a browser revisiting a site
+	tlsSessions        *utils.SessionCache
+	tlsSessionsOnce    sync.Once
+	Timeout            time.Duration // of each request to the negotiator, 0 -> none
+	MaxResponseSize    int64         // of the responses of the negotiator, in bytes, 0 -> 4 MiB
+	RoundTripper       RoundTripper  // sends the requests, nil -> the uTLS client, see RoundTripper
+	Envelope           bool          // seal requests and responses in an envelope keyed by the Secret, not supported with Token
+	BindResponses      bool          // reject the responses not bound to the request, see Client.BindResponses
+	Challenge          bool          // authenticate with the MAC of a challenge in place of the Secret, see Client.Challenge
 	insecureWarnOnce   sync.Once
 
-	Logger           logging.Logger
+	Logger           rtcsocks.Logger
 	nextOfferHandler rtcsocks.NextOfferHandlerFunction
 	startLoopOnce    sync.Once
 	WaitAfterSuccess time.Duration // sleep duration when success returned by readNextOffer, 0 -> no sleep
 	WaitAfterPending time.Duration // sleep duration when readNextOffer waits for new offer, 0 -> defaultWaitAfterPending
 	WaitAfterError   time.Duration // sleep duration when error occurs in readNextOffer, 0 -> return immediately if errored
+
+	RestartPolicy *rtcsocks.RestartPolicy // of the offer and heartbeat loops after a panic, nil -> rtcsocks.DefaultRestartPolicy
+
+	SessionID         string        // identifies this Edge Server within the group, empty -> random
+	Capabilities      []string      // capabilities advertised via heartbeat, e.g. "relay", "ipv6"
+	HeartbeatInterval time.Duration // interval between heartbeats, 0 -> no heartbeat
+	sessionOnce       sync.Once
+
+	ErrorClassifier ErrorClassifierFunction // decides how to react to readNextOffer errors, nil -> WaitAfterPending/WaitAfterError
+	ErrorNotifier   func(err error)         // called for errors classified as ActionNotify
+
+	// AnswerSigningKey signs answers for Clients to verify, see rtcsocks.SignAnswer.
+	// The public key is distributed to Clients by the operator. nil -> answers are not signed.
+	AnswerSigningKey ed25519.PrivateKey
+	offers           map[rtcsocks.OfferID]*serverOffer // offer_id -> offer being answered, if AnswerSigningKey is set
+	mutexOffers      sync.Mutex
+
+	// OfferVerifyKeys are the public keys of the negotiator signing offer metadata,
+	// see rtcsocks.Negotiator.SetOfferSigningKey. Offers not signed with one of them
+	// are dropped. Empty -> offers are not verified.
+	OfferVerifyKeys []ed25519.PublicKey
+	AllowedUsers    []rtcsocks.UserID // users whose verified offers are answered, nil -> any
+
+	CandidatePolicy *rtcsocks.CandidatePolicy // candidates allowed in answers, nil -> all
+	SDPPolicy       *sdputil.Policy           // sanitizes answers, see sdputil.Policy.Sanitize, nil -> sent as is
+
+	// Admit reports whether a new offer can be accepted, e.g. rtcsocks.ConcurrencyLimit.Admit.
+	// The Server does not poll for offers while it returns false. nil -> always.
+	Admit func() bool
+
+	lastPoll int64 // unix nanoseconds of the last poll answered by the negotiator, see Ready
+
+	pollToken       string // see API.SetPollSessions, empty -> authenticated with the credentials
+	pollTokenExpiry time.Time
+	mutexPollToken  sync.Mutex
+
+	OnDrain    func()        // called when Close starts draining, e.g. to refuse new streams
+	closing    chan struct{} // closed by Close to stop the loops
+	pollCtx    context.Context
+	cancelPoll context.CancelFunc // called by Close to cancel the poll in flight, if any
+	loopDone   chan struct{}      // closed when loopReadNextOffer returns, nil if never started
+	closeOnce  sync.Once
+}
+
+type serverOffer struct {
+	sdp      []byte
+	received time.Time
 }
 
 func (s *Server) SetNextOfferHandler(handler rtcsocks.NextOfferHandlerFunction) {
 	s.nextOfferHandler = handler
 
 	s.startLoopOnce.Do(func() {
-		go s.loopReadNextOffer()
+		s.closeOnce.Do(s.initClose)
+		s.loopDone = make(chan struct{})
+		go func() {
+			defer close(s.loopDone)
+			rtcsocks.Supervise("Server: offer loop", s.RestartPolicy, s.Logger, s.loopReadNextOffer)
+		}()
+		if s.HeartbeatInterval > 0 {
+			go rtcsocks.Supervise("Server: heartbeat loop", s.RestartPolicy, s.Logger, s.loopHeartbeat)
+		}
 	}) // start loopReadNextOffer if not started
 }
 
-func (s *Server) RegisterAnswer(offerID uint64, answer []byte) error {
+// Session returns the session ID used to identify this Edge Server, generating
+// a random one if SessionID is not set.
+func (s *Server) Session() string {
+	s.sessionOnce.Do(func() {
+		if s.SessionID != "" {
+			return
+		}
+		var buf [16]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			if s.Logger != nil {
+				s.Logger.Errorf("Server: failed to generate session ID: %v", err)
+			}
+			return
+		}
+		s.SessionID = hex.EncodeToString(buf[:])
+	})
+	return s.SessionID
+}
+
+// Heartbeat registers the session and capabilities of this Edge Server with the negotiator.
+func (s *Server) Heartbeat() error {
+	return s.HeartbeatContext(context.Background())
+}
+
+// HeartbeatContext is Heartbeat, cancelled with ctx.
+func (s *Server) HeartbeatContext(ctx context.Context) error {
+	if s.ServerAddr == "" {
+		return ErrInvalidServerAddr
+	}
+
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/server/heartbeat")
+
+	capabilities := s.Capabilities
+	if capabilities == nil {
+		capabilities = []string{}
+	}
+	session := s.Session()
+	postForm := map[string]interface{}{
+		"gid":          s.GroupID.String(), // hex string
+		"session":      session,
+		"capabilities": capabilities,
+	}
+	if err := s.authorize(ctx, postForm, groupRequest("server/heartbeat", append([]string{session}, capabilities...)...)); err != nil {
+		return err
+	}
+
+	seal, err := s.sealer()
+	if err != nil {
+		return err
+	}
+	_, resp, err := send(
+		ctx,
+		s.Carrier,
+		seal,
+		serverUrl,
+		postForm,
+		s.httpOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return ErrInvalidResponseFormat
+	}
+
+	if responseData.Status != "success" {
+		return responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+	return nil
+}
+
+func (s *Server) loopHeartbeat() {
+	for {
+		if err := s.HeartbeatContext(s.pollContext()); err != nil {
+			if s.Logger != nil {
+				s.Logger.Errorf("Server: heartbeat failed: %v", err)
+			}
+		}
+		if !s.sleep(s.HeartbeatInterval) {
+			return
+		}
+	}
+}
+
+func (s *Server) RegisterAnswer(offerID rtcsocks.OfferID, answer []byte) error {
+	return s.RegisterAnswerContext(context.Background(), offerID, answer)
+}
+
+// RegisterAnswerContext is RegisterAnswer, cancelled with ctx.
+func (s *Server) RegisterAnswerContext(ctx context.Context, offerID rtcsocks.OfferID, answer []byte) error {
 	if s.ServerAddr == "" {
 		return ErrInvalidServerAddr
 	}
@@ -53,29 +223,57 @@ func (s *Server) RegisterAnswer(offerID uint64, answer []byte) error {
 		}
 	})
 
-	serverUrl := s.ServerAddr + "/rtcsocks/answer/new"
-	if !s.InsecurePlainHTTP {
-		serverUrl = "https://" + serverUrl
-	} else {
-		serverUrl = "http://" + serverUrl
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/answer/new")
+
+	var err error
+	if s.SDPPolicy != nil {
+		answer, err = s.SDPPolicy.Sanitize(answer)
+		if err != nil {
+			return err
+		}
+	}
+	if s.CandidatePolicy != nil {
+		answer, err = s.CandidatePolicy.Apply(answer)
+		if err != nil {
+			return err
+		}
 	}
 
+	if s.AnswerSigningKey != nil {
+		s.mutexOffers.Lock()
+		offer, ok := s.offers[offerID]
+		s.mutexOffers.Unlock()
+		if !ok {
+			return rtcsocks.ErrInvalidOfferID
+		}
+		answer = rtcsocks.SignAnswer(s.AnswerSigningKey, offer.sdp, answer)
+	}
+
+	answerB64 := base64.StdEncoding.EncodeToString(answer)
 	postForm := map[string]interface{}{
-		"gid":      fmt.Sprintf("%x", s.GroupID), // uint64 as hex string
-		"secret":   s.Secret,
-		"offer_id": fmt.Sprintf("%x", offerID), // uint64 as hex string
-		"answer":   base64.StdEncoding.EncodeToString(answer),
+		"gid":      s.GroupID.String(), // hex string
+		"offer_id": offerID.String(),   // hex string
+		"answer":   answerB64,
+	}
+	if err := s.authorize(ctx, postForm, groupRequest("answer/new", offerID.String(), answerB64)); err != nil {
+		return err
 	}
 	if s.Logger != nil {
 		s.Logger.Debugf("Server: POST %s, form: %v", serverUrl, postForm)
 	}
 
 	// POST answer to negotiator server
-	_, resp, err := utils.POST(
+	seal, err := s.sealer()
+	if err != nil {
+		return err
+	}
+	_, resp, err := send(
+		ctx,
+		s.Carrier,
+		seal,
 		serverUrl,
 		postForm,
-		s.InsecureSkipVerify,
-		s.SNI,
+		s.httpOptions(),
 	)
 	if err != nil {
 		return fmt.Errorf("POST %s: %w", serverUrl, err)
@@ -83,51 +281,119 @@ func (s *Server) RegisterAnswer(offerID uint64, answer []byte) error {
 
 	// parse response
 	var responseData struct {
-		Status    string `json:"status"`
-		Reference string `json:"reference"` // reference for debugging or error reporting
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
 	}
 	if json.Unmarshal(resp, &responseData) != nil {
 		return ErrInvalidResponseFormat
 	}
 
 	if responseData.Status == "success" {
+		if s.AnswerSigningKey != nil {
+			s.mutexOffers.Lock()
+			delete(s.offers, offerID)
+			s.mutexOffers.Unlock()
+		}
 		return nil
 	} else {
-		return fmt.Errorf("POST %s returned status: %s, reference: %s", serverUrl, responseData.Status, responseData.Reference)
+		return responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
 	}
 }
 
 func (s *Server) loopReadNextOffer() {
+	classify := s.ErrorClassifier
+	if classify == nil {
+		classify = s.defaultErrorClassifier
+	}
+
+	var failures int // consecutive failures, for ActionBackoff
 	for {
+		select {
+		case <-s.closing:
+			return
+		default:
+		}
+
+		if s.Admit != nil && !s.Admit() {
+			// saturated, leave the offers to the other Edge Servers
+			if !s.sleep(s.waitAfterDecline()) {
+				return
+			}
+			continue
+		}
+
 		offerID, offer, err := s.readNextOffer()
+		if err == nil || errors.Is(err, rtcsocks.ErrNoOfferAvailable) {
+			atomic.StoreInt64(&s.lastPoll, time.Now().UnixNano())
+		}
 		if err != nil {
+			failures++
+			policy := classify(err)
 			if err == rtcsocks.ErrNoOfferAvailable {
 				if s.Logger != nil {
 					s.Logger.Debugf("Server: readNextOffer: empty offer queue, retry later...")
 				}
-				if s.WaitAfterPending > 0 {
-					time.Sleep(s.WaitAfterPending)
-				} else {
-					time.Sleep(defaultWaitAfterPending)
+			} else if s.Logger != nil {
+				s.Logger.Errorf("Server: readNextOffer failed: %v", err)
+			}
+
+			var wait time.Duration
+			switch policy.Action {
+			case ActionRetry:
+				wait = policy.Wait
+			case ActionBackoff:
+				wait = policy.backoff(failures)
+			case ActionNotify:
+				if s.ErrorNotifier != nil {
+					s.ErrorNotifier(err)
 				}
-			} else {
+				wait = policy.Wait
+			default: // ActionAbort
 				if s.Logger != nil {
-					s.Logger.Errorf("Server: readNextOffer failed: %v", err)
-				}
-				if s.WaitAfterError > 0 {
-					time.Sleep(s.WaitAfterError)
-				} else {
-					return
+					s.Logger.Errorf("Server: readNextOffer loop aborted")
 				}
+				return
 			}
+			if retryAfter := rtcsocks.RetryAfter(err); retryAfter > wait {
+				wait = retryAfter // as requested by an overloaded negotiator
+			}
+			if !s.sleep(wait) {
+				return
+			}
+			continue
 		}
+		failures = 0
+
 		if s.Logger != nil {
-			s.Logger.Debugf("Server: readNextOffer: offerID: %d, offer: %x", offerID, offer)
+			s.Logger.Debugf("Server: readNextOffer: offerID: %s, offer: %x", offerID, offer)
 		}
 
-		if s.nextOfferHandler != nil {
-			err := s.nextOfferHandler(offerID, offer)
+		if len(s.OfferVerifyKeys) > 0 {
+			offer, err = s.verifyOffer(offerID, offer)
 			if err != nil {
+				if s.Logger != nil {
+					s.Logger.Warnf("Server: offer %s dropped: %v", offerID, err)
+				}
+				continue
+			}
+		}
+
+		if s.AnswerSigningKey != nil {
+			s.rememberOffer(offerID, offer)
+		}
+
+		if s.nextOfferHandler != nil {
+			err := s.handleOffer(offerID, offer)
+			if errors.Is(err, rtcsocks.ErrOfferDeclined) {
+				s.declineOffer(offerID)
+				// or the same offer may come right back
+				if !s.sleep(s.waitAfterDecline()) {
+					return
+				}
+				continue
+			} else if err != nil {
 				if s.Logger != nil {
 					s.Logger.Errorf("Server: newOfferHandler failed: %v", err)
 				}
@@ -138,13 +404,70 @@ func (s *Server) loopReadNextOffer() {
 			}
 		}
 
-		if s.WaitAfterSuccess > 0 {
-			time.Sleep(s.WaitAfterSuccess)
+		if s.WaitAfterSuccess > 0 && !s.sleep(s.WaitAfterSuccess) {
+			return
+		}
+	}
+}
+
+// handleOffer calls the nextOfferHandler, recovering its panics so that one offer
+// does not stop the loop.
+func (s *Server) handleOffer(offerID rtcsocks.OfferID, offer []byte) error {
+	defer rtcsocks.Recover("Server: newOfferHandler", s.Logger, nil)
+	return s.nextOfferHandler(offerID, offer)
+}
+
+// verifyOffer checks the metadata signed by the negotiator and that the user is
+// allowed, returning the offer as registered by the Client.
+func (s *Server) verifyOffer(offerID rtcsocks.OfferID, signed []byte) ([]byte, error) {
+	offer, user, err := rtcsocks.VerifyOfferMetadata(s.OfferVerifyKeys, offerID, signed)
+	if err != nil {
+		return nil, err
+	}
+	if s.AllowedUsers != nil {
+		allowed := false
+		for _, u := range s.AllowedUsers {
+			allowed = allowed || u == user
+		}
+		if !allowed {
+			return nil, fmt.Errorf("%w: user %s", rtcsocks.ErrUserNotAllowed, user)
+		}
+	}
+	return offer, nil
+}
+
+// sealer returns the sealer of the requests, nil if Envelope is disabled.
+func (s *Server) sealer() (*sealer, error) {
+	if !s.Envelope {
+		return nil, nil
+	}
+	if s.Token != "" {
+		return nil, ErrEnvelopeUnsupported
+	}
+	return groupSealer(s.GroupID, s.Secret)
+}
+
+// rememberOffer keeps the offer for RegisterAnswer to sign the answer with, and
+// forgets offers never answered.
+func (s *Server) rememberOffer(offerID rtcsocks.OfferID, offer []byte) {
+	s.mutexOffers.Lock()
+	defer s.mutexOffers.Unlock()
+	if s.offers == nil {
+		s.offers = make(map[rtcsocks.OfferID]*serverOffer)
+	}
+	now := time.Now()
+	for id, o := range s.offers {
+		if now.Sub(o.received) > unansweredOfferTTL {
+			delete(s.offers, id)
 		}
 	}
+	s.offers[offerID] = &serverOffer{
+		sdp:      offer,
+		received: now,
+	}
 }
 
-func (s *Server) readNextOffer() (offerID uint64, offer []byte, err error) {
+func (s *Server) readNextOffer() (offerID rtcsocks.OfferID, offer []byte, err error) {
 	if s.ServerAddr == "" {
 		return 0, nil, ErrInvalidServerAddr
 	}
@@ -156,27 +479,36 @@ func (s *Server) readNextOffer() (offerID uint64, offer []byte, err error) {
 			}
 		}
 	})
-	serverUrl := s.ServerAddr + "/rtcsocks/offer/next"
-	if !s.InsecurePlainHTTP {
-		serverUrl = "https://" + serverUrl
-	} else {
-		serverUrl = "http://" + serverUrl
-	}
+	ctx := s.pollContext()
+	serverUrl := utils.URL(s.ServerAddr, !s.InsecurePlainHTTP, "/rtcsocks/offer/next")
 
+	session := s.Session()
 	postForm := map[string]interface{}{
-		"gid":    fmt.Sprintf("%x", s.GroupID), // uint64 as hex string
-		"secret": s.Secret,
+		"gid":     s.GroupID.String(), // hex string
+		"session": session,
+	}
+	pollToken, ok := s.usePollToken()
+	if ok {
+		postForm["poll_token"] = pollToken
+	} else if err := s.authorize(ctx, postForm, groupRequest("offer/next", session)); err != nil {
+		return 0, nil, err
 	}
 	if s.Logger != nil {
 		s.Logger.Debugf("Client: POST %s, form: %v", serverUrl, postForm)
 	}
 
 	// POST offer to negotiator server
-	_, resp, err := utils.POST(
+	seal, err := s.sealer()
+	if err != nil {
+		return 0, nil, err
+	}
+	_, resp, err := send(
+		ctx,
+		s.Carrier,
+		seal,
 		serverUrl,
 		postForm,
-		s.InsecureSkipVerify,
-		s.SNI,
+		s.httpOptions(),
 	)
 	if err != nil {
 		return 0, nil, fmt.Errorf("POST %s: %w", serverUrl, err)
@@ -184,18 +516,25 @@ func (s *Server) readNextOffer() (offerID uint64, offer []byte, err error) {
 
 	// parse response
 	var responseData struct {
-		Status     string `json:"status"`
-		OfferIDHex string `json:"offer_id"`
-		OfferB64   string `json:"offer"`
-		Reference  string `json:"reference"` // reference for debugging or error reporting
+		Status       string `json:"status"`
+		OfferIDHex   string `json:"offer_id"`
+		OfferB64     string `json:"offer"`
+		PollToken    string `json:"poll_token"`     // in place of the credentials for the next polls, see API.SetPollSessions
+		PollTokenTTL int    `json:"poll_token_ttl"` // seconds
+		Code         string `json:"code"`           // error code, see ErrorCode
+		Reference    string `json:"reference"`      // reference for debugging or error reporting
+		RetryAfter   int    `json:"retry_after"`    // seconds to wait before retrying, if overloaded
 	}
 	if json.Unmarshal(resp, &responseData) != nil {
+		if pollToken != "" {
+			s.dropPollToken(pollToken) // rejected, e.g. by a replica with another key
+		}
 		return 0, nil, ErrInvalidResponseFormat
 	}
+	s.setPollToken(responseData.PollToken, responseData.PollTokenTTL)
 
 	if responseData.Status == "success" {
-		// hex string to uint64
-		offerID, err = strconv.ParseUint(responseData.OfferIDHex, 16, 64)
+		offerID, err = rtcsocks.ParseOfferID(responseData.OfferIDHex)
 		if err != nil {
 			return 0, nil, fmt.Errorf("non-Hex offer_id returned by negotiator: %s", responseData.OfferIDHex)
 		}
@@ -210,6 +549,6 @@ func (s *Server) readNextOffer() (offerID uint64, offer []byte, err error) {
 	} else if responseData.Status == "pending" {
 		return 0, nil, rtcsocks.ErrNoOfferAvailable
 	} else {
-		return 0, nil, fmt.Errorf("POST %s returned status: %s, reference: %s", serverUrl, responseData.Status, responseData.Reference)
+		return 0, nil, responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
 	}
 }
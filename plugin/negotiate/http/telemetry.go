@@ -0,0 +1,150 @@
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/internal/utils"
+	"github.com/gofiber/fiber/v2"
+	fiberutils "github.com/gofiber/fiber/v2/utils"
+)
+
+func (a *API) SetTelemetryCallback(f rtcsocks.TelemetryCallbackFunction) {
+	a.telemetryCallback = f
+}
+
+// reportRendezvous accepts a RendezvousReport from an authenticated user, and passes
+// it on without the user ID.
+func (a *API) reportRendezvous(c *fiber.Ctx) error {
+	var postForm struct {
+		UID       string `json:"uid" validate:"required,id"`           // User ID, hex
+		Timestamp string `json:"ts" validate:"required,decimal"`       // Unix time in seconds, decimal
+		Transport string `json:"transport" validate:"required,max=64"` // transport name
+		Stage     string `json:"stage" validate:"required,max=64"`     // see rtcsocks.RendezvousStage
+		Duration  string `json:"duration" validate:"required,decimal"` // seconds, decimal
+		HMAC      string `json:"hmac" validate:"base64"`               // HMAC or signature of the report, base64
+		Scheme    string `json:"scheme"`                               // authentication scheme, empty -> auth.DefaultScheme
+		PAKE      string `json:"pake_session"`                         // PAKE session ID, if Scheme is PAKEScheme
+		Chal      string `json:"challenge" validate:"base64"`          // challenge included in the HMAC, optional
+	}
+
+	if err := a.parseForm(c, &postForm); err != nil {
+		return a.rejectForm(c, err)
+	}
+
+	uid, err := rtcsocks.ParseUserID(postForm.UID)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	ts, err := strconv.ParseInt(postForm.Timestamp, 10, 64)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > maxCollectSkew || skew < -maxCollectSkew {
+		return c.SendStatus(fiber.StatusNotFound) // limits replay of the request
+	}
+
+	seconds, err := strconv.Atoi(postForm.Duration)
+	if err != nil || seconds < 0 {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	hmac, err := base64.StdEncoding.DecodeString(postForm.HMAC)
+	if err != nil {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	msg := reportMessage(postForm.Timestamp, postForm.Transport, postForm.Stage, postForm.Duration)
+	if !a.verifyAuth(uid, postForm.Scheme, postForm.PAKE, postForm.Chal, msg, hmac) {
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+
+	if a.telemetryCallback == nil {
+		return a.sendError(c, fiber.StatusNotFound, rtcsocks.ErrTelemetryDisabled)
+	}
+	ctx, cancel := a.requestContext(c, "")
+	defer cancel()
+	err = a.telemetryCallback(ctx, rtcsocks.RendezvousReport{
+		Transport: fiberutils.CopyString(postForm.Transport), // fiber reuses the buffers of the request
+		Stage:     rtcsocks.RendezvousStage(fiberutils.CopyString(postForm.Stage)),
+		Duration:  time.Duration(seconds) * time.Second,
+	})
+	if err != nil {
+		return a.sendError(c, fiber.StatusBadRequest, err)
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"status": "success",
+	})
+}
+
+// reportMessage is the message authenticated by a user reporting a rendezvous.
+func reportMessage(ts, transport, stage, duration string) []byte {
+	return []byte("telemetry:" + ts + ":" + transport + ":" + stage + ":" + duration)
+}
+
+// ReportRendezvous reports the outcome of a rendezvous to the operator of the
+// negotiator, if the user opted in to telemetry. The report is authenticated like the
+// offers, but the negotiator keeps neither the user ID nor the exact duration, see
+// rtcsocks.RendezvousReport.
+func (c *Client) ReportRendezvous(report rtcsocks.RendezvousReport) error {
+	if c.ServerAddr == "" {
+		return ErrInvalidServerAddr
+	}
+
+	ctx := context.Background()
+	serverUrl := utils.URL(c.ServerAddr, !c.InsecurePlainHTTP, "/rtcsocks/telemetry/report")
+
+	uid, err := c.userID()
+	if err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	duration := strconv.Itoa(int(rtcsocks.CoarseDuration(report.Duration) / time.Second)) // coarse already on the wire
+	postForm := map[string]interface{}{
+		"uid":       uid.String(), // hex string
+		"ts":        ts,
+		"transport": report.Transport,
+		"stage":     string(report.Stage),
+		"duration":  duration,
+	}
+	if err := c.authenticate(ctx, postForm, uid, reportMessage(ts, report.Transport, string(report.Stage), duration), false); err != nil {
+		return err
+	}
+	s, err := c.sealer(uid)
+	if err != nil {
+		return err
+	}
+
+	_, resp, err := send(
+		ctx,
+		c.Carrier,
+		s,
+		serverUrl,
+		postForm,
+		c.httpOptions(),
+	)
+	if err != nil {
+		return fmt.Errorf("POST %s: %w", serverUrl, err)
+	}
+
+	var responseData struct {
+		Status     string `json:"status"`
+		Code       string `json:"code"`        // error code, see ErrorCode
+		Reference  string `json:"reference"`   // reference for debugging or error reporting
+		RetryAfter int    `json:"retry_after"` // seconds to wait before retrying, if overloaded
+	}
+	if json.Unmarshal(resp, &responseData) != nil {
+		return ErrInvalidResponseFormat
+	}
+	if responseData.Status != "success" {
+		return responseError(serverUrl, responseData.Status, responseData.Code, responseData.Reference, responseData.RetryAfter)
+	}
+	return nil
+}
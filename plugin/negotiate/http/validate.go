@@ -0,0 +1,130 @@
+package http
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ValidationError is a request field violating the schema of its endpoint. It is
+// only reported in debug mode, see SetDebugErrors.
+type ValidationError struct {
+	Field  string // as on the wire, empty for the request as a whole
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Field == "" {
+		return "invalid request: " + e.Reason
+	}
+	return "invalid field " + e.Field + ": " + e.Reason
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrInvalidRequest
+}
+
+// SetDebugErrors reports why malformed requests are rejected, with 400 Bad Request,
+// the code invalid_request and the field and reason of the ValidationError, instead
+// of 404 Not Found. It is meant for developing Clients and Edge Servers: it MUST NOT be
+// enabled in production, where it tells the API apart from any other web server.
+//
+// Requests failing authentication get 404 Not Found regardless.
+func (a *API) SetDebugErrors(enabled bool) {
+	a.debugErrors = enabled
+}
+
+// rejectForm rejects a malformed request, see SetDebugErrors.
+func (a *API) rejectForm(c *fiber.Ctx, err error) error {
+	if !a.debugErrors || err == fiber.ErrNotFound { // sealed forms failing to open are not told apart either
+		return c.SendStatus(fiber.StatusNotFound)
+	}
+	if _, ok := err.(*ValidationError); !ok {
+		err = &ValidationError{Reason: err.Error()}
+	}
+	return a.sendError(c, fiber.StatusBadRequest, err)
+}
+
+// validateForm checks the fields of a form against the rules in their validate tags,
+// comma-separated:
+//
+//	required  the field is set
+//	id        a user, group or offer ID: up to 16 hex digits
+//	hex       hex digits
+//	base64    standard base64
+//	decimal   a non-negative decimal integer, e.g. a Unix time
+//	max=N     at most N bytes, or N elements for an array
+//
+// Rules other than required apply to the fields set only. It returns the first
+// violation as a *ValidationError.
+func validateForm(form interface{}) error {
+	v := reflect.ValueOf(form)
+	if v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		rules := t.Field(i).Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if reason := checkRules(v.Field(i), rules); reason != "" {
+			return &ValidationError{Field: name, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// checkRules returns the rule the value violates, empty if none.
+func checkRules(v reflect.Value, rules string) string {
+	if v.IsZero() {
+		if strings.Contains(","+rules+",", ",required,") {
+			return "required"
+		}
+		return ""
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		rule, arg, _ := strings.Cut(rule, "=")
+		switch rule {
+		case "id":
+			if _, err := strconv.ParseUint(v.String(), 16, 64); err != nil {
+				return "not a hex ID"
+			}
+		case "hex":
+			if !isHex(v.String()) {
+				return "not hex"
+			}
+		case "base64":
+			if _, err := base64.StdEncoding.DecodeString(v.String()); err != nil {
+				return "not base64"
+			}
+		case "decimal":
+			if _, err := strconv.ParseUint(v.String(), 10, 64); err != nil {
+				return "not a decimal integer"
+			}
+		case "max":
+			max, _ := strconv.Atoi(arg)
+			if v.Len() > max {
+				return "longer than " + arg
+			}
+		}
+	}
+	return ""
+}
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !('0' <= r && r <= '9' || 'a' <= r && r <= 'f' || 'A' <= r && r <= 'F') {
+			return false
+		}
+	}
+	return true
+}
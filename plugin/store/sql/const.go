@@ -0,0 +1,17 @@
+package sql
+
+import "errors"
+
+var (
+	ErrUnknownDialect = errors.New("unknown SQL dialect")
+	ErrSchemaTooNew   = errors.New("database schema is newer than supported")
+)
+
+// Dialect selects the SQL flavor of the database.
+type Dialect uint8
+
+const (
+	Postgres Dialect = iota
+	MySQL
+	SQLite
+)
@@ -0,0 +1,108 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"strings"
+)
+
+// migrations[i] upgrades the schema from version i to version i+1.
+// Placeholders {{autoinc}} and {{text}} are replaced per Dialect.
+var migrations = [][]string{
+	{ // version 1
+		`CREATE TABLE rtcsocks_users (
+			uid BIGINT PRIMARY KEY,
+			secret VARCHAR(255) NOT NULL
+		)`,
+		`CREATE TABLE rtcsocks_groups (
+			gid BIGINT PRIMARY KEY,
+			secret VARCHAR(255) NOT NULL,
+			ttl_ms BIGINT NOT NULL DEFAULT 0,
+			max_offers_per_user INTEGER NOT NULL DEFAULT 0,
+			max_offer_size INTEGER NOT NULL DEFAULT 0,
+			match_policy INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE TABLE rtcsocks_events (
+			id {{autoinc}},
+			offer_id BIGINT NOT NULL,
+			event_type INTEGER NOT NULL,
+			origin VARCHAR(255) NOT NULL,
+			payload {{text}} NOT NULL,
+			expiry BIGINT NOT NULL,
+			recorded_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX rtcsocks_events_offer ON rtcsocks_events (offer_id)`,
+	},
+	{ // version 2: credential validity, Unix milliseconds, 0 -> unbounded
+		`ALTER TABLE rtcsocks_users ADD COLUMN not_before BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE rtcsocks_users ADD COLUMN not_after BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE rtcsocks_groups ADD COLUMN not_before BIGINT NOT NULL DEFAULT 0`,
+		`ALTER TABLE rtcsocks_groups ADD COLUMN not_after BIGINT NOT NULL DEFAULT 0`,
+	},
+	{ // version 3: GroupProfile.AllowedUsers, restricted = 0 -> any user
+		`ALTER TABLE rtcsocks_groups ADD COLUMN restricted INTEGER NOT NULL DEFAULT 0`,
+		`CREATE TABLE rtcsocks_group_users (
+			gid BIGINT NOT NULL,
+			uid BIGINT NOT NULL,
+			PRIMARY KEY (gid, uid)
+		)`,
+	},
+	{ // version 4: GroupProfile.MaxSessions
+		`ALTER TABLE rtcsocks_groups ADD COLUMN max_sessions INTEGER NOT NULL DEFAULT 0`,
+	},
+}
+
+func (d Dialect) rewriteDDL(stmt string) string {
+	var autoinc, text string
+	switch d {
+	case Postgres:
+		autoinc, text = "BIGSERIAL PRIMARY KEY", "TEXT"
+	case MySQL:
+		autoinc, text = "BIGINT AUTO_INCREMENT PRIMARY KEY", "MEDIUMTEXT"
+	default: // SQLite
+		autoinc, text = "INTEGER PRIMARY KEY AUTOINCREMENT", "TEXT"
+	}
+	stmt = strings.ReplaceAll(stmt, "{{autoinc}}", autoinc)
+	return strings.ReplaceAll(stmt, "{{text}}", text)
+}
+
+// migrate upgrades the schema to the latest version.
+func (s *Store) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS rtcsocks_schema (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var version int
+	err := s.db.QueryRow(`SELECT version FROM rtcsocks_schema`).Scan(&version)
+	if err == dbsql.ErrNoRows {
+		if _, err := s.db.Exec(`INSERT INTO rtcsocks_schema (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if version > len(migrations) {
+		return ErrSchemaTooNew
+	}
+
+	for ; version < len(migrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range migrations[version] {
+			if _, err := tx.Exec(s.dialect.rewriteDDL(stmt)); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(s.rebind(`UPDATE rtcsocks_schema SET version = ?`), version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
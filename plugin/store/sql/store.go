@@ -0,0 +1,286 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+)
+
+// Store is a SQL-backed rtcsocks.CredentialStore and rtcsocks.StateStore. It keeps
+// users, groups with their profiles, and an audit history of all offer/answer events.
+//
+// The database driver is to be imported by the caller.
+type Store struct {
+	db      *dbsql.DB
+	dialect Dialect
+
+	Logger rtcsocks.Logger
+}
+
+// New creates a Store on the database and migrates its schema to the latest version.
+func New(db *dbsql.DB, dialect Dialect) (*Store, error) {
+	if dialect > SQLite {
+		return nil, ErrUnknownDialect
+	}
+
+	s := &Store{
+		db:      db,
+		dialect: dialect,
+	}
+	if err := s.migrate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// UserSecret returns the secret of the user, if within its validity window.
+func (s *Store) UserSecret(user rtcsocks.UserID) (string, error) {
+	var secret string
+	now := time.Now().UnixMilli()
+	err := s.db.QueryRow(s.rebind(`SELECT secret FROM rtcsocks_users WHERE uid = ? AND `+validNow),
+		int64(user), now, now).Scan(&secret)
+	if err == dbsql.ErrNoRows {
+		return "", rtcsocks.ErrNotAuthenticated
+	}
+	return secret, err
+}
+
+// GroupSecret returns the secret of the group, if within its validity window.
+func (s *Store) GroupSecret(group rtcsocks.GroupID) (string, error) {
+	var secret string
+	now := time.Now().UnixMilli()
+	err := s.db.QueryRow(s.rebind(`SELECT secret FROM rtcsocks_groups WHERE gid = ? AND `+validNow),
+		int64(group), now, now).Scan(&secret)
+	if err == dbsql.ErrNoRows {
+		return "", rtcsocks.ErrNotAuthenticated
+	}
+	return secret, err
+}
+
+// PutUser adds the user or updates its secret, valid with no window until
+// SetUserValidity is called.
+func (s *Store) PutUser(user rtcsocks.UserID, secret string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(s.rebind(`DELETE FROM rtcsocks_users WHERE uid = ?`), int64(user)); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(s.rebind(`INSERT INTO rtcsocks_users (uid, secret) VALUES (?, ?)`), int64(user), secret); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// SetUserValidity sets the validity window of the user's credential.
+func (s *Store) SetUserValidity(user rtcsocks.UserID, v rtcsocks.Validity) error {
+	return s.setValidity(`UPDATE rtcsocks_users SET not_before = ?, not_after = ? WHERE uid = ?`, int64(user), v)
+}
+
+// DeleteUser removes the user.
+func (s *Store) DeleteUser(user rtcsocks.UserID) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM rtcsocks_users WHERE uid = ?`), int64(user))
+	return err
+}
+
+// PutGroup adds the group or updates its secret and profile, valid with no window
+// until SetGroupValidity is called.
+func (s *Store) PutGroup(group rtcsocks.GroupID, secret string, profile rtcsocks.GroupProfile) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.deleteGroup(tx, group); err != nil {
+		tx.Rollback()
+		return err
+	}
+	restricted := 0
+	if profile.AllowedUsers != nil {
+		restricted = 1 // even if empty, no user is allowed then
+	}
+	if _, err := tx.Exec(s.rebind(`INSERT INTO rtcsocks_groups (gid, secret, ttl_ms, max_offers_per_user, max_offer_size, max_sessions, match_policy, restricted) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		int64(group), secret, profile.TTL.Milliseconds(), profile.MaxOffersPerUser, profile.MaxOfferSize, profile.MaxSessions, int(profile.MatchPolicy), restricted); err != nil {
+		tx.Rollback()
+		return err
+	}
+	seen := make(map[rtcsocks.UserID]bool, len(profile.AllowedUsers))
+	for _, user := range profile.AllowedUsers {
+		if seen[user] {
+			continue
+		}
+		seen[user] = true
+		if _, err := tx.Exec(s.rebind(`INSERT INTO rtcsocks_group_users (gid, uid) VALUES (?, ?)`), int64(group), int64(user)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SetGroupValidity sets the validity window of the group secret.
+func (s *Store) SetGroupValidity(group rtcsocks.GroupID, v rtcsocks.Validity) error {
+	return s.setValidity(`UPDATE rtcsocks_groups SET not_before = ?, not_after = ? WHERE gid = ?`, int64(group), v)
+}
+
+func (s *Store) setValidity(query string, id int64, v rtcsocks.Validity) error {
+	res, err := s.db.Exec(s.rebind(query), unixMilli(v.NotBefore), unixMilli(v.NotAfter), id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return rtcsocks.ErrNotAuthenticated
+	}
+	return nil
+}
+
+// DeleteGroup removes the group.
+func (s *Store) DeleteGroup(group rtcsocks.GroupID) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := s.deleteGroup(tx, group); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Store) deleteGroup(tx *dbsql.Tx, group rtcsocks.GroupID) error {
+	if _, err := tx.Exec(s.rebind(`DELETE FROM rtcsocks_groups WHERE gid = ?`), int64(group)); err != nil {
+		return err
+	}
+	_, err := tx.Exec(s.rebind(`DELETE FROM rtcsocks_group_users WHERE gid = ?`), int64(group))
+	return err
+}
+
+// GroupProfiles returns the profiles of all groups, to be set with Negotiator.SetGroupProfile.
+func (s *Store) GroupProfiles() (map[rtcsocks.GroupID]rtcsocks.GroupProfile, error) {
+	rows, err := s.db.Query(`SELECT g.gid, g.ttl_ms, g.max_offers_per_user, g.max_offer_size, g.max_sessions, g.match_policy, g.restricted, u.uid
+		FROM rtcsocks_groups g LEFT JOIN rtcsocks_group_users u ON u.gid = g.gid
+		ORDER BY g.gid, u.uid`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	profiles := make(map[rtcsocks.GroupID]rtcsocks.GroupProfile)
+	for rows.Next() {
+		var gid, ttlMs int64
+		var maxOffers, maxSize, maxSessions, matchPolicy, restricted int
+		var uid dbsql.NullInt64
+		if err := rows.Scan(&gid, &ttlMs, &maxOffers, &maxSize, &maxSessions, &matchPolicy, &restricted, &uid); err != nil {
+			return nil, err
+		}
+		profile, ok := profiles[rtcsocks.GroupID(gid)]
+		if !ok {
+			profile = rtcsocks.GroupProfile{
+				TTL:              time.Duration(ttlMs) * time.Millisecond,
+				MaxOffersPerUser: maxOffers,
+				MaxOfferSize:     maxSize,
+				MaxSessions:      maxSessions,
+				MatchPolicy:      rtcsocks.MatchPolicy(matchPolicy),
+			}
+			if restricted != 0 {
+				profile.AllowedUsers = make([]rtcsocks.UserID, 0)
+			}
+		}
+		if uid.Valid && profile.AllowedUsers != nil {
+			profile.AllowedUsers = append(profile.AllowedUsers, rtcsocks.UserID(uid.Int64))
+		}
+		profiles[rtcsocks.GroupID(gid)] = profile
+	}
+	return profiles, rows.Err()
+}
+
+func (s *Store) Record(event rtcsocks.ReplicationEvent) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		if s.Logger != nil {
+			s.Logger.Errorf("Store: failed to marshal event: %v", err)
+		}
+		return
+	}
+
+	var expiry int64
+	if event.Type == rtcsocks.EventOfferRegistered {
+		expiry = event.Expiry.UnixMilli()
+	}
+
+	if _, err := s.db.Exec(s.rebind(`INSERT INTO rtcsocks_events (offer_id, event_type, origin, payload, expiry, recorded_at) VALUES (?, ?, ?, ?, ?, ?)`),
+		int64(event.OfferID), int(event.Type), event.Origin, string(payload), expiry, time.Now().UnixMilli()); err != nil {
+		if s.Logger != nil {
+			s.Logger.Errorf("Store: failed to record event: %v", err)
+		}
+	}
+}
+
+func (s *Store) Load() ([]rtcsocks.ReplicationEvent, error) {
+	rows, err := s.db.Query(s.rebind(`SELECT payload FROM rtcsocks_events WHERE offer_id IN (
+		SELECT offer_id FROM rtcsocks_events WHERE event_type = ? AND expiry > ?
+	) ORDER BY id`), int(rtcsocks.EventOfferRegistered), time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := make([]rtcsocks.ReplicationEvent, 0)
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			return nil, err
+		}
+		var event rtcsocks.ReplicationEvent
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// PurgeHistory deletes the events of offers registered before the specified time,
+// which are no longer needed except for auditing.
+func (s *Store) PurgeHistory(before time.Time) error {
+	_, err := s.db.Exec(s.rebind(`DELETE FROM rtcsocks_events WHERE offer_id IN (
+		SELECT offer_id FROM (SELECT offer_id FROM rtcsocks_events WHERE event_type = ? AND recorded_at < ?) AS expired
+	)`), int(rtcsocks.EventOfferRegistered), before.UnixMilli())
+	return err
+}
+
+// validNow matches the rows valid at the time bound to both placeholders.
+const validNow = `(not_before = 0 OR not_before <= ?) AND (not_after = 0 OR not_after > ?)`
+
+// unixMilli converts a validity bound, the zero time to 0.
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// rebind replaces the ? placeholders with the placeholders of the dialect.
+func (s *Store) rebind(query string) string {
+	if s.dialect != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
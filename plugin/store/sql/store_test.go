@@ -0,0 +1,72 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func newTestStore(t *testing.T) *Store {
+	db, err := dbsql.Open("sqlite3", filepath.Join(t.TempDir(), "rtcsocks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	s, err := New(db, SQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestGroupProfilesRoundTrip(t *testing.T) {
+	s := newTestStore(t)
+	profiles := map[rtcsocks.GroupID]rtcsocks.GroupProfile{
+		1: {},
+		2: {
+			TTL:              90 * time.Second,
+			MaxOffersPerUser: 3,
+			MaxOfferSize:     8192,
+			MaxSessions:      16,
+			MatchPolicy:      rtcsocks.MatchExclusive,
+			AllowedUsers:     []rtcsocks.UserID{5, 7},
+		},
+		3: {AllowedUsers: []rtcsocks.UserID{}}, // no user allowed
+	}
+	for gid, profile := range profiles {
+		if err := s.PutGroup(gid, "secret", profile); err != nil {
+			t.Fatalf("PutGroup(%s): %v", gid, err)
+		}
+	}
+
+	got, err := s.GroupProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, profiles) {
+		t.Fatalf("GroupProfiles() = %+v, want %+v", got, profiles)
+	}
+
+	// updating a group replaces its allow-list
+	if err := s.PutGroup(2, "secret", rtcsocks.GroupProfile{MaxSessions: 4, AllowedUsers: []rtcsocks.UserID{9}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteGroup(3); err != nil {
+		t.Fatal(err)
+	}
+	want := map[rtcsocks.GroupID]rtcsocks.GroupProfile{
+		1: {},
+		2: {MaxSessions: 4, AllowedUsers: []rtcsocks.UserID{9}},
+	}
+	if got, err = s.GroupProfiles(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("GroupProfiles() after update = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,164 @@
+package rtcsocks
+
+import (
+	"container/heap"
+	"time"
+)
+
+const (
+	purgeBucketWidth = time.Second // granularity of the expiry index
+	purgeBatchSize   = 256         // max offers purged per hold of n.mutexAnswers
+)
+
+// expiryIndex buckets offer IDs by expiry, so that purging looks at the expired offers
+// only instead of scanning all of them. An offer deleted or replaced before it expires
+// is left in its bucket, the purge checks that it is still due.
+type expiryIndex struct {
+	buckets map[int64][]OfferID // expiry / purgeBucketWidth -> offer IDs
+	keys    bucketHeap          // of buckets, soonest first
+	oldest  int64               // no bucket before it
+}
+
+// bucketHeap is a min-heap of bucket keys, see container/heap.
+type bucketHeap []int64
+
+func (h bucketHeap) Len() int            { return len(h) }
+func (h bucketHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h bucketHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *bucketHeap) Push(x interface{}) { *h = append(*h, x.(int64)) }
+func (h *bucketHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+func newExpiryIndex() *expiryIndex {
+	return &expiryIndex{
+		buckets: make(map[int64][]OfferID),
+		oldest:  time.Now().UnixNano() / int64(purgeBucketWidth),
+	}
+}
+
+func (x *expiryIndex) add(offerID OfferID, expiry time.Time) {
+	bucket := expiry.UnixNano()/int64(purgeBucketWidth) + 1 // round up, so due means expired
+	if bucket < x.oldest {
+		bucket = x.oldest
+	}
+	if _, ok := x.buckets[bucket]; !ok {
+		heap.Push(&x.keys, bucket)
+	}
+	x.buckets[bucket] = append(x.buckets[bucket], offerID)
+}
+
+// soonest returns the offer ID expiring soonest for which live returns true. The IDs
+// scanned for which it returns false are removed from the index.
+func (x *expiryIndex) soonest(live func(OfferID) bool) (OfferID, bool) {
+	for len(x.keys) > 0 {
+		bucket := x.keys[0]
+		for i, offerID := range x.buckets[bucket] {
+			if live(offerID) {
+				x.buckets[bucket] = x.buckets[bucket][i:]
+				return offerID, true
+			}
+		}
+		delete(x.buckets, bucket)
+		heap.Pop(&x.keys)
+	}
+	return 0, false
+}
+
+// due removes and returns the offer IDs of the buckets ended by now.
+func (x *expiryIndex) due(now time.Time) []OfferID {
+	current := now.UnixNano() / int64(purgeBucketWidth)
+	var due []OfferID
+	for len(x.keys) > 0 && x.keys[0] <= current {
+		bucket := heap.Pop(&x.keys).(int64)
+		due = append(due, x.buckets[bucket]...)
+		delete(x.buckets, bucket)
+	}
+	if x.oldest <= current {
+		x.oldest = current + 1
+	}
+	return due
+}
+
+func (n *Negotiator) autoPurge() {
+	for {
+		time.Sleep(n.ttl / 2)
+		// a round given up on is retried at the next tick
+		Supervise("Negotiator: purge", n.restartPolicy, n.logger, func() {
+			n.purge(time.Now())
+			n.purgeSessions()
+		})
+	}
+}
+
+// purge deletes the answers expired by now, remembering those unanswered, and forgets
+// the tombstones past their grace period. n.mutexAnswers is held for one batch of
+// purgeBatchSize offers at a time, so that the hot path is never blocked for long.
+func (n *Negotiator) purge(now time.Time) {
+	grace := n.expiryGrace
+	if grace <= 0 {
+		grace = n.ttl
+	}
+
+	n.mutexAnswers.Lock()
+	answers := n.answerExpiry.due(now)
+	tombstones := n.expiredExpiry.due(now)
+	n.mutexAnswers.Unlock()
+
+	unanswered := 0
+	for len(answers) > 0 {
+		batch := answers
+		if len(batch) > purgeBatchSize {
+			batch = batch[:purgeBatchSize]
+		}
+		answers = answers[len(batch):]
+
+		n.mutexAnswers.Lock()
+		for _, offerID := range batch {
+			answer, ok := n.answers[offerID]
+			if !ok || !now.After(answer.expiry) {
+				continue // deleted, or replaced by an offer expiring later
+			}
+			if answer.body == nil {
+				n.bury(offerID, answer.user, grace)
+				unanswered++
+			}
+			n.deleteAnswer(offerID)
+		}
+		n.mutexAnswers.Unlock()
+	}
+
+	for len(tombstones) > 0 {
+		batch := tombstones
+		if len(batch) > purgeBatchSize {
+			batch = batch[:purgeBatchSize]
+		}
+		tombstones = tombstones[len(batch):]
+
+		n.mutexAnswers.Lock()
+		for _, offerID := range batch {
+			if t, ok := n.expired[offerID]; ok && now.After(t.until) {
+				delete(n.expired, offerID)
+			}
+		}
+		n.mutexAnswers.Unlock()
+	}
+
+	if unanswered > 0 && n.logger != nil {
+		n.logger.Infof("Negotiator: %d offers expired unanswered", unanswered)
+	}
+}
+
+// bury remembers an offer deleted unanswered for the grace period, so that its owner
+// is told it expired. The caller MUST hold n.mutexAnswers.
+func (n *Negotiator) bury(offerID OfferID, user UserID, grace time.Duration) {
+	until := time.Now().Add(grace)
+	n.expired[offerID] = &tombstone{
+		user:  user,
+		until: until,
+	}
+	n.expiredExpiry.add(offerID, until)
+}
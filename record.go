@@ -0,0 +1,152 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// RecordedCall is a call to a callback function recorded by a Recorder, once it returned.
+type RecordedCall struct {
+	Time         time.Time      `json:"time"`
+	Method       CallbackMethod `json:"method"`
+	User         UserID         `json:"user,omitempty"`
+	Group        GroupID        `json:"group,omitempty"`
+	Groups       []GroupID      `json:"groups,omitempty"`
+	Session      string         `json:"session,omitempty"`
+	Capabilities []string       `json:"capabilities,omitempty"`
+	OfferID      OfferID        `json:"offer_id,omitempty"`
+	SDP          []byte         `json:"sdp,omitempty"`   // sanitized, see Recorder
+	Error        string         `json:"error,omitempty"` // empty if the call succeeded
+}
+
+// Recorder records the calls of a NegotiatorAPI as JSON lines, to reproduce rendezvous
+// failures offline with Replay. Wrap the NegotiatorAPI with Recorder.Middleware, see
+// WithMiddleware, innermost to record what the Negotiator sees.
+//
+// The SDPs are sanitized: the ICE credentials and DTLS fingerprints are masked, keeping
+// their length, and public IP addresses are replaced by documentation addresses
+// (192.0.2.1 or 2001:db8::1). User IDs and session IDs are kept, as they drive the
+// quotas and the dispatch.
+type Recorder struct {
+	enc   *json.Encoder
+	err   error
+	mutex sync.Mutex
+}
+
+// NewRecorder returns a Recorder writing to w.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Middleware returns the Middleware recording the calls.
+func (r *Recorder) Middleware() Middleware {
+	return func(next CallHandler) CallHandler {
+		return func(ctx context.Context, call *Call) error {
+			err := next(ctx, call)
+			r.record(call, err)
+			return err
+		}
+	}
+}
+
+// Err returns the first error writing the recording, if any. Calls are not recorded
+// after it.
+func (r *Recorder) Err() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(call *Call, err error) {
+	rc := RecordedCall{
+		Time:         time.Now(),
+		Method:       call.Method,
+		User:         call.User,
+		Group:        call.Group,
+		Groups:       call.Groups,
+		Session:      call.Session,
+		Capabilities: call.Capabilities,
+		OfferID:      call.OfferID,
+		SDP:          sanitizeSDP(call.SDP),
+	}
+	if err != nil {
+		rc.Error = err.Error()
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.err == nil {
+		r.err = r.enc.Encode(&rc)
+	}
+}
+
+// sanitizeSDP masks what identifies the peers in an SDP, see Recorder.
+func sanitizeSDP(sdp []byte) []byte {
+	if sdp == nil {
+		return nil
+	}
+	out := make([]byte, 0, len(sdp))
+	for _, line := range bytes.SplitAfter(sdp, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, "\r\n")
+		ending := line[len(trimmed):]
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("a=ice-ufrag:")), bytes.HasPrefix(trimmed, []byte("a=ice-pwd:")):
+			trimmed = maskFrom(trimmed, bytes.IndexByte(trimmed, ':')+1)
+		case bytes.HasPrefix(trimmed, []byte("a=fingerprint:")):
+			trimmed = maskFrom(trimmed, bytes.IndexByte(trimmed, ' ')+1) // keep the hash function
+		default:
+			if c, ok := parseCandidate(trimmed); ok {
+				fields := make([][]byte, len(c.fields))
+				copy(fields, c.fields)
+				fields[4] = sanitizeAddress(fields[4])
+				if c.raddr > 0 {
+					fields[c.raddr] = sanitizeAddress(fields[c.raddr])
+				}
+				trimmed = append([]byte("a=candidate:"), bytes.Join(fields, []byte(" "))...)
+			} else if idx := connectionAddress(trimmed); idx > 0 {
+				end := idx
+				for end < len(trimmed) && trimmed[end] != ' ' && trimmed[end] != '/' {
+					end++
+				}
+				sanitized := append([]byte{}, trimmed[:idx]...)
+				sanitized = append(sanitized, sanitizeAddress(trimmed[idx:end])...)
+				trimmed = append(sanitized, trimmed[end:]...)
+			}
+		}
+		out = append(out, trimmed...)
+		out = append(out, ending...)
+	}
+	return out
+}
+
+// maskFrom replaces the bytes of the line from idx with 'x'. An idx of 0 or less masks
+// nothing, as the separator was not found.
+func maskFrom(line []byte, idx int) []byte {
+	if idx <= 0 {
+		return line
+	}
+	masked := append([]byte{}, line...)
+	for i := idx; i < len(masked); i++ {
+		masked[i] = 'x'
+	}
+	return masked
+}
+
+// sanitizeAddress replaces a public IP address by a documentation address of the same
+// family. Private, loopback, link-local and unspecified addresses, and mDNS hostnames,
+// are kept.
+func sanitizeAddress(address []byte) []byte {
+	ip := net.ParseIP(string(address))
+	if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return address
+	}
+	if ip.To4() != nil {
+		return []byte("192.0.2.1")
+	}
+	return []byte("2001:db8::1")
+}
@@ -0,0 +1,116 @@
+package rtcsocks
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Crash is a panic recovered in a goroutine or request handler of rtcsocks, so that a
+// bug or malformed input does not take the whole daemon down.
+type Crash struct {
+	Subsystem string      // e.g. "Negotiator: purge"
+	Value     interface{} // as passed to panic
+	Stack     []byte      // of the panicking goroutine
+	Time      time.Time
+	Restarts  int // restarts of the subsystem before this crash, see RestartPolicy
+}
+
+func (c *Crash) Error() string {
+	return fmt.Sprintf("%s: panic: %v", c.Subsystem, c.Value)
+}
+
+// RestartPolicy decides how a long-running goroutine is restarted after a panic.
+type RestartPolicy struct {
+	MaxRestarts int           // restarts before giving up, <0 -> unlimited
+	Backoff     time.Duration // delay before the first restart, doubled for each next one
+	MaxBackoff  time.Duration // max delay between restarts, 0 -> Backoff
+	OnCrash     func(*Crash)  // called for every crash, e.g. to alert, nil -> only logged
+}
+
+// DefaultRestartPolicy restarts forever, backing off from 1 second to 1 minute.
+var DefaultRestartPolicy = RestartPolicy{
+	MaxRestarts: -1,
+	Backoff:     time.Second,
+	MaxBackoff:  time.Minute,
+}
+
+// Supervise runs f, restarting it after a panic as the policy says, nil ->
+// DefaultRestartPolicy. Every crash is logged at LogLevelError with its stack trace.
+// It returns nil once f returns, or the last Crash if the policy gave up.
+func Supervise(subsystem string, policy *RestartPolicy, logger Logger, f func()) *Crash {
+	if policy == nil {
+		policy = &DefaultRestartPolicy
+	}
+	backoff := policy.Backoff
+	for restarts := 0; ; restarts++ {
+		crash := runRecovered(subsystem, f)
+		if crash == nil {
+			return nil
+		}
+		crash.Restarts = restarts
+		reportCrash(crash, logger, policy.OnCrash)
+		if policy.MaxRestarts >= 0 && restarts >= policy.MaxRestarts {
+			if logger != nil {
+				logger.Errorf("%s: given up after %d restarts", subsystem, restarts)
+			}
+			return crash
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		if policy.MaxBackoff <= 0 {
+			backoff = policy.Backoff
+		}
+	}
+}
+
+// Recover recovers a panic of the calling goroutine, logging it like Supervise and
+// passing it to onCrash if not nil. It MUST be deferred directly, e.g. in a request
+// handler:
+//
+//	defer rtcsocks.Recover("API: request", logger, nil)
+func Recover(subsystem string, logger Logger, onCrash func(*Crash)) {
+	if v := recover(); v != nil {
+		reportCrash(newCrash(subsystem, v), logger, onCrash)
+	}
+}
+
+func runRecovered(subsystem string, f func()) (crash *Crash) {
+	defer func() {
+		if v := recover(); v != nil {
+			crash = newCrash(subsystem, v)
+		}
+	}()
+	f()
+	return nil
+}
+
+func newCrash(subsystem string, v interface{}) *Crash {
+	return &Crash{
+		Subsystem: subsystem,
+		Value:     v,
+		Stack:     debug.Stack(),
+		Time:      time.Now(),
+	}
+}
+
+func reportCrash(crash *Crash, logger Logger, onCrash func(*Crash)) {
+	if logger != nil {
+		logger.Errorf("%v\n%s", crash, crash.Stack)
+	}
+	if onCrash != nil {
+		onCrash(crash)
+	}
+}
+
+// SetRestartPolicy sets how the purge loop of the Negotiator is restarted after a
+// panic. A round of purge given up on is retried at the next tick regardless. Panics
+// in the callback functions are recovered by the NegotiatorAPI.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetRestartPolicy(p RestartPolicy) {
+	n.restartPolicy = &p
+}
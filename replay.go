@@ -0,0 +1,111 @@
+package rtcsocks
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// replayWaitTimeout bounds a replayed WaitAnswer, which was recorded once the answer
+// was in, so it should return at once too.
+const replayWaitTimeout = time.Second
+
+// ReplayResult is the outcome of replaying a RecordedCall.
+type ReplayResult struct {
+	Recorded RecordedCall
+	Skipped  bool // not replayable, see Replay
+
+	Expected OfferID // replayed ID of Recorded.OfferID, 0 if unknown
+	OfferID  OfferID // returned by the replayed call, if any
+	Err      error   // returned by the replayed call
+}
+
+// Diverged reports whether the replayed call did not end like the recorded one: with
+// another error, or for NextOffer with another offer.
+func (r *ReplayResult) Diverged() bool {
+	if r.Skipped {
+		return false
+	}
+	errString := ""
+	if r.Err != nil {
+		errString = r.Err.Error()
+	}
+	if errString != r.Recorded.Error {
+		return true
+	}
+	return r.Recorded.Method == MethodNextOffer && r.Err == nil && r.Expected != 0 && r.OfferID != r.Expected
+}
+
+// Replay feeds the calls recorded by a Recorder, read from r, to the callback functions
+// of the Negotiator in order, and calls report with the result of each. The recorded
+// offer IDs are mapped to the ones assigned by the Negotiator.
+//
+// The calls are replayed back to back, or with the recorded delays between them if
+// realtime, which matters for the expiry of offers and sessions. ReplicationEvent calls
+// are skipped, as the events are not recorded. Replay the recording to a fresh
+// Negotiator configured like the recorded one.
+func Replay(ctx context.Context, n *Negotiator, r io.Reader, realtime bool, report func(*ReplayResult)) error {
+	dec := json.NewDecoder(bufio.NewReader(r))
+	offerIDs := make(map[OfferID]OfferID) // recorded -> replayed
+	var last time.Time
+	for {
+		result := &ReplayResult{}
+		if err := dec.Decode(&result.Recorded); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		rc := &result.Recorded
+
+		if realtime && !last.IsZero() && rc.Time.After(last) {
+			timer := time.NewTimer(rc.Time.Sub(last))
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			}
+		}
+		last = rc.Time
+
+		offerID := rc.OfferID
+		if replayed, ok := offerIDs[offerID]; ok {
+			offerID = replayed
+			result.Expected = replayed
+		}
+
+		switch rc.Method {
+		case MethodRegisterOffer, MethodRegisterMailboxOffer:
+			result.OfferID, result.Err = n.register(ctx, rc.User, rc.SDP, rc.Groups, rc.Method == MethodRegisterMailboxOffer)
+			if result.Err == nil && rc.OfferID != 0 {
+				offerIDs[rc.OfferID] = result.OfferID
+			}
+		case MethodNextOffer:
+			result.OfferID, _, result.Err = n.nextOffer(ctx, rc.Group, rc.Session)
+			if result.Err == nil && rc.OfferID != 0 && result.Expected == 0 {
+				offerIDs[rc.OfferID] = result.OfferID // registered before the recording
+			}
+		case MethodRegisterAnswer:
+			result.Err = n.registerAnswer(ctx, offerID, rc.SDP)
+		case MethodLookupAnswer:
+			_, result.Err = n.lookupAnswer(ctx, rc.User, offerID)
+		case MethodWaitAnswer:
+			waitCtx, cancel := context.WithTimeout(ctx, replayWaitTimeout)
+			_, result.Err = n.waitAnswer(waitCtx, rc.User, offerID)
+			cancel()
+		case MethodCollectAnswers:
+			_, result.Err = n.collectAnswers(ctx, rc.User)
+		case MethodHeartbeat:
+			result.Err = n.heartbeat(ctx, rc.Group, rc.Session, rc.Capabilities)
+		case MethodDeregister:
+			result.Err = n.deregister(ctx, rc.Group, rc.Session)
+		case MethodDeclineOffer:
+			result.Err = n.declineOffer(ctx, rc.Group, rc.Session, offerID)
+		default:
+			result.Skipped = true
+		}
+		report(result)
+	}
+}
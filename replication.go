@@ -0,0 +1,238 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"time"
+)
+
+// ReplicationEventType is the type of a state change replicated between Negotiators.
+type ReplicationEventType uint8
+
+const (
+	EventOfferRegistered  ReplicationEventType = iota + 1 // a client registered an offer
+	EventOfferDispatched                                  // an offer was handed out to an edge server
+	EventAnswerRegistered                                 // an edge server registered an answer
+	EventOfferRequeued                                    // an offer was put back in queue after its edge server left
+	EventAnswerCollected                                  // a mailbox answer was collected by its owner
+	EventOfferDropped                                     // an offer was dropped after it was registered, its bin being full
+)
+
+// ReplicationEvent is a state change of a Negotiator to be applied by its peer replicas.
+type ReplicationEvent struct {
+	Type    ReplicationEventType `json:"type"`
+	Origin  string               `json:"origin"` // replica ID of the originating Negotiator
+	OfferID OfferID              `json:"offer_id"`
+
+	// EventOfferRegistered and EventOfferRequeued
+	User    UserID    `json:"user,omitempty"`
+	Groups  []GroupID `json:"groups,omitempty"`
+	Created time.Time `json:"created,omitempty"`
+	Expiry  time.Time `json:"expiry,omitempty"`
+	Mailbox bool      `json:"mailbox,omitempty"`
+
+	// EventOfferDispatched and EventOfferRequeued
+	Group   GroupID `json:"group,omitempty"`
+	Session string  `json:"session,omitempty"`
+
+	// EventOfferRegistered, EventOfferRequeued and EventAnswerRegistered
+	SDP []byte `json:"sdp,omitempty"`
+}
+
+// Replicator propagates the ReplicationEvents of a Negotiator to its peer replicas,
+// which apply them with ApplyReplicationEvent.
+//
+// Broadcast MUST NOT block the caller.
+type Replicator interface {
+	Broadcast(event ReplicationEvent)
+}
+
+type ReplicationCallbackFunction func(ctx context.Context, event ReplicationEvent) error
+
+// ReplicationAPI is implemented by the NegotiatorAPIs able to receive ReplicationEvents
+// from peer replicas. HookToAPI sets the replication callback if the API implements it.
+type ReplicationAPI interface {
+	SetReplicationCallback(ReplicationCallbackFunction)
+}
+
+// SetReplicator enables replication. The replicaID MUST be unique among the peers.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetReplicator(replicaID string, r Replicator) {
+	n.replicaID = replicaID
+	n.replicator = r
+}
+
+func (n *Negotiator) replicate(event ReplicationEvent) {
+	event.Origin = n.replicaID
+	if n.store != nil {
+		n.store.Record(event)
+	}
+	if n.replicator != nil {
+		n.replicator.Broadcast(event)
+	}
+}
+
+// ApplyReplicationEvent applies a ReplicationEvent received from a peer replica.
+// Applied events are not broadcasted again.
+//
+// If an offer ID registered by a peer collides with a different local offer, the
+// offer registered earlier wins, ties are broken by the lower replica ID. The losing
+// offer is dropped, and its owner sees ErrInvalidOfferID.
+func (n *Negotiator) ApplyReplicationEvent(event ReplicationEvent) error {
+	if event.Origin == n.replicaID {
+		return nil
+	}
+
+	if err := n.apply(event); err != nil {
+		if n.logger != nil {
+			n.logger.Warnf("Negotiator: replication event %d of offer %s from %q: %v", event.Type, event.OfferID, event.Origin, err)
+		}
+		return err
+	}
+	if n.store != nil {
+		n.store.Record(event)
+	}
+	return nil
+}
+
+func (n *Negotiator) applyReplicationEvent(_ context.Context, event ReplicationEvent) error {
+	return n.ApplyReplicationEvent(event)
+}
+
+func (n *Negotiator) apply(event ReplicationEvent) error {
+	switch event.Type {
+	case EventOfferRegistered:
+		return n.applyOfferRegistered(event)
+	case EventOfferDispatched:
+		return n.applyOfferDispatched(event)
+	case EventAnswerRegistered:
+		return n.applyAnswerRegistered(event)
+	case EventOfferRequeued:
+		return n.applyOfferRequeued(event)
+	case EventAnswerCollected, EventOfferDropped:
+		n.mutexAnswers.Lock()
+		n.deleteAnswer(event.OfferID)
+		n.mutexAnswers.Unlock()
+		return nil
+	default:
+		return ErrBadReplicationEvent
+	}
+}
+
+func (n *Negotiator) applyOfferRegistered(event ReplicationEvent) error {
+	binID, validGroups := n.binOf(event.Groups)
+	if binID == 0 {
+		return ErrBadGroupID
+	}
+	if event.Expiry.Before(time.Now()) {
+		return nil
+	}
+
+	key := offerKey{
+		user: event.User,
+		hash: sha256.Sum256(event.SDP),
+	}
+
+	n.mutexAnswers.Lock()
+	if existing, ok := n.answers[event.OfferID]; ok {
+		existing.mutex.Lock()
+		same := existing.key == key
+		localWins := existing.created.Before(event.Created) ||
+			(existing.created.Equal(event.Created) && n.replicaID < event.Origin)
+		existing.mutex.Unlock()
+		if same || localWins {
+			n.mutexAnswers.Unlock()
+			return nil
+		}
+		n.deleteAnswer(event.OfferID)
+	}
+	n.insertAnswer(event.OfferID, key, validGroups, event.Created, event.Expiry, event.Mailbox)
+	n.mutexAnswers.Unlock()
+
+	return n.enqueueOffer(binID, &offer{
+		id:     event.OfferID,
+		key:    key,
+		user:   event.User,
+		sdp:    event.SDP,
+		expiry: event.Expiry,
+	})
+}
+
+func (n *Negotiator) applyOfferDispatched(event ReplicationEvent) error {
+	n.mutexAnswers.Lock()
+	defer n.mutexAnswers.Unlock()
+	answer, ok := n.answers[event.OfferID]
+	if !ok {
+		return ErrInvalidOfferID
+	}
+	answer.mutex.Lock()
+	defer answer.mutex.Unlock()
+	if answer.dispatched.IsZero() {
+		answer.dispatched = time.Now()
+		answer.group = event.Group
+		answer.session = event.Session
+		answer.byPeer = true
+	}
+	return nil
+}
+
+func (n *Negotiator) applyAnswerRegistered(event ReplicationEvent) error {
+	n.mutexAnswers.Lock()
+	defer n.mutexAnswers.Unlock()
+	answer, ok := n.answers[event.OfferID]
+	if !ok {
+		return ErrInvalidOfferID
+	}
+	answer.mutex.Lock()
+	defer answer.mutex.Unlock()
+	if answer.body != nil {
+		if bytes.Equal(answer.body, event.SDP) {
+			return nil
+		}
+		return ErrAnswerRepeated
+	}
+	answer.setBody(event.SDP)
+	n.countPending(answer.user, answer.groups, -1)
+	return nil
+}
+
+func (n *Negotiator) applyOfferRequeued(event ReplicationEvent) error {
+	binID, _ := n.binOf(event.Groups)
+	if binID == 0 {
+		return ErrBadGroupID
+	}
+
+	n.mutexAnswers.Lock()
+	answer, ok := n.answers[event.OfferID]
+	if !ok {
+		n.mutexAnswers.Unlock()
+		return ErrInvalidOfferID
+	}
+	answer.mutex.Lock()
+	// only if still dispatched to the edge server which left
+	requeue := answer.body == nil && answer.byPeer &&
+		answer.group == event.Group && answer.session == event.Session
+	if requeue {
+		answer.dispatched = time.Time{}
+		answer.group = 0
+		answer.session = ""
+		answer.byPeer = false
+		answer.offer = nil
+	}
+	key, expiry := answer.key, answer.expiry
+	answer.mutex.Unlock()
+	n.mutexAnswers.Unlock()
+
+	if !requeue {
+		return nil
+	}
+	return n.enqueueOffer(binID, &offer{
+		id:     event.OfferID,
+		key:    key,
+		user:   event.User,
+		sdp:    event.SDP,
+		expiry: expiry,
+	})
+}
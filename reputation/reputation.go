@@ -0,0 +1,271 @@
+// Package reputation checks whether the exit IP address of an Edge Server landed on
+// common blocklists or is blocked by major destinations, so that operators know when
+// to rotate it. A Monitor checks periodically and keeps the last Report, e.g. for
+// debug.PublishReputation.
+package reputation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gaukas/rtcsocks"
+	"github.com/gaukas/rtcsocks/nat"
+)
+
+var (
+	ErrNoExitIP = errors.New("reputation: exit IP unknown")
+)
+
+const (
+	defaultInterval = time.Hour
+	defaultTimeout  = 10 * time.Second
+)
+
+// DefaultBlocklists are DNS blocklists commonly consulted by destinations.
+var DefaultBlocklists = []string{
+	"zen.spamhaus.org",
+	"bl.spamcop.net",
+	"dnsbl.dronebl.org",
+	"b.barracudacentral.org",
+}
+
+// DefaultSTUNServers find the exit IP address if Monitor.ExitIP is not set.
+var DefaultSTUNServers = []string{
+	"stun.l.google.com:19302",
+	"stun.cloudflare.com:3478",
+}
+
+// Probe is a destination whose answer tells whether it blocks the exit IP.
+type Probe struct {
+	Name string
+	URL  string
+
+	// Blocked reports whether the response means the exit IP is blocked, e.g. a
+	// CAPTCHA page. nil -> status 403 Forbidden or 429 Too Many Requests.
+	Blocked func(resp *http.Response) bool
+}
+
+// DefaultProbes are major destinations answering small requests.
+var DefaultProbes = []Probe{
+	{Name: "google", URL: "https://www.google.com/generate_204"},
+	{Name: "cloudflare", URL: "https://www.cloudflare.com/cdn-cgi/trace"},
+	{Name: "wikipedia", URL: "https://en.wikipedia.org/wiki/Special:BlankPage"},
+}
+
+// Report is the outcome of a check.
+type Report struct {
+	Time    time.Time `json:"time"`
+	ExitIP  string    `json:"exit_ip"`
+	Listed  []string  `json:"listed"`  // blocklists listing the exit IP
+	Blocked []string  `json:"blocked"` // probes blocking the exit IP
+	Errors  []string  `json:"errors"`  // checks which could not be completed
+}
+
+// Clean reports whether no blocklist lists the exit IP and no probe blocks it.
+func (r Report) Clean() bool {
+	return len(r.Listed) == 0 && len(r.Blocked) == 0
+}
+
+// Monitor periodically checks the reputation of the exit IP address.
+type Monitor struct {
+	// ExitIP returns the exit IP address. nil -> as seen by DefaultSTUNServers.
+	ExitIP func(ctx context.Context) (net.IP, error)
+
+	Blocklists []string // DNS blocklist zones, nil -> DefaultBlocklists
+	Probes     []Probe  // nil -> DefaultProbes
+
+	Interval time.Duration // between checks, 0 -> 1 hour
+	Timeout  time.Duration // of each lookup and probe, 0 -> 10 seconds
+
+	// OnChange is called when a check is not clean while the previous one was, or
+	// the other way round, e.g. to alert the operator. It MUST NOT block.
+	OnChange func(Report)
+
+	Resolver *net.Resolver // nil -> net.DefaultResolver
+	Client   *http.Client  // of the probes, nil -> http.DefaultClient
+
+	Logger rtcsocks.Logger
+
+	last  *Report
+	mutex sync.Mutex
+}
+
+// Latest returns the last Report, nil if not checked yet.
+func (m *Monitor) Latest() *Report {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.last
+}
+
+// Start checks every Interval until stop is called.
+func (m *Monitor) Start() (stop func()) {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = defaultInterval
+	}
+	done := make(chan struct{})
+	go func() {
+		defer rtcsocks.Recover("reputation: monitor", m.Logger, nil)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			m.Check(context.Background())
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Check checks the reputation of the exit IP now, and keeps the Report as the Latest.
+func (m *Monitor) Check(ctx context.Context) Report {
+	report := Report{Time: time.Now(), Listed: []string{}, Blocked: []string{}, Errors: []string{}}
+	ip, err := m.exitIP(ctx)
+	if err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("exit IP: %v", err))
+	}
+	if ip != nil {
+		report.ExitIP = ip.String()
+		m.checkBlocklists(ctx, ip, &report)
+	}
+	m.checkProbes(ctx, &report)
+
+	m.mutex.Lock()
+	previous := m.last
+	m.last = &report
+	m.mutex.Unlock()
+
+	if !report.Clean() && m.Logger != nil {
+		m.Logger.Warnf("reputation: exit IP %s listed by %v, blocked by %v", report.ExitIP, report.Listed, report.Blocked)
+	}
+	if previous != nil && previous.Clean() != report.Clean() && m.OnChange != nil {
+		m.OnChange(report)
+	}
+	return report
+}
+
+func (m *Monitor) exitIP(ctx context.Context) (net.IP, error) {
+	if m.ExitIP != nil {
+		return m.ExitIP(ctx)
+	}
+	result, err := nat.Detect(DefaultSTUNServers, m.timeout())
+	if err != nil {
+		return nil, err
+	}
+	if result.MappedAddr == nil {
+		return nil, ErrNoExitIP
+	}
+	return result.MappedAddr.IP, nil
+}
+
+// checkBlocklists looks up the exit IP in the DNS blocklists: a listed address has
+// an A record in 127.0.0.0/8 under the zone, e.g. 4.3.2.1.zen.spamhaus.org for 1.2.3.4.
+func (m *Monitor) checkBlocklists(ctx context.Context, ip net.IP, report *Report) {
+	name := reverseName(ip)
+	if name == "" {
+		return
+	}
+	resolver := m.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	blocklists := m.Blocklists
+	if blocklists == nil {
+		blocklists = DefaultBlocklists
+	}
+
+	for _, zone := range blocklists {
+		ctx, cancel := context.WithTimeout(ctx, m.timeout())
+		addrs, err := resolver.LookupIP(ctx, "ip4", name+"."+zone)
+		cancel()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			continue // not listed
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", zone, err))
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.To4() != nil && addr.To4()[0] == 127 {
+				report.Listed = append(report.Listed, zone)
+				break
+			}
+		}
+	}
+}
+
+// reverseName returns the name of the IPv4 address in DNS blocklists, empty for IPv6
+// addresses, which most blocklists do not list.
+func reverseName(ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+}
+
+func (m *Monitor) checkProbes(ctx context.Context, report *Report) {
+	client := m.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	probes := m.Probes
+	if probes == nil {
+		probes = DefaultProbes
+	}
+
+	for _, probe := range probes {
+		blocked, err := m.probe(ctx, client, probe)
+		switch {
+		case err != nil:
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", probe.Name, err))
+		case blocked:
+			report.Blocked = append(report.Blocked, probe.Name)
+		}
+	}
+}
+
+func (m *Monitor) probe(ctx context.Context, client *http.Client, probe Probe) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, probe.URL, nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if probe.Blocked != nil {
+		return probe.Blocked(resp), nil
+	}
+	return resp.StatusCode == http.StatusForbidden || resp.StatusCode == http.StatusTooManyRequests, nil
+}
+
+func (m *Monitor) timeout() time.Duration {
+	if m.Timeout > 0 {
+		return m.Timeout
+	}
+	return defaultTimeout
+}
+
+// String summarizes the report for logs.
+func (r Report) String() string {
+	if r.Clean() {
+		return "exit IP " + r.ExitIP + " clean"
+	}
+	return "exit IP " + r.ExitIP + " listed by " + strings.Join(r.Listed, ", ") + "; blocked by " + strings.Join(r.Blocked, ", ")
+}
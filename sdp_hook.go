@@ -0,0 +1,126 @@
+package rtcsocks
+
+import (
+	"context"
+
+	"github.com/gaukas/rtcsocks/sdputil"
+)
+
+// SDPKind tells offers from answers, see SDPHookFunction.
+type SDPKind uint8
+
+const (
+	SDPOffer SDPKind = iota + 1
+	SDPAnswer
+)
+
+func (k SDPKind) String() string {
+	switch k {
+	case SDPOffer:
+		return "offer"
+	case SDPAnswer:
+		return "answer"
+	default:
+		return "unknown SDP"
+	}
+}
+
+// SDPInfo is what the Negotiator knows of an SDP passed to the SDP hook.
+type SDPInfo struct {
+	Kind    SDPKind
+	User    UserID    // who registered the offer, or the one answered
+	Groups  []GroupID // the valid groups listed in the offer, or the group answering
+	OfferID OfferID   // of the offer answered, 0 for an offer not registered yet
+}
+
+// SDPHookFunction inspects an offer before it is queued, or an answer before it is
+// delivered, once it passed the SDPValidation and the SDP policy. It returns the SDP
+// to queue or deliver, as is or rewritten, or an error to reject it with, which
+// SHOULD be ErrSDPNotAllowed for the API to report it as such.
+type SDPHookFunction func(ctx context.Context, info SDPInfo, sdp []byte) ([]byte, error)
+
+// SetSDPHook sets the hook the offers and answers pass through, e.g. to require relay
+// candidates for some groups, see GroupSDPHook and CandidateSDPHook. The hook is
+// called concurrently, without any lock of the Negotiator held.
+//
+// Rewriting SDPs breaks the answer signatures, see SignAnswer: the Edge Servers sign
+// the offer they receive and the Clients verify the answer against the offer they
+// sent. If the Clients verify answers, the hook SHOULD only reject SDPs, leaving the
+// rewriting to the Clients and Edge Servers. The offer metadata is signed after the
+// hook, see SetOfferSigningKey.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetSDPHook(hook SDPHookFunction) {
+	n.sdpHook = hook
+}
+
+// hookSDP passes an offer or answer through the SDP hook, if any.
+func (n *Negotiator) hookSDP(ctx context.Context, info SDPInfo, sdp []byte) ([]byte, error) {
+	if n.sdpHook == nil {
+		return sdp, nil
+	}
+	hooked, err := n.sdpHook(ctx, info, sdp)
+	if err != nil {
+		if n.logger != nil {
+			n.logger.Debugf("Negotiator: %s by user %s rejected by the SDP hook: %v", info.Kind, info.User, err)
+		}
+		return nil, err
+	}
+	return hooked, nil
+}
+
+// ChainSDPHooks returns a hook passing the SDP through the hooks in order, until one
+// of them rejects it.
+func ChainSDPHooks(hooks ...SDPHookFunction) SDPHookFunction {
+	return func(ctx context.Context, info SDPInfo, sdp []byte) ([]byte, error) {
+		var err error
+		for _, hook := range hooks {
+			if sdp, err = hook(ctx, info, sdp); err != nil {
+				return nil, err
+			}
+		}
+		return sdp, nil
+	}
+}
+
+// GroupSDPHook returns a hook applying the hook to the offers listing the group and
+// the answers of its Edge Servers only. Chained, the hooks of several groups all apply
+// to the offers listing them together.
+func GroupSDPHook(group GroupID, hook SDPHookFunction) SDPHookFunction {
+	return func(ctx context.Context, info SDPInfo, sdp []byte) ([]byte, error) {
+		for _, g := range info.Groups {
+			if g == group {
+				return hook(ctx, info, sdp)
+			}
+		}
+		return sdp, nil
+	}
+}
+
+// CandidateSDPHook returns a hook removing the ICE candidates not allowed by the
+// policy, and rejecting with ErrSDPNotAllowed the SDPs left without any.
+func CandidateSDPHook(p *CandidatePolicy) SDPHookFunction {
+	return func(_ context.Context, _ SDPInfo, sdp []byte) ([]byte, error) {
+		allowed, err := p.Apply(sdp)
+		if err == ErrNoCandidateAllowed {
+			return nil, ErrSDPNotAllowed
+		}
+		return allowed, err
+	}
+}
+
+// SanitizeSDPHook returns a hook rejecting with ErrSDPNotAllowed the SDPs violating
+// the policy, e.g. with more than MaxMedia media sections, and stripping the
+// attributes it does not allow from the others, see sdputil.Policy.Sanitize.
+func SanitizeSDPHook(p *sdputil.Policy) SDPHookFunction {
+	return func(_ context.Context, _ SDPInfo, sdp []byte) ([]byte, error) {
+		if _, err := sdputil.Parse(sdp); err != nil {
+			return nil, ErrMalformedSDP
+		}
+		sanitized, err := p.Sanitize(sdp)
+		if err != nil {
+			return nil, ErrSDPNotAllowed
+		}
+		return sanitized, nil
+	}
+}
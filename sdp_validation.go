@@ -0,0 +1,100 @@
+package rtcsocks
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gaukas/rtcsocks/sdputil"
+)
+
+// SDPValidation configures the sanity checks performed on offer and answer SDPs
+// before they are accepted. The zero value performs no check.
+type SDPValidation struct {
+	MinSize        int  // min SDP size in bytes, 0 -> no minimum
+	MaxSize        int  // max SDP size in bytes, 0 -> unlimited
+	CheckStructure bool // require "v=0" as the first line and "<type>=<value>" lines only
+	CheckCharset   bool // require valid UTF-8 without control characters other than CR, LF and TAB
+}
+
+// Validate checks the SDP against the configured rules.
+func (v SDPValidation) Validate(sdp []byte) error {
+	if len(sdp) < v.MinSize {
+		return ErrSDPTooSmall
+	}
+	if v.MaxSize > 0 && len(sdp) > v.MaxSize {
+		return ErrSDPTooLarge
+	}
+
+	if v.CheckCharset {
+		if !utf8.Valid(sdp) {
+			return ErrMalformedSDP
+		}
+		for _, r := range string(sdp) {
+			if unicode.IsControl(r) && r != '\r' && r != '\n' && r != '\t' {
+				return ErrMalformedSDP
+			}
+		}
+	}
+
+	if v.CheckStructure {
+		lines := bytes.Split(bytes.ReplaceAll(sdp, []byte("\r\n"), []byte("\n")), []byte("\n"))
+		first := true
+		for _, line := range lines {
+			if len(line) == 0 {
+				continue
+			}
+			if len(line) < 2 || line[1] != '=' || line[0] < 'a' || line[0] > 'z' {
+				return ErrMalformedSDP
+			}
+			if first && !bytes.Equal(line, []byte("v=0")) {
+				return ErrMalformedSDP
+			}
+			first = false
+		}
+		if first { // no line at all
+			return ErrMalformedSDP
+		}
+	}
+	return nil
+}
+
+// SetSDPValidation sets the checks performed on offers and answers.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetSDPValidation(v SDPValidation) {
+	n.sdpValidation = v
+}
+
+// SetSDPPolicy rejects the offers and answers violating the policy with
+// ErrSDPNotAllowed, or ErrMalformedSDP if they cannot be parsed. The SDPs are not
+// rewritten, as that would break answer signatures: the attributes to strip are left
+// to the Clients and Edge Servers, see sdputil.Policy.Sanitize, or to the SDP hook,
+// see SanitizeSDPHook.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetSDPPolicy(p *sdputil.Policy) {
+	n.sdpPolicy = p
+}
+
+// checkSDP checks an offer or answer against the SDPValidation and the policy.
+func (n *Negotiator) checkSDP(sdp []byte) error {
+	if err := n.sdpValidation.Validate(sdp); err != nil {
+		return err
+	}
+	if n.sdpPolicy == nil {
+		return nil
+	}
+
+	s, err := sdputil.Parse(sdp)
+	if err != nil {
+		return ErrMalformedSDP
+	}
+	if err := n.sdpPolicy.Check(s); err != nil {
+		if n.logger != nil {
+			n.logger.Debugf("Negotiator: SDP rejected: %v", err)
+		}
+		return ErrSDPNotAllowed
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+// Package sdputil parses, validates and normalizes the SDPs of offers and answers, see
+// RFC 8866. It knows the lines, media sections and attributes, not their semantics,
+// which is enough to enforce a Policy on the SDPs exchanged by rtcsocks peers.
+//
+// It is used by the Negotiator to reject the SDPs violating a Policy, see
+// rtcsocks.Negotiator.SetSDPPolicy, and by Clients and Edge Servers to sanitize theirs
+// before sending them.
+package sdputil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrMalformed        = errors.New("sdputil: malformed SDP")
+	ErrMediaNotAllowed  = errors.New("sdputil: media section not allowed by the policy")
+	ErrTooManyMedia     = errors.New("sdputil: too many media sections")
+	ErrMissingAttribute = errors.New("sdputil: required attribute missing")
+)
+
+// Line is a "<type>=<value>" line of an SDP.
+type Line struct {
+	Type  byte
+	Value string
+}
+
+// Attribute returns the name and value of an "a=" line, e.g. "ice-ufrag" and "F7gI" for
+// "a=ice-ufrag:F7gI", or "sendrecv" and "" for "a=sendrecv". ok is false for other lines.
+func (l Line) Attribute() (name, value string, ok bool) {
+	if l.Type != 'a' {
+		return "", "", false
+	}
+	name, value, _ = strings.Cut(l.Value, ":")
+	return name, value, true
+}
+
+// Media is a media section of an SDP, from its "m=" line to the next.
+type Media struct {
+	Kind    string // "application", "audio", "video"...
+	Port    string
+	Proto   string   // e.g. "UDP/DTLS/SCTP"
+	Formats []string // e.g. "webrtc-datachannel"
+	Lines   []Line   // following the "m=" line
+}
+
+// IsDataChannel reports whether the media section is a WebRTC data channel, see RFC 8841.
+func (m *Media) IsDataChannel() bool {
+	return m.Kind == "application" && strings.HasSuffix(m.Proto, "DTLS/SCTP")
+}
+
+// SessionDescription is a parsed SDP.
+type SessionDescription struct {
+	Session []Line // session-level lines, from "v=0"
+	Media   []*Media
+}
+
+// Parse parses an SDP. Lines may end with CRLF or LF, and trailing whitespace and empty
+// lines are ignored.
+func Parse(sdp []byte) (*SessionDescription, error) {
+	s := &SessionDescription{}
+	for _, raw := range bytes.Split(sdp, []byte("\n")) {
+		raw = bytes.TrimRight(raw, " \t\r")
+		if len(raw) == 0 {
+			continue
+		}
+		if len(raw) < 2 || raw[1] != '=' || raw[0] < 'a' || raw[0] > 'z' {
+			return nil, fmt.Errorf("%w: bad line %q", ErrMalformed, raw)
+		}
+		line := Line{Type: raw[0], Value: string(raw[2:])}
+
+		switch {
+		case len(s.Session) == 0:
+			if line.Type != 'v' || line.Value != "0" {
+				return nil, fmt.Errorf("%w: does not start with v=0", ErrMalformed)
+			}
+			s.Session = append(s.Session, line)
+		case line.Type == 'm':
+			fields := strings.Fields(line.Value)
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%w: bad media line %q", ErrMalformed, raw)
+			}
+			s.Media = append(s.Media, &Media{
+				Kind:    fields[0],
+				Port:    fields[1],
+				Proto:   fields[2],
+				Formats: fields[3:],
+			})
+		case len(s.Media) > 0:
+			m := s.Media[len(s.Media)-1]
+			m.Lines = append(m.Lines, line)
+		default:
+			s.Session = append(s.Session, line)
+		}
+	}
+	if len(s.Session) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrMalformed)
+	}
+	return s, nil
+}
+
+// Marshal returns the SDP with CRLF line endings.
+func (s *SessionDescription) Marshal() []byte {
+	var buf bytes.Buffer
+	writeLines(&buf, s.Session)
+	for _, m := range s.Media {
+		buf.WriteString("m=")
+		buf.WriteString(strings.Join(append([]string{m.Kind, m.Port, m.Proto}, m.Formats...), " "))
+		buf.WriteString("\r\n")
+		writeLines(&buf, m.Lines)
+	}
+	return buf.Bytes()
+}
+
+func writeLines(buf *bytes.Buffer, lines []Line) {
+	for _, l := range lines {
+		buf.WriteByte(l.Type)
+		buf.WriteByte('=')
+		buf.WriteString(l.Value)
+		buf.WriteString("\r\n")
+	}
+}
+
+// Normalize parses and marshals the SDP: CRLF line endings, without trailing whitespace
+// or empty lines. Normalizing a normalized SDP returns it unchanged.
+func Normalize(sdp []byte) ([]byte, error) {
+	s, err := Parse(sdp)
+	if err != nil {
+		return nil, err
+	}
+	return s.Marshal(), nil
+}
+
+// Policy restricts the SDPs exchanged. The zero value allows any well-formed SDP.
+type Policy struct {
+	DataChannelOnly bool // allow data channel media sections only, see Media.IsDataChannel
+	MaxMedia        int  // max media sections, 0 -> unlimited
+
+	// RequireAttributes are the attributes every SDP MUST have, at the session level
+	// or in every media section, e.g. "fingerprint", "ice-ufrag" and "ice-pwd".
+	RequireAttributes []string
+
+	// StripAttributes are removed by Sanitize, e.g. "extmap" or "ssrc". If
+	// AllowAttributes is set, only those are kept instead.
+	StripAttributes []string
+	AllowAttributes []string
+}
+
+// Check reports whether the SDP complies with the policy. Attributes to strip are not
+// a violation, see Sanitize.
+func (p *Policy) Check(s *SessionDescription) error {
+	if p.MaxMedia > 0 && len(s.Media) > p.MaxMedia {
+		return ErrTooManyMedia
+	}
+	if p.DataChannelOnly {
+		for _, m := range s.Media {
+			if !m.IsDataChannel() {
+				return fmt.Errorf("%w: m=%s %s", ErrMediaNotAllowed, m.Kind, m.Proto)
+			}
+		}
+	}
+	for _, name := range p.RequireAttributes {
+		if hasAttribute(s.Session, name) {
+			continue
+		}
+		if len(s.Media) == 0 {
+			return fmt.Errorf("%w: %s", ErrMissingAttribute, name)
+		}
+		for _, m := range s.Media {
+			if !hasAttribute(m.Lines, name) {
+				return fmt.Errorf("%w: %s", ErrMissingAttribute, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Sanitize checks the SDP against the policy, strips the attributes it does not allow
+// and returns it normalized.
+func (p *Policy) Sanitize(sdp []byte) ([]byte, error) {
+	s, err := Parse(sdp)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Check(s); err != nil {
+		return nil, err
+	}
+	s.Session = p.strip(s.Session)
+	for _, m := range s.Media {
+		m.Lines = p.strip(m.Lines)
+	}
+	return s.Marshal(), nil
+}
+
+// strip removes the attributes not allowed from lines, in place.
+func (p *Policy) strip(lines []Line) []Line {
+	if len(p.StripAttributes) == 0 && len(p.AllowAttributes) == 0 {
+		return lines
+	}
+	kept := lines[:0]
+	for _, l := range lines {
+		if name, _, ok := l.Attribute(); ok {
+			if contains(p.StripAttributes, name) || (len(p.AllowAttributes) > 0 && !contains(p.AllowAttributes, name)) {
+				continue
+			}
+		}
+		kept = append(kept, l)
+	}
+	return kept
+}
+
+func hasAttribute(lines []Line, name string) bool {
+	for _, l := range lines {
+		if n, _, ok := l.Attribute(); ok && n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,234 @@
+package rtcsocks
+
+import (
+	"context"
+	"time"
+)
+
+// SessionInfo describes an edge server session registered via heartbeat.
+type SessionInfo struct {
+	Group        GroupID
+	ID           string
+	Capabilities []string
+	LastSeen     time.Time
+}
+
+// HeartbeatCallbackFunction registers a session ID and the capabilities of an Edge
+// Server within a group.
+type HeartbeatCallbackFunction func(ctx context.Context, group GroupID, session string, capabilities []string) error
+
+// HeartbeatAPI is implemented by the NegotiatorAPIs letting Edge Servers register
+// their session and capabilities ahead of polling, see Sessions. HookToAPI sets the
+// callback if the API implements it.
+type HeartbeatAPI interface {
+	// SetHeartbeatCallback sets the callback function for Edge Server heartbeats. It
+	// returns ErrTooManySessions if the session is new and the group has too many.
+	SetHeartbeatCallback(HeartbeatCallbackFunction)
+}
+
+// DeregisterCallbackFunction removes the session of an Edge Server leaving a group.
+type DeregisterCallbackFunction func(ctx context.Context, group GroupID, session string) error
+
+// DeregisterAPI is implemented by the NegotiatorAPIs letting Edge Servers leave their
+// group, e.g. on shutdown. HookToAPI sets the callback if the API implements it.
+type DeregisterAPI interface {
+	// SetDeregisterCallback sets the callback function for Edge Servers leaving the
+	// group. The offers dispatched to the session and not answered yet are handed out
+	// to other Edge Servers.
+	SetDeregisterCallback(DeregisterCallbackFunction)
+}
+
+type sessionKey struct {
+	group GroupID
+	id    string
+}
+
+func (n *Negotiator) heartbeat(_ context.Context, group GroupID, session string, capabilities []string) error {
+	if group == 0 || group > n.maxGroupID {
+		return ErrBadGroupID
+	}
+	if session == "" {
+		return ErrInvalidSessionID
+	}
+
+	max := n.maxSessions(group)
+	now := time.Now()
+	n.mutexLastSeen.Lock()
+	defer n.mutexLastSeen.Unlock()
+	n.lastSeen[group] = now
+	return n.putSession(&SessionInfo{
+		Group:        group,
+		ID:           session,
+		Capabilities: capabilities,
+		LastSeen:     now,
+	}, max)
+}
+
+// putSession stores the session, or returns ErrTooManySessions if it is new and the
+// group has max sessions already. The caller MUST hold n.mutexLastSeen.
+func (n *Negotiator) putSession(s *SessionInfo, max int) error {
+	key := sessionKey{s.Group, s.ID}
+	if _, ok := n.sessions[key]; !ok {
+		if n.sessionCount[s.Group] >= max {
+			return ErrTooManySessions
+		}
+		n.sessionCount[s.Group]++
+	}
+	n.sessions[key] = s
+	return nil
+}
+
+// deleteSession removes the session, if any. The caller MUST hold n.mutexLastSeen.
+func (n *Negotiator) deleteSession(key sessionKey) {
+	if _, ok := n.sessions[key]; !ok {
+		return
+	}
+	delete(n.sessions, key)
+	if n.sessionCount[key.group]--; n.sessionCount[key.group] <= 0 {
+		delete(n.sessionCount, key.group)
+	}
+}
+
+// deregister removes the session of an edge server leaving the group. The offers
+// dispatched to the session and not answered yet are put back in queue for other
+// edge servers.
+func (n *Negotiator) deregister(_ context.Context, group GroupID, session string) error {
+	if group == 0 || group > n.maxGroupID {
+		return ErrBadGroupID
+	}
+	if session == "" {
+		return ErrInvalidSessionID
+	}
+
+	n.mutexLastSeen.Lock()
+	n.deleteSession(sessionKey{group, session})
+	n.mutexLastSeen.Unlock()
+
+	if requeued := n.requeue(group, session); requeued > 0 && n.logger != nil {
+		n.logger.Infof("Negotiator: session %q of group %s left, %d offers requeued", session, group, requeued)
+	}
+	return nil
+}
+
+// requeue puts the offers dispatched to the session and not answered yet back in queue
+// for other edge servers, and returns how many were. Only the specified offers are, if
+// any are specified.
+func (n *Negotiator) requeue(group GroupID, session string, offerIDs ...OfferID) int {
+	type requeued struct {
+		offer  *offer
+		answer *answer
+	}
+	var offers []requeued
+	now := time.Now()
+	n.mutexAnswers.Lock()
+	answers := n.answers
+	if len(offerIDs) > 0 {
+		answers = make(map[OfferID]*answer, len(offerIDs))
+		for _, offerID := range offerIDs {
+			if answer, ok := n.answers[offerID]; ok {
+				answers[offerID] = answer
+			}
+		}
+	}
+	for _, answer := range answers {
+		answer.mutex.Lock()
+		if answer.body == nil && answer.offer != nil && !answer.byPeer &&
+			answer.group == group && answer.session == session && answer.expiry.After(now) {
+			offers = append(offers, requeued{answer.offer, answer})
+			answer.dispatched = time.Time{}
+			answer.group = 0
+			answer.session = ""
+			answer.offer = nil
+		}
+		answer.mutex.Unlock()
+	}
+	n.mutexAnswers.Unlock()
+
+	count := 0
+	for _, r := range offers {
+		binID, _ := n.binOf(r.answer.groups)
+		if err := n.enqueueOffer(binID, r.offer); err != nil {
+			continue // dropped, the client sees ErrInvalidOfferID and registers again
+		}
+		count++
+		n.replicate(ReplicationEvent{
+			Type:    EventOfferRequeued,
+			OfferID: r.offer.id,
+			User:    r.offer.user,
+			Groups:  r.answer.groups,
+			Group:   group,
+			Session: session,
+			SDP:     r.offer.sdp,
+		})
+	}
+	return count
+}
+
+// touch records a poll from the group, and from the session if any. It returns
+// ErrTooManySessions if the session is new and the group has too many already.
+func (n *Negotiator) touch(group GroupID, session string) error {
+	max := 0
+	if session != "" {
+		max = n.maxSessions(group)
+	}
+	now := time.Now()
+	n.mutexLastSeen.Lock()
+	defer n.mutexLastSeen.Unlock()
+	n.lastSeen[group] = now
+	if session == "" {
+		return nil
+	}
+	if s, ok := n.sessions[sessionKey{group, session}]; ok {
+		s.LastSeen = now
+		return nil
+	}
+	return n.putSession(&SessionInfo{
+		Group:    group,
+		ID:       session,
+		LastSeen: now,
+	}, max)
+}
+
+// seen returns the last time the session was seen, or the last time any member of the
+// group was seen if session is empty.
+func (n *Negotiator) seen(group GroupID, session string) time.Time {
+	n.mutexLastSeen.Lock()
+	defer n.mutexLastSeen.Unlock()
+	if session == "" {
+		return n.lastSeen[group]
+	}
+	if s, ok := n.sessions[sessionKey{group, session}]; ok {
+		return s.LastSeen
+	}
+	return time.Time{}
+}
+
+// Sessions returns the edge server sessions seen in the specified group.
+func (n *Negotiator) Sessions(group GroupID) []SessionInfo {
+	n.mutexLastSeen.Lock()
+	defer n.mutexLastSeen.Unlock()
+	sessions := make([]SessionInfo, 0)
+	for key, s := range n.sessions {
+		if key.group == group {
+			sessions = append(sessions, *s)
+		}
+	}
+	return sessions
+}
+
+// purgeSessions removes sessions not seen for longer than the TTL (or the liveness
+// timeout, whichever is larger).
+func (n *Negotiator) purgeSessions() {
+	maxAge := n.ttl
+	if n.livenessTimeout > maxAge {
+		maxAge = n.livenessTimeout
+	}
+
+	n.mutexLastSeen.Lock()
+	defer n.mutexLastSeen.Unlock()
+	for key, s := range n.sessions {
+		if time.Since(s.LastSeen) > maxAge {
+			n.deleteSession(key)
+		}
+	}
+}
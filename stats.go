@@ -0,0 +1,112 @@
+package rtcsocks
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Stats is a snapshot of the state of a Negotiator, for monitoring.
+type Stats struct {
+	Time time.Time
+
+	QueuedOffers     int // offers waiting for an edge server
+	DispatchedOffers int // offers dispatched to an edge server and not answered yet
+	AnsweredOffers   int // offers answered and not purged yet
+
+	// Registered since the Negotiator was created. The match rate is the ratio of
+	// AnswersRegistered to OffersRegistered.
+	OffersRegistered  uint64
+	AnswersRegistered uint64
+	AnswersEvicted    uint64 // offers evicted before expiry, see SetMaxAnswers
+
+	Groups []GroupStats // sorted by Group
+
+	Telemetry []TelemetryCount // of the last period, nil if disabled, see SetTelemetry
+}
+
+// GroupStats is the activity of a group of edge servers in Stats.
+type GroupStats struct {
+	Group GroupID
+
+	QueuedOffers      int       // offers listing the group waiting for an edge server
+	DispatchedOffers  int       // offers dispatched to the group and not answered yet
+	AnswersRegistered uint64    // answers registered by the group since the Negotiator was created
+	Sessions          int       // edge server sessions seen
+	LastSeen          time.Time // zero if never seen
+}
+
+// StatsCallbackFunction returns a snapshot of the state of the Negotiator.
+type StatsCallbackFunction func(ctx context.Context) Stats
+
+// StatsAPI is implemented by the NegotiatorAPIs reporting the state of the
+// Negotiator to operators, e.g. on an admin console. HookToAPI sets the callback
+// if the API implements it.
+type StatsAPI interface {
+	SetStatsCallback(StatsCallbackFunction)
+}
+
+// Stats returns a snapshot of the state of the Negotiator.
+func (n *Negotiator) Stats() Stats {
+	return n.stats(context.Background())
+}
+
+func (n *Negotiator) stats(_ context.Context) Stats {
+	stats := Stats{Time: time.Now()}
+	groups := make(map[GroupID]*GroupStats)
+	group := func(id GroupID) *GroupStats {
+		gs, ok := groups[id]
+		if !ok {
+			gs = &GroupStats{Group: id}
+			groups[id] = gs
+		}
+		return gs
+	}
+
+	n.mutexAnswers.Lock()
+	stats.OffersRegistered = n.offersRegistered
+	stats.AnswersRegistered = n.answersRegistered
+	stats.AnswersEvicted = n.answersEvicted
+	for id, count := range n.answeredBy {
+		group(id).AnswersRegistered = count
+	}
+	for _, answer := range n.answers {
+		answer.mutex.Lock()
+		switch {
+		case answer.body != nil:
+			stats.AnsweredOffers++
+		case !answer.dispatched.IsZero():
+			stats.DispatchedOffers++
+			if answer.group != 0 {
+				group(answer.group).DispatchedOffers++
+			}
+		case answer.expiry.After(stats.Time):
+			stats.QueuedOffers++
+			for _, id := range answer.groups {
+				group(id).QueuedOffers++
+			}
+		}
+		answer.mutex.Unlock()
+	}
+	n.mutexAnswers.Unlock()
+
+	n.mutexLastSeen.Lock()
+	for id, t := range n.lastSeen {
+		group(id).LastSeen = t
+	}
+	for key := range n.sessions {
+		group(key.group).Sessions++
+	}
+	n.mutexLastSeen.Unlock()
+
+	stats.Telemetry = n.telemetryCounts()
+
+	stats.Groups = make([]GroupStats, 0, len(groups))
+	for _, gs := range groups {
+		stats.Groups = append(stats.Groups, *gs)
+	}
+	sort.Slice(stats.Groups, func(i, j int) bool {
+		return stats.Groups[i].Group < stats.Groups[j].Group
+	})
+	return stats
+}
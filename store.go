@@ -0,0 +1,30 @@
+package rtcsocks
+
+// StateStore durably records the state changes of a Negotiator, so pending offers
+// and answers survive a restart of the Negotiator.
+type StateStore interface {
+	// Record persists the event. It is called synchronously, errors are to be
+	// handled by the StateStore itself.
+	Record(event ReplicationEvent)
+
+	// Load returns the recorded events of all offers not yet expired, in the
+	// order they were recorded.
+	Load() ([]ReplicationEvent, error)
+}
+
+// SetStateStore sets the StateStore and restores the offers and answers recorded in it.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetStateStore(store StateStore) error {
+	events, err := store.Load()
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		// events of an offer lost in conflict or failed to apply are skipped
+		_ = n.apply(event)
+	}
+	n.store = store
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package systemd
+
+import "net"
+
+// Listeners returns nil, systemd socket activation is only supported on unix.
+func Listeners() ([]net.Listener, error) {
+	return nil, nil
+}
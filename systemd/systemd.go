@@ -0,0 +1,99 @@
+// Package systemd integrates the daemons embedding rtcsocks with systemd: socket
+// activation of the listeners, e.g. of the Negotiator API, and service state and
+// watchdog notifications (sd_notify).
+//
+// Everything is a no-op when not running under systemd, so it is safe to call
+// unconditionally:
+//
+//	listeners, _ := systemd.Listeners()
+//	if len(listeners) > 0 {
+//		go api.Serve(listeners[0])
+//	} else {
+//		go api.Listen(addr)
+//	}
+//	systemd.Ready()
+//	go systemd.Watchdog(ctx, nil)
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const listenFDsStart = 3 // SD_LISTEN_FDS_START
+
+// Notify sends the state to the service manager, e.g. "READY=1" or "STOPPING=1", see
+// sd_notify(3). It returns false without error if not running under systemd, i.e.,
+// NOTIFY_SOCKET is not set.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' {
+		name = "\x00" + name[1:] // abstract namespace
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells the service manager that startup is complete, for Type=notify services.
+func Ready() (bool, error) {
+	return Notify("READY=1")
+}
+
+// Stopping tells the service manager that the daemon is shutting down, e.g. while
+// an Edge Server drains.
+func Stopping() (bool, error) {
+	return Notify("STOPPING=1")
+}
+
+// WatchdogInterval returns the watchdog timeout configured with WatchdogSec, or 0 if
+// the watchdog is disabled or meant for another process.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseUint(os.Getenv("WATCHDOG_USEC"), 10, 63)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog keeps the service manager watchdog fed until ctx is done, at half the
+// watchdog timeout as recommended by sd_watchdog_enabled(3). If healthy is not nil,
+// the watchdog is only fed while it returns true, so that systemd restarts a daemon
+// which stopped working. It returns immediately if the watchdog is disabled.
+func Watchdog(ctx context.Context, healthy func() bool) error {
+	interval := WatchdogInterval() / 2
+	if interval <= 0 {
+		return nil
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if healthy == nil || healthy() {
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
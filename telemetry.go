@@ -0,0 +1,233 @@
+package rtcsocks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"math"
+	mrand "math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// RendezvousStage is the stage a rendezvous failed at, or StageConnected.
+type RendezvousStage string
+
+const (
+	StageRegister  RendezvousStage = "register"  // the offer could not be registered
+	StageAnswer    RendezvousStage = "answer"    // no answer was received
+	StageConnect   RendezvousStage = "connect"   // the peer connection failed after the answer
+	StageConnected RendezvousStage = "connected" // success
+)
+
+const (
+	defaultTelemetryEpsilon = 1.0
+	defaultTelemetryPeriod  = time.Hour
+	maxTransportNameLen     = 32
+)
+
+// RendezvousReport is the outcome of a rendezvous reported by a Client which opted in
+// to telemetry. It carries nothing about the user: the NegotiatorAPI drops the
+// identity of the reporter once authenticated.
+type RendezvousReport struct {
+	Transport string          // as named by the Client, e.g. "https" or "amp"
+	Stage     RendezvousStage // reached
+	Duration  time.Duration   // of the rendezvous, rounded up by CoarseDuration
+}
+
+var (
+	rendezvousStages = []RendezvousStage{StageRegister, StageAnswer, StageConnect, StageConnected}
+	durationBuckets  = []time.Duration{time.Second, 2 * time.Second, 5 * time.Second, 10 * time.Second, 30 * time.Second, time.Minute}
+)
+
+// CoarseDuration rounds d up to 1, 2, 5, 10 or 30 seconds, or 1 minute for longer
+// durations, so that the timing of a report does not tell the reporter apart.
+func CoarseDuration(d time.Duration) time.Duration {
+	for _, bucket := range durationBuckets {
+		if d <= bucket {
+			return bucket
+		}
+	}
+	return durationBuckets[len(durationBuckets)-1]
+}
+
+type TelemetryCallbackFunction func(ctx context.Context, report RendezvousReport) error
+
+// TelemetryAPI is implemented by the NegotiatorAPIs accepting RendezvousReports from
+// Clients. HookToAPI sets the telemetry callback if the API implements it.
+type TelemetryAPI interface {
+	SetTelemetryCallback(TelemetryCallbackFunction)
+}
+
+// Telemetry configures the aggregation of the RendezvousReports, see SetTelemetry.
+type Telemetry struct {
+	// Epsilon is the differential privacy parameter of each published count: the
+	// counts get Laplace noise of scale 1/Epsilon. 0 -> 1.
+	Epsilon float64
+
+	// Period is how often the counts are published, and reset. Only the counts of the
+	// last complete period are published, so that repeated queries do not average the
+	// noise out. 0 -> 1 hour.
+	Period time.Duration
+
+	// Transports are the accepted transport names, nil -> any. Other reports are
+	// dropped, so that Clients cannot be told apart by a made-up name. With
+	// Transports, the counts of all kinds of reports are published, zeros included;
+	// without, only the kinds reported in the period are, which tells they were
+	// reported at least once.
+	Transports []string
+}
+
+// TelemetryCount is the noisy count of the reports of a kind over a period.
+type TelemetryCount struct {
+	Transport string
+	Stage     RendezvousStage
+	Duration  time.Duration // coarse, see CoarseDuration
+	Count     int           // with noise, never negative
+}
+
+// telemetry aggregates the reports of the current period and keeps the published
+// counts of the last one.
+type telemetry struct {
+	config    Telemetry
+	transport map[string]bool // nil -> any
+
+	counts    map[RendezvousReport]int // current period
+	start     time.Time                // of the current period
+	published []TelemetryCount         // last complete period
+	rand      *mrand.Rand
+	mutex     sync.Mutex
+}
+
+// SetTelemetry enables the aggregation of RendezvousReports, published in Stats with
+// differential privacy noise so that blocked transports can be detected fleet-wide
+// without telling on any Client.
+//
+// It SHOULD be set before HookToAPI is called.
+func (n *Negotiator) SetTelemetry(config Telemetry) {
+	if config.Epsilon <= 0 {
+		config.Epsilon = defaultTelemetryEpsilon
+	}
+	if config.Period <= 0 {
+		config.Period = defaultTelemetryPeriod
+	}
+	t := &telemetry{
+		config: config,
+		counts: make(map[RendezvousReport]int),
+		start:  time.Now(),
+	}
+	if config.Transports != nil {
+		t.transport = make(map[string]bool, len(config.Transports))
+		for _, name := range config.Transports {
+			t.transport[name] = true
+		}
+	}
+	var seed [8]byte
+	rand.Read(seed[:])
+	t.rand = mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+	n.telemetry = t
+}
+
+func (n *Negotiator) reportRendezvous(_ context.Context, report RendezvousReport) error {
+	t := n.telemetry
+	if t == nil {
+		return ErrTelemetryDisabled
+	}
+	if !validStage(report.Stage) {
+		return ErrBadReport
+	}
+	if len(report.Transport) > maxTransportNameLen || t.transport != nil && !t.transport[report.Transport] {
+		return ErrBadReport
+	}
+	report.Duration = CoarseDuration(report.Duration)
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rotate(time.Now())
+	t.counts[report]++
+	return nil
+}
+
+// telemetryCounts returns the published counts, nil if telemetry is disabled.
+func (n *Negotiator) telemetryCounts() []TelemetryCount {
+	t := n.telemetry
+	if t == nil {
+		return nil
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.rotate(time.Now())
+	return append([]TelemetryCount{}, t.published...)
+}
+
+// rotate publishes the counts of the current period if it is over. t.mutex MUST be
+// held.
+func (t *telemetry) rotate(now time.Time) {
+	if now.Sub(t.start) < t.config.Period {
+		return
+	}
+
+	// a period of more than a period ago publishes nothing, as no one looked at it
+	t.published = make([]TelemetryCount, 0, len(t.counts))
+	if now.Sub(t.start) < 2*t.config.Period {
+		if t.transport != nil {
+			for name := range t.transport {
+				for _, stage := range rendezvousStages {
+					for _, d := range durationBuckets {
+						key := RendezvousReport{Transport: name, Stage: stage, Duration: d}
+						if _, ok := t.counts[key]; !ok {
+							t.counts[key] = 0 // published with noise too
+						}
+					}
+				}
+			}
+		}
+		for report, count := range t.counts {
+			noisy := int(math.Round(float64(count) + t.laplace(1/t.config.Epsilon)))
+			if noisy < 0 {
+				noisy = 0
+			}
+			t.published = append(t.published, TelemetryCount{
+				Transport: report.Transport,
+				Stage:     report.Stage,
+				Duration:  report.Duration,
+				Count:     noisy,
+			})
+		}
+	}
+	sort.Slice(t.published, func(i, j int) bool {
+		a, b := t.published[i], t.published[j]
+		if a.Transport != b.Transport {
+			return a.Transport < b.Transport
+		}
+		if a.Stage != b.Stage {
+			return a.Stage < b.Stage
+		}
+		return a.Duration < b.Duration
+	})
+
+	t.counts = make(map[RendezvousReport]int)
+	t.start = now.Truncate(t.config.Period)
+}
+
+// laplace draws from the Laplace distribution of the scale, centered on 0.
+func (t *telemetry) laplace(scale float64) float64 {
+	u := t.rand.Float64() - 0.5
+	for u == -0.5 { // log(0)
+		u = t.rand.Float64() - 0.5
+	}
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
+
+func validStage(stage RendezvousStage) bool {
+	for _, s := range rendezvousStages {
+		if s == stage {
+			return true
+		}
+	}
+	return false
+}